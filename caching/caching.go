@@ -2,6 +2,7 @@ package caching
 
 import (
 	"regexp"
+	"time"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
@@ -14,6 +15,10 @@ type App struct {
 	OrgName    string
 	OrgGuid    string
 	IgnoredApp bool
+	// Labels and Annotations are the v3 metadata of the app, nil when it
+	// has none or apps are resolved through the v2 API
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 //go:generate counterfeiter . Caching
@@ -24,11 +29,38 @@ type Caching interface {
 
 	GetAllApps() (map[string]*App, error)
 	GetApp(string) (*App, error)
+	Stats() Stats
+	// Invalidate forgets an app, so that its next event resolves it again
+	Invalidate(string)
+}
+
+// Stats describes how the cache behaved since the nozzle started
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+	// MissingAppHits are the lookups of apps remembered as missing with
+	// IgnoreMissingApps, which CC isn't asked again about. They are
+	// counted in Hits too.
+	MissingAppHits uint64
+	// Apps is the number of apps cached in memory
+	Apps        int
+	LastRefresh time.Time
+	// Open tells whether the cache was opened and its backend, the Bolt
+	// files or Redis, can currently be used
+	Open bool
+}
+
+// CCApp is an app as resolved from the Cloud Controller, along with the
+// v3 metadata that the v2 shape of cfclient lacks.
+type CCApp struct {
+	cfclient.App
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 type AppClient interface {
-	AppByGuid(appGuid string) (cfclient.App, error)
-	ListApps() ([]cfclient.App, error)
+	AppByGuid(appGuid string) (CCApp, error)
+	ListApps() ([]CCApp, error)
 }
 
 func IsNeeded(wantedEvents string) bool {
@@ -0,0 +1,195 @@
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+const (
+	CCAPIv2 = "v2"
+	CCAPIv3 = "v3"
+)
+
+// NewAppClient returns the AppClient resolving apps through the given Cloud
+// Controller API version.
+func NewAppClient(client *cfclient.Client, apiVersion string) (AppClient, error) {
+	switch apiVersion {
+	case CCAPIv2:
+		return &appClientV2{client: client}, nil
+	case CCAPIv3:
+		return &appClientV3{client: client}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported Cloud Controller API version [%s]", apiVersion)
+	}
+}
+
+// appClientV2 resolves apps through the /v2 endpoints served by cfclient,
+// which carry no metadata.
+type appClientV2 struct {
+	client *cfclient.Client
+}
+
+func (a *appClientV2) AppByGuid(appGuid string) (CCApp, error) {
+	app, err := a.client.AppByGuid(appGuid)
+	return CCApp{App: app}, err
+}
+
+func (a *appClientV2) ListApps() ([]CCApp, error) {
+	apps, err := a.client.ListApps()
+	if err != nil {
+		return nil, err
+	}
+	ccApps := make([]CCApp, len(apps))
+	for i := range apps {
+		ccApps[i] = CCApp{App: apps[i]}
+	}
+	return ccApps, nil
+}
+
+// appClientV3 resolves apps, spaces and orgs through the /v3 endpoints,
+// including space and org in the same request.
+type appClientV3 struct {
+	client *cfclient.Client
+}
+
+type v3Relationship struct {
+	Data struct {
+		Guid string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3Metadata struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type v3Resource struct {
+	Guid          string                    `json:"guid"`
+	Name          string                    `json:"name"`
+	Relationships map[string]v3Relationship `json:"relationships"`
+	Metadata      v3Metadata                `json:"metadata"`
+}
+
+type v3Included struct {
+	Spaces        []v3Resource `json:"spaces"`
+	Organizations []v3Resource `json:"organizations"`
+}
+
+type v3AppResponse struct {
+	v3Resource
+	Included v3Included `json:"included"`
+}
+
+type v3AppsResponse struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources []v3Resource `json:"resources"`
+	Included  v3Included   `json:"included"`
+}
+
+type v3EnvironmentResponse struct {
+	Var map[string]interface{} `json:"var"`
+}
+
+func (a *appClientV3) AppByGuid(appGuid string) (CCApp, error) {
+	var resp v3AppResponse
+	if err := a.get("/v3/apps/"+appGuid+"?include=space.organization", &resp); err != nil {
+		return CCApp{}, err
+	}
+	return a.toApp(resp.v3Resource, resp.Included)
+}
+
+func (a *appClientV3) ListApps() ([]CCApp, error) {
+	var apps []CCApp
+
+	path := "/v3/apps?include=space.organization&per_page=5000"
+	for path != "" {
+		var resp v3AppsResponse
+		if err := a.get(path, &resp); err != nil {
+			return nil, err
+		}
+		for _, resource := range resp.Resources {
+			app, err := a.toApp(resource, resp.Included)
+			if err != nil {
+				return nil, err
+			}
+			apps = append(apps, app)
+		}
+
+		path = ""
+		if resp.Pagination.Next != nil {
+			next, err := url.Parse(resp.Pagination.Next.Href)
+			if err != nil {
+				return nil, err
+			}
+			path = next.RequestURI()
+		}
+	}
+	return apps, nil
+}
+
+// toApp maps a v3 app and its included space and org onto the v2 shape the
+// cache is filled from. Environment variables need a request of their own.
+func (a *appClientV3) toApp(resource v3Resource, included v3Included) (CCApp, error) {
+	var env v3EnvironmentResponse
+	if err := a.get("/v3/apps/"+resource.Guid+"/environment_variables", &env); err != nil {
+		return CCApp{}, err
+	}
+
+	app := CCApp{App: cfclient.App{
+		Guid:        resource.Guid,
+		Name:        resource.Name,
+		Environment: env.Var,
+	}}
+	if len(resource.Metadata.Labels) > 0 {
+		app.Labels = resource.Metadata.Labels
+	}
+	if len(resource.Metadata.Annotations) > 0 {
+		app.Annotations = resource.Metadata.Annotations
+	}
+
+	space := findV3Resource(included.Spaces, resource.Relationships["space"].Data.Guid)
+	org := findV3Resource(included.Organizations, space.Relationships["organization"].Data.Guid)
+	app.SpaceData.Entity.Guid = space.Guid
+	app.SpaceData.Entity.Name = space.Name
+	app.SpaceData.Entity.OrgData.Entity.Guid = org.Guid
+	app.SpaceData.Entity.OrgData.Entity.Name = org.Name
+	return app, nil
+}
+
+func findV3Resource(resources []v3Resource, guid string) v3Resource {
+	for _, resource := range resources {
+		if resource.Guid == guid {
+			return resource
+		}
+	}
+	return v3Resource{}
+}
+
+func (a *appClientV3) get(path string, out interface{}) error {
+	resp, err := a.client.DoRequest(a.client.NewRequest("GET", path))
+	if err != nil {
+		return fmt.Errorf("Error requesting %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", path, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrAppNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error requesting %s: status code %d", path, resp.StatusCode)
+	}
+	return json.Unmarshal(body, out)
+}
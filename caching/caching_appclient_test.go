@@ -0,0 +1,137 @@
+package caching_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const v3Included = `"included": {
+	"spaces": [{"guid": "space-guid", "name": "space-name", "relationships": {"organization": {"data": {"guid": "org-guid"}}}}],
+	"organizations": [{"guid": "org-guid", "name": "org-name"}]
+}`
+
+func newFakeCloudController() *httptest.Server {
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/v2/info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"token_endpoint": "%s"}`, server.URL)
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "token", "token_type": "bearer", "expires_in": 3600}`)
+	})
+	mux.HandleFunc("/v3/apps", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprintf(w, `{"pagination": {"next": null}, "resources": [
+				{"guid": "app-2", "name": "app-name-2", "relationships": {"space": {"data": {"guid": "space-guid"}}}}
+			], %s}`, v3Included)
+			return
+		}
+		fmt.Fprintf(w, `{"pagination": {"next": {"href": "%s/v3/apps?page=2"}}, "resources": [
+			{"guid": "app-1", "name": "app-name-1", "relationships": {"space": {"data": {"guid": "space-guid"}}}}
+		], %s}`, server.URL, v3Included)
+	})
+	mux.HandleFunc("/v2/apps/app-1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"metadata": {"guid": "app-1"}, "entity": {"name": "app-name-1",
+			"space": {"metadata": {"guid": "space-guid"}, "entity": {"name": "space-name",
+				"organization": {"metadata": {"guid": "org-guid"}, "entity": {"name": "org-name"}}}}}}`)
+	})
+	mux.HandleFunc("/v3/apps/app-1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"guid": "app-1", "name": "app-name-1", "relationships": {"space": {"data": {"guid": "space-guid"}}},
+			"metadata": {"labels": {"team": "payments"}, "annotations": {"contact": "payments@example.com"}}, %s}`, v3Included)
+	})
+	mux.HandleFunc("/v3/apps/app-1/environment_variables", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"var": {"F2S_DISABLE_LOGGING": "true"}}`)
+	})
+	mux.HandleFunc("/v3/apps/app-2/environment_variables", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"var": {}}`)
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+var _ = Describe("AppClient", func() {
+	var (
+		server    *httptest.Server
+		appClient AppClient
+	)
+
+	BeforeEach(func() {
+		server = newFakeCloudController()
+		client, err := cfclient.NewClient(&cfclient.Config{
+			ApiAddress:   server.URL,
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		appClient, err = NewAppClient(client, CCAPIv3)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("v3", func() {
+		It("Expect app with its space, org and environment", func() {
+			app, err := appClient.AppByGuid("app-1")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.Name).To(Equal("app-name-1"))
+			Expect(app.SpaceData.Entity.Name).To(Equal("space-name"))
+			Expect(app.SpaceData.Entity.OrgData.Entity.Guid).To(Equal("org-guid"))
+			Expect(app.SpaceData.Entity.OrgData.Entity.Name).To(Equal("org-name"))
+			Expect(app.Environment["F2S_DISABLE_LOGGING"]).To(Equal("true"))
+			Expect(app.Labels).To(Equal(map[string]string{"team": "payments"}))
+			Expect(app.Annotations).To(Equal(map[string]string{"contact": "payments@example.com"}))
+		})
+
+		It("Expect every page of apps", func() {
+			apps, err := appClient.ListApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(apps).To(HaveLen(2))
+			Expect(apps[1].Guid).To(Equal("app-2"))
+			Expect(apps[1].SpaceData.Entity.OrgData.Entity.Name).To(Equal("org-name"))
+			Expect(apps[1].Labels).To(BeNil())
+		})
+
+		It("Expect an error on missing app", func() {
+			_, err := appClient.AppByGuid("missing")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("v2", func() {
+		It("Expect app with its space and org, without metadata", func() {
+			client, err := cfclient.NewClient(&cfclient.Config{
+				ApiAddress:   server.URL,
+				ClientID:     "client-id",
+				ClientSecret: "client-secret",
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+			appClient, err := NewAppClient(client, CCAPIv2)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			app, err := appClient.AppByGuid("app-1")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.Guid).To(Equal("app-1"))
+			Expect(app.SpaceData.Entity.Guid).To(Equal("space-guid"))
+			Expect(app.SpaceData.Entity.OrgData.Entity.Name).To(Equal("org-name"))
+			Expect(app.Labels).To(BeNil())
+		})
+	})
+
+	Context("unknown version", func() {
+		It("Expect error", func() {
+			_, err := NewAppClient(nil, "v4")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,37 @@
+package caching_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/caching"
+)
+
+func benchmarkFill(b *testing.B, shards int) {
+	client := newMockAppClient(200)
+	for i := 0; i < b.N; i++ {
+		config := &CachingBoltConfig{
+			Path:   fmt.Sprintf("/tmp/bench-%d", time.Now().UnixNano()),
+			Shards: shards,
+		}
+		cache, err := NewCachingBolt(client, config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := cache.Open(); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		cache.Close()
+		for _, path := range ShardPaths(config.Path, shards) {
+			os.Remove(path)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkFillSingleBolt(b *testing.B)  { benchmarkFill(b, 1) }
+func BenchmarkFillShardedBolt(b *testing.B) { benchmarkFill(b, 8) }
@@ -3,12 +3,13 @@ package caching
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
-	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
 	json "github.com/mailru/easyjson"
 )
 
@@ -16,19 +17,57 @@ const (
 	APP_BUCKET = "AppBucket"
 )
 
+// errMissingApp is returned for apps remembered as missing with
+// IgnoreMissingApps
+var errMissingApp = errors.New("App was missed and ignored")
+
 type CachingBoltConfig struct {
 	Path               string
 	IgnoreMissingApps  bool
 	CacheInvalidateTTL time.Duration
+	// Shards spreads the cache over that many Bolt files, routed by app
+	// GUID hash. 0 or 1 keeps a single file at Path.
+	Shards int
+	// DeletedEntityPolicy handles events of apps whose space or org was
+	// deleted: one of none, drop, placeholder or last-known
+	DeletedEntityPolicy string
+	// CacheUnavailablePolicy handles Bolt writes or CC refreshes failing
+	// mid-run: degrade keeps forwarding events, stop exits
+	CacheUnavailablePolicy string
+	// MaxEntryAge evicts entries neither refreshed nor resolved for that
+	// long, 0 keeps them until the next successful refresh
+	MaxEntryAge time.Duration
+	// Warmup loads every app from CC when opening the cache, rather than
+	// resolving apps on their first event. A CC slower than WarmupTimeout
+	// leaves the cache as loaded from Bolt, 0 waits for it.
+	Warmup        bool
+	WarmupTimeout time.Duration
 }
 
 type CachingBolt struct {
 	appClient AppClient
-	appdb     *bolt.DB
+	appdbs    []*bolt.DB
 
 	lock        sync.RWMutex
 	cache       map[string]*App
 	missingApps map[string]struct{}
+	deletedApps map[string]*App
+	lastKnown   map[string]*App
+	// lastRefresh is when the whole cache was last refreshed, resolvedAt
+	// when apps were resolved one by one since
+	lastRefresh time.Time
+	resolvedAt  map[string]time.Time
+
+	deletedLookups *metrics.Counter
+	hits           *metrics.Counter
+	misses         *metrics.Counter
+	missingAppHits *metrics.Counter
+
+	open               bool
+	unavailable        bool
+	unavailableGauge   *metrics.Gauge
+	unavailablePeriods *metrics.Counter
+	evictions          *metrics.Counter
 
 	closing chan struct{}
 	wg      sync.WaitGroup
@@ -37,22 +76,35 @@ type CachingBolt struct {
 
 func NewCachingBolt(client AppClient, config *CachingBoltConfig) (*CachingBolt, error) {
 	return &CachingBolt{
-		appClient:   client,
-		cache:       make(map[string]*App),
-		missingApps: make(map[string]struct{}),
-		closing:     make(chan struct{}),
-		config:      config,
+		appClient:          client,
+		cache:              make(map[string]*App),
+		missingApps:        make(map[string]struct{}),
+		deletedApps:        make(map[string]*App),
+		lastKnown:          make(map[string]*App),
+		resolvedAt:         make(map[string]time.Time),
+		deletedLookups:     metrics.NewCounter("deleted_app_lookups"),
+		hits:               metrics.NewCounter("cache_hits"),
+		misses:             metrics.NewCounter("cache_misses"),
+		missingAppHits:     metrics.NewCounter("cache_missing_app_hits"),
+		unavailableGauge:   metrics.NewGauge("cache_unavailable"),
+		unavailablePeriods: metrics.NewCounter("cache_unavailable_periods"),
+		evictions:          metrics.NewCounter("cache_evictions"),
+		closing:            make(chan struct{}),
+		config:             config,
 	}, nil
 }
 
 func (c *CachingBolt) Open() error {
-	// Open bolt db
-	db, err := bolt.Open(c.config.Path, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		logging.LogError("Fail to open boltdb: ", err)
-		return err
+	// Open bolt db, one per shard
+	for _, path := range ShardPaths(c.config.Path, c.config.Shards) {
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			logging.LogError("Fail to open boltdb: ", err)
+			c.closeDatabases()
+			return err
+		}
+		c.appdbs = append(c.appdbs, db)
 	}
-	c.appdb = db
 
 	if err := c.createBucket(); err != nil {
 		logging.LogError("Fail to create bucket: ", err)
@@ -63,16 +115,32 @@ func (c *CachingBolt) Open() error {
 		c.invalidateCache()
 	}
 
-	return c.populateCache()
+	if err := c.populateCache(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.open = true
+	c.lock.Unlock()
+	return nil
 }
 
 func (c *CachingBolt) populateCache() error {
+	if c.config.Warmup {
+		apps, err := c.warmup()
+		if err == nil {
+			c.cache = apps
+			c.lastRefresh = time.Now()
+			return nil
+		}
+		logging.LogError("Cache warmup failed, apps will be resolved on their first event: ", err)
+	}
+
 	apps, err := c.getAllAppsFromBoltDB()
 	if err != nil {
 		return err
 	}
 
-	if len(apps) == 0 {
+	if len(apps) == 0 && !c.config.Warmup {
 		// populate from remote
 		apps, err = c.getAllAppsFromRemote()
 		if err != nil {
@@ -81,17 +149,54 @@ func (c *CachingBolt) populateCache() error {
 	}
 
 	c.cache = apps
+	c.lastRefresh = time.Now()
 
 	return nil
 }
 
 func (c *CachingBolt) Close() error {
+	c.lock.Lock()
+	c.open = false
+	c.lock.Unlock()
 	close(c.closing)
 
 	// Wait for background goroutine exit
 	c.wg.Wait()
 
-	return c.appdb.Close()
+	return c.closeDatabases()
+}
+
+func (c *CachingBolt) closeDatabases() error {
+	var closeErr error
+	for _, db := range c.appdbs {
+		if err := db.Close(); err != nil {
+			closeErr = err
+		}
+	}
+	c.appdbs = nil
+	return closeErr
+}
+
+// ShardPaths returns the Bolt files used for a cache at path split in shards.
+func ShardPaths(path string, shards int) []string {
+	if shards <= 1 {
+		return []string{path}
+	}
+	paths := make([]string, shards)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s.%d", path, i)
+	}
+	return paths
+}
+
+// shardFor returns the index of the shard holding appGuid.
+func (c *CachingBolt) shardFor(appGuid string) int {
+	if len(c.appdbs) <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(appGuid))
+	return int(h.Sum32() % uint32(len(c.appdbs)))
 }
 
 // GetAppInfo tries first get app info from cache. If caches doesn't have this
@@ -104,16 +209,28 @@ func (c *CachingBolt) Close() error {
 func (c *CachingBolt) GetApp(appGuid string) (*App, error) {
 	app, err := c.getAppFromCache(appGuid)
 	if err != nil {
+		c.hits.Inc()
+		if err == errMissingApp {
+			c.missingAppHits.Inc()
+		}
 		return nil, err
 	}
 
 	// Find in cache
 	if app != nil {
+		c.hits.Inc()
 		return app, nil
 	}
 
 	// First time seeing app
+	c.misses.Inc()
 	app, err = c.getAppFromRemote(appGuid)
+	if c.tracksDeleted() && isDeleted(app, err) {
+		return c.deletedApp(appGuid, app)
+	}
+	if err != nil && err != ErrAppNotFound && c.isUnavailable() {
+		return placeholderApp(appGuid, nil, UnknownPlaceholder), nil
+	}
 	if err != nil {
 		if c.config.IgnoreMissingApps {
 			// Record this missing app
@@ -124,9 +241,12 @@ func (c *CachingBolt) GetApp(appGuid string) (*App, error) {
 		return nil, err
 	}
 
+	c.setAvailable(c.fillDatabase(map[string]*App{app.Guid: app}))
+
 	// Add to in-memory cache
 	c.lock.Lock()
 	c.cache[app.Guid] = app
+	c.resolvedAt[app.Guid] = time.Now()
 	c.lock.Unlock()
 
 	return app, nil
@@ -145,11 +265,38 @@ func (c *CachingBolt) GetAllApps() (map[string]*App, error) {
 	return apps, nil
 }
 
+// Stats returns the lookups counts and the size and age of the cache
+func (c *CachingBolt) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return Stats{
+		Hits:           c.hits.Value(),
+		Misses:         c.misses.Value(),
+		MissingAppHits: c.missingAppHits.Value(),
+		Apps:           len(c.cache),
+		LastRefresh:    c.lastRefresh,
+		Open:           c.open && !c.unavailable,
+	}
+}
+
 func (c *CachingBolt) getAppFromCache(appGuid string) (*App, error) {
 	c.lock.RLock()
 	if app, ok := c.cache[appGuid]; ok {
 		// in in-memory cache
+		expired := c.isExpired(appGuid)
+		c.lock.RUnlock()
+		if expired {
+			c.evict(appGuid)
+			return nil, nil
+		}
+		return app, nil
+	}
+
+	if app, deleted := c.deletedApps[appGuid]; deleted {
 		c.lock.RUnlock()
+		if app == nil {
+			return nil, ErrAppDeleted
+		}
 		return app, nil
 	}
 
@@ -157,7 +304,7 @@ func (c *CachingBolt) getAppFromCache(appGuid string) (*App, error) {
 	if c.config.IgnoreMissingApps && alreadyMissed {
 		// already missed
 		c.lock.RUnlock()
-		return nil, errors.New("App was missed and ignored")
+		return nil, errMissingApp
 	}
 	c.lock.RUnlock()
 
@@ -167,14 +314,16 @@ func (c *CachingBolt) getAppFromCache(appGuid string) (*App, error) {
 
 func (c *CachingBolt) getAllAppsFromBoltDB() (map[string]*App, error) {
 	var allData [][]byte
-	c.appdb.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(APP_BUCKET))
-		b.ForEach(func(guid []byte, v []byte) error {
-			allData = append(allData, v)
+	for _, db := range c.appdbs {
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(APP_BUCKET))
+			b.ForEach(func(guid []byte, v []byte) error {
+				allData = append(allData, v)
+				return nil
+			})
 			return nil
 		})
-		return nil
-	})
+	}
 
 	apps := make(map[string]*App, len(allData))
 	for i := range allData {
@@ -190,6 +339,18 @@ func (c *CachingBolt) getAllAppsFromBoltDB() (map[string]*App, error) {
 }
 
 func (c *CachingBolt) getAllAppsFromRemote() (map[string]*App, error) {
+	apps, err := c.listRemoteApps()
+	if err != nil {
+		return nil, err
+	}
+
+	c.setAvailable(c.fillDatabase(apps))
+	logging.LogStd(fmt.Sprintf("Found [%d] Apps!", len(apps)), false)
+
+	return apps, nil
+}
+
+func (c *CachingBolt) listRemoteApps() (map[string]*App, error) {
 	logging.LogStd("Retrieving Apps for Cache...", false)
 
 	cfApps, err := c.appClient.ListApps()
@@ -200,23 +361,106 @@ func (c *CachingBolt) getAllAppsFromRemote() (map[string]*App, error) {
 	apps := make(map[string]*App, len(cfApps))
 	for i := range cfApps {
 		logging.LogStd(fmt.Sprintf("App [%s] Found...", cfApps[i].Name), false)
-		app := c.fromPCFApp(&cfApps[i])
+		app := fromPCFApp(&cfApps[i])
 		apps[app.Guid] = app
 	}
+	return apps, nil
+}
 
-	c.fillDatabase(apps)
-	logging.LogStd(fmt.Sprintf("Found [%d] Apps!", len(apps)), false)
+// warmup lists every app from CC and writes them to Bolt, giving up after
+// WarmupTimeout. A listing still running then is left to finish unused.
+func (c *CachingBolt) warmup() (map[string]*App, error) {
+	start := time.Now()
+	type listing struct {
+		apps map[string]*App
+		err  error
+	}
+	listed := make(chan listing, 1)
+	go func() {
+		apps, err := c.listRemoteApps()
+		listed <- listing{apps, err}
+	}()
 
-	return apps, nil
+	var timeout <-chan time.Time
+	if c.config.WarmupTimeout > 0 {
+		timer := time.NewTimer(c.config.WarmupTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case result := <-listed:
+		if result.err != nil {
+			return nil, result.err
+		}
+		c.setAvailable(c.fillDatabase(result.apps))
+		logging.LogStd(fmt.Sprintf("Cache warmup loaded [%d] apps in %s", len(result.apps), time.Since(start)), true)
+		return result.apps, nil
+	case <-timeout:
+		return nil, fmt.Errorf("listing apps took longer than %s", c.config.WarmupTimeout)
+	}
 }
 
 func (c *CachingBolt) createBucket() error {
-	return c.appdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(APP_BUCKET))
+	for _, db := range c.appdbs {
+		err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(APP_BUCKET))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+			return err
 		}
-		return nil
+	}
+	return nil
+}
+
+// isExpired tells whether the entry of appGuid outlived MaxEntryAge. The
+// caller holds the lock.
+func (c *CachingBolt) isExpired(appGuid string) bool {
+	if c.config.MaxEntryAge <= 0 {
+		return false
+	}
+	refreshed := c.lastRefresh
+	if resolved, ok := c.resolvedAt[appGuid]; ok && resolved.After(refreshed) {
+		refreshed = resolved
+	}
+	return time.Since(refreshed) > c.config.MaxEntryAge
+}
+
+// evict removes an app from the in-memory cache and its Bolt shard, so that
+// it is resolved again on its next event
+func (c *CachingBolt) evict(appGuid string) {
+	c.lock.Lock()
+	delete(c.cache, appGuid)
+	delete(c.resolvedAt, appGuid)
+	c.lock.Unlock()
+	c.evictions.Inc()
+
+	c.deleteFromDatabase(appGuid)
+}
+
+// Invalidate removes an app from the cache as evict does, forgetting that
+// it was missing or deleted too, when CC notifies it changed. Under the
+// last-known policy the app is remembered in case it was deleted.
+func (c *CachingBolt) Invalidate(appGuid string) {
+	c.lock.Lock()
+	if app, ok := c.cache[appGuid]; ok && c.config.DeletedEntityPolicy == DeletedEntityLastKnown {
+		c.lastKnown[appGuid] = app
+	}
+	delete(c.cache, appGuid)
+	delete(c.resolvedAt, appGuid)
+	delete(c.missingApps, appGuid)
+	delete(c.deletedApps, appGuid)
+	c.lock.Unlock()
+
+	c.deleteFromDatabase(appGuid)
+}
+
+func (c *CachingBolt) deleteFromDatabase(appGuid string) {
+	c.appdbs[c.shardFor(appGuid)].Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(APP_BUCKET)).Delete([]byte(appGuid))
 	})
 }
 
@@ -234,9 +478,16 @@ func (c *CachingBolt) invalidateCache() {
 			case <-ticker.C:
 				// continue
 				apps, err := c.getAllAppsFromRemote()
-				if err == nil {
+				if err != nil {
+					c.setAvailable(err)
+				} else {
 					c.lock.Lock()
+					if c.config.DeletedEntityPolicy == DeletedEntityLastKnown {
+						c.rememberEvicted(apps)
+					}
 					c.cache = apps
+					c.lastRefresh = time.Now()
+					c.resolvedAt = make(map[string]time.Time)
 					c.lock.Unlock()
 				}
 			case <-c.closing:
@@ -246,9 +497,40 @@ func (c *CachingBolt) invalidateCache() {
 	}()
 }
 
-func (c *CachingBolt) fillDatabase(apps map[string]*App) {
+// fillDatabase writes apps to their shard, shards being filled concurrently
+func (c *CachingBolt) fillDatabase(apps map[string]*App) error {
+	byShard := make([][]*App, len(c.appdbs))
+	for _, app := range apps {
+		shard := c.shardFor(app.Guid)
+		byShard[shard] = append(byShard[shard], app)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(byShard))
+	for shard := range byShard {
+		if len(byShard[shard]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			errs[shard] = fillShard(c.appdbs[shard], byShard[shard])
+		}(shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fillShard(db *bolt.DB, apps []*App) error {
+	var failed error
 	for _, app := range apps {
-		c.appdb.Update(func(tx *bolt.Tx) error {
+		err := db.Update(func(tx *bolt.Tx) error {
 			serialize, err := json.Marshal(app)
 			if err != nil {
 				return fmt.Errorf("Error Marshaling data: %s", err)
@@ -260,10 +542,14 @@ func (c *CachingBolt) fillDatabase(apps map[string]*App) {
 			}
 			return nil
 		})
+		if err != nil && failed == nil {
+			failed = err
+		}
 	}
+	return failed
 }
 
-func (c *CachingBolt) fromPCFApp(app *cfclient.App) *App {
+func fromPCFApp(app *CCApp) *App {
 	return &App{
 		app.Name,
 		app.Guid,
@@ -271,7 +557,9 @@ func (c *CachingBolt) fromPCFApp(app *cfclient.App) *App {
 		app.SpaceData.Entity.Guid,
 		app.SpaceData.Entity.OrgData.Entity.Name,
 		app.SpaceData.Entity.OrgData.Entity.Guid,
-		c.isOptOut(app.Environment),
+		isOptOut(app.Environment),
+		app.Labels,
+		app.Annotations,
 	}
 }
 
@@ -281,13 +569,15 @@ func (c *CachingBolt) getAppFromRemote(appGuid string) (*App, error) {
 		return nil, err
 	}
 
-	app := c.fromPCFApp(&cfApp)
-	c.fillDatabase(map[string]*App{app.Guid: app})
+	// the v2 API answers 404 with a body that has no app in it
+	if cfApp.Guid == "" {
+		return nil, ErrAppNotFound
+	}
 
-	return app, nil
+	return fromPCFApp(&cfApp), nil
 }
 
-func (c *CachingBolt) isOptOut(envVar map[string]interface{}) bool {
+func isOptOut(envVar map[string]interface{}) bool {
 	if val, ok := envVar["F2S_DISABLE_LOGGING"]; ok && val == "true" {
 		return true
 	}
@@ -0,0 +1,90 @@
+package caching
+
+import (
+	"errors"
+)
+
+const (
+	// DeletedEntityNone leaves apps whose space or org is gone without
+	// metadata, as CC returns it
+	DeletedEntityNone        = "none"
+	DeletedEntityDrop        = "drop"
+	DeletedEntityPlaceholder = "placeholder"
+	DeletedEntityLastKnown   = "last-known"
+
+	// DeletedPlaceholder replaces the names of deleted apps, spaces and orgs
+	DeletedPlaceholder = "deleted"
+)
+
+var (
+	// ErrAppNotFound is returned when CC doesn't know the app anymore
+	ErrAppNotFound = errors.New("App not found")
+	// ErrAppDeleted is returned for deleted apps under the drop policy:
+	// their events must not be shipped
+	ErrAppDeleted = errors.New("App, space or org was deleted")
+)
+
+func (c *CachingBolt) tracksDeleted() bool {
+	policy := c.config.DeletedEntityPolicy
+	return policy != "" && policy != DeletedEntityNone
+}
+
+// isDeleted tells whether a remote lookup hit an app that was deleted, or
+// whose space or org was, while its events were still in flight.
+func isDeleted(app *App, err error) bool {
+	if err != nil {
+		return err == ErrAppNotFound
+	}
+	return app.SpaceName == "" || app.OrgName == ""
+}
+
+// deletedApp resolves a deleted app according to the deleted entity policy
+// and remembers the outcome, so that CC is asked only once.
+func (c *CachingBolt) deletedApp(appGuid string, app *App) (*App, error) {
+	c.deletedLookups.Inc()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var resolved *App
+	switch c.config.DeletedEntityPolicy {
+	case DeletedEntityLastKnown:
+		resolved = c.lastKnown[appGuid]
+		if resolved == nil {
+			resolved = placeholderApp(appGuid, app, DeletedPlaceholder)
+		}
+	case DeletedEntityPlaceholder:
+		resolved = placeholderApp(appGuid, app, DeletedPlaceholder)
+	}
+
+	c.deletedApps[appGuid] = resolved
+	if resolved == nil {
+		return nil, ErrAppDeleted
+	}
+	return resolved, nil
+}
+
+// placeholderApp keeps whatever CC still returned for the app and fills in
+// the missing names with placeholder.
+func placeholderApp(appGuid string, app *App, placeholder string) *App {
+	resolved := &App{Guid: appGuid}
+	if app != nil {
+		*resolved = *app
+	}
+	for _, name := range []*string{&resolved.Name, &resolved.SpaceName, &resolved.OrgName} {
+		if *name == "" {
+			*name = placeholder
+		}
+	}
+	return resolved
+}
+
+// rememberEvicted keeps apps a cache refresh dropped, for the last-known
+// policy to use once their events show up.
+func (c *CachingBolt) rememberEvicted(apps map[string]*App) {
+	for guid, app := range c.cache {
+		if _, ok := apps[guid]; !ok {
+			c.lastKnown[guid] = app
+		}
+	}
+}
@@ -49,6 +49,10 @@ func easyjson633f8c25DecodeGithubComCloudfoundryCommunityFirehoseToSyslogCaching
 			out.OrgGuid = string(in.String())
 		case "IgnoredApp":
 			out.IgnoredApp = bool(in.Bool())
+		case "Labels":
+			out.Labels = easyjson633f8c25DecodeStringMap(in)
+		case "Annotations":
+			out.Annotations = easyjson633f8c25DecodeStringMap(in)
 		default:
 			in.SkipRecursive()
 		}
@@ -105,6 +109,52 @@ func easyjson633f8c25EncodeGithubComCloudfoundryCommunityFirehoseToSyslogCaching
 	first = false
 	out.RawString("\"IgnoredApp\":")
 	out.Bool(bool(in.IgnoredApp))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Labels\":")
+	easyjson633f8c25EncodeStringMap(out, in.Labels)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Annotations\":")
+	easyjson633f8c25EncodeStringMap(out, in.Annotations)
+	out.RawByte('}')
+}
+func easyjson633f8c25DecodeStringMap(in *jlexer.Lexer) map[string]string {
+	if in.IsNull() {
+		in.Skip()
+		return nil
+	}
+	in.Delim('{')
+	out := make(map[string]string)
+	for !in.IsDelim('}') {
+		key := string(in.String())
+		in.WantColon()
+		out[key] = string(in.String())
+		in.WantComma()
+	}
+	in.Delim('}')
+	return out
+}
+func easyjson633f8c25EncodeStringMap(out *jwriter.Writer, in map[string]string) {
+	if in == nil {
+		out.RawString(`null`)
+		return
+	}
+	out.RawByte('{')
+	first := true
+	for key, value := range in {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.String(string(key))
+		out.RawByte(':')
+		out.String(string(value))
+	}
 	out.RawByte('}')
 }
 
@@ -21,3 +21,10 @@ func (c *CachingEmpty) GetAllApps() (map[string]*App, error) {
 func (c *CachingEmpty) GetApp(appGuid string) (*App, error) {
 	return nil, nil
 }
+
+func (c *CachingEmpty) Stats() Stats {
+	return Stats{}
+}
+
+func (c *CachingEmpty) Invalidate(appGuid string) {
+}
@@ -0,0 +1,40 @@
+package caching
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	LIFECYCLE_BUCKET = "LifecycleBucket"
+	startCountKey    = "start_count"
+)
+
+// RecordStart increments the number of times the nozzle started, persisted
+// in the Bolt file at path, and returns the new count. It must be called
+// while the cache is closed as Bolt holds an exclusive lock on the file.
+func RecordStart(path string) (uint64, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var count uint64
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(LIFECYCLE_BUCKET))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(startCountKey)); len(v) == 8 {
+			count = binary.BigEndian.Uint64(v)
+		}
+		count++
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, count)
+		return b.Put([]byte(startCountKey), v)
+	})
+	return count, err
+}
@@ -0,0 +1,272 @@
+package caching
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+type CachingMemoryConfig struct {
+	// MaxEntries bounds the number of apps, missing ones included, the
+	// least recently used being evicted beyond it. 0 doesn't bound it.
+	MaxEntries int
+	// IgnoreMissingApps remembers apps CC doesn't know for MissingAppsTTL,
+	// their events being shipped without metadata until then. 0 remembers
+	// them until evicted.
+	IgnoreMissingApps bool
+	MissingAppsTTL    time.Duration
+	// CacheInvalidateTTL refreshes the cached apps from CC that often,
+	// dropping the ones CC doesn't list anymore. 0 never refreshes them.
+	CacheInvalidateTTL time.Duration
+}
+
+// memoryEntry is an app of the LRU, or an app missing from CC when app is
+// nil, until expires unless zero
+type memoryEntry struct {
+	guid    string
+	app     *App
+	expires time.Time
+}
+
+// CachingMemory keeps apps in memory only, in an LRU of up to MaxEntries
+// apps keyed by GUID, so that its size stays bounded whatever the number
+// of apps of the foundation. Nothing survives a restart.
+type CachingMemory struct {
+	appClient AppClient
+	config    *CachingMemoryConfig
+
+	lock        sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	apps        int
+	lastRefresh time.Time
+	open        bool
+
+	hits           *metrics.Counter
+	misses         *metrics.Counter
+	missingAppHits *metrics.Counter
+	evictions      *metrics.Counter
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewCachingMemory(client AppClient, config *CachingMemoryConfig) *CachingMemory {
+	return &CachingMemory{
+		appClient:      client,
+		config:         config,
+		entries:        make(map[string]*list.Element),
+		lru:            list.New(),
+		hits:           metrics.NewCounter("cache_hits"),
+		misses:         metrics.NewCounter("cache_misses"),
+		missingAppHits: metrics.NewCounter("cache_missing_app_hits"),
+		evictions:      metrics.NewCounter("cache_evictions"),
+		closing:        make(chan struct{}),
+	}
+}
+
+// Open fills the cache with the apps CC lists, up to MaxEntries, and starts
+// refreshing them every CacheInvalidateTTL.
+func (c *CachingMemory) Open() error {
+	logging.LogStd("Retrieving Apps for Cache...", false)
+	cfApps, err := c.appClient.ListApps()
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	for i := range cfApps {
+		if c.config.MaxEntries > 0 && len(c.entries) >= c.config.MaxEntries {
+			break
+		}
+		c.store(fromPCFApp(&cfApps[i]))
+	}
+	c.lastRefresh = time.Now()
+	c.open = true
+	cached := c.apps
+	c.lock.Unlock()
+	logging.LogStd(fmt.Sprintf("Found [%d] Apps, cached [%d]!", len(cfApps), cached), false)
+
+	if c.config.CacheInvalidateTTL > 0 {
+		c.wg.Add(1)
+		go c.refreshEvery(c.config.CacheInvalidateTTL)
+	}
+	return nil
+}
+
+func (c *CachingMemory) Close() error {
+	c.lock.Lock()
+	wasOpen := c.open
+	c.open = false
+	c.lock.Unlock()
+	if wasOpen {
+		close(c.closing)
+		c.wg.Wait()
+	}
+	return nil
+}
+
+func (c *CachingMemory) GetApp(appGuid string) (*App, error) {
+	c.lock.Lock()
+	if element, ok := c.entries[appGuid]; ok {
+		entry := element.Value.(*memoryEntry)
+		if entry.app != nil {
+			c.lru.MoveToFront(element)
+			c.lock.Unlock()
+			c.hits.Inc()
+			return entry.app, nil
+		}
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			c.lock.Unlock()
+			c.hits.Inc()
+			c.missingAppHits.Inc()
+			return nil, errMissingApp
+		}
+		c.remove(element)
+	}
+	c.lock.Unlock()
+
+	c.misses.Inc()
+	cfApp, err := c.appClient.AppByGuid(appGuid)
+	if err == nil && cfApp.Guid == "" {
+		err = ErrAppNotFound
+	}
+	if err != nil {
+		if c.config.IgnoreMissingApps {
+			missing := &memoryEntry{guid: appGuid}
+			if c.config.MissingAppsTTL > 0 {
+				missing.expires = time.Now().Add(c.config.MissingAppsTTL)
+			}
+			c.lock.Lock()
+			c.add(missing)
+			c.lock.Unlock()
+		}
+		return nil, err
+	}
+
+	app := fromPCFApp(&cfApp)
+	c.lock.Lock()
+	c.store(app)
+	c.lock.Unlock()
+	return app, nil
+}
+
+// GetAllApps returns copies of the cached apps
+func (c *CachingMemory) GetAllApps() (map[string]*App, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	apps := make(map[string]*App, c.apps)
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		if entry := element.Value.(*memoryEntry); entry.app != nil {
+			dup := *entry.app
+			apps[dup.Guid] = &dup
+		}
+	}
+	return apps, nil
+}
+
+// Stats returns the lookups counts and the size and age of the cache, Apps
+// not counting the missing apps remembered
+func (c *CachingMemory) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return Stats{
+		Hits:           c.hits.Value(),
+		Misses:         c.misses.Value(),
+		MissingAppHits: c.missingAppHits.Value(),
+		Apps:           c.apps,
+		LastRefresh:    c.lastRefresh,
+		Open:           c.open,
+	}
+}
+
+// Invalidate forgets an app, missing or not
+func (c *CachingMemory) Invalidate(appGuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[appGuid]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *CachingMemory) refreshEvery(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh()
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// refresh replaces the cached apps by the ones CC lists, dropping those it
+// doesn't list anymore and the missing apps it lists now. Apps that aren't
+// cached are left to their first event, so that the LRU keeps the apps
+// actually logging.
+func (c *CachingMemory) refresh() {
+	cfApps, err := c.appClient.ListApps()
+	if err != nil {
+		logging.LogError("Unable to refresh the apps cache, keeping the cached apps: ", err)
+		return
+	}
+	listed := make(map[string]*App, len(cfApps))
+	for i := range cfApps {
+		listed[cfApps[i].Guid] = fromPCFApp(&cfApps[i])
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*memoryEntry)
+		if app, ok := listed[entry.guid]; ok {
+			if entry.app == nil {
+				c.apps++
+			}
+			entry.app, entry.expires = app, time.Time{}
+		} else if entry.app != nil {
+			c.remove(element)
+		}
+		element = next
+	}
+	c.lastRefresh = time.Now()
+}
+
+// store caches app as the most recently used. The caller holds the lock.
+func (c *CachingMemory) store(app *App) {
+	c.add(&memoryEntry{guid: app.Guid, app: app})
+}
+
+// add inserts entry as the most recently used, replacing the one of the
+// same app, if any, and evicting the least recently used ones beyond
+// MaxEntries. The caller holds the lock.
+func (c *CachingMemory) add(entry *memoryEntry) {
+	if element, ok := c.entries[entry.guid]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.guid] = c.lru.PushFront(entry)
+	if entry.app != nil {
+		c.apps++
+	}
+	for c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries {
+		c.remove(c.lru.Back())
+		c.evictions.Inc()
+	}
+}
+
+// remove drops the entry of element. The caller holds the lock.
+func (c *CachingMemory) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*memoryEntry)
+	delete(c.entries, entry.guid)
+	if entry.app != nil {
+		c.apps--
+	}
+}
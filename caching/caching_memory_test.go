@@ -0,0 +1,113 @@
+package caching_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/caching"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Memory caching", func() {
+	var (
+		client *mockAppClient
+		config *CachingMemoryConfig
+	)
+
+	BeforeEach(func() {
+		client = newMockAppClient(10)
+		config = &CachingMemoryConfig{MaxEntries: 5, IgnoreMissingApps: true}
+	})
+
+	It("should fill the cache up to its max entries", func() {
+		cache := NewCachingMemory(client, config)
+		Expect(cache.Open()).To(Succeed())
+		defer cache.Close()
+
+		apps, err := cache.GetAllApps()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(5))
+		Expect(cache.Stats().Apps).To(Equal(5))
+		Expect(cache.Stats().Open).To(BeTrue())
+	})
+
+	It("should evict the least recently used apps", func() {
+		cache := NewCachingMemory(client, &CachingMemoryConfig{MaxEntries: 2})
+		for _, guid := range []string{"cf_app_id_1", "cf_app_id_2", "cf_app_id_1", "cf_app_id_3"} {
+			_, err := cache.GetApp(guid)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		apps, _ := cache.GetAllApps()
+		Expect(apps).To(HaveKey("cf_app_id_1"))
+		Expect(apps).To(HaveKey("cf_app_id_3"))
+		Expect(apps).NotTo(HaveKey("cf_app_id_2"))
+		Expect(cache.Stats().Misses).To(BeNumerically(">=", 3))
+	})
+
+	It("should remember missing apps for their TTL", func() {
+		config.MissingAppsTTL = 50 * time.Millisecond
+		cache := NewCachingMemory(client, config)
+		_, err := cache.GetApp("missing-app")
+		Expect(err).To(MatchError("No such app"))
+
+		client.CreateApp("missing-app", "space", "org")
+		_, err = cache.GetApp("missing-app")
+		Expect(err).To(MatchError("App was missed and ignored"))
+
+		time.Sleep(100 * time.Millisecond)
+		app, err := cache.GetApp("missing-app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.Name).To(Equal("missing-app"))
+	})
+
+	It("should not remember missing apps unless ignored", func() {
+		cache := NewCachingMemory(client, &CachingMemoryConfig{})
+		_, err := cache.GetApp("missing-app")
+		Expect(err).To(HaveOccurred())
+
+		client.CreateApp("missing-app", "space", "org")
+		_, err = cache.GetApp("missing-app")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should refresh the cached apps every CacheInvalidateTTL", func() {
+		config.CacheInvalidateTTL = 50 * time.Millisecond
+		cache := NewCachingMemory(client, config)
+		Expect(cache.Open()).To(Succeed())
+		defer cache.Close()
+		apps, _ := cache.GetAllApps()
+		var cached string
+		for guid := range apps {
+			cached = guid
+		}
+
+		client.DeleteApp(cached)
+		Eventually(func() map[string]*App {
+			apps, _ := cache.GetAllApps()
+			return apps
+		}).ShouldNot(HaveKey(cached))
+		Expect(cache.Stats().Apps).To(Equal(4))
+	})
+
+	It("should keep the cached apps when a refresh fails", func() {
+		config.CacheInvalidateTTL = 20 * time.Millisecond
+		cache := NewCachingMemory(client, config)
+		Expect(cache.Open()).To(Succeed())
+		defer cache.Close()
+
+		client.SetListError(errors.New("CC down"))
+		time.Sleep(100 * time.Millisecond)
+		Expect(cache.Stats().Apps).To(Equal(5))
+	})
+
+	It("should forget invalidated apps", func() {
+		cache := NewCachingMemory(client, config)
+		_, err := cache.GetApp("cf_app_id_1")
+		Expect(err).ToNot(HaveOccurred())
+		cache.Invalidate("cf_app_id_1")
+		Expect(cache.Stats().Apps).To(Equal(0))
+	})
+})
@@ -0,0 +1,276 @@
+package caching
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	json "github.com/mailru/easyjson"
+)
+
+const (
+	CacheBackendBolt   = "bolt"
+	CacheBackendRedis  = "redis"
+	CacheBackendMemory = "memory"
+
+	// redisKeyPrefix namespaces the keys of the nozzle in a shared Redis
+	redisKeyPrefix = "firehose-to-syslog:"
+	// redisLocalTTL is how long an instance keeps apps read from Redis in
+	// memory, so that Redis is queried at most once per app in that time
+	redisLocalTTL = time.Minute
+)
+
+type CachingRedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	// IgnoreMissingApps remembers apps CC doesn't know for MissingAppsTTL,
+	// their events being shipped without metadata until then. 0 remembers
+	// them until Redis evicts them.
+	IgnoreMissingApps bool
+	MissingAppsTTL    time.Duration
+	// CacheInvalidateTTL expires apps in Redis, so that they are resolved
+	// from CC again. 0 keeps them.
+	CacheInvalidateTTL time.Duration
+}
+
+type localApp struct {
+	app     *App
+	expires time.Time
+}
+
+// CachingRedis keeps apps in a Redis server, shared by every nozzle
+// instance using it. When Redis can't be reached, apps are resolved from
+// CC directly rather than failing events.
+type CachingRedis struct {
+	appClient AppClient
+	redis     *redisClient
+	config    *CachingRedisConfig
+
+	lock        sync.RWMutex
+	local       map[string]localApp
+	lastRefresh time.Time
+
+	open           bool
+	unreachable    bool
+	hits           *metrics.Counter
+	misses         *metrics.Counter
+	missingAppHits *metrics.Counter
+	redisErrors    *metrics.Counter
+}
+
+func NewCachingRedis(client AppClient, config *CachingRedisConfig) *CachingRedis {
+	return &CachingRedis{
+		appClient:      client,
+		redis:          newRedisClient(config.Addr, config.Password, config.DB),
+		config:         config,
+		local:          make(map[string]localApp),
+		hits:           metrics.NewCounter("cache_hits"),
+		misses:         metrics.NewCounter("cache_misses"),
+		missingAppHits: metrics.NewCounter("cache_missing_app_hits"),
+		redisErrors:    metrics.NewCounter("cache_redis_errors"),
+	}
+}
+
+// Open fills Redis with every app unless another instance did so within
+// CacheInvalidateTTL.
+func (c *CachingRedis) Open() error {
+	c.lock.Lock()
+	c.open = true
+	c.lock.Unlock()
+	populated, err := c.redis.do("SET", redisKeyPrefix+"populated", "1", "NX")
+	if c.checkRedis(err) != nil || populated == nil {
+		return nil
+	}
+	if c.config.CacheInvalidateTTL > 0 {
+		c.checkRedis(c.expire(redisKeyPrefix+"populated", c.config.CacheInvalidateTTL))
+	}
+
+	logging.LogStd("Retrieving Apps for Cache...", false)
+	cfApps, err := c.appClient.ListApps()
+	if err != nil {
+		return err
+	}
+	for i := range cfApps {
+		c.store(fromPCFApp(&cfApps[i]))
+	}
+	c.lock.Lock()
+	c.lastRefresh = time.Now()
+	c.lock.Unlock()
+	logging.LogStd(fmt.Sprintf("Found [%d] Apps!", len(cfApps)), false)
+	return nil
+}
+
+func (c *CachingRedis) Close() error {
+	c.lock.Lock()
+	c.open = false
+	c.lock.Unlock()
+	return c.redis.Close()
+}
+
+// GetAllApps returns the apps stored in Redis
+func (c *CachingRedis) GetAllApps() (map[string]*App, error) {
+	apps := make(map[string]*App)
+	cursor := "0"
+	for {
+		reply, err := c.redis.do("SCAN", cursor, "MATCH", appKey("*"), "COUNT", "1000")
+		if err := c.checkRedis(err); err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, errors.New("Redis: unexpected SCAN reply")
+		}
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			if app, err := c.load(fmt.Sprint(key)); err == nil && app != nil {
+				apps[app.Guid] = app
+			}
+		}
+		if cursor = fmt.Sprint(page[0]); cursor == "0" {
+			return apps, nil
+		}
+	}
+}
+
+// Stats returns the lookups counts of the instance. Apps only counts the
+// apps it holds in memory, LastRefresh is when it filled Redis, if it did,
+// and the cache isn't Open while Redis can't be reached.
+func (c *CachingRedis) Stats() Stats {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return Stats{
+		Hits:           c.hits.Value(),
+		Misses:         c.misses.Value(),
+		MissingAppHits: c.missingAppHits.Value(),
+		Apps:           len(c.local),
+		LastRefresh:    c.lastRefresh,
+		Open:           c.open && !c.unreachable,
+	}
+}
+
+// Invalidate removes an app from Redis and the memory of the instance.
+// Other instances may still serve it from memory for up to a minute.
+func (c *CachingRedis) Invalidate(appGuid string) {
+	c.lock.Lock()
+	delete(c.local, appGuid)
+	c.lock.Unlock()
+	_, err := c.redis.do("DEL", appKey(appGuid), missingKey(appGuid))
+	c.checkRedis(err)
+}
+
+func (c *CachingRedis) GetApp(appGuid string) (*App, error) {
+	c.lock.RLock()
+	local, ok := c.local[appGuid]
+	c.lock.RUnlock()
+	if ok && time.Now().Before(local.expires) {
+		c.hits.Inc()
+		return local.app, nil
+	}
+
+	app, err := c.load(appKey(appGuid))
+	if c.checkRedis(err) == nil && app != nil {
+		c.hits.Inc()
+		c.remember(app)
+		return app, nil
+	}
+
+	if c.config.IgnoreMissingApps {
+		missing, err := c.redis.do("EXISTS", missingKey(appGuid))
+		if c.checkRedis(err) == nil && missing == int64(1) {
+			c.hits.Inc()
+			c.missingAppHits.Inc()
+			return nil, errMissingApp
+		}
+	}
+
+	c.misses.Inc()
+	cfApp, err := c.appClient.AppByGuid(appGuid)
+	if err == nil && cfApp.Guid == "" {
+		err = ErrAppNotFound
+	}
+	if err != nil {
+		if c.config.IgnoreMissingApps {
+			c.checkRedis(c.set(missingKey(appGuid), "1", c.config.MissingAppsTTL))
+		}
+		return nil, err
+	}
+
+	app = fromPCFApp(&cfApp)
+	c.store(app)
+	c.remember(app)
+	return app, nil
+}
+
+func (c *CachingRedis) load(key string) (*App, error) {
+	reply, err := c.redis.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	var app App
+	if err := json.Unmarshal([]byte(fmt.Sprint(reply)), &app); err != nil {
+		logging.LogError(fmt.Sprintf("Ignoring malformed Redis entry [%s]: ", key), err)
+		return nil, nil
+	}
+	return &app, nil
+}
+
+func (c *CachingRedis) store(app *App) {
+	serialized, err := json.Marshal(app)
+	if err != nil {
+		logging.LogError("Error Marshaling data: ", err)
+		return
+	}
+	c.checkRedis(c.set(appKey(app.Guid), string(serialized), c.config.CacheInvalidateTTL))
+}
+
+func (c *CachingRedis) remember(app *App) {
+	c.lock.Lock()
+	c.local[app.Guid] = localApp{app: app, expires: time.Now().Add(redisLocalTTL)}
+	c.lock.Unlock()
+}
+
+func (c *CachingRedis) set(key string, value string, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = c.redis.do("SET", key, value, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	} else {
+		_, err = c.redis.do("SET", key, value)
+	}
+	return err
+}
+
+func (c *CachingRedis) expire(key string, ttl time.Duration) error {
+	_, err := c.redis.do("PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// checkRedis counts Redis failures, logging when Redis becomes unreachable
+// and reachable again, and returns err.
+func (c *CachingRedis) checkRedis(err error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		c.redisErrors.Inc()
+		if !c.unreachable {
+			logging.LogError("Redis cache unavailable, resolving apps from the Cloud Controller: ", err)
+		}
+		c.unreachable = true
+	} else if c.unreachable {
+		logging.LogStd("Redis cache available again", true)
+		c.unreachable = false
+	}
+	return err
+}
+
+func appKey(appGuid string) string {
+	return redisKeyPrefix + "app:" + appGuid
+}
+
+func missingKey(appGuid string) string {
+	return redisKeyPrefix + "missing:" + appGuid
+}
@@ -0,0 +1,151 @@
+package caching
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds dialing and every command, so that an unreachable
+// Redis slows events down instead of blocking them
+const redisTimeout = 2 * time.Second
+
+// redisError is an error reply of the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis: " + string(e)
+}
+
+// redisClient speaks enough of the RESP protocol for the cache: commands
+// are sent one at a time over a single connection, dialed again after any
+// failure.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRedisClient(addr string, password string, db int) *redisClient {
+	return &redisClient{addr: addr, password: password, db: db}
+}
+
+// do sends a command and returns its reply: a string, an int64, nil or a
+// []interface{} of replies.
+func (r *redisClient) do(args ...string) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn == nil {
+		if err := r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := r.roundTrip(args)
+	if _, isReply := err.(redisError); err != nil && !isReply {
+		r.close()
+	}
+	return reply, err
+}
+
+func (r *redisClient) dial() error {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader = conn, bufio.NewReader(conn)
+
+	if r.password != "" {
+		if _, err := r.roundTrip([]string{"AUTH", r.password}); err != nil {
+			r.close()
+			return err
+		}
+	}
+	if r.db != 0 {
+		if _, err := r.roundTrip([]string{"SELECT", strconv.Itoa(r.db)}); err != nil {
+			r.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisClient) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn, r.reader = nil, nil
+	}
+}
+
+// Close closes the connection, the next command dialing again.
+func (r *redisClient) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.close()
+	return nil
+}
+
+func (r *redisClient) roundTrip(args []string) (interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(r.conn, command); err != nil {
+		return nil, err
+	}
+	return r.readReply()
+}
+
+func (r *redisClient) readReply() (interface{}, error) {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("Redis: malformed reply")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, count)
+		for i := range replies {
+			if replies[i], err = r.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("Redis: unexpected reply type %q", kind)
+}
@@ -0,0 +1,185 @@
+package caching_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/caching"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeRedis serves the commands the cache uses from memory, ignoring TTLs
+type fakeRedis struct {
+	listener net.Listener
+	lock     sync.Mutex
+	data     map[string]string
+	commands []string
+}
+
+func newFakeRedis() *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	r := &fakeRedis{listener: listener, data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			line, _ = reader.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			data := make([]byte, size+2)
+			io.ReadFull(reader, data)
+			args[i] = string(data[:size])
+		}
+		io.WriteString(conn, r.execute(args))
+	}
+}
+
+func (r *fakeRedis) execute(args []string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.commands = append(r.commands, strings.Join(args, " "))
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if value, ok := r.data[args[1]]; ok {
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+		}
+		return "$-1\r\n"
+	case "SET":
+		if _, ok := r.data[args[1]]; ok && len(args) > 3 && args[3] == "NX" {
+			return "$-1\r\n"
+		}
+		r.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "EXISTS":
+		if _, ok := r.data[args[1]]; ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "PEXPIRE":
+		return ":1\r\n"
+	case "SCAN":
+		var keys []string
+		for key := range r.data {
+			if strings.HasPrefix(key, strings.TrimSuffix(args[3], "*")) {
+				keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key))
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (r *fakeRedis) sent(prefix string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for _, command := range r.commands {
+		if strings.HasPrefix(command, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+var _ = Describe("Redis caching", func() {
+	var (
+		redis  *fakeRedis
+		client *mockAppClient
+		config *CachingRedisConfig
+	)
+
+	BeforeEach(func() {
+		redis = newFakeRedis()
+		client = newMockAppClient(10)
+		config = &CachingRedisConfig{Addr: redis.addr(), IgnoreMissingApps: true}
+	})
+
+	AfterEach(func() {
+		redis.listener.Close()
+	})
+
+	It("should fill Redis with every app once", func() {
+		cache := NewCachingRedis(client, config)
+		Expect(cache.Open()).To(Succeed())
+		apps, err := cache.GetAllApps()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(apps).To(HaveLen(10))
+		Expect(apps["cf_app_id_1"].SpaceName).To(Equal("cf_space_name_1"))
+
+		client.SetListError(fmt.Errorf("must not be listed twice"))
+		Expect(NewCachingRedis(client, config).Open()).To(Succeed())
+	})
+
+	It("should share the apps resolved by other instances", func() {
+		first := NewCachingRedis(client, config)
+		client.CreateApp("new-app", "space", "org")
+		app, err := first.GetApp("new-app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.OrgName).To(Equal("org"))
+
+		client.DeleteApp("new-app")
+		app, err = NewCachingRedis(client, config).GetApp("new-app")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.Name).To(Equal("new-app"))
+	})
+
+	It("should keep the apps it read in memory", func() {
+		cache := NewCachingRedis(client, config)
+		_, err := cache.GetApp("cf_app_id_3")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = cache.GetApp("cf_app_id_3")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(redis.sent("GET firehose-to-syslog:app:cf_app_id_3")).To(Equal(1))
+	})
+
+	It("should remember missing apps", func() {
+		cache := NewCachingRedis(client, config)
+		_, err := cache.GetApp("missing-app")
+		Expect(err).To(MatchError("No such app"))
+
+		client.CreateApp("missing-app", "space", "org")
+		_, err = NewCachingRedis(client, config).GetApp("missing-app")
+		Expect(err).To(MatchError("App was missed and ignored"))
+	})
+
+	It("should resolve apps from CC when Redis is unreachable", func() {
+		redis.listener.Close()
+		cache := NewCachingRedis(client, config)
+		Expect(cache.Open()).To(Succeed())
+
+		app, err := cache.GetApp("cf_app_id_5")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app.Name).To(Equal("cf_app_name_5"))
+	})
+})
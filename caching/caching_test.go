@@ -19,6 +19,9 @@ type mockAppClient struct {
 	lock sync.RWMutex
 	apps map[string]cfclient.App
 	n    int
+	err  error
+	// delay slows ListApps down
+	delay time.Duration
 }
 
 func newMockAppClient(n int) *mockAppClient {
@@ -29,24 +32,29 @@ func newMockAppClient(n int) *mockAppClient {
 	}
 }
 
-func (m *mockAppClient) AppByGuid(guid string) (cfclient.App, error) {
+func (m *mockAppClient) AppByGuid(guid string) (CCApp, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
 	app, ok := m.apps[guid]
 	if ok {
-		return app, nil
+		return CCApp{App: app}, nil
 	}
-	return app, errors.New("No such app")
+	return CCApp{App: app}, errors.New("No such app")
 }
 
-func (m *mockAppClient) ListApps() ([]cfclient.App, error) {
+func (m *mockAppClient) ListApps() ([]CCApp, error) {
+	time.Sleep(m.delay)
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	var apps []cfclient.App
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	var apps []CCApp
 	for k := range m.apps {
-		apps = append(apps, m.apps[k])
+		apps = append(apps, CCApp{App: m.apps[k]})
 	}
 	return apps, nil
 }
@@ -75,6 +83,20 @@ func (m *mockAppClient) CreateApp(appID, spaceID, orgID string) {
 	m.apps[appID] = app
 }
 
+func (m *mockAppClient) DeleteApp(appID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.apps, appID)
+}
+
+func (m *mockAppClient) SetListError(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.err = err
+}
+
 func getApps(n int) map[string]cfclient.App {
 	apps := make(map[string]cfclient.App, n)
 	for i := 0; i < n; i++ {
@@ -172,6 +194,56 @@ var _ = Describe("Caching", func() {
 		})
 	})
 
+	Context("Invalidate", func() {
+		It("Expect a renamed app to be resolved again", func() {
+			client.CreateApp("cf_app_id_0", "renamed_space", "renamed_org")
+			app, err := cache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.SpaceName).To(Equal("cf_space_name_0"))
+
+			cache.Invalidate("cf_app_id_0")
+			app, err = cache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.SpaceName).To(Equal("renamed_space"))
+		})
+
+		It("Expect a deleted app to be removed", func() {
+			client.DeleteApp("cf_app_id_1")
+			cache.Invalidate("cf_app_id_1")
+
+			apps, err := cache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(apps).NotTo(HaveKey("cf_app_id_1"))
+			_, err = cache.GetApp("cf_app_id_1")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("Stats", func() {
+		It("Expect lookups and cached apps to be counted", func() {
+			before := cache.Stats()
+			Expect(before.Apps).To(Equal(n))
+			Expect(before.LastRefresh).To(BeTemporally("~", time.Now(), 5*time.Second))
+
+			cache.GetApp("cf_app_id_0")
+			cache.GetApp("cf_app_id_not_exists")
+			cache.GetApp("cf_app_id_not_exists")
+
+			after := cache.Stats()
+			Expect(after.Hits - before.Hits).To(BeEquivalentTo(2))
+			Expect(after.Misses - before.Misses).To(BeEquivalentTo(1))
+			Expect(after.MissingAppHits - before.MissingAppHits).To(BeEquivalentTo(1))
+		})
+
+		It("Expect the cache to be reported open", func() {
+			Expect(cache.Stats().Open).To(BeTrue())
+		})
+
+		It("Expect zeroes without cache", func() {
+			Expect(NewCachingEmpty().Stats()).To(Equal(Stats{}))
+		})
+	})
+
 	Context("Cache invalidation", func() {
 		It("Expect new app", func() {
 			id := fmt.Sprintf("id_%d", time.Now().UnixNano())
@@ -234,4 +306,234 @@ var _ = Describe("Caching", func() {
 			Expect(len(apps)).To(Equal(n))
 		})
 	})
+
+	Context("Deleted space or org", func() {
+		openWithPolicy := func(policy string) (*CachingBolt, string) {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.CacheInvalidateTTL = 0
+			dup.DeletedEntityPolicy = policy
+			bcache, err := NewCachingBolt(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).ShouldNot(HaveOccurred())
+			return bcache, dup.Path
+		}
+
+		It("Expect placeholder names", func() {
+			bcache, path := openWithPolicy(DeletedEntityPlaceholder)
+			defer os.Remove(path)
+			defer bcache.Close()
+
+			client.CreateApp("orphan", "", "")
+			app, err := bcache.GetApp("orphan")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.Name).To(Equal("orphan"))
+			Expect(app.SpaceName).To(Equal(DeletedPlaceholder))
+			Expect(app.OrgName).To(Equal(DeletedPlaceholder))
+		})
+
+		It("Expect events of deleted apps to be dropped", func() {
+			bcache, path := openWithPolicy(DeletedEntityDrop)
+			defer os.Remove(path)
+			defer bcache.Close()
+
+			client.CreateApp("orphan", "", "")
+			_, err := bcache.GetApp("orphan")
+			Expect(err).To(Equal(ErrAppDeleted))
+
+			// the outcome is remembered even once CC answers again
+			client.CreateApp("orphan", "space", "org")
+			_, err = bcache.GetApp("orphan")
+			Expect(err).To(Equal(ErrAppDeleted))
+		})
+	})
+
+	Context("Cache unavailable", func() {
+		It("Expect placeholder names while CC can't be reached", func() {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.CacheInvalidateTTL = 100 * time.Millisecond
+			dup.IgnoreMissingApps = false
+			dup.CacheUnavailablePolicy = CacheUnavailableDegrade
+			bcache, err := NewCachingBolt(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).ShouldNot(HaveOccurred())
+			defer os.Remove(dup.Path)
+			defer bcache.Close()
+
+			client.SetListError(errors.New("CC is down"))
+			time.Sleep(300 * time.Millisecond)
+			app, err := bcache.GetApp("cf_app_id_unknown")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.OrgName).To(Equal(UnknownPlaceholder))
+
+			// apps resolved before keep their metadata
+			app, err = bcache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.Name).To(Equal("cf_app_name_0"))
+
+			client.SetListError(nil)
+			time.Sleep(300 * time.Millisecond)
+			_, err = bcache.GetApp("cf_app_id_unknown")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("Max entry age", func() {
+		It("Expect entries to be evicted and resolved again", func() {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.CacheInvalidateTTL = 0
+			dup.MaxEntryAge = 200 * time.Millisecond
+			bcache, err := NewCachingBolt(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).ShouldNot(HaveOccurred())
+			defer os.Remove(dup.Path)
+			defer bcache.Close()
+
+			client.DeleteApp("cf_app_id_0")
+			_, err = bcache.GetApp("cf_app_id_0")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			time.Sleep(300 * time.Millisecond)
+			_, err = bcache.GetApp("cf_app_id_0")
+			Ω(err).Should(HaveOccurred())
+
+			apps, err := bcache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(apps).ToNot(HaveKey("cf_app_id_0"))
+		})
+	})
+
+	Context("Sharded boltdb", func() {
+		It("Expect apps spread over shards and reloaded from them", func() {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.Shards = 4
+			paths := ShardPaths(dup.Path, dup.Shards)
+			for _, path := range paths {
+				defer os.Remove(path)
+			}
+
+			bcache, err := NewCachingBolt(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bcache.Open()
+			Ω(err).ShouldNot(HaveOccurred())
+			bcache.Close()
+
+			Expect(paths).To(HaveLen(4))
+			for _, path := range paths {
+				_, err := os.Stat(path)
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+
+			// Load from existing shards, the remote is no longer needed
+			bcache, err = NewCachingBolt(newMockAppClient(0), &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = bcache.Open()
+			Ω(err).ShouldNot(HaveOccurred())
+			defer bcache.Close()
+
+			apps, err := bcache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(len(apps)).To(Equal(n))
+
+			app, err := bcache.GetApp("cf_app_id_3")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.Guid).To(Equal("cf_app_id_3"))
+		})
+	})
+
+	Context("Cache warmup", func() {
+		openWithWarmup := func(client *mockAppClient, timeout time.Duration) (*CachingBolt, string) {
+			dup := *config
+			dup.Path = fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			dup.Warmup = true
+			dup.WarmupTimeout = timeout
+			bcache, err := NewCachingBolt(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).ShouldNot(HaveOccurred())
+			return bcache, dup.Path
+		}
+
+		It("Expect apps listed from CC over the ones in boltdb", func() {
+			bcache, path := openWithWarmup(client, time.Minute)
+			defer os.Remove(path)
+			bcache.Close()
+
+			client.CreateApp("new_app", "new_space", "new_org")
+			dup := *config
+			dup.Path = path
+			dup.Warmup = true
+			bcache, err := NewCachingBolt(client, &dup)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(bcache.Open()).ShouldNot(HaveOccurred())
+			defer bcache.Close()
+
+			apps, err := bcache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(apps).To(HaveLen(n + 1))
+			Expect(apps).To(HaveKey("new_app"))
+		})
+
+		It("Expect an empty cache when CC is slower than the timeout", func() {
+			slow := newMockAppClient(n)
+			slow.delay = 500 * time.Millisecond
+			start := time.Now()
+			bcache, path := openWithWarmup(slow, 50*time.Millisecond)
+			defer os.Remove(path)
+			defer bcache.Close()
+
+			Expect(time.Since(start)).To(BeNumerically("<", slow.delay))
+			apps, err := bcache.GetAllApps()
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(apps).To(BeEmpty())
+
+			// apps are still resolved on their first event
+			app, err := bcache.GetApp("cf_app_id_1")
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(app.Name).To(Equal("cf_app_name_1"))
+		})
+	})
+
+	Context("RecordStart", func() {
+		It("Expect the start count to persist across calls", func() {
+			path := fmt.Sprintf("/tmp/%d", time.Now().UnixNano())
+			defer os.Remove(path)
+
+			count, err := RecordStart(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(1)))
+
+			count, err = RecordStart(path)
+			Ω(err).ShouldNot(HaveOccurred())
+			Expect(count).To(Equal(uint64(2)))
+		})
+	})
+})
+
+var _ = Describe("App encoding", func() {
+	It("Expect labels and annotations to survive a round trip", func() {
+		app := App{
+			Name:        "app",
+			Guid:        "app-guid",
+			Labels:      map[string]string{"team": "payments", "env": "prod"},
+			Annotations: map[string]string{"contact": "payments@example.com"},
+		}
+		data, err := app.MarshalJSON()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		var decoded App
+		Ω(decoded.UnmarshalJSON(data)).Should(Succeed())
+		Expect(decoded).To(Equal(app))
+	})
+
+	It("Expect apps without metadata to decode without it", func() {
+		var decoded App
+		Ω(decoded.UnmarshalJSON([]byte(`{"Name":"app","Guid":"app-guid","IgnoredApp":false}`))).Should(Succeed())
+		Expect(decoded.Labels).To(BeNil())
+		Expect(decoded.Annotations).To(BeNil())
+	})
 })
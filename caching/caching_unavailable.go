@@ -0,0 +1,51 @@
+package caching
+
+import (
+	"os"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+)
+
+const (
+	CacheUnavailableDegrade = "degrade"
+	CacheUnavailableStop    = "stop"
+
+	// UnknownPlaceholder names apps that can't be resolved while the cache
+	// is unavailable
+	UnknownPlaceholder = "unknown"
+)
+
+// setAvailable tracks the periods during which the Bolt files can't be
+// written or CC can't be reached, err being the outcome of the last attempt.
+// Under the stop policy the nozzle exits instead, leaving the restart to
+// its supervisor.
+func (c *CachingBolt) setAvailable(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		if c.unavailable {
+			c.unavailable = false
+			c.unavailableGauge.Set(0)
+			logging.LogStd("Cache is available again", true)
+		}
+		return
+	}
+
+	if c.config.CacheUnavailablePolicy == CacheUnavailableStop {
+		logging.LogError("Cache is unavailable, stopping", err)
+		os.Exit(1)
+	}
+	if !c.unavailable {
+		c.unavailable = true
+		c.unavailableGauge.Set(1)
+		c.unavailablePeriods.Inc()
+		logging.LogError("Cache is unavailable, forwarding events with the metadata at hand", err)
+	}
+}
+
+func (c *CachingBolt) isUnavailable() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.unavailable
+}
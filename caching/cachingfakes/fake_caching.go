@@ -50,6 +50,20 @@ type FakeCaching struct {
 		result1 *caching.App
 		result2 error
 	}
+	StatsStub        func() caching.Stats
+	statsMutex       sync.RWMutex
+	statsArgsForCall []struct{}
+	statsReturns     struct {
+		result1 caching.Stats
+	}
+	statsReturnsOnCall map[int]struct {
+		result1 caching.Stats
+	}
+	InvalidateStub        func(string)
+	invalidateMutex       sync.RWMutex
+	invalidateArgsForCall []struct {
+		arg1 string
+	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
@@ -228,6 +242,70 @@ func (fake *FakeCaching) GetAppReturnsOnCall(i int, result1 *caching.App, result
 	}{result1, result2}
 }
 
+func (fake *FakeCaching) Stats() caching.Stats {
+	fake.statsMutex.Lock()
+	ret, specificReturn := fake.statsReturnsOnCall[len(fake.statsArgsForCall)]
+	fake.statsArgsForCall = append(fake.statsArgsForCall, struct{}{})
+	fake.recordInvocation("Stats", []interface{}{})
+	fake.statsMutex.Unlock()
+	if fake.StatsStub != nil {
+		return fake.StatsStub()
+	}
+	if specificReturn {
+		return ret.result1
+	}
+	return fake.statsReturns.result1
+}
+
+func (fake *FakeCaching) StatsCallCount() int {
+	fake.statsMutex.RLock()
+	defer fake.statsMutex.RUnlock()
+	return len(fake.statsArgsForCall)
+}
+
+func (fake *FakeCaching) StatsReturns(result1 caching.Stats) {
+	fake.StatsStub = nil
+	fake.statsReturns = struct {
+		result1 caching.Stats
+	}{result1}
+}
+
+func (fake *FakeCaching) StatsReturnsOnCall(i int, result1 caching.Stats) {
+	fake.StatsStub = nil
+	if fake.statsReturnsOnCall == nil {
+		fake.statsReturnsOnCall = make(map[int]struct {
+			result1 caching.Stats
+		})
+	}
+	fake.statsReturnsOnCall[i] = struct {
+		result1 caching.Stats
+	}{result1}
+}
+
+func (fake *FakeCaching) Invalidate(arg1 string) {
+	fake.invalidateMutex.Lock()
+	fake.invalidateArgsForCall = append(fake.invalidateArgsForCall, struct {
+		arg1 string
+	}{arg1})
+	fake.recordInvocation("Invalidate", []interface{}{arg1})
+	fake.invalidateMutex.Unlock()
+	if fake.InvalidateStub != nil {
+		fake.InvalidateStub(arg1)
+	}
+}
+
+func (fake *FakeCaching) InvalidateCallCount() int {
+	fake.invalidateMutex.RLock()
+	defer fake.invalidateMutex.RUnlock()
+	return len(fake.invalidateArgsForCall)
+}
+
+func (fake *FakeCaching) InvalidateArgsForCall(i int) string {
+	fake.invalidateMutex.RLock()
+	defer fake.invalidateMutex.RUnlock()
+	return fake.invalidateArgsForCall[i].arg1
+}
+
 func (fake *FakeCaching) Invocations() map[string][][]interface{} {
 	fake.invocationsMutex.RLock()
 	defer fake.invocationsMutex.RUnlock()
@@ -239,6 +317,10 @@ func (fake *FakeCaching) Invocations() map[string][][]interface{} {
 	defer fake.getAllAppsMutex.RUnlock()
 	fake.getAppMutex.RLock()
 	defer fake.getAppMutex.RUnlock()
+	fake.statsMutex.RLock()
+	defer fake.statsMutex.RUnlock()
+	fake.invalidateMutex.RLock()
+	defer fake.invalidateMutex.RUnlock()
 	copiedInvocations := map[string][][]interface{}{}
 	for key, value := range fake.invocations {
 		copiedInvocations[key] = value
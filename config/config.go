@@ -0,0 +1,241 @@
+// Package config loads option values from a YAML or JSON file. They become
+// the defaults of the flags they name, so that flags and environment
+// variables take precedence over the file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Apply loads the file given to the configFlag flag of app, on the command
+// line or through its environment variable, and makes its values the
+// defaults of the flags they name. Keys naming no flag are rejected.
+func Apply(app *kingpin.Application, args []string, configFlag string) error {
+	flag := app.GetFlag(configFlag)
+	if flag == nil {
+		return fmt.Errorf("No [%s] flag", configFlag)
+	}
+	path := os.Getenv(flag.Model().Envar)
+	// parse errors are reported when the application parses args
+	if context, _ := app.ParseContext(args); context != nil {
+		for _, element := range context.Elements {
+			if element.Clause == flag && element.Value != nil {
+				path = *element.Value
+			}
+		}
+	}
+	if path == "" {
+		return nil
+	}
+
+	values, err := Load(path)
+	if err != nil {
+		return err
+	}
+	var unknown []string
+	for key := range values {
+		if key == configFlag || app.GetFlag(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("Unknown options in %s: %s", path, strings.Join(unknown, ", "))
+	}
+	for key, value := range values {
+		app.GetFlag(key).Default(value...)
+	}
+	return nil
+}
+
+// Load reads the option values of a YAML or JSON file, keyed by flag name.
+// Lists are the values of repeatable flags.
+func Load(path string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(path)) == ".json" || strings.HasPrefix(strings.TrimSpace(string(content)), "{") {
+		values, err := parseJSON(content)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JSON config file %s: %v", path, err)
+		}
+		return values, nil
+	}
+	values, err := parseYAML(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid YAML config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+func parseJSON(content []byte) (map[string][]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]string, len(raw))
+	for key, value := range raw {
+		list, isList := value.([]interface{})
+		if !isList {
+			list = []interface{}{value}
+		}
+		for _, item := range list {
+			s, err := jsonScalar(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			values[key] = append(values[key], s)
+		}
+		if values[key] == nil {
+			values[key] = []string{}
+		}
+	}
+	return values, nil
+}
+
+func jsonScalar(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", value)
+	}
+}
+
+// parseYAML parses the flat YAML documents options are written as: one
+// `key: value` per line, values being plain or quoted scalars, or lists
+// written as `[a, b]` or as `- item` lines below their key. Nested mappings
+// aren't supported.
+func parseYAML(content string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	listKey := ""
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" || line == trimmed {
+				return nil, fmt.Errorf("line %d: list item without key", i+1)
+			}
+			item, err := yamlScalar(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			values[listKey] = append(values[listKey], item)
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("line %d: nested mappings are not supported", i+1)
+		}
+
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		key := strings.TrimSpace(line[:colon])
+		if _, duplicate := values[key]; duplicate {
+			return nil, fmt.Errorf("line %d: duplicate key %s", i+1, key)
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		listKey = ""
+		switch {
+		case value == "" || strings.HasPrefix(value, "#"):
+			// a list follows, or the value is empty
+			listKey = key
+			values[key] = []string{}
+		case strings.HasPrefix(value, "["):
+			items, err := yamlFlowList(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			values[key] = items
+		default:
+			item, err := yamlScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			values[key] = []string{item}
+		}
+	}
+	return values, nil
+}
+
+func yamlFlowList(value string) ([]string, error) {
+	if i := strings.LastIndex(value, "]"); i > 0 && strings.HasPrefix(strings.TrimSpace(value[i+1:]), "#") {
+		value = value[:i+1]
+	}
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("unterminated list %s", value)
+	}
+	items := []string{}
+	body := strings.TrimSpace(value[1 : len(value)-1])
+	if body == "" {
+		return items, nil
+	}
+	for _, item := range strings.Split(body, ",") {
+		s, err := yamlScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+// yamlScalar unquotes a scalar, dropping the trailing comment of plain ones
+func yamlScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := closingQuote(value)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.Replace(value[1:end], "''", "'", -1), nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	if value == "~" || value == "null" {
+		return "", nil
+	}
+	return value, nil
+}
+
+// closingQuote returns the index of the quote closing a double quoted
+// string, -1 if there is none
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
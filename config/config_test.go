@@ -0,0 +1,133 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var _ = Describe("Config file", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return path
+	}
+
+	Context("Load", func() {
+		It("should read YAML files", func() {
+			values, err := Load(write("config.yml", `
+# nozzle settings
+syslog-server: syslog.example.com:514  # default server
+events: "LogMessage,ValueMetric"
+skip-ssl-validation: true
+extra-fields: 'env:prod'
+cc-pull-time: 60s
+route-map:
+tags:
+  - a
+  - "b c"
+flow: [x, 'y']
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(values).To(Equal(map[string][]string{
+				"syslog-server":       {"syslog.example.com:514"},
+				"events":              {"LogMessage,ValueMetric"},
+				"skip-ssl-validation": {"true"},
+				"extra-fields":        {"env:prod"},
+				"cc-pull-time":        {"60s"},
+				"route-map":           {},
+				"tags":                {"a", "b c"},
+				"flow":                {"x", "y"},
+			}))
+		})
+
+		It("should read JSON files", func() {
+			values, err := Load(write("config.json", `{"syslog-server": "syslog:514", "batch-size": 100, "debug": false, "tags": ["a", "b"]}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(values).To(Equal(map[string][]string{
+				"syslog-server": {"syslog:514"},
+				"batch-size":    {"100"},
+				"debug":         {"false"},
+				"tags":          {"a", "b"},
+			}))
+		})
+
+		It("should reject what it can't parse", func() {
+			_, err := Load(write("nested.yml", "logging:\n  format: json\n"))
+			Expect(err).To(MatchError(ContainSubstring("line 2: nested mappings are not supported")))
+			_, err = Load(write("bad.json", `{"logging": {"format": "json"}}`))
+			Expect(err).To(MatchError(ContainSubstring("logging: unsupported value")))
+			_, err = Load(write("dup.yml", "debug: true\ndebug: false\n"))
+			Expect(err).To(MatchError(ContainSubstring("duplicate key debug")))
+		})
+	})
+
+	Context("Apply", func() {
+		var (
+			app      *kingpin.Application
+			server   *string
+			protocol *string
+			interval *time.Duration
+		)
+
+		BeforeEach(func() {
+			app = kingpin.New("nozzle", "")
+			app.Flag("config", "").Envar("TEST_CONFIG_FILE").String()
+			server = app.Flag("syslog-server", "").Envar("TEST_SYSLOG_SERVER").String()
+			protocol = app.Flag("syslog-protocol", "").Default("tcp").Envar("TEST_SYSLOG_PROTOCOL").String()
+			interval = app.Flag("interval", "").Default("1s").Duration()
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("TEST_CONFIG_FILE")
+			os.Unsetenv("TEST_SYSLOG_SERVER")
+		})
+
+		It("should rank flags over env over the file over defaults", func() {
+			path := write("config.yml", "syslog-server: file:514\nsyslog-protocol: udp\ninterval: 5s\n")
+			os.Setenv("TEST_SYSLOG_SERVER", "env:514")
+			args := []string{"--config", path, "--interval=10s"}
+
+			Expect(Apply(app, args, "config")).To(Succeed())
+			_, err := app.Parse(args)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*server).To(Equal("env:514"))
+			Expect(*protocol).To(Equal("udp"))
+			Expect(*interval).To(Equal(10 * time.Second))
+		})
+
+		It("should take the file from the environment", func() {
+			os.Setenv("TEST_CONFIG_FILE", write("config.json", `{"syslog-server": "file:514"}`))
+
+			Expect(Apply(app, nil, "config")).To(Succeed())
+			_, err := app.Parse(nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*server).To(Equal("file:514"))
+			Expect(*protocol).To(Equal("tcp"))
+		})
+
+		It("should report unknown keys", func() {
+			path := write("config.yml", "syslog-sever: file:514\nprotocol: udp\n")
+			err := Apply(app, []string{"--config=" + path}, "config")
+			Expect(err).To(MatchError(ContainSubstring("Unknown options in " + path + ": protocol, syslog-sever")))
+		})
+	})
+})
@@ -1,14 +1,44 @@
 package eventRouting_test
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
 	. "github.com/cloudfoundry-community/firehose-to-syslog/caching/cachingfakes"
 	. "github.com/cloudfoundry-community/firehose-to-syslog/eventRouting"
+	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
+	"github.com/cloudfoundry-community/firehose-to-syslog/extrafields"
 	. "github.com/cloudfoundry-community/firehose-to-syslog/logging/loggingfakes"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/transforms"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	. "github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
 
+// appClient resolves apps by name, from a map updated by tests
+type appClient map[string]string
+
+func (c appClient) AppByGuid(appGuid string) (caching.CCApp, error) {
+	name, ok := c[appGuid]
+	if !ok {
+		return caching.CCApp{}, caching.ErrAppNotFound
+	}
+	app := caching.CCApp{App: cfclient.App{Guid: appGuid, Name: name}}
+	app.SpaceData.Entity.Name = "space"
+	app.SpaceData.Entity.OrgData.Entity.Name = "org"
+	return app, nil
+}
+
+func (c appClient) ListApps() ([]caching.CCApp, error) {
+	return nil, nil
+}
+
 var _ = Describe("Events", func() {
 
 	var eventRouting EventRouting
@@ -16,7 +46,7 @@ var _ = Describe("Events", func() {
 	BeforeEach(func() {
 		logging := new(FakeLogging)
 		caching := new(FakeCaching)
-		eventRouting = NewEventRouting(caching, logging)
+		eventRouting = NewEventRouting(caching, logging, &EventRoutingConfig{})
 		eventRouting.SetupEventRouting("")
 
 	})
@@ -46,6 +76,29 @@ var _ = Describe("Events", func() {
 		})
 	})
 
+	Context("called with the all selector", func() {
+		It("should select every authorized event", func() {
+			Expect(eventRouting.SetupEventRouting("all")).To(Succeed())
+			Expect(eventRouting.GetSelectedEvents()).To(HaveLen(len(Envelope_EventType_name)))
+			Expect(eventRouting.GetSelectedEvents()).To(HaveKey("Error"))
+		})
+
+		It("should err out combined with other events", func() {
+			Expect(eventRouting.SetupEventRouting("all,LogMessage")).NotTo(Succeed())
+		})
+
+		It("should combine all-metrics with other events", func() {
+			expected := map[string]bool{
+				"ContainerMetric": true,
+				"CounterEvent":    true,
+				"ValueMetric":     true,
+				"LogMessage":      true,
+			}
+			Expect(eventRouting.SetupEventRouting("LogMessage, all-metrics,ValueMetric")).To(Succeed())
+			Expect(eventRouting.GetSelectedEvents()).To(Equal(expected))
+		})
+	})
+
 	Context("called after 10 events have been routed", func() {
 		var expected = uint64(10)
 		BeforeEach(func() {
@@ -59,6 +112,666 @@ var _ = Describe("Events", func() {
 		})
 	})
 
+	Context("called with a transform pipeline", func() {
+		It("should ship the transformed message", func() {
+			logging := new(FakeLogging)
+			pipeline := transforms.Pipeline{transforms.CollapseWhitespace}
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{Transforms: pipeline})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.RouteEvent(&Envelope{
+				EventType:  Envelope_LogMessage.Enum(),
+				LogMessage: &LogMessage{Message: []byte("padded  \t line   \n")},
+			})
+			Expect(logging.ShipEventsCallCount()).To(Equal(1))
+			_, msg := logging.ShipEventsArgsForCall(0)
+			Expect(msg).To(Equal("padded line\n"))
+		})
+
+		It("should count and not ship events dropped by a stage", func() {
+			logging := new(FakeLogging)
+			dropAll := transforms.TransformFunc(func(e *fevents.Event) (*fevents.Event, bool) {
+				return e, false
+			})
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{Transforms: transforms.Pipeline{dropAll}})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			Expect(logging.ShipEventsCallCount()).To(Equal(0))
+			Expect(eventRouting.GetSelectedEventsCount()["dropped_by_transforms"]).To(Equal(uint64(1)))
+		})
+	})
+
+	Context("called with crash detection enabled", func() {
+		It("should ship a crash event even when LogMessage is not selected", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{DetectCrashes: true})
+			eventRouting.SetupEventRouting("ValueMetric")
+			sourceType := "API"
+			eventRouting.RouteEvent(&Envelope{
+				EventType: Envelope_LogMessage.Enum(),
+				LogMessage: &LogMessage{
+					SourceType: &sourceType,
+					Message:    []byte(`App instance exited with guid abc payload: {"index"=>0, "reason"=>"CRASHED", "exit_description"=>"Exited with status 1"}`),
+				},
+			})
+			Expect(logging.ShipEventsCallCount()).To(Equal(1))
+			fields, _ := logging.ShipEventsArgsForCall(0)
+			Expect(fields["event_type"]).To(Equal("crash"))
+			Expect(fields["exit_code"]).To(Equal(1))
+			Expect(eventRouting.GetSelectedEventsCount()["crash"]).To(Equal(uint64(1)))
+		})
+	})
+
+	Context("called with templated extra fields", func() {
+		It("should fill the tokens from each event", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{})
+			eventRouting.SetupEventRouting("LogMessage,ValueMetric")
+			eventRouting.SetExtraFields("env:prod,instance:cell-{source_instance},type:{event_type}")
+			for _, instance := range []string{"0", "1"} {
+				sourceInstance := instance
+				eventRouting.RouteEvent(&Envelope{
+					EventType:  Envelope_LogMessage.Enum(),
+					LogMessage: &LogMessage{SourceInstance: &sourceInstance},
+				})
+			}
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+
+			Expect(logging.ShipEventsCallCount()).To(Equal(3))
+			for i, instance := range []string{"cell-0", "cell-1", "cell-"} {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				Expect(fields["env"]).To(Equal("prod"))
+				Expect(fields["instance"]).To(Equal(instance))
+			}
+			fields, _ := logging.ShipEventsArgsForCall(2)
+			Expect(fields["type"]).To(Equal("ValueMetric"))
+		})
+
+		It("should leave unknown tokens literal when not strict", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{ExtraFieldsStrict: extrafields.StrictSkip})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.SetExtraFields("note:{bogus}")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			fields, _ := logging.ShipEventsArgsForCall(0)
+			Expect(fields["note"]).To(Equal("{bogus}"))
+		})
+	})
+
+	Context("called with Loggregator drops surfaced", func() {
+		It("should ship a loggregator_dropped event even when CounterEvent is not selected", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{SurfaceLoggregatorDrops: true})
+			eventRouting.SetupEventRouting("LogMessage")
+			name := "TruncatingBuffer.DroppedMessages"
+			delta := uint64(5)
+			eventRouting.RouteEvent(&Envelope{
+				EventType:    Envelope_CounterEvent.Enum(),
+				CounterEvent: &CounterEvent{Name: &name, Delta: &delta},
+			})
+			Expect(logging.ShipEventsCallCount()).To(Equal(1))
+			fields, _ := logging.ShipEventsArgsForCall(0)
+			Expect(fields["event_type"]).To(Equal("loggregator_dropped"))
+			Expect(fields["dropped"]).To(Equal(uint64(5)))
+		})
+	})
+
+	Context("called with events to route", func() {
+		It("should count routed events per type and unselected ones as dropped", func() {
+			routed := metrics.NewCounterVec("routed_events", "event_type").With("LogMessage")
+			unselected := metrics.NewCounterVec("dropped_events", "reason").With("unselected")
+			routedBefore, unselectedBefore := routed.Value(), unselected.Value()
+
+			eventRouting = NewEventRouting(new(FakeCaching), new(FakeLogging), &EventRoutingConfig{})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+			Expect(routed.Value()).To(Equal(routedBefore + 1))
+			Expect(unselected.Value()).To(Equal(unselectedBefore + 1))
+		})
+	})
+
+	Context("called with app GUID filters", func() {
+		route := func(config *EventRoutingConfig, caching *FakeCaching) *FakeLogging {
+			logging := new(FakeLogging)
+			caching.GetAppReturns(nil, errors.New("App not found"))
+			eventRouting = NewEventRouting(caching, logging, config)
+			eventRouting.SetupEventRouting("LogMessage,ValueMetric")
+			for _, appID := range []string{"app-a", "APP-B", "app-c"} {
+				appID := appID
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum(), LogMessage: &LogMessage{AppId: &appID}})
+			}
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+			return logging
+		}
+		shippedApps := func(logging *FakeLogging) []interface{} {
+			var apps []interface{}
+			for i := 0; i < logging.ShipEventsCallCount(); i++ {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				apps = append(apps, fields["cf_app_id"])
+			}
+			return apps
+		}
+
+		It("should only ship allowed apps, before looking them up", func() {
+			caching := new(FakeCaching)
+			logging := route(&EventRoutingConfig{AppAllowlist: ParseAppGUIDs("app-a, app-b")}, caching)
+			Expect(shippedApps(logging)).To(Equal([]interface{}{"app-a", "APP-B", nil}))
+			Expect(caching.GetAppCallCount()).To(Equal(2))
+			Expect(eventRouting.GetSelectedEventsCount()["filtered_app_message"]).To(Equal(uint64(1)))
+		})
+
+		It("should drop denied apps, the denylist winning", func() {
+			logging := route(&EventRoutingConfig{AppAllowlist: ParseAppGUIDs("app-a,app-b"), AppDenylist: ParseAppGUIDs("app-b")}, new(FakeCaching))
+			Expect(shippedApps(logging)).To(Equal([]interface{}{"app-a", nil}))
+		})
+
+		It("should not filter without lists", func() {
+			logging := route(&EventRoutingConfig{AppAllowlist: ParseAppGUIDs(""), AppDenylist: ParseAppGUIDs("")}, new(FakeCaching))
+			Expect(logging.ShipEventsCallCount()).To(Equal(4))
+		})
+	})
+
+	Context("called with org and space filters", func() {
+		route := func(config *EventRoutingConfig) []interface{} {
+			cachingClient := new(FakeCaching)
+			cachingClient.GetAppStub = func(appID string) (*caching.App, error) {
+				switch appID {
+				case "app-a":
+					return &caching.App{Guid: appID, OrgName: "org-a", SpaceName: "dev"}, nil
+				case "app-b":
+					return &caching.App{Guid: appID, OrgName: "org-b", SpaceName: "dev"}, nil
+				}
+				return nil, errors.New("App not found")
+			}
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(cachingClient, logging, config)
+			eventRouting.SetupEventRouting("LogMessage,ValueMetric")
+			for _, appID := range []string{"app-a", "app-b", "app-unknown"} {
+				appID := appID
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum(), LogMessage: &LogMessage{AppId: &appID}})
+			}
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+
+			var apps []interface{}
+			for i := 0; i < logging.ShipEventsCallCount(); i++ {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				apps = append(apps, fields["cf_app_id"])
+			}
+			return apps
+		}
+
+		It("should only ship the apps of the listed orgs and spaces", func() {
+			Expect(route(&EventRoutingConfig{OrgFilter: ParseNames("org-a"), SpaceFilter: ParseNames("dev, prod")})).To(Equal([]interface{}{"app-a", nil}))
+			Expect(eventRouting.GetSelectedEventsCount()["filtered_org_space_message"]).To(Equal(uint64(2)))
+		})
+
+		It("should pass unresolved apps when asked to", func() {
+			Expect(route(&EventRoutingConfig{SpaceFilter: ParseNames("dev"), MissingMetadataPolicy: MissingMetadataPass})).To(Equal([]interface{}{"app-a", "app-b", "app-unknown", nil}))
+		})
+	})
+
+	Context("called with event latency profiling enabled", func() {
+		It("should time the transform pipeline of every routed event", func() {
+			before := metrics.NewHistogram("latency_transforms_us", metrics.LatencyBuckets).Count()
+			eventRouting = NewEventRouting(new(FakeCaching), new(FakeLogging), &EventRoutingConfig{ProfileLatency: true})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			Expect(metrics.NewHistogram("latency_transforms_us", metrics.LatencyBuckets).Count()).To(Equal(before + 1))
+		})
+	})
+
+	Context("called with the subscription ID included", func() {
+		It("should add the current subscription ID to every event", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{IncludeSubscriptionID: true})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.SetSubscriptionID("firehose-a")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+
+			fields, _ := logging.ShipEventsArgsForCall(0)
+			Expect(fields["subscription_id"]).To(Equal("firehose-a"))
+		})
+	})
+
+	Context("called with an envelope timestamp", func() {
+		It("should add the event and receive times", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{TimestampFormat: fevents.TimestampEpochMillis})
+			eventRouting.SetupEventRouting("ValueMetric")
+			timestamp := time.Now().Add(-time.Minute).UnixNano()
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum(), Timestamp: &timestamp, ValueMetric: &ValueMetric{}})
+
+			fields, _ := logging.ShipEventsArgsForCall(0)
+			Expect(fields["timestamp"]).To(Equal(timestamp / int64(time.Millisecond)))
+			Expect(fields["received_at"]).To(BeNumerically("~", time.Now().UnixNano()/int64(time.Millisecond), 1000))
+		})
+	})
+
+	Context("called with the schema version included", func() {
+		It("should add the schema and nozzle versions to every event", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{IncludeSchemaVersion: true, NozzleVersion: "1.2.3"})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			eventRouting.LogSelfMetrics(10 * time.Millisecond)
+			Eventually(logging.ShipEventsCallCount).Should(BeNumerically(">", 1))
+
+			for i := 0; i < 2; i++ {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				Expect(fields["schema_version"]).To(Equal(fevents.SchemaVersion))
+				Expect(fields["nozzle_version"]).To(Equal("1.2.3"))
+			}
+		})
+	})
+
+	Context("called with self metrics enabled", func() {
+		It("should periodically ship the nozzle resource usage", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{})
+			eventRouting.LogSelfMetrics(10 * time.Millisecond)
+			Eventually(logging.ShipEventsCallCount).Should(BeNumerically(">", 0))
+
+			fields, _ := logging.ShipEventsArgsForCall(0)
+			Expect(fields["event_type"]).To(Equal("firehose_to_syslog_self"))
+			Expect(fields["source_type"]).To(Equal(SelfMetricsSourceType))
+			Expect(fields["goroutines"]).To(BeNumerically(">", 0))
+			Expect(fields).To(HaveKey("cpu_percentage"))
+			Expect(fields).To(HaveKey("events_per_sec"))
+		})
+	})
+
+	Context("called with internal metrics enabled", func() {
+		It("should periodically ship the routed, dropped, reconnect and cache counters", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{})
+			eventRouting.SetupEventRouting("LogMessage")
+			routed := metrics.NewCounterVec("routed_events", "event_type").With("LogMessage").Value()
+			unselected := metrics.NewCounterVec("dropped_events", "reason").With("unselected").Value()
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_Error.Enum()})
+			metrics.NewCounter("firehose_reconnects")
+			metrics.NewCounter("cache_hits")
+			eventRouting.LogInternalMetrics(10 * time.Millisecond)
+			Eventually(logging.ShipEventsCallCount).Should(BeNumerically(">", 1))
+
+			fields, msg := logging.ShipEventsArgsForCall(1)
+			Expect(msg).To(Equal("Internal metrics of firehose to syslog"))
+			Expect(fields["event_type"]).To(Equal(InternalMetricsType))
+			Expect(fields["source_type"]).To(Equal(InternalMetricsType))
+			Expect(fields["routed_LogMessage"]).To(Equal(routed + 1))
+			Expect(fields["dropped_unselected"]).To(Equal(unselected + 1))
+			Expect(fields).To(HaveKey("routed_total"))
+			Expect(fields).To(HaveKey("dropped_total"))
+			Expect(fields).To(HaveKey("firehose_reconnects"))
+			Expect(fields).To(HaveKey("cache_hits"))
+			Expect(fields).ToNot(HaveKey("regex_filtered_events"))
+		})
+	})
+
+	Context("ParseRouteMap", func() {
+		It("should map event types to their destination", func() {
+			routes, err := ParseRouteMap("LogMessage=tcp+tls://siem:6514, ValueMetric=udp://metrics:514,")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(Equal(map[string]string{
+				"LogMessage":  "tcp+tls://siem:6514",
+				"ValueMetric": "udp://metrics:514",
+			}))
+		})
+
+		It("should reject malformed routes", func() {
+			_, err := ParseRouteMap("LogMessage")
+			Expect(err).To(MatchError(ContainSubstring("Malformed route")))
+			_, err = ParseRouteMap("Logs=tcp://siem:514")
+			Expect(err).To(MatchError(ContainSubstring("Unknown event type [Logs]")))
+			_, err = ParseRouteMap("LogMessage=http://siem:514")
+			Expect(err).To(MatchError(ContainSubstring("Unsupported syslog protocol [http]")))
+			_, err = ParseRouteMap("LogMessage=siem:514")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("called with app update notifications", func() {
+		apiMessage := func(appID string, message string) *Envelope {
+			return &Envelope{
+				EventType: Envelope_LogMessage.Enum(),
+				LogMessage: &LogMessage{
+					AppId:      &appID,
+					SourceType: proto.String("API"),
+					Message:    []byte(message),
+				},
+			}
+		}
+
+		It("should resolve a renamed app again", func() {
+			appID := "eea38ba5-53a5-4173-9617-b442d35ec2fd"
+			client := appClient{appID: "before"}
+			path := fmt.Sprintf("/tmp/eventrouting-%d", time.Now().UnixNano())
+			defer os.Remove(path)
+			cache, _ := caching.NewCachingBolt(client, &caching.CachingBoltConfig{Path: path})
+			Expect(cache.Open()).To(Succeed())
+			defer cache.Close()
+
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(cache, logging, &EventRoutingConfig{})
+			eventRouting.SetupEventRouting("LogMessage")
+			eventRouting.RouteEvent(apiMessage(appID, "Started app"))
+			client[appID] = "after"
+			eventRouting.RouteEvent(apiMessage(appID, "Still running"))
+			eventRouting.RouteEvent(apiMessage(appID, `Updated app with guid `+appID+` ({"name"=>"after"})`))
+			eventRouting.RouteEvent(apiMessage(appID, "Restarted app"))
+
+			var names []interface{}
+			for i := 0; i < logging.ShipEventsCallCount(); i++ {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				names = append(names, fields["cf_app_name"])
+			}
+			Expect(names).To(Equal([]interface{}{"before", "before", "after", "after"}))
+		})
+
+		It("should invalidate deleted apps", func() {
+			fakeCaching := new(FakeCaching)
+			eventRouting = NewEventRouting(fakeCaching, new(FakeLogging), &EventRoutingConfig{})
+			eventRouting.SetupEventRouting("ValueMetric")
+			appID := "eea38ba5-53a5-4173-9617-b442d35ec2fd"
+			eventRouting.RouteEvent(apiMessage(appID, "Deleted app with guid "+appID))
+			eventRouting.RouteEvent(apiMessage(appID, "Stopped app"))
+			Expect(fakeCaching.InvalidateCallCount()).To(Equal(1))
+			Expect(fakeCaching.InvalidateArgsForCall(0)).To(Equal(appID))
+		})
+	})
+
+	Context("called with log source types", func() {
+		route := func(sourceTypes string) *FakeLogging {
+			types, err := ParseLogSourceTypes(sourceTypes)
+			Expect(err).NotTo(HaveOccurred())
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{LogSourceTypes: types})
+			eventRouting.SetupEventRouting("LogMessage")
+			for i, messageType := range []LogMessage_MessageType{LogMessage_OUT, LogMessage_ERR, LogMessage_OUT, LogMessage_ERR, LogMessage_ERR} {
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum(), LogMessage: &LogMessage{
+					Message:     []byte(fmt.Sprintf("line %d", i)),
+					MessageType: messageType.Enum(),
+				}})
+			}
+			return logging
+		}
+
+		It("should only forward the listed streams of a mixed stream", func() {
+			logging := route("STDERR")
+			Expect(logging.ShipEventsCallCount()).To(Equal(3))
+			for i := 0; i < logging.ShipEventsCallCount(); i++ {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				Expect(fields["message_type"]).To(Equal("ERR"))
+			}
+			Expect(eventRouting.GetSelectedEventsCount()["filtered_source_type_message"]).To(BeEquivalentTo(2))
+		})
+
+		It("should forward both streams without a list", func() {
+			Expect(route("").ShipEventsCallCount()).To(Equal(5))
+			Expect(route("stdout, stderr").ShipEventsCallCount()).To(Equal(5))
+		})
+
+		It("should reject unknown streams", func() {
+			_, err := ParseLogSourceTypes("STDERR,APP")
+			Expect(err).To(MatchError(ContainSubstring("Unknown log source type [APP]")))
+		})
+	})
+
+	Context("called with an HTTP status filter", func() {
+		route := func(filter string) []interface{} {
+			statuses, err := ParseHTTPStatusFilter(filter)
+			Expect(err).NotTo(HaveOccurred())
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{HTTPStatuses: statuses})
+			eventRouting.SetupEventRouting("HttpStartStop")
+			for _, status := range []int32{200, 302, 404, 500, 503} {
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_HttpStartStop.Enum(), HttpStartStop: &HttpStartStop{
+					StatusCode: proto.Int32(status),
+				}})
+			}
+			var shipped []interface{}
+			for i := 0; i < logging.ShipEventsCallCount(); i++ {
+				fields, _ := logging.ShipEventsArgsForCall(i)
+				shipped = append(shipped, fields["status_code"])
+			}
+			return shipped
+		}
+
+		It("should only forward the status classes listed", func() {
+			Expect(route("4xx, 5xx")).To(Equal([]interface{}{int32(404), int32(500), int32(503)}))
+			Expect(eventRouting.GetSelectedEventsCount()["filtered_http_status"]).To(BeEquivalentTo(2))
+		})
+
+		It("should forward single codes and ranges", func() {
+			Expect(route("302,500-502")).To(Equal([]interface{}{int32(302), int32(500)}))
+		})
+
+		It("should forward every status without a filter", func() {
+			Expect(route("")).To(HaveLen(5))
+		})
+
+		It("should reject malformed filters", func() {
+			for _, filter := range []string{"6xx0", "4x", "abc", "504-500", "1000"} {
+				_, err := ParseHTTPStatusFilter(filter)
+				Expect(err).To(MatchError(ContainSubstring("Invalid HTTP status filter")), filter)
+			}
+		})
+	})
+
+	Context("called with message regexes", func() {
+		route := func(include, exclude string) []string {
+			includeRegex, err := ParseMessageRegex(include)
+			Expect(err).NotTo(HaveOccurred())
+			excludeRegex, err := ParseMessageRegex(exclude)
+			Expect(err).NotTo(HaveOccurred())
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{MessageInclude: includeRegex, MessageExclude: excludeRegex})
+			eventRouting.SetupEventRouting("LogMessage")
+			for _, line := range []string{"GET /healthz 200", "GET /orders 200", "POST /orders 500", "GET /healthz 503"} {
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum(), LogMessage: &LogMessage{Message: []byte(line)}})
+			}
+			var shipped []string
+			for i := 0; i < logging.ShipEventsCallCount(); i++ {
+				_, msg := logging.ShipEventsArgsForCall(i)
+				shipped = append(shipped, msg)
+			}
+			return shipped
+		}
+
+		It("should drop the messages matching the exclude regex", func() {
+			filtered := metrics.NewCounter("regex_filtered_events")
+			before := filtered.Value()
+			Expect(route("", "^GET /healthz 200$")).To(Equal([]string{"GET /orders 200", "POST /orders 500", "GET /healthz 503"}))
+			Expect(filtered.Value() - before).To(BeEquivalentTo(1))
+			Expect(eventRouting.GetSelectedEventsCount()["filtered_regex_message"]).To(BeEquivalentTo(1))
+		})
+
+		It("should only forward the messages matching the include regex, the exclude one winning", func() {
+			Expect(route("orders", "")).To(Equal([]string{"GET /orders 200", "POST /orders 500"}))
+			Expect(route(" [45]0[0-9]$", "healthz")).To(Equal([]string{"POST /orders 500"}))
+		})
+
+		It("should reject invalid patterns", func() {
+			_, err := ParseMessageRegex("GET (")
+			Expect(err).To(MatchError(ContainSubstring("Invalid message regex [GET (]")))
+			re, err := ParseMessageRegex("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(re).To(BeNil())
+		})
+	})
+
+	Context("called with sample rates", func() {
+		It("should forward the sampled fraction of an event type and count the others", func() {
+			sampledOut := metrics.NewCounterVec("sampled_out_events", "event_type")
+			logsBefore, metricsBefore := sampledOut.With("LogMessage").Value(), sampledOut.With("ValueMetric").Value()
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{
+				SampleRates: map[string]float64{"LogMessage": 0.25, "ValueMetric": 0, "CounterEvent": 1},
+			})
+			eventRouting.SetupEventRouting("LogMessage,ValueMetric,CounterEvent")
+			for i := 0; i < 4000; i++ {
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			}
+			for i := 0; i < 10; i++ {
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_CounterEvent.Enum()})
+			}
+
+			counts := eventRouting.GetSelectedEventsCount()
+			Expect(counts["LogMessage"]).To(BeNumerically("~", 1000, 200))
+			Expect(counts).NotTo(HaveKey("ValueMetric"))
+			Expect(counts["CounterEvent"]).To(BeEquivalentTo(10))
+			Expect(counts["dropped_by_sampling"]).To(Equal(4000 - counts["LogMessage"] + 10))
+			Expect(sampledOut.With("LogMessage").Value() - logsBefore).To(Equal(4000 - counts["LogMessage"]))
+			Expect(sampledOut.With("ValueMetric").Value() - metricsBefore).To(BeEquivalentTo(10))
+			Expect(logging.ShipEventsCallCount()).To(BeEquivalentTo(counts["LogMessage"] + 10))
+		})
+	})
+
+	Context("ParseSampleRates", func() {
+		It("should map event types to their rate", func() {
+			rates, err := ParseSampleRates("LogMessage=0.1, ContainerMetric=1.0,")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rates).To(Equal(map[string]float64{"LogMessage": 0.1, "ContainerMetric": 1}))
+		})
+
+		It("should reject malformed rates", func() {
+			_, err := ParseSampleRates("LogMessage")
+			Expect(err).To(MatchError(ContainSubstring("Malformed sample rate")))
+			_, err = ParseSampleRates("Logs=0.5")
+			Expect(err).To(MatchError(ContainSubstring("Unknown event type [Logs]")))
+			_, err = ParseSampleRates("LogMessage=1.5")
+			Expect(err).To(MatchError(ContainSubstring("Invalid sample rate")))
+			_, err = ParseSampleRates("LogMessage=half")
+			Expect(err).To(MatchError(ContainSubstring("Invalid sample rate")))
+		})
+	})
+
+	Context("ParseRateLimits", func() {
+		It("should map event types to their events per second", func() {
+			limits, err := ParseRateLimits("LogMessage=5000, HttpStartStop=1000,")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(limits).To(Equal(map[string]float64{"LogMessage": 5000, "HttpStartStop": 1000}))
+		})
+
+		It("should reject malformed limits", func() {
+			_, err := ParseRateLimits("LogMessage")
+			Expect(err).To(MatchError(ContainSubstring("Malformed rate limit")))
+			_, err = ParseRateLimits("Logs=10")
+			Expect(err).To(MatchError(ContainSubstring("Unknown event type [Logs]")))
+			_, err = ParseRateLimits("LogMessage=0")
+			Expect(err).To(MatchError(ContainSubstring("Invalid rate limit")))
+		})
+	})
+
+	Context("called with rate limits", func() {
+		route := func(policy string, count int) *FakeLogging {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{
+				RateLimits:      map[string]float64{"ValueMetric": 10},
+				RateLimitPolicy: policy,
+			})
+			eventRouting.SetupEventRouting("LogMessage,ValueMetric")
+			for i := 0; i < count; i++ {
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum()})
+			}
+			return logging
+		}
+
+		It("should drop and count the events over the limit of their type", func() {
+			logging := route(RateLimitDrop, 15)
+			Expect(logging.ShipEventsCallCount()).To(Equal(25))
+			Expect(eventRouting.GetSelectedEventsCount()["ValueMetric"]).To(BeEquivalentTo(10))
+			Expect(eventRouting.GetSelectedEventsCount()["LogMessage"]).To(BeEquivalentTo(15))
+			Expect(eventRouting.GetSelectedEventsCount()["dropped_by_rate_limit"]).To(BeEquivalentTo(5))
+		})
+
+		It("should hold the events over the limit when blocking", func() {
+			start := time.Now()
+			logging := route(RateLimitBlock, 12)
+			Expect(logging.ShipEventsCallCount()).To(Equal(24))
+			Expect(eventRouting.GetSelectedEventsCount()["dropped_by_rate_limit"]).To(BeZero())
+			Expect(time.Since(start)).To(BeNumerically(">=", 150*time.Millisecond))
+		})
+		It("should let events through under one per second", func() {
+			logging := new(FakeLogging)
+			eventRouting = NewEventRouting(new(FakeCaching), logging, &EventRoutingConfig{
+				RateLimits:      map[string]float64{"ValueMetric": 0.5},
+				RateLimitPolicy: RateLimitDrop,
+			})
+			eventRouting.SetupEventRouting("ValueMetric")
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+			eventRouting.RouteEvent(&Envelope{EventType: Envelope_ValueMetric.Enum()})
+			Expect(logging.ShipEventsCallCount()).To(Equal(1))
+		})
+
+		It("should only charge the limit with events that would ship", func() {
+			logging := new(FakeLogging)
+			caching := new(FakeCaching)
+			caching.GetAppReturns(nil, errors.New("App not found"))
+			eventRouting = NewEventRouting(caching, logging, &EventRoutingConfig{
+				RateLimits:      map[string]float64{"LogMessage": 5},
+				RateLimitPolicy: RateLimitDrop,
+				AppDenylist:     ParseAppGUIDs("app-denied"),
+			})
+			eventRouting.SetupEventRouting("LogMessage")
+			for _, appID := range []string{"app-denied", "app-denied", "app-denied", "app-denied", "app-denied", "app-a", "app-a", "app-a"} {
+				appID := appID
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum(), LogMessage: &LogMessage{AppId: &appID}})
+			}
+			Expect(logging.ShipEventsCallCount()).To(Equal(3))
+			Expect(eventRouting.GetSelectedEventsCount()["dropped_by_rate_limit"]).To(BeZero())
+		})
+	})
+
+	Context("called with a dedup window", func() {
+		routeLines := func(config *EventRoutingConfig, lines [][2]string) *FakeLogging {
+			logging := new(FakeLogging)
+			caching := new(FakeCaching)
+			caching.GetAppReturns(nil, errors.New("App not found"))
+			eventRouting = NewEventRouting(caching, logging, config)
+			eventRouting.SetupEventRouting("LogMessage")
+			for _, line := range lines {
+				appID, message := line[0], line[1]
+				eventRouting.RouteEvent(&Envelope{EventType: Envelope_LogMessage.Enum(), LogMessage: &LogMessage{AppId: &appID, Message: []byte(message)}})
+			}
+			return logging
+		}
+
+		It("should suppress repeated lines and ship their count when the window closes", func() {
+			key, _ := ParseDedupKey(DefaultDedupKey)
+			logging := routeLines(&EventRoutingConfig{DedupWindow: 100 * time.Millisecond, DedupKey: key, DedupMaxKeys: 10}, [][2]string{
+				{"app-a", "retrying"}, {"app-a", "retrying"}, {"app-a", "retrying"}, {"app-a", "retrying"},
+				{"app-a", "connected"}, {"app-b", "retrying"}, {"app-b", "retrying"},
+			})
+			Expect(logging.ShipEventsCallCount()).To(Equal(3))
+			Expect(eventRouting.GetSelectedEventsCount()["dedup_suppressed"]).To(BeEquivalentTo(4))
+
+			Eventually(logging.ShipEventsCallCount).Should(Equal(5))
+			repeats := map[interface{}]interface{}{}
+			for i := 3; i < 5; i++ {
+				fields, msg := logging.ShipEventsArgsForCall(i)
+				Expect(msg).To(Equal("retrying"))
+				repeats[fields["cf_app_id"]] = fields["repeat_count"]
+			}
+			Expect(repeats).To(Equal(map[interface{}]interface{}{"app-a": 3, "app-b": 1}))
+			Consistently(logging.ShipEventsCallCount, "300ms").Should(Equal(5))
+		})
+
+		It("should ship lines of keys past the cap as they come", func() {
+			key, _ := ParseDedupKey("msg")
+			logging := routeLines(&EventRoutingConfig{DedupWindow: time.Minute, DedupKey: key, DedupMaxKeys: 1}, [][2]string{
+				{"app-a", "first"}, {"app-a", "first"}, {"app-a", "second"}, {"app-b", "second"},
+			})
+			Expect(logging.ShipEventsCallCount()).To(Equal(3))
+		})
+
+		It("should reject empty keys", func() {
+			_, err := ParseDedupKey(" , ")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 
 	Context("GetListAuthorizedEventEvents", func() {
 		It("should return right list of authorized events", func() {
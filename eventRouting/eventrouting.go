@@ -1,10 +1,14 @@
 package eventRouting
 
 import (
+	"fmt"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
@@ -16,6 +20,9 @@ type EventRouting interface {
 	GetTotalCountOfSelectedEvents() uint64
 	GetSelectedEventsCount() map[string]uint64
 	LogEventTotals(logTotalsTime time.Duration)
+	LogSelfMetrics(interval time.Duration)
+	LogInternalMetrics(interval time.Duration)
+	SetSubscriptionID(subscriptionID string)
 }
 
 func IsAuthorizedEvent(wantedEvent string) bool {
@@ -28,10 +35,210 @@ func IsAuthorizedEvent(wantedEvent string) bool {
 }
 
 func GetListAuthorizedEventEvents() (authorizedEvents string) {
+	return strings.Join(authorizedEventList(), ", ")
+}
+
+func authorizedEventList() []string {
 	arrEvents := []string{}
 	for _, listEvent := range events.Envelope_EventType_name {
 		arrEvents = append(arrEvents, listEvent)
 	}
 	sort.Strings(arrEvents)
-	return strings.Join(arrEvents, ", ")
+	return arrEvents
+}
+
+const (
+	// EventsAll selects every authorized event type, alone
+	EventsAll = "all"
+	// EventsAllMetrics selects the metric event types
+	EventsAllMetrics = "all-metrics"
+)
+
+var metricEvents = []string{"ContainerMetric", "CounterEvent", "ValueMetric"}
+
+// ExpandEvents replaces the all and all-metrics selectors of a comma
+// separated list of event types by the types they select, leaving a list
+// without selectors untouched. all can't be combined with other types.
+func ExpandEvents(wantedEvents string) (string, error) {
+	wanted := strings.Split(wantedEvents, ",")
+	expanded := []string{}
+	selected := make(map[string]bool)
+	hasSelector := false
+	for _, event := range wanted {
+		event = strings.TrimSpace(event)
+		eventTypes := []string{event}
+		switch event {
+		case EventsAll:
+			if len(wanted) > 1 {
+				return "", fmt.Errorf("Event selector [%s] can't be combined with other events, got [%s]", EventsAll, wantedEvents)
+			}
+			eventTypes, hasSelector = authorizedEventList(), true
+		case EventsAllMetrics:
+			eventTypes, hasSelector = metricEvents, true
+		}
+		for _, eventType := range eventTypes {
+			if !selected[eventType] {
+				selected[eventType] = true
+				expanded = append(expanded, eventType)
+			}
+		}
+	}
+	if !hasSelector {
+		return wantedEvents, nil
+	}
+	return strings.Join(expanded, ","), nil
+}
+
+// ParseRouteMap parses comma separated EventType=destination pairs, such as
+// 'LogMessage=tcp://siem:514,ValueMetric=udp://metrics:514', into the
+// syslog destination of each event type.
+func ParseRouteMap(routeMap string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, pair := range strings.Split(routeMap, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed route [%s], expected EventType=protocol://host:port", pair)
+		}
+		eventType, destination := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !IsAuthorizedEvent(eventType) {
+			return nil, fmt.Errorf("Unknown event type [%s] in route [%s], valid options are %s", eventType, pair, GetListAuthorizedEventEvents())
+		}
+		if _, _, err := logging.ParseDestination(destination); err != nil {
+			return nil, err
+		}
+		routes[eventType] = destination
+	}
+	return routes, nil
+}
+
+// ParseSampleRates parses comma separated EventType=rate pairs, such as
+// 'LogMessage=0.1,ContainerMetric=1.0', into the fraction of the events of
+// each type to forward, between 0 and 1.
+func ParseSampleRates(sampleRates string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(sampleRates, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed sample rate [%s], expected EventType=rate", pair)
+		}
+		eventType := strings.TrimSpace(parts[0])
+		if !IsAuthorizedEvent(eventType) {
+			return nil, fmt.Errorf("Unknown event type [%s] in sample rate [%s], valid options are %s", eventType, pair, GetListAuthorizedEventEvents())
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("Invalid sample rate [%s], expected a number between 0 and 1", pair)
+		}
+		rates[eventType] = rate
+	}
+	return rates, nil
+}
+
+// ParseRateLimits parses comma separated EventType=rate pairs, such as
+// 'LogMessage=5000,HttpStartStop=1000', into the events per second each
+// event type is limited to.
+func ParseRateLimits(rateLimits string) (map[string]float64, error) {
+	limits := make(map[string]float64)
+	for _, pair := range strings.Split(rateLimits, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed rate limit [%s], expected EventType=rate", pair)
+		}
+		eventType := strings.TrimSpace(parts[0])
+		if !IsAuthorizedEvent(eventType) {
+			return nil, fmt.Errorf("Unknown event type [%s] in rate limit [%s], valid options are %s", eventType, pair, GetListAuthorizedEventEvents())
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid rate limit [%s], expected a positive number of events per second", pair)
+		}
+		limits[eventType] = limit
+	}
+	return limits, nil
+}
+
+// ParseLogSourceTypes parses a comma separated list of the LogMessage
+// streams to forward, STDOUT and STDERR, into their message types. An empty
+// list forwards both.
+func ParseLogSourceTypes(sourceTypes string) (map[events.LogMessage_MessageType]bool, error) {
+	types := make(map[events.LogMessage_MessageType]bool)
+	for _, name := range strings.Split(sourceTypes, ",") {
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case "":
+		case "STDOUT":
+			types[events.LogMessage_OUT] = true
+		case "STDERR":
+			types[events.LogMessage_ERR] = true
+		default:
+			return nil, fmt.Errorf("Unknown log source type [%s], valid options are STDOUT and STDERR", strings.TrimSpace(name))
+		}
+	}
+	return types, nil
+}
+
+// StatusRange is an inclusive range of HTTP status codes
+type StatusRange struct {
+	Min int32
+	Max int32
+}
+
+// ParseHTTPStatusFilter parses comma separated HTTP status classes, codes
+// and ranges, such as '4xx,5xx', '404' or '500-504', into the status codes
+// of the HttpStartStop events to forward. An empty filter forwards them all.
+func ParseHTTPStatusFilter(filter string) ([]StatusRange, error) {
+	var ranges []StatusRange
+	for _, entry := range strings.Split(filter, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry == "" {
+			continue
+		}
+		var statusRange StatusRange
+		var err error
+		switch {
+		case len(entry) == 3 && strings.HasSuffix(entry, "xx"):
+			var class int64
+			class, err = strconv.ParseInt(entry[:1], 10, 32)
+			statusRange = StatusRange{Min: int32(class) * 100, Max: int32(class)*100 + 99}
+		case strings.Contains(entry, "-"):
+			bounds := strings.SplitN(entry, "-", 2)
+			statusRange.Min, err = parseStatusCode(bounds[0])
+			if err == nil {
+				statusRange.Max, err = parseStatusCode(bounds[1])
+			}
+		default:
+			statusRange.Min, err = parseStatusCode(entry)
+			statusRange.Max = statusRange.Min
+		}
+		if err != nil || statusRange.Min < 100 || statusRange.Max > 999 || statusRange.Min > statusRange.Max {
+			return nil, fmt.Errorf("Invalid HTTP status filter [%s], expected a class such as 4xx, a code or a range such as 500-504", entry)
+		}
+		ranges = append(ranges, statusRange)
+	}
+	return ranges, nil
+}
+
+func parseStatusCode(code string) (int32, error) {
+	status, err := strconv.ParseInt(strings.TrimSpace(code), 10, 32)
+	return int32(status), err
+}
+
+// ParseMessageRegex compiles a LogMessage filter pattern, nil standing for
+// an empty one.
+func ParseMessageRegex(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid message regex [%s]: %v", pattern, err)
+	}
+	return re, nil
 }
@@ -0,0 +1,10 @@
+package eventRouting
+
+import (
+	"time"
+)
+
+// processCPUTime is not available on Windows
+func processCPUTime() time.Duration {
+	return 0
+}
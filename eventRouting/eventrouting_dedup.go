@@ -0,0 +1,131 @@
+package eventRouting
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+const (
+	// DefaultDedupKey identifies the lines an app repeats
+	DefaultDedupKey = "cf_app_id,msg"
+	// dedupMessageKey stands for the event message in dedup keys
+	dedupMessageKey = "msg"
+	// dedupMaxSweepInterval bounds how late windows are closed
+	dedupMaxSweepInterval = time.Second
+)
+
+// ParseDedupKey parses the comma separated fields identifying duplicate
+// events, msg standing for the message.
+func ParseDedupKey(key string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(key, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Empty dedup key [%s]", key)
+	}
+	return fields, nil
+}
+
+// deduplicator suppresses the events identical to one shipped less than a
+// window ago, following the fields of the key. The first event of a window
+// is shipped right away; when its window closes after repeats, a copy of it
+// is shipped with their number as repeat_count. At most maxKeys windows are
+// open at once, events of other keys being shipped as they come.
+type deduplicator struct {
+	window  time.Duration
+	key     []string
+	maxKeys int
+
+	mu         sync.Mutex
+	windows    map[string]*dedupWindow
+	suppressed *metrics.Counter
+	untracked  *metrics.Counter
+}
+
+type dedupWindow struct {
+	fields  map[string]interface{}
+	msg     string
+	closes  time.Time
+	repeats int
+}
+
+func newDeduplicator(window time.Duration, key []string, maxKeys int) *deduplicator {
+	return &deduplicator{
+		window:     window,
+		key:        key,
+		maxKeys:    maxKeys,
+		windows:    make(map[string]*dedupWindow),
+		suppressed: metrics.NewCounter("dedup_suppressed_events"),
+		untracked:  metrics.NewCounter("dedup_untracked_events"),
+	}
+}
+
+// admit tells whether an event is shipped, opening a window when it is
+func (d *deduplicator) admit(fields map[string]interface{}, msg string, now time.Time) bool {
+	values := make([]string, len(d.key))
+	for i, field := range d.key {
+		if field == dedupMessageKey {
+			values[i] = msg
+		} else if value, ok := fields[field]; ok {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	key := strings.Join(values, "\x00")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if w, ok := d.windows[key]; ok && now.Before(w.closes) {
+		w.repeats++
+		d.suppressed.Inc()
+		return false
+	}
+	if len(d.windows) >= d.maxKeys {
+		d.untracked.Inc()
+		return true
+	}
+	d.windows[key] = &dedupWindow{fields: fields, msg: msg, closes: now.Add(d.window)}
+	return true
+}
+
+// close ends the windows closed by now, returning the summaries of the ones
+// with repeats
+func (d *deduplicator) close(now time.Time) []*dedupWindow {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var summaries []*dedupWindow
+	for key, w := range d.windows {
+		if now.Before(w.closes) {
+			continue
+		}
+		delete(d.windows, key)
+		if w.repeats > 0 {
+			summaries = append(summaries, w)
+		}
+	}
+	return summaries
+}
+
+// sweepInterval is how often windows are closed
+func (d *deduplicator) sweepInterval() time.Duration {
+	if d.window < dedupMaxSweepInterval {
+		return d.window
+	}
+	return dedupMaxSweepInterval
+}
+
+// summary is the event shipped when a window with repeats closes
+func (w *dedupWindow) summary() map[string]interface{} {
+	fields := make(map[string]interface{}, len(w.fields)+1)
+	for name, value := range w.fields {
+		fields[name] = value
+	}
+	fields["repeat_count"] = w.repeats
+	return fields
+}
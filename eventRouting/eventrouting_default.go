@@ -2,9 +2,14 @@ package eventRouting
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"regexp"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -12,9 +17,88 @@ import (
 	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
 	"github.com/cloudfoundry-community/firehose-to-syslog/extrafields"
 	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/ratelimit"
+	"github.com/cloudfoundry-community/firehose-to-syslog/transforms"
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
+type EventRoutingConfig struct {
+	Transforms    transforms.Pipeline
+	DetectCrashes bool
+	// SurfaceLoggregatorDrops turns Loggregator dropped messages counters
+	// into dedicated high severity events
+	SurfaceLoggregatorDrops bool
+	ProfileLatency          bool
+	// ExtraFieldsOverride lets extra fields win over resolved metadata
+	// holding the same key
+	ExtraFieldsOverride bool
+	// ExtraFieldsStrict tells whether malformed extra fields stop the nozzle
+	// (extrafields.StrictFail) or are skipped (extrafields.StrictSkip)
+	ExtraFieldsStrict string
+	// IncludeSubscriptionID adds the firehose subscription ID the event was
+	// delivered through as a subscription_id field
+	IncludeSubscriptionID bool
+	// IncludeSchemaVersion adds the events schema version and NozzleVersion
+	// as schema_version and nozzle_version fields
+	IncludeSchemaVersion bool
+	NozzleVersion        string
+	// AppAllowlist, when not empty, only lets through the events of these
+	// app GUIDs, AppDenylist drops the events of its app GUIDs. Events
+	// without app GUID are never filtered.
+	AppAllowlist map[string]bool
+	AppDenylist  map[string]bool
+	// OrgFilter and SpaceFilter, when not empty, only let through the app
+	// events resolved to these org and space names. Events of apps that
+	// can't be resolved are handled by MissingMetadataPolicy.
+	OrgFilter             map[string]bool
+	SpaceFilter           map[string]bool
+	MissingMetadataPolicy string
+	// LogSourceTypes, when not empty, only lets through the LogMessage
+	// events of these message types, STDOUT or STDERR
+	LogSourceTypes map[events.LogMessage_MessageType]bool
+	// HTTPStatuses, when not empty, only lets through the HttpStartStop
+	// events whose status code is in one of these ranges
+	HTTPStatuses []StatusRange
+	// MessageInclude, when set, only lets through the LogMessage events
+	// whose text matches it, MessageExclude drops the ones matching it
+	MessageInclude *regexp.Regexp
+	MessageExclude *regexp.Regexp
+	// SampleRates is the fraction of the events of a type forwarded, picked
+	// at random, event types without a rate being all forwarded
+	SampleRates map[string]float64
+	// RateLimits caps the events per second of a type, events over the
+	// limit being dropped or, with RateLimitPolicy RateLimitBlock, held
+	// until the limit lets them through. Event types without a limit are
+	// unlimited.
+	RateLimits      map[string]float64
+	RateLimitPolicy string
+	// DedupWindow, when set, suppresses the events repeating one shipped
+	// less than that long ago, identified by the DedupKey fields, msg
+	// standing for the message. A summary with the repeat_count is shipped
+	// when the window closes. At most DedupMaxKeys windows are open at once.
+	DedupWindow  time.Duration
+	DedupKey     []string
+	DedupMaxKeys int
+	// IncludeLabels and IncludeAnnotations are the keys of the v3 app
+	// labels and annotations added to app events
+	IncludeLabels      []string
+	IncludeAnnotations []string
+	// TimestampFormat is the format of the timestamp and received_at
+	// fields, events.TimestampRFC3339Nano or events.TimestampEpochMillis
+	TimestampFormat string
+}
+
+const (
+	MissingMetadataDrop = "drop"
+	MissingMetadataPass = "pass"
+)
+
+const (
+	RateLimitDrop  = "drop"
+	RateLimitBlock = "block"
+)
+
 type EventRoutingDefault struct {
 	CachingClient       caching.Caching
 	selectedEvents      map[string]bool
@@ -22,17 +106,64 @@ type EventRoutingDefault struct {
 	mutex               *sync.Mutex
 	log                 logging.Logging
 	ExtraFields         map[string]string
+	extraTemplates      map[string]*extrafields.Template
+	config              *EventRoutingConfig
+	collisions          *metrics.Counter
+	loggregatorDropped  *metrics.Counter
+	routed              *metrics.CounterVec
+	dropped             *metrics.CounterVec
+	sampledOut          *metrics.CounterVec
+	rateLimited         *metrics.CounterVec
+	rateLimits          map[string]*ratelimit.TokenBucket
+	regexFiltered       *metrics.Counter
+	warnedCollisions    map[string]bool
+	subscriptionID      atomic.Value
+	dedup               *deduplicator
+
+	// Only set when profiling event latency
+	cacheLatency      *metrics.Histogram
+	transformsLatency *metrics.Histogram
 }
 
-func NewEventRouting(caching caching.Caching, logging logging.Logging) EventRouting {
-	return &EventRoutingDefault{
+func NewEventRouting(caching caching.Caching, logging logging.Logging, config *EventRoutingConfig) EventRouting {
+	e := &EventRoutingDefault{
 		CachingClient:       caching,
 		selectedEvents:      make(map[string]bool),
 		selectedEventsCount: make(map[string]uint64),
 		log:                 logging,
 		mutex:               &sync.Mutex{},
 		ExtraFields:         make(map[string]string),
+		config:              config,
+		collisions:          metrics.NewCounter("extra_fields_collisions"),
+		loggregatorDropped:  metrics.NewCounter("loggregator_dropped_messages"),
+		routed:              metrics.NewCounterVec("routed_events", "event_type"),
+		dropped:             metrics.NewCounterVec("dropped_events", "reason"),
+		sampledOut:          metrics.NewCounterVec("sampled_out_events", "event_type"),
+		rateLimited:         metrics.NewCounterVec("rate_limited_events", "event_type"),
+		rateLimits:          make(map[string]*ratelimit.TokenBucket),
+		regexFiltered:       metrics.NewCounter("regex_filtered_events"),
+		warnedCollisions:    make(map[string]bool),
+	}
+	e.subscriptionID.Store("")
+	for eventType, limit := range config.RateLimits {
+		// the bucket holds at least one event, for limits under one per second
+		e.rateLimits[eventType] = ratelimit.NewTokenBucket(limit, math.Max(limit, 1))
+	}
+	if config.DedupWindow > 0 {
+		e.dedup = newDeduplicator(config.DedupWindow, config.DedupKey, config.DedupMaxKeys)
+		go e.closeDedupWindows()
+	}
+	if config.ProfileLatency {
+		e.cacheLatency = metrics.NewHistogram("latency_cache_lookup_us", metrics.LatencyBuckets)
+		e.transformsLatency = metrics.NewHistogram("latency_transforms_us", metrics.LatencyBuckets)
 	}
+	return e
+}
+
+// SetSubscriptionID records the subscription ID events are currently
+// delivered through.
+func (e *EventRoutingDefault) SetSubscriptionID(subscriptionID string) {
+	e.subscriptionID.Store(subscriptionID)
 }
 
 func (e *EventRoutingDefault) GetSelectedEvents() map[string]bool {
@@ -43,7 +174,53 @@ func (e *EventRoutingDefault) RouteEvent(msg *events.Envelope) {
 
 	eventType := msg.GetEventType()
 
+	if eventType == events.Envelope_LogMessage {
+		if appID, change := fevents.AppChange(msg); change != "" {
+			// resolve the app again rather than shipping stale metadata
+			// until the next cache refresh
+			e.CachingClient.Invalidate(appID)
+		}
+	}
+
+	if e.config.DetectCrashes && eventType == events.Envelope_LogMessage {
+		if crash := fevents.AppCrash(msg); crash != nil {
+			e.routeEvent(crash, msg)
+		}
+	}
+
+	if e.config.SurfaceLoggregatorDrops && eventType == events.Envelope_CounterEvent {
+		if dropped := fevents.LoggregatorDropped(msg); dropped != nil {
+			e.loggregatorDropped.Add(msg.GetCounterEvent().GetDelta())
+			e.routeEvent(dropped, msg)
+		}
+	}
+
 	if e.selectedEvents[eventType.String()] {
+		if eventType == events.Envelope_LogMessage && e.logSourceFiltered(msg.GetLogMessage()) {
+			e.mutex.Lock()
+			e.selectedEventsCount["filtered_source_type_message"]++
+			e.mutex.Unlock()
+			e.dropped.With("source_type_filter").Inc()
+			return
+		}
+		if eventType == events.Envelope_LogMessage && e.messageFiltered(msg.GetLogMessage()) {
+			e.mutex.Lock()
+			e.selectedEventsCount["filtered_regex_message"]++
+			e.mutex.Unlock()
+			e.dropped.With("message_regex").Inc()
+			e.regexFiltered.Inc()
+			return
+		}
+		if eventType == events.Envelope_HttpStartStop && e.httpStatusFiltered(msg.GetHttpStartStop()) {
+			e.mutex.Lock()
+			e.selectedEventsCount["filtered_http_status"]++
+			e.mutex.Unlock()
+			e.dropped.With("http_status_filter").Inc()
+			return
+		}
+		if e.droppedBySampling(eventType.String()) {
+			return
+		}
 		var event *fevents.Event
 		switch eventType {
 		case events.Envelope_HttpStartStop:
@@ -60,28 +237,252 @@ func (e *EventRoutingDefault) RouteEvent(msg *events.Envelope) {
 			event = fevents.ContainerMetric(msg)
 		}
 
-		event.AnnotateWithEnveloppeData(msg)
+		e.routeEvent(event, msg)
+	} else {
+		e.dropped.With("unselected").Inc()
+	}
+}
+
+// logSourceFiltered tells whether a LogMessage is dropped by the log source
+// types filter.
+func (e *EventRoutingDefault) logSourceFiltered(logMessage *events.LogMessage) bool {
+	return len(e.config.LogSourceTypes) > 0 && !e.config.LogSourceTypes[logMessage.GetMessageType()]
+}
 
-		event.AnnotateWithMetaData(e.ExtraFields)
-		if _, hasAppId := event.Fields["cf_app_id"]; hasAppId {
-			event.AnnotateWithAppData(e.CachingClient)
+// httpStatusFiltered tells whether an HttpStartStop is dropped by the HTTP
+// status filter.
+func (e *EventRoutingDefault) httpStatusFiltered(httpStartStop *events.HttpStartStop) bool {
+	if len(e.config.HTTPStatuses) == 0 {
+		return false
+	}
+	status := httpStartStop.GetStatusCode()
+	for _, statusRange := range e.config.HTTPStatuses {
+		if status >= statusRange.Min && status <= statusRange.Max {
+			return false
 		}
+	}
+	return true
+}
 
+// messageFiltered tells whether a LogMessage is dropped by the message
+// regexes, the exclude one winning.
+func (e *EventRoutingDefault) messageFiltered(logMessage *events.LogMessage) bool {
+	if e.config.MessageInclude == nil && e.config.MessageExclude == nil {
+		return false
+	}
+	text := logMessage.GetMessage()
+	if e.config.MessageExclude != nil && e.config.MessageExclude.Match(text) {
+		return true
+	}
+	return e.config.MessageInclude != nil && !e.config.MessageInclude.Match(text)
+}
+
+// droppedBySampling tells whether an event of eventType is left out by its
+// sample rate, counting it then.
+func (e *EventRoutingDefault) droppedBySampling(eventType string) bool {
+	rate, sampled := e.config.SampleRates[eventType]
+	if !sampled || rate >= 1 || (rate > 0 && rand.Float64() < rate) {
+		return false
+	}
+	e.mutex.Lock()
+	e.selectedEventsCount["dropped_by_sampling"]++
+	e.mutex.Unlock()
+	e.sampledOut.With(eventType).Inc()
+	return true
+}
+
+// droppedByRateLimit tells whether an event of eventType is over the rate
+// limit of its type, counting it then. With the block policy, it waits for
+// the limit to let the event through instead, holding the consumer back.
+// It is the last check before shipping, so that only events that would
+// ship take from the limit. The caller holds the lock.
+func (e *EventRoutingDefault) droppedByRateLimit(eventType string) bool {
+	bucket, limited := e.rateLimits[eventType]
+	if !limited {
+		return false
+	}
+	if e.config.RateLimitPolicy == RateLimitBlock {
+		bucket.Wait(1)
+		return false
+	}
+	if bucket.Take(1) {
+		return false
+	}
+	e.selectedEventsCount["dropped_by_rate_limit"]++
+	e.dropped.With("rate_limit").Inc()
+	e.rateLimited.With(eventType).Inc()
+	return true
+}
+
+func (e *EventRoutingDefault) routeEvent(event *fevents.Event, msg *events.Envelope) {
+	if appID, _ := event.Fields["cf_app_id"].(string); appID != "" && e.appFiltered(appID) {
 		e.mutex.Lock()
-		//We do not ship Event
-		if ignored, hasIgnoredField := event.Fields["cf_ignored_app"]; ignored == true && hasIgnoredField {
-			e.selectedEventsCount["ignored_app_message"]++
-		} else {
-			e.log.ShipEvents(event.Fields, event.Msg)
-			e.selectedEventsCount[eventType.String()]++
+		e.selectedEventsCount["filtered_app_message"]++
+		e.mutex.Unlock()
+		e.dropped.With("app_filter").Inc()
+		return
+	}
 
+	event.AnnotateWithEnveloppeData(msg)
+	event.AnnotateWithTimestamps(msg, time.Now(), e.config.TimestampFormat)
+
+	event.AnnotateWithMetaData(nil)
+	if e.config.IncludeSubscriptionID {
+		event.Fields["subscription_id"] = e.subscriptionID.Load()
+	}
+	e.annotateWithVersion(event.Fields)
+	if _, hasAppId := event.Fields["cf_app_id"]; hasAppId {
+		start := time.Now()
+		app := event.AnnotateWithAppData(e.CachingClient)
+		e.cacheLatency.ObserveSince(start)
+		if app != nil {
+			event.AnnotateWithAppLabels(app, e.config.IncludeLabels, e.config.IncludeAnnotations)
 		}
-		e.mutex.Unlock()
+
+		if appID, _ := event.Fields["cf_app_id"].(string); appID != "" && e.orgSpaceFiltered(event.Fields) {
+			e.mutex.Lock()
+			e.selectedEventsCount["filtered_org_space_message"]++
+			e.mutex.Unlock()
+			e.dropped.With("org_space_filter").Inc()
+			return
+		}
+	}
+	if collisions := event.AnnotateWithExtraFields(e.extraFields(event.Fields), e.config.ExtraFieldsOverride); len(collisions) > 0 {
+		e.recordCollisions(collisions)
+	}
+
+	eventType := event.Type
+	start := time.Now()
+	event, keep := e.config.Transforms.Apply(event)
+	e.transformsLatency.ObserveSince(start)
+
+	e.mutex.Lock()
+	//We do not ship Event
+	if !keep {
+		e.selectedEventsCount["dropped_by_transforms"]++
+		e.dropped.With("transforms").Inc()
+	} else if ignored, hasIgnoredField := event.Fields["cf_ignored_app"]; ignored == true && hasIgnoredField {
+		e.selectedEventsCount["ignored_app_message"]++
+		e.dropped.With("ignored_app").Inc()
+	} else if deleted, _ := event.Fields["cf_app_deleted"].(bool); deleted {
+		e.selectedEventsCount["deleted_app_message"]++
+		e.dropped.With("deleted_app").Inc()
+	} else if e.dedup != nil && !e.dedup.admit(event.Fields, event.Msg, time.Now()) {
+		e.selectedEventsCount["dedup_suppressed"]++
+		e.dropped.With("dedup").Inc()
+	} else if !e.droppedByRateLimit(eventType) {
+		e.log.ShipEvents(event.Fields, event.Msg)
+		e.selectedEventsCount[eventType]++
+		e.routed.With(eventType).Inc()
+
+	}
+	e.mutex.Unlock()
+}
+
+// closeDedupWindows ships the summaries of the dedup windows as they close
+func (e *EventRoutingDefault) closeDedupWindows() {
+	for now := range time.Tick(e.dedup.sweepInterval()) {
+		for _, window := range e.dedup.close(now) {
+			e.mutex.Lock()
+			e.log.ShipEvents(window.summary(), window.msg)
+			e.selectedEventsCount["dedup_summary"]++
+			e.mutex.Unlock()
+		}
+	}
+}
+
+// appFiltered tells whether the events of appID are dropped by the app
+// allowlist or denylist, the denylist winning.
+func (e *EventRoutingDefault) appFiltered(appID string) bool {
+	appID = strings.ToLower(appID)
+	if e.config.AppDenylist[appID] {
+		return true
+	}
+	return len(e.config.AppAllowlist) > 0 && !e.config.AppAllowlist[appID]
+}
+
+// orgSpaceFiltered tells whether an app event is dropped by the org or
+// space filter.
+func (e *EventRoutingDefault) orgSpaceFiltered(fields map[string]interface{}) bool {
+	for _, filter := range []struct {
+		names map[string]bool
+		field string
+	}{
+		{e.config.OrgFilter, "cf_org_name"},
+		{e.config.SpaceFilter, "cf_space_name"},
+	} {
+		if len(filter.names) == 0 {
+			continue
+		}
+		name, _ := fields[filter.field].(string)
+		if name == "" || name == caching.UnknownPlaceholder {
+			if e.config.MissingMetadataPolicy != MissingMetadataPass {
+				return true
+			}
+			continue
+		}
+		if !filter.names[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAppGUIDs splits a comma separated list of app GUIDs
+func ParseAppGUIDs(guids string) map[string]bool {
+	return ParseNames(strings.ToLower(guids))
+}
+
+// ParseNames splits a comma separated list of names
+func ParseNames(names string) map[string]bool {
+	parsed := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			parsed[name] = true
+		}
+	}
+	return parsed
+}
+
+// annotateWithVersion adds the versions downstream pipelines can branch on
+// when the shipped fields change across nozzle upgrades.
+func (e *EventRoutingDefault) annotateWithVersion(fields map[string]interface{}) {
+	if e.config.IncludeSchemaVersion {
+		fields["schema_version"] = fevents.SchemaVersion
+		fields["nozzle_version"] = e.config.NozzleVersion
+	}
+}
+
+// recordCollisions counts extra fields colliding with resolved metadata and
+// warns once per key
+func (e *EventRoutingDefault) recordCollisions(keys []string) {
+	e.collisions.Add(uint64(len(keys)))
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, key := range keys {
+		if e.warnedCollisions[key] {
+			continue
+		}
+		e.warnedCollisions[key] = true
+		winner := "resolved value"
+		if e.config.ExtraFieldsOverride {
+			winner = "extra field"
+		}
+		logging.LogStd(fmt.Sprintf("Extra field [%s] collides with resolved event metadata, keeping the %s", key, winner), true)
 	}
 }
 
 func (e *EventRoutingDefault) SetupEventRouting(wantedEvents string) error {
 	e.selectedEvents = make(map[string]bool)
+	expandedEvents, err := ExpandEvents(wantedEvents)
+	if err != nil {
+		return err
+	}
+	if expandedEvents != wantedEvents {
+		logging.LogStd(fmt.Sprintf("Events [%s] expanded to [%s]", wantedEvents, expandedEvents), true)
+		wantedEvents = expandedEvents
+	}
 	if wantedEvents == "" {
 		e.selectedEvents["LogMessage"] = true
 	} else {
@@ -99,12 +500,48 @@ func (e *EventRoutingDefault) SetupEventRouting(wantedEvents string) error {
 
 func (e *EventRoutingDefault) SetExtraFields(extraEventsString string) {
 	// Parse extra fields from cmd call
-	extraFields, err := extrafields.ParseExtraFields(extraEventsString)
-	if err != nil {
-		logging.LogError("Error parsing extra fields: ", err)
-		os.Exit(1)
+	extraFields, malformed := extrafields.ValidateExtraFields(extraEventsString)
+	if len(malformed) > 0 {
+		if e.config.ExtraFieldsStrict != extrafields.StrictSkip {
+			for _, err := range malformed {
+				logging.LogError("Error parsing extra fields: ", err)
+			}
+			os.Exit(1)
+		}
+		for _, err := range malformed {
+			logging.LogStd(fmt.Sprintf("Skipping extra field: %v", err), true)
+		}
+	}
+	static, templates, unknown := extrafields.ParseTemplates(extraFields)
+	if len(unknown) > 0 {
+		if e.config.ExtraFieldsStrict != extrafields.StrictSkip {
+			for _, err := range unknown {
+				logging.LogError("Error parsing extra fields: ", err)
+			}
+			os.Exit(1)
+		}
+		for _, err := range unknown {
+			logging.LogStd(fmt.Sprintf("Leaving extra field literal: %v", err), true)
+		}
+	}
+	e.ExtraFields = static
+	e.extraTemplates = templates
+}
+
+// extraFields returns the extra fields of an event, the templates being
+// rendered from its fields.
+func (e *EventRoutingDefault) extraFields(fields map[string]interface{}) map[string]string {
+	if len(e.extraTemplates) == 0 {
+		return e.ExtraFields
+	}
+	extraFields := make(map[string]string, len(e.ExtraFields)+len(e.extraTemplates))
+	for k, v := range e.ExtraFields {
+		extraFields[k] = v
+	}
+	for k, template := range e.extraTemplates {
+		extraFields[k] = template.Render(fields)
 	}
-	e.ExtraFields = extraFields
+	return extraFields
 }
 
 func (e *EventRoutingDefault) GetTotalCountOfSelectedEvents() uint64 {
@@ -132,11 +569,120 @@ func (e *EventRoutingDefault) LogEventTotals(logTotalsTime time.Duration) {
 			startTime = time.Now()
 			event, lastCount := e.getEventTotals(totalElapsedTime, elapsedTime, count)
 			count = lastCount
+			e.annotateWithVersion(event.Fields)
 			e.log.ShipEvents(event.Fields, event.Msg)
 		}
 	}()
 }
 
+// SelfMetricsSourceType tags the events describing the nozzle itself
+const SelfMetricsSourceType = "F2S"
+
+// LogSelfMetrics periodically ships an event with the nozzle's own CPU,
+// memory, goroutine count and event throughput, for environments without
+// a metrics scraper.
+func (e *EventRoutingDefault) LogSelfMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	lastTime := time.Now()
+	lastCPU := processCPUTime()
+	lastCount := e.totalCount()
+
+	go func() {
+		for range ticker.C {
+			now, cpu, count := time.Now(), processCPUTime(), e.totalCount()
+			event := getSelfMetrics(now.Sub(lastTime), cpu, cpu-lastCPU, count-lastCount)
+			lastTime, lastCPU, lastCount = now, cpu, count
+			e.annotateWithVersion(event.Fields)
+			e.log.ShipEvents(event.Fields, event.Msg)
+		}
+	}()
+}
+
+// InternalMetricsType tags the events carrying the nozzle's own counters
+const InternalMetricsType = "nozzle_internal"
+
+// internalMetricsPrefixes select, among the registered metrics, the
+// reconnect and cache counters shipped with the internal metrics
+var internalMetricsPrefixes = []string{"firehose_reconnects", "firehose_stall_reconnects", "cache_"}
+
+// LogInternalMetrics periodically ships an event with the counters of the
+// events routed by type and dropped by reason, along with the firehose
+// reconnects and the cache counters, for environments whose syslog
+// destination is the only one watched.
+func (e *EventRoutingDefault) LogInternalMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for range ticker.C {
+			event := e.getInternalMetrics()
+			e.annotateWithVersion(event.Fields)
+			e.log.ShipEvents(event.Fields, event.Msg)
+		}
+	}()
+}
+
+func (e *EventRoutingDefault) getInternalMetrics() *fevents.Event {
+	fields := logrus.Fields{
+		"source_type": InternalMetricsType,
+	}
+	for prefix, counters := range map[string]map[string]uint64{
+		"routed":  e.routed.Values(),
+		"dropped": e.dropped.Values(),
+	} {
+		total := uint64(0)
+		for label, count := range counters {
+			fields[prefix+"_"+label] = count
+			total += count
+		}
+		fields[prefix+"_total"] = total
+	}
+	for name, value := range metrics.Snapshot() {
+		for _, prefix := range internalMetricsPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				fields[name] = value
+				break
+			}
+		}
+	}
+
+	event := &fevents.Event{
+		Type:   InternalMetricsType,
+		Msg:    "Internal metrics of firehose to syslog",
+		Fields: fields,
+	}
+	event.AnnotateWithMetaData(map[string]string{})
+	return event
+}
+
+func (e *EventRoutingDefault) totalCount() uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.GetTotalCountOfSelectedEvents()
+}
+
+func getSelfMetrics(elapsed time.Duration, cpu time.Duration, cpuDelta time.Duration, countDelta uint64) *fevents.Event {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	fields := logrus.Fields{
+		"source_type":    SelfMetricsSourceType,
+		"cpu_seconds":    cpu.Seconds(),
+		"cpu_percentage": 100 * cpuDelta.Seconds() / elapsed.Seconds(),
+		"memory_bytes":   memStats.Sys,
+		"heap_bytes":     memStats.HeapAlloc,
+		"goroutines":     runtime.NumGoroutine(),
+		"events_per_sec": float64(countDelta) / elapsed.Seconds(),
+	}
+
+	event := &fevents.Event{
+		Type:   "firehose_to_syslog_self",
+		Msg:    "Resource usage of firehose to syslog",
+		Fields: fields,
+	}
+	event.AnnotateWithMetaData(map[string]string{})
+	return event
+}
+
 func (e *EventRoutingDefault) getEventTotals(totalElapsedTime float64, elapsedTime float64, lastCount uint64) (*fevents.Event, uint64) {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
@@ -151,6 +697,10 @@ func (e *EventRoutingDefault) getEventTotals(totalElapsedTime float64, elapsedTi
 		fields[eventtype] = count
 	}
 
+	for name, value := range metrics.Snapshot() {
+		fields[name] = value
+	}
+
 	event := &fevents.Event{
 		Type:   "firehose_to_syslog_stats",
 		Msg:    "Statistic for firehose to syslog",
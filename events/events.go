@@ -2,6 +2,11 @@ package events
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
@@ -9,12 +14,43 @@ import (
 	"github.com/cloudfoundry/sonde-go/events"
 )
 
+var (
+	crashReason          = regexp.MustCompile(`"reason"=>"([^"]*)"`)
+	crashIndex           = regexp.MustCompile(`"index"=>(\d+)`)
+	crashExitStatus      = regexp.MustCompile(`"exit_status"=>(-?\d+)`)
+	crashExitDescription = regexp.MustCompile(`"exit_description"=>"([^"]*)"`)
+	crashCount           = regexp.MustCompile(`"crash_count"=>(\d+)`)
+	exitedWithStatus     = regexp.MustCompile(`[Ee]xited with status (-?\d+)`)
+	appChange            = regexp.MustCompile(`^(Updated|Deleted) app with guid ([0-9a-fA-F-]+)`)
+)
+
+// AppUpdated and AppDeleted are the app changes AppChange tells apart
+const (
+	AppUpdated = "Updated"
+	AppDeleted = "Deleted"
+)
+
+// SchemaVersion is the version of the set of fields events are shipped with,
+// sent as the schema_version field. Bump it whenever a field is added to,
+// renamed in or removed from an event type, or changes type.
+const SchemaVersion = 3
+
+// Formats of the timestamp and received_at fields
+const (
+	TimestampRFC3339Nano = "rfc3339nano"
+	TimestampEpochMillis = "epoch-millis"
+)
+
 type Event struct {
 	Fields map[string]interface{}
 	Msg    string
 	Type   string
 }
 
+// HttpStartStop decomposes an HTTP request into access log fields. The
+// duration_ms is derived from the start and stop timestamps, 0 when they
+// are missing, status_class from the status code, such as 4xx, and uri_host
+// and uri_path from the URI.
 func HttpStartStop(msg *events.Envelope) *Event {
 	httpStartStop := msg.GetHttpStartStop()
 
@@ -32,9 +68,13 @@ func HttpStartStop(msg *events.Envelope) *Event {
 		"stop_timestamp":  httpStartStop.GetStopTimestamp(),
 		"uri":             httpStartStop.GetUri(),
 		"user_agent":      httpStartStop.GetUserAgent(),
-		"duration_ms":     (((httpStartStop.GetStopTimestamp() - httpStartStop.GetStartTimestamp()) / 1000) / 1000),
+		"duration_ms":     httpDurationMillis(httpStartStop),
+		"status_class":    StatusClass(httpStartStop.GetStatusCode()),
 		"forwarded":       httpStartStop.GetForwarded(),
 	}
+	host, path := splitURI(httpStartStop.GetUri())
+	fields["uri_host"] = host
+	fields["uri_path"] = path
 
 	return &Event{
 		Fields: fields,
@@ -42,12 +82,44 @@ func HttpStartStop(msg *events.Envelope) *Event {
 	}
 }
 
+func httpDurationMillis(httpStartStop *events.HttpStartStop) int64 {
+	start, stop := httpStartStop.GetStartTimestamp(), httpStartStop.GetStopTimestamp()
+	if start <= 0 || stop < start {
+		return 0
+	}
+	return (stop - start) / int64(time.Millisecond)
+}
+
+// StatusClass is the class of an HTTP status code, such as 2xx, empty when
+// the code is missing.
+func StatusClass(statusCode int32) string {
+	if statusCode < 100 || statusCode > 999 {
+		return ""
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// splitURI returns the host and path of an HttpStartStop URI, which may
+// lack the scheme, such as "app.example.com/path?query".
+func splitURI(uri string) (string, string) {
+	if uri == "" {
+		return "", ""
+	}
+	if !strings.Contains(uri, "://") {
+		uri = "http://" + uri
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", ""
+	}
+	return parsed.Host, parsed.Path
+}
+
 func LogMessage(msg *events.Envelope) *Event {
 	logMessage := msg.GetLogMessage()
 
 	fields := logrus.Fields{
 		"cf_app_id":       logMessage.GetAppId(),
-		"timestamp":       logMessage.GetTimestamp(),
 		"source_type":     logMessage.GetSourceType(),
 		"message_type":    logMessage.GetMessageType().String(),
 		"source_instance": logMessage.GetSourceInstance(),
@@ -122,14 +194,113 @@ func ContainerMetric(msg *events.Envelope) *Event {
 	}
 }
 
-func (e *Event) AnnotateWithAppData(caching caching.Caching) {
+// AppCrash extracts a "crash" event from the Cloud Controller notification
+// emitted when an app instance exits with reason CRASHED. It returns nil for
+// any other envelope.
+func AppCrash(msg *events.Envelope) *Event {
+	logMessage := msg.GetLogMessage()
+	if logMessage.GetSourceType() != "API" {
+		return nil
+	}
+
+	body := string(logMessage.GetMessage())
+	if !strings.Contains(body, "App instance exited") {
+		return nil
+	}
+
+	reason := submatch(crashReason, body)
+	if reason != "CRASHED" {
+		return nil
+	}
+
+	exitDescription := submatch(crashExitDescription, body)
+	exitCode := submatch(crashExitStatus, body)
+	if exitCode == "" {
+		exitCode = submatch(exitedWithStatus, exitDescription)
+	}
+
+	fields := logrus.Fields{
+		"cf_app_id":        logMessage.GetAppId(),
+		"exit_reason":      reason,
+		"exit_description": exitDescription,
+	}
+	if index, err := strconv.Atoi(submatch(crashIndex, body)); err == nil {
+		fields["instance_index"] = index
+	}
+	if code, err := strconv.Atoi(exitCode); err == nil {
+		fields["exit_code"] = code
+	}
+	if count, err := strconv.Atoi(submatch(crashCount, body)); err == nil {
+		fields["crash_count"] = count
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    body,
+		Type:   "crash",
+	}
+}
+
+// AppChange returns the GUID of the app and the change (AppUpdated or
+// AppDeleted) of the Cloud Controller notification emitted when an app is
+// updated, renamed included, or deleted. It returns empty strings for any
+// other envelope.
+func AppChange(msg *events.Envelope) (string, string) {
+	logMessage := msg.GetLogMessage()
+	if logMessage.GetSourceType() != "API" {
+		return "", ""
+	}
+
+	match := appChange.FindStringSubmatch(string(logMessage.GetMessage()))
+	if match == nil {
+		return "", ""
+	}
+	return match[2], match[1]
+}
+
+// LoggregatorDropped extracts a "loggregator_dropped" event from the counter
+// Loggregator emits when it drops messages because the subscription does not
+// keep up. It returns nil for any other envelope.
+func LoggregatorDropped(msg *events.Envelope) *Event {
+	counterEvent := msg.GetCounterEvent()
+	if counterEvent.GetName() != "TruncatingBuffer.DroppedMessages" {
+		return nil
+	}
+
+	fields := logrus.Fields{
+		"name":    counterEvent.GetName(),
+		"dropped": counterEvent.GetDelta(),
+		"total":   counterEvent.GetTotal(),
+	}
+
+	return &Event{
+		Fields: fields,
+		Msg:    fmt.Sprintf("Loggregator dropped %d messages, the nozzle is not keeping up", counterEvent.GetDelta()),
+		Type:   "loggregator_dropped",
+	}
+}
+
+func submatch(r *regexp.Regexp, s string) string {
+	if match := r.FindStringSubmatch(s); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// AnnotateWithAppData adds the name, space and org of the app of the event,
+// returning the app or nil when it couldn't be resolved.
+func (e *Event) AnnotateWithAppData(cachingClient caching.Caching) *caching.App {
 	cf_app_id := e.Fields["cf_app_id"]
 	appGuid := fmt.Sprintf("%s", cf_app_id)
 
 	if cf_app_id != nil && appGuid != "<nil>" && cf_app_id != "" {
-		appInfo, err := caching.GetApp(appGuid)
+		appInfo, err := cachingClient.GetApp(appGuid)
+		if err == caching.ErrAppDeleted {
+			e.Fields["cf_app_deleted"] = true
+			return nil
+		}
 		if err != nil {
-			return
+			return nil
 		}
 
 		cf_app_name := appInfo.Name
@@ -160,7 +331,24 @@ func (e *Event) AnnotateWithAppData(caching caching.Caching) {
 		}
 
 		e.Fields["cf_ignored_app"] = cf_ignored_app
+		return appInfo
+	}
+	return nil
+}
 
+// AnnotateWithAppLabels adds the given labels and annotations of app as
+// cf_app_label_<key> and cf_app_annotation_<key> fields, skipping the ones
+// the app doesn't have.
+func (e *Event) AnnotateWithAppLabels(app *caching.App, labels []string, annotations []string) {
+	for _, key := range labels {
+		if value, ok := app.Labels[key]; ok {
+			e.Fields["cf_app_label_"+key] = value
+		}
+	}
+	for _, key := range annotations {
+		if value, ok := app.Annotations[key]; ok {
+			e.Fields["cf_app_annotation_"+key] = value
+		}
 	}
 }
 
@@ -172,12 +360,53 @@ func (e *Event) AnnotateWithMetaData(extraFields map[string]string) {
 	}
 }
 
+// AnnotateWithExtraFields adds user supplied fields on top of the resolved
+// ones. On a key already holding a different value, the extra field only
+// wins when override is set. The colliding keys are returned.
+func (e *Event) AnnotateWithExtraFields(extraFields map[string]string, override bool) []string {
+	var collisions []string
+	for k, v := range extraFields {
+		if existing, ok := e.Fields[k]; ok && existing != v {
+			collisions = append(collisions, k)
+			if !override {
+				continue
+			}
+		}
+		e.Fields[k] = v
+	}
+	return collisions
+}
+
 func (e *Event) AnnotateWithEnveloppeData(msg *events.Envelope) {
 	e.Fields["origin"] = msg.GetOrigin()
 	e.Fields["deployment"] = msg.GetDeployment()
 	e.Fields["ip"] = msg.GetIp()
 	e.Fields["job"] = msg.GetJob()
 	e.Fields["job_index"] = msg.GetIndex()
-	e.Type = msg.GetEventType().String()
+	if e.Type == "" {
+		e.Type = msg.GetEventType().String()
+	}
+
+}
 
+// AnnotateWithTimestamps adds the time the event happened as timestamp, and
+// the time the nozzle received it as received_at, in format, so that the
+// ingestion lag can be measured downstream. Log messages carry their own
+// timestamp, other events the one of their envelope.
+func (e *Event) AnnotateWithTimestamps(msg *events.Envelope, receivedAt time.Time, format string) {
+	timestamp := msg.GetTimestamp()
+	if logTimestamp := msg.GetLogMessage().GetTimestamp(); logTimestamp != 0 {
+		timestamp = logTimestamp
+	}
+	e.Fields["timestamp"] = FormatTimestamp(time.Unix(0, timestamp), format)
+	e.Fields["received_at"] = FormatTimestamp(receivedAt, format)
+}
+
+// FormatTimestamp renders t as an RFC 3339 string with nanoseconds, or as
+// milliseconds since the epoch with TimestampEpochMillis.
+func FormatTimestamp(t time.Time, format string) interface{} {
+	if format == TimestampEpochMillis {
+		return t.UnixNano() / int64(time.Millisecond)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
 }
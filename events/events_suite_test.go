@@ -39,3 +39,45 @@ func CreateLogMessage() (msg *Envelope) {
 	}
 	return envelope
 }
+
+func CreateCrashMessage() (msg *Envelope) {
+	var eventType Envelope_EventType = 5
+	var messageType LogMessage_MessageType = 1
+	var sourceType string = "API"
+	var appID string = "eea38ba5-53a5-4173-9617-b442d35ec2fd"
+	var logMsg string = `App instance exited with guid eea38ba5-53a5-4173-9617-b442d35ec2fd payload: {"instance"=>"", "index"=>2, "reason"=>"CRASHED", "exit_description"=>"APP/PROC/WEB: Exited with status 137", "crash_count"=>3, "crash_timestamp"=>1500000000}`
+
+	return &Envelope{
+		EventType: &eventType,
+		LogMessage: &LogMessage{
+			Message:     []byte(logMsg),
+			AppId:       &appID,
+			SourceType:  &sourceType,
+			MessageType: &messageType,
+		},
+	}
+}
+
+func CreateAPIMessage(logMsg string) (msg *Envelope) {
+	msg = CreateCrashMessage()
+	msg.LogMessage.Message = []byte(logMsg)
+	return msg
+}
+
+func CreateDroppedMessagesCounter() (msg *Envelope) {
+	var eventType Envelope_EventType = 7
+	var origin string = "DopplerServer"
+	var name string = "TruncatingBuffer.DroppedMessages"
+	var delta uint64 = 42
+	var total uint64 = 1000
+
+	return &Envelope{
+		EventType: &eventType,
+		Origin:    &origin,
+		CounterEvent: &CounterEvent{
+			Name:  &name,
+			Delta: &delta,
+			Total: &total,
+		},
+	}
+}
@@ -1,6 +1,8 @@
 package events_test
 
 import (
+	"time"
+
 	. "github.com/cloudfoundry-community/firehose-to-syslog/caching"
 	. "github.com/cloudfoundry-community/firehose-to-syslog/caching/cachingfakes"
 	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
@@ -24,13 +26,31 @@ var _ = Describe("Events", func() {
 		It("should give us what we want", func() {
 			Expect(event.Fields["origin"]).To(Equal("yomomma__0"))
 			Expect(event.Fields["cf_app_id"]).To(Equal("eea38ba5-53a5-4173-9617-b442d35ec2fd"))
-			Expect(event.Fields["timestamp"]).To(Equal(int64(1)))
 			Expect(event.Fields["source_type"]).To(Equal("Kehe"))
 			Expect(event.Fields["message_type"]).To(Equal("OUT"))
 			Expect(event.Fields["source_instance"]).To(Equal(">9000"))
 			Expect(event.Msg).To(Equal("Help, I'm a rock! Help, I'm a rock! Help, I'm a cop! Help, I'm a cop!"))
 		})
 	})
+	Context("given timestamps", func() {
+		receivedAt := time.Date(2017, 6, 1, 12, 0, 0, 500, time.UTC)
+
+		It("Should add the log message and receive times in RFC 3339", func() {
+			event.AnnotateWithTimestamps(msg, receivedAt, fevents.TimestampRFC3339Nano)
+			Expect(event.Fields["timestamp"]).To(Equal("1970-01-01T00:00:00.000000001Z"))
+			Expect(event.Fields["received_at"]).To(Equal("2017-06-01T12:00:00.0000005Z"))
+		})
+
+		It("Should fall back to the envelope time", func() {
+			var timestamp int64 = 1496318399250000000
+			msg.Timestamp = &timestamp
+			msg.LogMessage.Timestamp = nil
+			event.AnnotateWithTimestamps(msg, receivedAt, fevents.TimestampEpochMillis)
+			Expect(event.Fields["timestamp"]).To(Equal(int64(1496318399250)))
+			Expect(event.Fields["received_at"]).To(Equal(receivedAt.UnixNano() / int64(time.Millisecond)))
+		})
+	})
+
 	Context("given metadata", func() {
 		It("Should give us the right metadata", func() {
 			event.AnnotateWithMetaData(map[string]string{"extra": "field"})
@@ -42,6 +62,29 @@ var _ = Describe("Events", func() {
 
 	})
 
+	Context("given extra fields colliding with resolved ones", func() {
+		BeforeEach(func() {
+			event.Fields["cf_org_name"] = "real-org"
+		})
+
+		It("Should keep the resolved value by default", func() {
+			collisions := event.AnnotateWithExtraFields(map[string]string{"cf_org_name": "foo", "env": "dev"}, false)
+			Expect(collisions).To(Equal([]string{"cf_org_name"}))
+			Expect(event.Fields["cf_org_name"]).To(Equal("real-org"))
+			Expect(event.Fields["env"]).To(Equal("dev"))
+		})
+
+		It("Should let the extra field win when overriding", func() {
+			collisions := event.AnnotateWithExtraFields(map[string]string{"cf_org_name": "foo"}, true)
+			Expect(collisions).To(Equal([]string{"cf_org_name"}))
+			Expect(event.Fields["cf_org_name"]).To(Equal("foo"))
+		})
+
+		It("Should not report identical values as a collision", func() {
+			Expect(event.AnnotateWithExtraFields(map[string]string{"cf_org_name": "real-org"}, false)).To(BeEmpty())
+		})
+	})
+
 	Context("given Application Metadata", func() {
 		It("Should give us the right Application metadata", func() {
 			caching.GetAppStub = func(appid string) (*App, error) {
@@ -66,6 +109,122 @@ var _ = Describe("Events", func() {
 
 		})
 
+		It("Should add the selected labels and annotations the app has", func() {
+			app := &App{
+				Labels:      map[string]string{"team": "payments", "tier": "gold"},
+				Annotations: map[string]string{"contact": "payments@example.com"},
+			}
+			event.AnnotateWithAppLabels(app, []string{"team", "environment"}, []string{"contact"})
+			Expect(event.Fields["cf_app_label_team"]).To(Equal("payments"))
+			Expect(event.Fields["cf_app_annotation_contact"]).To(Equal("payments@example.com"))
+			Expect(event.Fields).ToNot(HaveKey("cf_app_label_environment"))
+			Expect(event.Fields).ToNot(HaveKey("cf_app_label_tier"))
+		})
+
+		It("Should flag events of deleted apps", func() {
+			caching.GetAppStub = func(appid string) (*App, error) {
+				return nil, ErrAppDeleted
+			}
+			event.AnnotateWithAppData(caching)
+			Expect(event.Fields["cf_app_deleted"]).To(Equal(true))
+			Expect(event.Fields).ToNot(HaveKey("cf_app_name"))
+		})
+
+	})
+
+	Context("given a Loggregator dropped messages counter", func() {
+		It("should extract a loggregator_dropped event", func() {
+			dropped := fevents.LoggregatorDropped(CreateDroppedMessagesCounter())
+			Expect(dropped).ToNot(BeNil())
+			Expect(dropped.Type).To(Equal("loggregator_dropped"))
+			Expect(dropped.Fields["dropped"]).To(Equal(uint64(42)))
+			Expect(dropped.Fields["total"]).To(Equal(uint64(1000)))
+		})
+
+		It("should ignore other counters", func() {
+			Expect(fevents.LoggregatorDropped(&Envelope{EventType: Envelope_CounterEvent.Enum()})).To(BeNil())
+		})
+	})
+
+	Context("given an app crash notification", func() {
+		It("should extract a crash event", func() {
+			crash := fevents.AppCrash(CreateCrashMessage())
+			Expect(crash).ToNot(BeNil())
+			Expect(crash.Type).To(Equal("crash"))
+			Expect(crash.Fields["cf_app_id"]).To(Equal("eea38ba5-53a5-4173-9617-b442d35ec2fd"))
+			Expect(crash.Fields["instance_index"]).To(Equal(2))
+			Expect(crash.Fields["exit_reason"]).To(Equal("CRASHED"))
+			Expect(crash.Fields["exit_code"]).To(Equal(137))
+			Expect(crash.Fields["crash_count"]).To(Equal(3))
+		})
+
+		It("should keep the crash type when annotated with envelope data", func() {
+			msg := CreateCrashMessage()
+			crash := fevents.AppCrash(msg)
+			crash.AnnotateWithEnveloppeData(msg)
+			Expect(crash.Type).To(Equal("crash"))
+		})
+	})
+
+	Context("given an app update notification", func() {
+		It("should return the app and its change", func() {
+			appID, change := fevents.AppChange(CreateAPIMessage(`Updated app with guid eea38ba5-53a5-4173-9617-b442d35ec2fd ({"name"=>"renamed"})`))
+			Expect(appID).To(Equal("eea38ba5-53a5-4173-9617-b442d35ec2fd"))
+			Expect(change).To(Equal(fevents.AppUpdated))
+
+			appID, change = fevents.AppChange(CreateAPIMessage("Deleted app with guid eea38ba5-53a5-4173-9617-b442d35ec2fd"))
+			Expect(appID).To(Equal("eea38ba5-53a5-4173-9617-b442d35ec2fd"))
+			Expect(change).To(Equal(fevents.AppDeleted))
+		})
+	})
+
+	Context("given an HttpStartStop", func() {
+		httpStartStop := func(start, stop int64, status int32, uri string) *fevents.Event {
+			return fevents.HttpStartStop(&Envelope{
+				EventType: Envelope_HttpStartStop.Enum(),
+				HttpStartStop: &HttpStartStop{
+					StartTimestamp: &start,
+					StopTimestamp:  &stop,
+					StatusCode:     &status,
+					Uri:            &uri,
+					Forwarded:      []string{"10.0.0.1", "10.0.0.2"},
+				},
+			})
+		}
+
+		It("should decompose it into access log fields", func() {
+			event := httpStartStop(1496318399000000000, 1496318399250500000, 404, "http://app.example.com/api/users?page=2")
+			Expect(event.Fields["duration_ms"]).To(Equal(int64(250)))
+			Expect(event.Fields["status_code"]).To(Equal(int32(404)))
+			Expect(event.Fields["status_class"]).To(Equal("4xx"))
+			Expect(event.Fields["uri_host"]).To(Equal("app.example.com"))
+			Expect(event.Fields["uri_path"]).To(Equal("/api/users"))
+			Expect(event.Fields["forwarded"]).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		})
+
+		It("should split URIs without scheme", func() {
+			event := httpStartStop(1, 2, 200, "app.example.com/healthz")
+			Expect(event.Fields["uri_host"]).To(Equal("app.example.com"))
+			Expect(event.Fields["uri_path"]).To(Equal("/healthz"))
+		})
+
+		It("should not derive a duration nor a class from missing values", func() {
+			event := httpStartStop(1496318399000000000, 0, 0, "")
+			Expect(event.Fields["duration_ms"]).To(Equal(int64(0)))
+			Expect(event.Fields["status_class"]).To(BeEmpty())
+			Expect(event.Fields["uri_host"]).To(BeEmpty())
+		})
+	})
+
+	Context("given a regular log message", func() {
+		It("should not extract a crash event", func() {
+			Expect(fevents.AppCrash(msg)).To(BeNil())
+		})
+
+		It("should not return an app change", func() {
+			_, change := fevents.AppChange(msg)
+			Expect(change).To(BeEmpty())
+		})
 	})
 
 })
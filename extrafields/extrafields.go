@@ -2,9 +2,30 @@ package extrafields
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 )
 
+const (
+	// StrictFail refuses any malformed extra field
+	StrictFail = "fail"
+	// StrictSkip drops malformed extra fields, keeping the well formed ones
+	StrictSkip = "skip"
+)
+
+// MalformedFieldError describes an extra field that can't be used, Position
+// being its 1-based index in the comma separated list.
+type MalformedFieldError struct {
+	Position int
+	Pair     string
+	Reason   string
+}
+
+func (e *MalformedFieldError) Error() string {
+	return fmt.Sprintf("Extra field #%d [%s] is malformed: %s", e.Position, e.Pair, e.Reason)
+}
+
 func getKeyValueFromString(kvPair string) (string, string, error) {
 	values := strings.Split(kvPair, ":")
 	if len(values) != 2 {
@@ -13,18 +34,45 @@ func getKeyValueFromString(kvPair string) (string, string, error) {
 	return strings.TrimSpace(values[0]), strings.TrimSpace(values[1]), nil
 }
 
-func ParseExtraFields(extraEventsString string) (map[string]string, error) {
+// ValidateExtraFields parses comma separated key:value pairs. Well formed
+// pairs are returned along with an error for each malformed one: a pair
+// without exactly one ':', with an empty key or value, or repeating a key.
+func ValidateExtraFields(extraEventsString string) (map[string]string, []error) {
 	extraEvents := map[string]string{}
+	var malformed []error
 
-	for _, kvPair := range strings.Split(extraEventsString, ",") {
-		if kvPair != "" {
-			cleaned := strings.TrimSpace(kvPair)
-			k, v, err := getKeyValueFromString(cleaned)
-			if err != nil {
-				return nil, err
-			}
-			extraEvents[k] = v
+	for i, kvPair := range strings.Split(extraEventsString, ",") {
+		cleaned := strings.TrimSpace(kvPair)
+		if cleaned == "" {
+			continue
+		}
+		reason := ""
+		k, v, err := getKeyValueFromString(cleaned)
+		switch {
+		case err != nil:
+			reason = "expected exactly one ':' between key and value"
+		case k == "":
+			reason = "empty key"
+		case v == "":
+			reason = "empty value"
+		case FieldExist(extraEvents, k):
+			reason = fmt.Sprintf("duplicate key %s", k)
 		}
+		if reason != "" {
+			malformed = append(malformed, &MalformedFieldError{Position: i + 1, Pair: cleaned, Reason: reason})
+			continue
+		}
+		extraEvents[k] = v
+	}
+	return extraEvents, malformed
+}
+
+// ParseExtraFields parses comma separated key:value pairs, failing on the
+// first malformed one.
+func ParseExtraFields(extraEventsString string) (map[string]string, error) {
+	extraEvents, malformed := ValidateExtraFields(extraEventsString)
+	if len(malformed) > 0 {
+		return nil, malformed[0]
 	}
 	return extraEvents, nil
 }
@@ -34,3 +82,94 @@ func FieldExist(fieldList map[string]string, field string) bool {
 	return presence
 
 }
+
+// Tokens maps the tokens extra field values can hold, such as
+// {source_instance}, to the event field substituted for them when the event
+// is shipped
+var Tokens = map[string]string{
+	"app_id":          "cf_app_id",
+	"app_name":        "cf_app_name",
+	"space_name":      "cf_space_name",
+	"org_name":        "cf_org_name",
+	"event_type":      "event_type",
+	"origin":          "origin",
+	"deployment":      "deployment",
+	"job":             "job",
+	"job_index":       "job_index",
+	"ip":              "ip",
+	"source_type":     "source_type",
+	"source_instance": "source_instance",
+}
+
+var tokenPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// UnknownTokenError describes a token of an extra field value that isn't
+// one of Tokens.
+type UnknownTokenError struct {
+	Key   string
+	Token string
+}
+
+func (e *UnknownTokenError) Error() string {
+	return fmt.Sprintf("Extra field [%s] holds the unknown token {%s}", e.Key, e.Token)
+}
+
+// Template is an extra field value holding tokens, literals[i] coming
+// before the value of fields[i].
+type Template struct {
+	literals []string
+	fields   []string
+}
+
+// Render substitutes the event fields for the tokens, fields the event
+// doesn't have, such as the app name of an unresolved app, being empty.
+func (t *Template) Render(fields map[string]interface{}) string {
+	rendered := t.literals[0]
+	for i, field := range t.fields {
+		if value, ok := fields[field]; ok && value != nil {
+			rendered += fmt.Sprint(value)
+		}
+		rendered += t.literals[i+1]
+	}
+	return rendered
+}
+
+// ParseTemplates splits extra fields into the static ones and the templates
+// of those holding tokens. An error is returned for each unknown token, the
+// value holding it being kept static so that it stays literal when the
+// errors are ignored.
+func ParseTemplates(extraFields map[string]string) (map[string]string, map[string]*Template, []error) {
+	static := map[string]string{}
+	templates := map[string]*Template{}
+	var unknown []error
+	keys := make([]string, 0, len(extraFields))
+	for key := range extraFields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := extraFields[key]
+		matches := tokenPattern.FindAllStringSubmatchIndex(value, -1)
+		template := &Template{}
+		last := 0
+		for _, match := range matches {
+			token := value[match[2]:match[3]]
+			field, known := Tokens[token]
+			if !known {
+				unknown = append(unknown, &UnknownTokenError{Key: key, Token: token})
+				template = nil
+				break
+			}
+			template.literals = append(template.literals, value[last:match[0]])
+			template.fields = append(template.fields, field)
+			last = match[1]
+		}
+		if template == nil || len(matches) == 0 {
+			static[key] = value
+			continue
+		}
+		template.literals = append(template.literals, value[last:])
+		templates[key] = template
+	}
+	return static, templates, unknown
+}
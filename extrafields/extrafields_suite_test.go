@@ -46,6 +46,72 @@ var _ = Describe("Extra Fields", func() {
 			})
 		})
 	})
+	Describe("ValidateExtraFields", func() {
+		It("should report each malformed pair with its position", func() {
+			fields, malformed := ValidateExtraFields("env:dev,broken,:nokey,team:core")
+			Expect(fields).To(Equal(map[string]string{"env": "dev", "team": "core"}))
+			Expect(malformed).To(HaveLen(2))
+			Expect(malformed[0]).To(Equal(&MalformedFieldError{Position: 2, Pair: "broken", Reason: "expected exactly one ':' between key and value"}))
+			Expect(malformed[1].(*MalformedFieldError).Position).To(Equal(3))
+			Expect(malformed[1].(*MalformedFieldError).Reason).To(Equal("empty key"))
+		})
+
+		It("should report empty values", func() {
+			fields, malformed := ValidateExtraFields("env: ,team:core")
+			Expect(fields).To(Equal(map[string]string{"team": "core"}))
+			Expect(malformed).To(HaveLen(1))
+			Expect(malformed[0].Error()).To(Equal("Extra field #1 [env:] is malformed: empty value"))
+		})
+
+		It("should keep the first occurrence of a duplicate key", func() {
+			fields, malformed := ValidateExtraFields("env:dev,env:prod")
+			Expect(fields).To(Equal(map[string]string{"env": "dev"}))
+			Expect(malformed).To(HaveLen(1))
+			Expect(malformed[0].(*MalformedFieldError).Position).To(Equal(2))
+			Expect(malformed[0].(*MalformedFieldError).Reason).To(Equal("duplicate key env"))
+		})
+
+		It("should report values containing colons", func() {
+			fields, malformed := ValidateExtraFields("url:http://example.com")
+			Expect(fields).To(BeEmpty())
+			Expect(malformed).To(HaveLen(1))
+			Expect(malformed[0].(*MalformedFieldError).Pair).To(Equal("url:http://example.com"))
+		})
+
+		It("should ignore empty pairs while counting them in positions", func() {
+			fields, malformed := ValidateExtraFields("env:dev,,oops,")
+			Expect(fields).To(Equal(map[string]string{"env": "dev"}))
+			Expect(malformed).To(HaveLen(1))
+			Expect(malformed[0].(*MalformedFieldError).Position).To(Equal(3))
+		})
+	})
+	Describe("ParseTemplates", func() {
+		It("should keep plain values static", func() {
+			static, templates, unknown := ParseTemplates(map[string]string{"env": "dev", "json": "{}"})
+			Expect(static).To(Equal(map[string]string{"env": "dev", "json": "{}"}))
+			Expect(templates).To(BeEmpty())
+			Expect(unknown).To(BeEmpty())
+		})
+
+		It("should render the event fields the tokens stand for", func() {
+			_, templates, unknown := ParseTemplates(map[string]string{"app": "{org_name}/{app_name}:{source_instance}"})
+			Expect(unknown).To(BeEmpty())
+			Expect(templates["app"].Render(map[string]interface{}{
+				"cf_org_name":     "org",
+				"cf_app_name":     "app",
+				"source_instance": "2",
+			})).To(Equal("org/app:2"))
+			Expect(templates["app"].Render(map[string]interface{}{})).To(Equal("/:"))
+		})
+
+		It("should report unknown tokens, keeping the value literal", func() {
+			static, templates, unknown := ParseTemplates(map[string]string{"note": "{app_name} {bogus}"})
+			Expect(templates).To(BeEmpty())
+			Expect(static).To(Equal(map[string]string{"note": "{app_name} {bogus}"}))
+			Expect(unknown).To(Equal([]error{&UnknownTokenError{Key: "note", Token: "bogus"}}))
+		})
+	})
+
 	Describe("FieldExist", func() {
 		Context("Called with existing value", func() {
 			It("should return true", func() {
@@ -2,23 +2,64 @@ package firehoseclient
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry-community/firehose-to-syslog/eventRouting"
 	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/retry"
 	"github.com/cloudfoundry-community/firehose-to-syslog/uaatokenrefresher"
 	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// rapidDisconnect is how soon after subscribing a disconnect hints at a
+	// subscription conflict rather than a network or load issue.
+	rapidDisconnect = 5 * time.Second
+	// shardBufferSize is the number of envelopes the connections of a
+	// sharded subscription queue for the event routing
+	shardBufferSize = 1024
+)
+
 type FirehoseNozzle struct {
 	errs         <-chan error
 	messages     <-chan *events.Envelope
-	consumer     *consumer.Consumer
+	consumers    []*consumer.Consumer
+	done         chan struct{}
 	eventRouting eventRouting.EventRouting
 	config       *FirehoseConfig
 	uaaRefresher consumer.TokenRefresher
+	stalls       *metrics.Counter
+	resubscribes *metrics.Counter
+	jitter       *rand.Rand
+
+	subscriptionID   string
+	subscribedAt     time.Time
+	rapidDisconnects int
+	conflicts        *metrics.Counter
+
+	reconnectAttempts int
+	reconnects        *metrics.Counter
+
+	// connected is set by the first envelope received after subscribing,
+	// cleared when the connections are closed
+	connected int32
+	// accepted is set once doppler accepted the stream after subscribing
+	accepted int32
+
+	// stop is closed by Stop, stopped once Start returned
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
 }
 
 type FirehoseConfig struct {
@@ -26,6 +67,59 @@ type FirehoseConfig struct {
 	InsecureSSLSkipVerify  bool
 	IdleTimeoutSeconds     time.Duration
 	FirehoseSubscriptionID string
+	// StallTimeout refreshes the token and resubscribes to the firehose
+	// when no envelope at all was received for that long. 0 disables the
+	// stall detection.
+	StallTimeout time.Duration
+	// Connections is the number of parallel connections opened with the
+	// same subscription ID, their envelopes being merged. Each connection
+	// reconnects on its own.
+	Connections int
+	// ResubscribeInterval tears down and re-establishes the subscription
+	// that often, plus a random delay up to ResubscribeJitter so that
+	// instances don't resubscribe together. 0 disables it.
+	ResubscribeInterval time.Duration
+	ResubscribeJitter   time.Duration
+	// ConflictResolveAfter appends a random suffix to the subscription ID
+	// after that many disconnects in a row happening right after doppler
+	// accepted the stream, the nozzle resubscribing following the reconnect
+	// settings. 0 keeps the subscription ID.
+	ConflictResolveAfter int
+	// ReconnectMaxRetries resubscribes after a disconnect up to that many
+	// times in a row, waiting from ReconnectBaseDelay, doubled on every
+	// attempt, up to ReconnectMaxDelay. 0 returns on the first disconnect,
+	// a negative value retries forever.
+	ReconnectMaxRetries int
+	ReconnectBaseDelay  time.Duration
+	ReconnectMaxDelay   time.Duration
+	// RLPGatewayURL is the endpoint of the RLP gateway consumed by the
+	// RLPGatewayNozzle, e.g. https://log-stream.<system domain>.
+	RLPGatewayURL string
+	// Proxy picks the proxy of the doppler and RLP gateway connections,
+	// the standard environment variables being used when nil.
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+const (
+	ConsumerFirehose   = "firehose"
+	ConsumerRLPGateway = "rlp-gateway"
+)
+
+// probeSuffix is appended to the subscription ID of probes, so that they
+// don't take a share of the envelopes of the running nozzles.
+const probeSuffix = "-validate"
+
+// Nozzle consumes envelopes and routes them until stopped or an
+// unrecoverable error.
+type Nozzle interface {
+	Start() error
+	Stop(timeout time.Duration) error
+	// Probe subscribes and unsubscribes right away, without routing any
+	// envelope, returning why the subscription failed if it did.
+	Probe(timeout time.Duration) error
+	// Connected tells whether envelopes are being received: from the first
+	// one after subscribing until the connection is lost or closed.
+	Connected() bool
 }
 
 func NewFirehoseNozzle(uaaR *uaatokenrefresher.UAATokenRefresher, eventRouting eventRouting.EventRouting, firehoseconfig *FirehoseConfig) *FirehoseNozzle {
@@ -35,37 +129,394 @@ func NewFirehoseNozzle(uaaR *uaatokenrefresher.UAATokenRefresher, eventRouting e
 		eventRouting: eventRouting,
 		config:       firehoseconfig,
 		uaaRefresher: uaaR,
+		stalls:       metrics.NewCounter("firehose_stall_reconnects"),
+		resubscribes: metrics.NewCounter("firehose_resubscribes"),
+		jitter:       rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		subscriptionID: firehoseconfig.FirehoseSubscriptionID,
+		conflicts:      metrics.NewCounter("firehose_subscription_conflicts"),
+		reconnects:     metrics.NewCounter("firehose_reconnects"),
+
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 }
 
+// Start consumes the firehose until an unrecoverable error, or until Stop
+// is called, returning nil then.
 func (f *FirehoseNozzle) Start() error {
+	defer close(f.stopped)
 	f.consumeFirehose()
 	err := f.routeEvent()
 	return err
 }
 
+// Stop closes the firehose connections once the event being routed, if
+// any, was handled, and waits up to timeout for Start to return.
+func (f *FirehoseNozzle) Stop(timeout time.Duration) error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	select {
+	case <-f.stopped:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("Timed out stopping the firehose nozzle")
+	}
+}
+
+// Probe opens a single firehose connection, succeeding once an envelope
+// was received or no error came up within timeout.
+func (f *FirehoseNozzle) Probe(timeout time.Duration) error {
+	c := consumer.New(
+		f.config.TrafficControllerURL,
+		&tls.Config{InsecureSkipVerify: f.config.InsecureSSLSkipVerify},
+		dopplerProxy(f.config.TrafficControllerURL, f.config.Proxy))
+	c.RefreshTokenFrom(f.uaaRefresher)
+	defer c.Close()
+
+	messages, errs := c.Firehose(f.subscriptionID+probeSuffix, currentToken(f.uaaRefresher))
+	select {
+	case <-messages:
+		return nil
+	case err := <-errs:
+		return err
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func (f *FirehoseNozzle) Connected() bool {
+	return atomic.LoadInt32(&f.connected) != 0
+}
+
 func (f *FirehoseNozzle) consumeFirehose() {
-	f.consumer = consumer.New(
+	connections := f.config.Connections
+	if connections < 1 {
+		connections = 1
+	}
+
+	f.consumers = nil
+	f.done = make(chan struct{})
+	f.subscribedAt = time.Now()
+	atomic.StoreInt32(&f.accepted, 0)
+	f.eventRouting.SetSubscriptionID(f.subscriptionID)
+	if connections == 1 {
+		c := f.newConsumer()
+		f.consumers = append(f.consumers, c)
+		f.messages, f.errs = c.Firehose(f.subscriptionID, currentToken(f.uaaRefresher))
+		return
+	}
+
+	messages := make(chan *events.Envelope, shardBufferSize)
+	errs := make(chan error, connections)
+	for i := 0; i < connections; i++ {
+		go f.shard(f.subscriptionID, messages, errs, f.done, rand.New(rand.NewSource(time.Now().UnixNano()+int64(i))))
+	}
+	f.messages, f.errs = messages, errs
+}
+
+func (f *FirehoseNozzle) newConsumer() *consumer.Consumer {
+	c := consumer.New(
 		f.config.TrafficControllerURL,
 		&tls.Config{InsecureSkipVerify: f.config.InsecureSSLSkipVerify},
-		nil)
-	f.consumer.RefreshTokenFrom(f.uaaRefresher)
-	f.consumer.SetIdleTimeout(time.Duration(f.config.IdleTimeoutSeconds) * time.Second)
-	f.messages, f.errs = f.consumer.Firehose(f.config.FirehoseSubscriptionID, "")
+		dopplerProxy(f.config.TrafficControllerURL, f.config.Proxy))
+	c.RefreshTokenFrom(f.uaaRefresher)
+	c.SetIdleTimeout(time.Duration(f.config.IdleTimeoutSeconds) * time.Second)
+	c.SetOnConnectCallback(func() { atomic.StoreInt32(&f.accepted, 1) })
+	return c
+}
+
+// dopplerProxy adapts proxy to noaa, which looks the proxy of the
+// trafficcontroller up with an http URL whatever its scheme: wss and https
+// trafficcontrollers are looked up with the https scheme instead.
+func dopplerProxy(trafficControllerURL string, proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	if proxy == nil {
+		return nil
+	}
+	scheme := "http"
+	if u, err := url.Parse(trafficControllerURL); err == nil && (u.Scheme == "wss" || u.Scheme == "https") {
+		scheme = "https"
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		target := *req.URL
+		if target.Scheme == "http" {
+			target.Scheme = scheme
+		}
+		return proxy(&http.Request{URL: &target})
+	}
+}
+
+// shard consumes one of the connections of the subscription, forwarding
+// its envelopes until the nozzle closes its connections. A disconnect only
+// reconnects this connection, following the reconnect settings; once they
+// are exhausted, the error is handed to the nozzle, which closes every
+// connection.
+func (f *FirehoseNozzle) shard(subscriptionID string, messages chan<- *events.Envelope, errs chan<- error, done <-chan struct{}, jitter *rand.Rand) {
+	attempts := 0
+	for {
+		c := f.newConsumer()
+		connMessages, connErrs := c.Firehose(subscriptionID, currentToken(f.uaaRefresher))
+		err := forward(connMessages, connErrs, messages, done, &attempts)
+		c.Close()
+		if err == nil {
+			return
+		}
+
+		maxRetries := f.config.ReconnectMaxRetries
+		if fatal(err) || maxRetries == 0 || (maxRetries > 0 && attempts >= maxRetries) {
+			select {
+			case errs <- err:
+			case <-done:
+			}
+			return
+		}
+		delay := reconnectDelay(f.config, jitter, attempts)
+		attempts++
+		f.reconnects.Inc()
+		logging.LogError(fmt.Sprintf("Error while reading from a firehose connection, reconnecting it in %s (attempt %d)", delay, attempts), err)
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return
+		}
+		f.refreshToken()
+	}
+}
+
+// forward sends the envelopes of one connection to messages, resetting the
+// reconnect attempts, until the connection fails, returning its error, or
+// the nozzle closes its connections, returning nil.
+func forward(connMessages <-chan *events.Envelope, connErrs <-chan error, messages chan<- *events.Envelope, done <-chan struct{}, attempts *int) error {
+	for {
+		select {
+		case envelope, ok := <-connMessages:
+			if !ok {
+				return errors.New("Firehose connection closed")
+			}
+			*attempts = 0
+			select {
+			case messages <- envelope:
+			case <-done:
+				return nil
+			}
+		case err, ok := <-connErrs:
+			if !ok {
+				return errors.New("Firehose connection closed")
+			}
+			return err
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// tokenGetter hands out a valid token, only fetching a new one when needed
+type tokenGetter interface {
+	GetToken() (string, error)
+}
+
+// getToken returns the token of refresher, fetching one unless it keeps a
+// valid one.
+func getToken(refresher consumer.TokenRefresher) (string, error) {
+	if getter, ok := refresher.(tokenGetter); ok {
+		return getter.GetToken()
+	}
+	return refresher.RefreshAuthToken()
+}
+
+// currentToken returns the token the consumer connects with, empty letting
+// the consumer fetch one itself. The consumer fetches a new one when the
+// token is rejected.
+func currentToken(refresher consumer.TokenRefresher) string {
+	authToken, err := getToken(refresher)
+	if err != nil {
+		logging.LogError("Failed to get a UAA token", err)
+		return ""
+	}
+	return authToken
+}
+
+func (f *FirehoseNozzle) closeConsumers() {
+	atomic.StoreInt32(&f.connected, 0)
+	close(f.done)
+	for _, c := range f.consumers {
+		c.Close()
+	}
 }
 
 func (f *FirehoseNozzle) routeEvent() error {
+	// The firehose carries metrics every component emits continuously, so
+	// a connection delivering no envelope at all is stalled, not quiet.
+	var stallCheck <-chan time.Time
+	if f.config.StallTimeout > 0 {
+		ticker := time.NewTicker(f.config.StallTimeout / 4)
+		defer ticker.Stop()
+		stallCheck = ticker.C
+	}
+	lastEnvelope := time.Now()
+
+	// Resubscribing lets Loggregator rebalance its sharding over the
+	// nozzle instances that joined or left since
+	var resubscribe <-chan time.Time
+	var resubscribeTimer *time.Timer
+	if f.config.ResubscribeInterval > 0 {
+		resubscribeTimer = time.NewTimer(f.resubscribeDelay())
+		defer resubscribeTimer.Stop()
+		resubscribe = resubscribeTimer.C
+	}
+
 	for {
 		select {
 		case envelope := <-f.messages:
+			lastEnvelope = time.Now()
+			f.reconnectAttempts = 0
+			atomic.StoreInt32(&f.connected, 1)
 			f.eventRouting.RouteEvent(envelope)
 		case err := <-f.errs:
+			f.handleConflict(err)
 			f.handleError(err)
+			if f.reconnect(err) {
+				lastEnvelope = time.Now()
+				continue
+			}
+			if f.stopping() {
+				return nil
+			}
 			return err
+		case <-stallCheck:
+			if time.Since(lastEnvelope) < f.config.StallTimeout {
+				continue
+			}
+			logging.LogError(fmt.Sprintf("No envelope received from the firehose for %s, resubscribing", f.config.StallTimeout), nil)
+			f.stalls.Inc()
+			f.closeConsumers()
+			f.refreshToken()
+			f.consumeFirehose()
+			lastEnvelope = time.Now()
+		case <-resubscribe:
+			logging.LogStd("Resubscribing to the firehose", true)
+			f.resubscribes.Inc()
+			f.closeConsumers()
+			f.consumeFirehose()
+			lastEnvelope = time.Now()
+			resubscribeTimer.Reset(f.resubscribeDelay())
+		case <-f.stop:
+			logging.LogStd("Closing the firehose connections", true)
+			f.closeConsumers()
+			return nil
 		}
 	}
 }
 
+// handleConflict diagnoses disconnects happening right after doppler
+// accepted the stream, the symptom of another process using the
+// subscription ID in a conflicting way, and switches to a suffixed ID after
+// ConflictResolveAfter of them in a row. The nozzle then resubscribes as
+// after any disconnect, following the reconnect settings.
+func (f *FirehoseNozzle) handleConflict(err error) {
+	// a rejected token or certificate is no conflict
+	if time.Since(f.subscribedAt) > rapidDisconnect || retry.IsFatal(err) {
+		f.rapidDisconnects = 0
+		return
+	}
+	// neither is a connection that was refused, or never got a stream
+	if atomic.LoadInt32(&f.accepted) == 0 {
+		return
+	}
+
+	f.rapidDisconnects++
+	f.conflicts.Inc()
+	logging.LogError(fmt.Sprintf("Disconnected right after subscribing with subscription ID [%s]. Another process may be using the same ID: make sure every nozzle deployment has its own ID, or see --auto-resolve-subscription-conflict", f.subscriptionID), err)
+	if f.config.ConflictResolveAfter > 0 && f.rapidDisconnects >= f.config.ConflictResolveAfter {
+		f.subscriptionID = fmt.Sprintf("%s-%04x", f.config.FirehoseSubscriptionID, f.jitter.Intn(0x10000))
+		f.rapidDisconnects = 0
+		logging.LogStd(fmt.Sprintf("Switching to subscription ID [%s]", f.subscriptionID), true)
+	}
+}
+
+// reconnect resubscribes after a disconnect, once the backoff delay elapsed
+// and the UAA token was refreshed. It returns false when err is fatal,
+// reconnecting is disabled or ReconnectMaxRetries attempts in a row failed;
+// the attempts count is reset by the first envelope received.
+func (f *FirehoseNozzle) reconnect(err error) bool {
+	maxRetries := f.config.ReconnectMaxRetries
+	if fatal(err) || maxRetries == 0 || (maxRetries > 0 && f.reconnectAttempts >= maxRetries) {
+		return false
+	}
+
+	delay := f.reconnectDelay(f.reconnectAttempts)
+	f.reconnectAttempts++
+	f.reconnects.Inc()
+	logging.LogStd(fmt.Sprintf("Reconnecting to the firehose in %s (attempt %d)", delay, f.reconnectAttempts), true)
+	select {
+	case <-time.After(delay):
+	case <-f.stop:
+		return false
+	}
+
+	f.refreshToken()
+	f.consumeFirehose()
+	return true
+}
+
+// fatal tells whether the connection failed with an error that reconnecting
+// won't fix, such as a token rejected once refreshed or an untrusted
+// certificate, logging its category then.
+func fatal(err error) bool {
+	if !retry.IsFatal(err) {
+		return false
+	}
+	category, _ := retry.Classify(err)
+	logging.LogError(fmt.Sprintf("Not reconnecting to the firehose after a fatal %s error", category), err)
+	return true
+}
+
+// refreshToken fetches a new UAA token before subscribing again, in case
+// the connection was lost to an expired one
+func (f *FirehoseNozzle) refreshToken() {
+	if _, err := f.uaaRefresher.RefreshAuthToken(); err != nil {
+		logging.LogError("Failed to refresh the UAA token before reconnecting", err)
+	}
+}
+
+func (f *FirehoseNozzle) stopping() bool {
+	select {
+	case <-f.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *FirehoseNozzle) reconnectDelay(attempt int) time.Duration {
+	return reconnectDelay(f.config, f.jitter, attempt)
+}
+
+// reconnectDelay returns ReconnectBaseDelay doubled attempt times, capped
+// at ReconnectMaxDelay, of which a random part up to half is taken off so
+// that instances don't reconnect together.
+func reconnectDelay(config *FirehoseConfig, jitter *rand.Rand, attempt int) time.Duration {
+	delay := config.ReconnectBaseDelay
+	for i := 0; i < attempt && delay < config.ReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > config.ReconnectMaxDelay {
+		delay = config.ReconnectMaxDelay
+	}
+	if delay/2 > 0 {
+		delay -= time.Duration(jitter.Int63n(int64(delay / 2)))
+	}
+	return delay
+}
+
+// resubscribeDelay returns the resubscribe interval plus a random jitter
+func (f *FirehoseNozzle) resubscribeDelay() time.Duration {
+	delay := f.config.ResubscribeInterval
+	if f.config.ResubscribeJitter > 0 {
+		delay += time.Duration(f.jitter.Int63n(int64(f.config.ResubscribeJitter)))
+	}
+	return delay
+}
+
 func (f *FirehoseNozzle) handleError(err error) {
 
 	switch {
@@ -80,7 +531,7 @@ func (f *FirehoseNozzle) handleError(err error) {
 	}
 
 	logging.LogError("Closing connection with traffic controller due to error", err)
-	f.consumer.Close()
+	f.closeConsumers()
 }
 
 func (f *FirehoseNozzle) handleMessage(envelope *events.Envelope) {
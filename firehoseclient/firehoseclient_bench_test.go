@@ -0,0 +1,111 @@
+package firehoseclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/eventRouting"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+type benchRefresher struct{}
+
+func (benchRefresher) RefreshAuthToken() (string, error) {
+	return "bearer bench", nil
+}
+
+// countingRouting counts the routed envelopes, closing done once target
+// were routed. The other methods are not called by the nozzle.
+type countingRouting struct {
+	eventRouting.EventRouting
+	routed int64
+	target int64
+	done   chan struct{}
+}
+
+func (r *countingRouting) RouteEvent(msg *events.Envelope) {
+	if atomic.AddInt64(&r.routed, 1) == r.target {
+		close(r.done)
+	}
+}
+
+func (r *countingRouting) SetSubscriptionID(subscriptionID string) {}
+
+func benchEnvelope(b *testing.B) []byte {
+	envelope := &events.Envelope{
+		Origin:    proto.String("rep"),
+		EventType: events.Envelope_LogMessage.Enum(),
+		Timestamp: proto.Int64(time.Now().UnixNano()),
+		LogMessage: &events.LogMessage{
+			Message:     []byte(strings.Repeat("x", 256)),
+			MessageType: events.LogMessage_OUT.Enum(),
+			Timestamp:   proto.Int64(time.Now().UnixNano()),
+			AppId:       proto.String("4630f6ba-8ddc-41f1-afea-1905332d6660"),
+			SourceType:  proto.String("APP"),
+		},
+	}
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// benchmarkShards routes b.N envelopes spread over shards connections, as
+// Loggregator does between the connections of a subscription.
+func benchmarkShards(b *testing.B, shards int) {
+	data := benchEnvelope(b)
+	var connections int32
+	// noaa sends its own origin
+	upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		count := b.N / shards
+		if atomic.AddInt32(&connections, 1) == 1 {
+			count += b.N % shards
+		}
+		for i := 0; i < count; i++ {
+			if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		}
+		// hold the connection until the nozzle closes it
+		ws.ReadMessage()
+	}))
+	defer server.Close()
+
+	routing := &countingRouting{target: int64(b.N), done: make(chan struct{})}
+	nozzle := NewFirehoseNozzle(nil, routing, &FirehoseConfig{
+		TrafficControllerURL:   "ws" + strings.TrimPrefix(server.URL, "http"),
+		FirehoseSubscriptionID: "bench",
+		Connections:            shards,
+	})
+	nozzle.uaaRefresher = benchRefresher{}
+
+	b.ResetTimer()
+	started := make(chan error, 1)
+	go func() { started <- nozzle.Start() }()
+	select {
+	case <-routing.done:
+	case err := <-started:
+		b.Fatalf("Nozzle stopped after %d envelopes, %v", atomic.LoadInt64(&routing.routed), err)
+	}
+	b.StopTimer()
+	if err := nozzle.Stop(5 * time.Second); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkSingleConnection(b *testing.B) { benchmarkShards(b, 1) }
+func BenchmarkTwoShards(b *testing.B)        { benchmarkShards(b, 2) }
+func BenchmarkFourShards(b *testing.B)       { benchmarkShards(b, 4) }
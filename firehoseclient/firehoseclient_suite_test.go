@@ -0,0 +1,13 @@
+package firehoseclient
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFirehoseclient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Firehoseclient Suite")
+}
@@ -0,0 +1,196 @@
+package firehoseclient
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/utils"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// connectProxy tunnels CONNECT requests to backend whatever their target,
+// keeping the targets it was asked for
+type connectProxy struct {
+	backend string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.mu.Unlock()
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		backend.Close()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		io.Copy(backend, conn)
+		backend.Close()
+	}()
+	io.Copy(conn, backend)
+	conn.Close()
+}
+
+func (p *connectProxy) connectTargets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+var _ = Describe("Firehose nozzle", func() {
+	It("should connect to doppler through the https proxy", func() {
+		data, err := proto.Marshal(&events.Envelope{
+			Origin:    proto.String("rep"),
+			EventType: events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{
+				Message:     []byte("hello"),
+				MessageType: events.LogMessage_OUT.Enum(),
+				Timestamp:   proto.Int64(time.Now().UnixNano()),
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		doppler := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			for i := 0; i < 3; i++ {
+				ws.WriteMessage(websocket.BinaryMessage, data)
+			}
+			ws.ReadMessage()
+		}))
+		defer doppler.Close()
+		connect := &connectProxy{backend: strings.TrimPrefix(doppler.URL, "https://")}
+		proxyServer := httptest.NewServer(connect)
+		defer proxyServer.Close()
+
+		proxy, err := utils.NewProxyFunc("", proxyServer.URL, "")
+		Expect(err).ToNot(HaveOccurred())
+		routing := &countingRouting{target: 3, done: make(chan struct{})}
+		// the doppler host only resolves through the proxy
+		nozzle := NewFirehoseNozzle(nil, routing, &FirehoseConfig{
+			TrafficControllerURL:   "wss://doppler.example.com:443",
+			InsecureSSLSkipVerify:  true,
+			FirehoseSubscriptionID: "proxied",
+			Proxy:                  proxy,
+		})
+		nozzle.uaaRefresher = benchRefresher{}
+
+		started := make(chan error, 1)
+		go func() { started <- nozzle.Start() }()
+		Eventually(routing.done, 5*time.Second).Should(BeClosed())
+		Expect(nozzle.Stop(5 * time.Second)).To(Succeed())
+		Expect(connect.connectTargets()).To(ConsistOf("doppler.example.com:443"))
+	})
+
+	It("should not reconnect once doppler rejected the token", func() {
+		doppler := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "You are not authorized", http.StatusUnauthorized)
+		}))
+		defer doppler.Close()
+		nozzle := NewFirehoseNozzle(nil, &countingRouting{done: make(chan struct{})}, &FirehoseConfig{
+			TrafficControllerURL:   "wss" + strings.TrimPrefix(doppler.URL, "https"),
+			InsecureSSLSkipVerify:  true,
+			FirehoseSubscriptionID: "unauthorized",
+			ReconnectMaxRetries:    -1,
+			ReconnectBaseDelay:     10 * time.Millisecond,
+			ReconnectMaxDelay:      10 * time.Millisecond,
+		})
+		nozzle.uaaRefresher = benchRefresher{}
+		reconnects := nozzle.reconnects.Value()
+
+		started := make(chan error, 1)
+		go func() { started <- nozzle.Start() }()
+		var err error
+		Eventually(started, 5*time.Second).Should(Receive(&err))
+		Expect(err).To(MatchError(ContainSubstring("Unauthorized error")))
+		Expect(nozzle.reconnects.Value()).To(Equal(reconnects))
+	})
+
+	It("should back off and switch the subscription ID of a conflicting subscription", func() {
+		var mu sync.Mutex
+		var paths []string
+		upgrader := websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		doppler := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths = append(paths, r.URL.Path)
+			mu.Unlock()
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			ws.Close()
+		}))
+		defer doppler.Close()
+		nozzle := NewFirehoseNozzle(nil, &countingRouting{done: make(chan struct{})}, &FirehoseConfig{
+			TrafficControllerURL:   "wss" + strings.TrimPrefix(doppler.URL, "https"),
+			InsecureSSLSkipVerify:  true,
+			FirehoseSubscriptionID: "conflict",
+			ConflictResolveAfter:   2,
+			ReconnectMaxRetries:    3,
+			ReconnectBaseDelay:     10 * time.Millisecond,
+			ReconnectMaxDelay:      10 * time.Millisecond,
+		})
+		nozzle.uaaRefresher = benchRefresher{}
+		reconnects, conflicts := nozzle.reconnects.Value(), nozzle.conflicts.Value()
+
+		started := make(chan error, 1)
+		go func() { started <- nozzle.Start() }()
+		Eventually(started, 5*time.Second).Should(Receive(HaveOccurred()))
+		Expect(nozzle.reconnects.Value() - reconnects).To(BeEquivalentTo(3))
+		Expect(nozzle.conflicts.Value() - conflicts).To(BeEquivalentTo(4))
+		mu.Lock()
+		defer mu.Unlock()
+		Expect(paths[0]).To(Equal("/firehose/conflict"))
+		Expect(paths).To(ContainElement(MatchRegexp(`^/firehose/conflict-[0-9a-f]{4}$`)))
+	})
+
+	It("should not diagnose a refused connection as a conflict", func() {
+		doppler := httptest.NewTLSServer(http.NotFoundHandler())
+		doppler.Close()
+		nozzle := NewFirehoseNozzle(nil, &countingRouting{done: make(chan struct{})}, &FirehoseConfig{
+			TrafficControllerURL:   "wss" + strings.TrimPrefix(doppler.URL, "https"),
+			InsecureSSLSkipVerify:  true,
+			FirehoseSubscriptionID: "refused",
+			ConflictResolveAfter:   1,
+			ReconnectMaxRetries:    2,
+			ReconnectBaseDelay:     10 * time.Millisecond,
+			ReconnectMaxDelay:      10 * time.Millisecond,
+		})
+		nozzle.uaaRefresher = benchRefresher{}
+		reconnects, conflicts := nozzle.reconnects.Value(), nozzle.conflicts.Value()
+
+		started := make(chan error, 1)
+		go func() { started <- nozzle.Start() }()
+		Eventually(started, 5*time.Second).Should(Receive(HaveOccurred()))
+		Expect(nozzle.reconnects.Value() - reconnects).To(BeEquivalentTo(2))
+		Expect(nozzle.conflicts.Value()).To(Equal(conflicts))
+		Expect(nozzle.subscriptionID).To(Equal("refused"))
+	})
+})
@@ -0,0 +1,239 @@
+package firehoseclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/eventRouting"
+	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/uaatokenrefresher"
+	"github.com/cloudfoundry/noaa/consumer"
+)
+
+// rlpGatewaySelectors are the v2 envelope types requested, the ones with a
+// v1 equivalent
+var rlpGatewaySelectors = []string{"log", "counter", "gauge", "timer"}
+
+// RLPGatewayNozzle consumes the loggregator v2 envelopes streamed by the RLP
+// gateway, converted into the v1 envelopes of the firehose so that the event
+// routing is the same. The subscription ID is used as the shard ID.
+//
+// The gateway ends streams periodically; they are reopened right away.
+// Failures are retried following the reconnect settings of the config.
+type RLPGatewayNozzle struct {
+	eventRouting eventRouting.EventRouting
+	config       *FirehoseConfig
+	uaaRefresher consumer.TokenRefresher
+	client       *http.Client
+	jitter       *rand.Rand
+	reconnects   *metrics.Counter
+	// connected is set while a stream accepted by the gateway is read
+	connected int32
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+func NewRLPGatewayNozzle(uaaR *uaatokenrefresher.UAATokenRefresher, eventRouting eventRouting.EventRouting, firehoseconfig *FirehoseConfig) *RLPGatewayNozzle {
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy := firehoseconfig.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	return &RLPGatewayNozzle{
+		eventRouting: eventRouting,
+		config:       firehoseconfig,
+		uaaRefresher: uaaR,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           proxy,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: firehoseconfig.InsecureSSLSkipVerify},
+			},
+		},
+		jitter:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		reconnects: metrics.NewCounter("firehose_reconnects"),
+
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+}
+
+// Start streams envelopes until an unrecoverable error, or until Stop is
+// called, returning nil then.
+func (n *RLPGatewayNozzle) Start() error {
+	defer close(n.stopped)
+	n.eventRouting.SetSubscriptionID(n.config.FirehoseSubscriptionID)
+
+	attempts := 0
+	for {
+		received, err := n.stream()
+		if n.ctx.Err() != nil {
+			return nil
+		}
+		if received {
+			attempts = 0
+		}
+		if err == nil {
+			continue
+		}
+
+		logging.LogError("Error while reading from the RLP gateway", err)
+		maxRetries := n.config.ReconnectMaxRetries
+		if maxRetries == 0 || (maxRetries > 0 && attempts >= maxRetries) {
+			return err
+		}
+		delay := reconnectDelay(n.config, n.jitter, attempts)
+		attempts++
+		n.reconnects.Inc()
+		logging.LogStd(fmt.Sprintf("Reconnecting to the RLP gateway in %s (attempt %d)", delay, attempts), true)
+		select {
+		case <-time.After(delay):
+		case <-n.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Stop closes the stream once the event being routed, if any, was handled,
+// and waits up to timeout for Start to return.
+func (n *RLPGatewayNozzle) Stop(timeout time.Duration) error {
+	n.cancel()
+	select {
+	case <-n.stopped:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("Timed out stopping the RLP gateway nozzle")
+	}
+}
+
+// Probe opens a stream and closes it once the gateway accepted it.
+func (n *RLPGatewayNozzle) Probe(timeout time.Duration) error {
+	authToken, err := getToken(n.uaaRefresher)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", n.readURL(n.config.FirehoseSubscriptionID+probeSuffix), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", authToken)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("RLP gateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (n *RLPGatewayNozzle) Connected() bool {
+	return atomic.LoadInt32(&n.connected) != 0
+}
+
+func (n *RLPGatewayNozzle) readURL(shardID string) string {
+	query := url.Values{"shard_id": {shardID}}
+	for _, selector := range rlpGatewaySelectors {
+		query.Set(selector, "")
+	}
+	return strings.TrimRight(n.config.RLPGatewayURL, "/") + "/v2/read?" + query.Encode()
+}
+
+// stream reads one server-sent events stream, routing the envelopes of
+// every batch. It returns whether any batch was received, and a nil error
+// when the gateway ended the stream after some.
+func (n *RLPGatewayNozzle) stream() (bool, error) {
+	authToken, err := getToken(n.uaaRefresher)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("GET", n.readURL(n.config.FirehoseSubscriptionID), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(n.ctx)
+	req.Header.Set("Authorization", authToken)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the next attempt connects with a new token
+		if _, err := n.uaaRefresher.RefreshAuthToken(); err != nil {
+			logging.LogError("Failed to refresh the UAA token", err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("RLP gateway returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	atomic.StoreInt32(&n.connected, 1)
+	defer atomic.StoreInt32(&n.connected, 0)
+
+	received := false
+	reader := bufio.NewReader(resp.Body)
+	var event string
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && received {
+			return true, nil
+		} else if err == io.EOF {
+			return false, errors.New("RLP gateway closed the stream before sending envelopes")
+		} else if err != nil {
+			return received, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// heartbeats and closing notices come as named events
+			if event == "" && len(data) > 0 {
+				n.routeBatch(strings.Join(data, "\n"))
+				received = true
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+func (n *RLPGatewayNozzle) routeBatch(data string) {
+	batch, err := decodeV2Batch(data)
+	if err != nil {
+		logging.LogError("Unable to decode an envelope batch from the RLP gateway", err)
+		return
+	}
+	for _, v2 := range batch {
+		for _, envelope := range toV1(v2) {
+			n.eventRouting.RouteEvent(envelope)
+		}
+	}
+}
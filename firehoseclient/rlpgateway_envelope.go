@@ -0,0 +1,214 @@
+package firehoseclient
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/utils"
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+)
+
+// v2Batch is the JSON encoding of the loggregator v2 envelope batches the
+// RLP gateway streams.
+type v2Batch struct {
+	Batch []v2Envelope `json:"batch"`
+}
+
+type v2Envelope struct {
+	Timestamp  jsonInt64         `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id"`
+	Tags       map[string]string `json:"tags"`
+	Log        *struct {
+		Payload []byte `json:"payload"`
+		Type    string `json:"type"`
+	} `json:"log"`
+	Counter *struct {
+		Name  string     `json:"name"`
+		Delta jsonUint64 `json:"delta"`
+		Total jsonUint64 `json:"total"`
+	} `json:"counter"`
+	Gauge *struct {
+		Metrics map[string]struct {
+			Unit  string  `json:"unit"`
+			Value float64 `json:"value"`
+		} `json:"metrics"`
+	} `json:"gauge"`
+	Timer *struct {
+		Name  string    `json:"name"`
+		Start jsonInt64 `json:"start"`
+		Stop  jsonInt64 `json:"stop"`
+	} `json:"timer"`
+}
+
+// jsonInt64 and jsonUint64 decode 64 bits integers, which the protobuf JSON
+// mapping encodes as strings.
+type jsonInt64 int64
+type jsonUint64 uint64
+
+func (i *jsonInt64) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	n, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	*i = jsonInt64(n)
+	return err
+}
+
+func (i *jsonUint64) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	n, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	*i = jsonUint64(n)
+	return err
+}
+
+// envelopeTags are the v2 tags v1 envelopes carry as fields of their own
+var envelopeTags = []string{"origin", "deployment", "job", "index", "ip"}
+
+// containerMetricGauges are the gauges Diego emits for app containers
+var containerMetricGauges = []string{"cpu", "memory", "disk", "memory_quota", "disk_quota"}
+
+// httpTimerTags are the tags of the http timers converted into HttpStartStop
+// fields
+var httpTimerTags = []string{"request_id", "peer_type", "method", "uri", "remote_address", "user_agent", "status_code", "content_length", "instance_id", "forwarded"}
+
+func decodeV2Batch(data string) ([]v2Envelope, error) {
+	var batch v2Batch
+	if err := json.Unmarshal([]byte(data), &batch); err != nil {
+		return nil, err
+	}
+	return batch.Batch, nil
+}
+
+// toV1 converts a v2 envelope into the v1 envelopes the event routing
+// consumes, following the loggregator conversion: a gauge becomes a
+// ContainerMetric when it carries the container gauges, a ValueMetric per
+// gauge otherwise, and http timers become HttpStartStop. Other envelopes
+// have no v1 equivalent and are skipped.
+func toV1(e v2Envelope) []*events.Envelope {
+	switch {
+	case e.Log != nil:
+		messageType := events.LogMessage_OUT
+		if e.Log.Type == "ERR" {
+			messageType = events.LogMessage_ERR
+		}
+		envelope := e.newV1(events.Envelope_LogMessage, "source_type")
+		envelope.LogMessage = &events.LogMessage{
+			Message:        e.Log.Payload,
+			MessageType:    &messageType,
+			Timestamp:      proto.Int64(int64(e.Timestamp)),
+			AppId:          proto.String(e.SourceID),
+			SourceType:     proto.String(e.Tags["source_type"]),
+			SourceInstance: proto.String(e.InstanceID),
+		}
+		return []*events.Envelope{envelope}
+	case e.Counter != nil:
+		envelope := e.newV1(events.Envelope_CounterEvent)
+		envelope.CounterEvent = &events.CounterEvent{
+			Name:  proto.String(e.Counter.Name),
+			Delta: proto.Uint64(uint64(e.Counter.Delta)),
+			Total: proto.Uint64(uint64(e.Counter.Total)),
+		}
+		return []*events.Envelope{envelope}
+	case e.Gauge != nil:
+		return e.gaugeToV1()
+	case e.Timer != nil && e.Timer.Name == "http":
+		envelope := e.newV1(events.Envelope_HttpStartStop, httpTimerTags...)
+		envelope.HttpStartStop = &events.HttpStartStop{
+			StartTimestamp: proto.Int64(int64(e.Timer.Start)),
+			StopTimestamp:  proto.Int64(int64(e.Timer.Stop)),
+			RequestId:      utils.ParseUUID(e.Tags["request_id"]),
+			PeerType:       events.PeerType(events.PeerType_value[e.Tags["peer_type"]]).Enum(),
+			Method:         events.Method(events.Method_value[e.Tags["method"]]).Enum(),
+			Uri:            proto.String(e.Tags["uri"]),
+			RemoteAddress:  proto.String(e.Tags["remote_address"]),
+			UserAgent:      proto.String(e.Tags["user_agent"]),
+			StatusCode:     proto.Int32(int32(atoi(e.Tags["status_code"]))),
+			ContentLength:  proto.Int64(int64(atoi(e.Tags["content_length"]))),
+			ApplicationId:  utils.ParseUUID(e.SourceID),
+			InstanceIndex:  proto.Int32(int32(atoi(e.InstanceID))),
+			InstanceId:     proto.String(e.Tags["instance_id"]),
+		}
+		if forwarded := e.Tags["forwarded"]; forwarded != "" {
+			envelope.HttpStartStop.Forwarded = strings.Split(forwarded, ",")
+		}
+		return []*events.Envelope{envelope}
+	}
+	return nil
+}
+
+func (e v2Envelope) gaugeToV1() []*events.Envelope {
+	metrics := e.Gauge.Metrics
+	isContainerMetric := true
+	for _, name := range containerMetricGauges {
+		if _, ok := metrics[name]; !ok {
+			isContainerMetric = false
+		}
+	}
+	if isContainerMetric {
+		envelope := e.newV1(events.Envelope_ContainerMetric)
+		envelope.ContainerMetric = &events.ContainerMetric{
+			ApplicationId:    proto.String(e.SourceID),
+			InstanceIndex:    proto.Int32(int32(atoi(e.InstanceID))),
+			CpuPercentage:    proto.Float64(metrics["cpu"].Value),
+			MemoryBytes:      proto.Uint64(uint64(metrics["memory"].Value)),
+			DiskBytes:        proto.Uint64(uint64(metrics["disk"].Value)),
+			MemoryBytesQuota: proto.Uint64(uint64(metrics["memory_quota"].Value)),
+			DiskBytesQuota:   proto.Uint64(uint64(metrics["disk_quota"].Value)),
+		}
+		return []*events.Envelope{envelope}
+	}
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var envelopes []*events.Envelope
+	for _, name := range names {
+		envelope := e.newV1(events.Envelope_ValueMetric)
+		envelope.ValueMetric = &events.ValueMetric{
+			Name:  proto.String(name),
+			Value: proto.Float64(metrics[name].Value),
+			Unit:  proto.String(metrics[name].Unit),
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes
+}
+
+// newV1 returns a v1 envelope with the common fields of e, the tags being
+// copied over except the ones the event carries as fields.
+func (e v2Envelope) newV1(eventType events.Envelope_EventType, consumedTags ...string) *events.Envelope {
+	origin := e.Tags["origin"]
+	if origin == "" {
+		origin = e.SourceID
+	}
+	envelope := &events.Envelope{
+		Origin:     proto.String(origin),
+		EventType:  eventType.Enum(),
+		Timestamp:  proto.Int64(int64(e.Timestamp)),
+		Deployment: proto.String(e.Tags["deployment"]),
+		Job:        proto.String(e.Tags["job"]),
+		Index:      proto.String(e.Tags["index"]),
+		Ip:         proto.String(e.Tags["ip"]),
+		Tags:       map[string]string{},
+	}
+	for k, v := range e.Tags {
+		envelope.Tags[k] = v
+	}
+	for _, k := range append(envelopeTags, consumedTags...) {
+		delete(envelope.Tags, k)
+	}
+	return envelope
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,122 @@
+// Package health reports whether the nozzle is alive and ready to forward
+// events, for liveness and readiness probes.
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check tells why a component isn't ready, nil when it is.
+type Check func() error
+
+// errNotStarted is the status of the components whose check wasn't set yet
+var errNotStarted = errors.New("not started")
+
+// Checker holds the readiness checks of the components of the nozzle, and
+// when an event was last forwarded, so that a stalled stream can be told
+// apart from a connected one.
+type Checker struct {
+	mu        sync.Mutex
+	names     []string
+	checks    map[string]Check
+	lastEvent func() time.Time
+}
+
+// NewChecker returns the checker of components, which aren't ready until
+// their check is set.
+func NewChecker(components ...string) *Checker {
+	c := &Checker{checks: make(map[string]Check, len(components))}
+	for _, name := range components {
+		c.Set(name, func() error { return errNotStarted })
+	}
+	return c
+}
+
+// Set sets the check of a component.
+func (c *Checker) Set(component string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.checks[component]; !ok {
+		c.names = append(c.names, component)
+	}
+	c.checks[component] = check
+}
+
+// SetLastEvent sets how the time of the last forwarded event is known.
+func (c *Checker) SetLastEvent(lastEvent func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastEvent = lastEvent
+}
+
+// ComponentStatus is the readiness of a component.
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the readiness of the nozzle: ready when every component is.
+type Report struct {
+	Status     string                     `json:"status"`
+	Time       time.Time                  `json:"time"`
+	LastEvent  *time.Time                 `json:"last_event"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Ready checks every component.
+func (c *Checker) Ready() Report {
+	c.mu.Lock()
+	names := append([]string(nil), c.names...)
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	lastEvent := c.lastEvent
+	c.mu.Unlock()
+
+	report := Report{Status: "ready", Time: time.Now().UTC(), Components: make(map[string]ComponentStatus, len(names))}
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			report.Status = "not ready"
+			report.Components[name] = ComponentStatus{Status: "down", Error: err.Error()}
+		} else {
+			report.Components[name] = ComponentStatus{Status: "up"}
+		}
+	}
+	if lastEvent != nil {
+		if t := lastEvent(); !t.IsZero() {
+			t = t.UTC()
+			report.LastEvent = &t
+		}
+	}
+	return report
+}
+
+// Handler serves /healthz, answering as long as the process runs, and
+// /readyz, answering 503 Service Unavailable unless every component is
+// ready, both in JSON.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "alive", "time": time.Now().UTC()})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := c.Ready()
+		status := http.StatusOK
+		if report.Status != "ready" {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,66 @@
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/health"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health", func() {
+	var checker *Checker
+
+	BeforeEach(func() {
+		checker = NewChecker("firehose", "syslog")
+	})
+
+	get := func(path string) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		checker.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		var body map[string]interface{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+		return recorder.Code, body
+	}
+
+	It("should report the process alive", func() {
+		code, body := get("/healthz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(HaveKeyWithValue("status", "alive"))
+	})
+
+	It("should not be ready until every check was set", func() {
+		checker.Set("syslog", func() error { return nil })
+		report := checker.Ready()
+		Expect(report.Status).To(Equal("not ready"))
+		Expect(report.Components).To(Equal(map[string]ComponentStatus{
+			"firehose": {Status: "down", Error: "not started"},
+			"syslog":   {Status: "up"},
+		}))
+	})
+
+	It("should answer 503 with the failing components", func() {
+		checker.Set("firehose", func() error { return nil })
+		checker.Set("syslog", func() error { return errors.New("write failed") })
+		code, body := get("/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(HaveKeyWithValue("status", "not ready"))
+		Expect(body["components"]).To(HaveKeyWithValue("syslog", map[string]interface{}{"status": "down", "error": "write failed"}))
+		Expect(body).To(HaveKeyWithValue("last_event", BeNil()))
+	})
+
+	It("should be ready with the time of the last event once every component is", func() {
+		lastEvent := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+		checker.Set("firehose", func() error { return nil })
+		checker.Set("syslog", func() error { return nil })
+		checker.SetLastEvent(func() time.Time { return lastEvent })
+		code, body := get("/readyz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(body).To(HaveKeyWithValue("status", "ready"))
+		Expect(body).To(HaveKeyWithValue("last_event", "2017-06-01T12:00:00Z"))
+	})
+})
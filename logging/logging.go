@@ -13,6 +13,24 @@ type Logging interface {
 	ShipEvents(map[string]interface{}, string)
 }
 
+// Flusher is implemented by the Logging clients holding events in memory,
+// flushed before the nozzle exits.
+type Flusher interface {
+	Flush()
+}
+
+// connectErrorer is implemented by the Logging clients telling why they
+// failed to connect
+type connectErrorer interface {
+	ConnectError() error
+}
+
+// Closer is implemented by the Logging clients holding files open, closed
+// once flushed before the nozzle exits.
+type Closer interface {
+	Close()
+}
+
 func LogStd(message string, force bool) {
 	Log(message, force, false, nil)
 }
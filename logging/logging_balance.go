@@ -0,0 +1,194 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+const (
+	SyslogBalanceFailover   = "failover"
+	SyslogBalanceRoundRobin = "roundrobin"
+)
+
+var backendFailures = metrics.NewCounterVec("syslog_backend_failures", "server")
+
+// ParseSyslogServers splits the comma separated addresses of --syslog-server
+func ParseSyslogServers(servers string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(servers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// syslogBackend is a syslog server of a balanced pool, with its own
+// connection. A backend whose write failed is down, its writer being nil,
+// until it is dialed again.
+type syslogBackend struct {
+	addr string
+
+	mu     sync.Mutex
+	writer syslogWriter
+}
+
+func (b *syslogBackend) current() syslogWriter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.writer
+}
+
+// fail marks the backend down unless writer was replaced meanwhile.
+func (b *syslogBackend) fail(writer syslogWriter, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.writer != writer {
+		return
+	}
+	b.writer = nil
+	writer.Close()
+	backendFailures.With(b.addr).Inc()
+	LogError(fmt.Sprintf("Syslog server [%s] failed, writing to the other servers", b.addr), err.Error())
+}
+
+// balancedPool writes to several syslog servers. In failover mode every
+// message goes to the first server up in the configured order, the ones
+// before it being dialed again every retryInterval; in round robin mode
+// messages are spread over the servers up. A failed write is retried on
+// the next server up.
+type balancedPool struct {
+	mode          string
+	dial          func(addr string) (syslogWriter, error)
+	retryInterval time.Duration
+	backends      []*syslogBackend
+	next          uint32
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newBalancedPool(config *LoggingConfig, addrs []string) (*balancedPool, error) {
+	p := &balancedPool{
+		mode: config.SyslogBalance,
+		dial: func(addr string) (syslogWriter, error) {
+			backendConfig := *config
+			backendConfig.SyslogServer = addr
+			return dialSyslog(&backendConfig)
+		},
+		retryInterval: config.SyslogFailback,
+		closing:       make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		p.backends = append(p.backends, &syslogBackend{addr: addr})
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// start dials every backend, failing when none can be reached, and redials
+// the ones that are down every retryInterval.
+func (p *balancedPool) start() error {
+	if p.redial() == 0 {
+		return fmt.Errorf("No reachable syslog server among [%s]", p.addrs())
+	}
+	if p.retryInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(p.retryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.redial()
+				case <-p.closing:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// redial dials the backends that are down, returning how many are up.
+func (p *balancedPool) redial() int {
+	up := 0
+	for _, backend := range p.backends {
+		if backend.current() != nil {
+			up++
+			continue
+		}
+		writer, err := p.dial(backend.addr)
+		if err != nil {
+			LogError(fmt.Sprintf("Unable to connect to syslog server [%s]!\n", backend.addr), err.Error())
+			continue
+		}
+		LogStd(fmt.Sprintf("Received hook to syslog server [%s]!\n", backend.addr), false)
+		backend.mu.Lock()
+		backend.writer = writer
+		backend.mu.Unlock()
+		up++
+	}
+	return up
+}
+
+func (p *balancedPool) addrs() string {
+	addrs := make([]string, len(p.backends))
+	for i, backend := range p.backends {
+		addrs[i] = backend.addr
+	}
+	return strings.Join(addrs, ", ")
+}
+
+func (p *balancedPool) WriteWithPriority(priority syslog.Priority, b []byte) (int, error) {
+	first := 0
+	if p.mode == SyslogBalanceRoundRobin {
+		first = int(atomic.AddUint32(&p.next, 1) % uint32(len(p.backends)))
+	}
+	for i := range p.backends {
+		backend := p.backends[(first+i)%len(p.backends)]
+		writer := backend.current()
+		if writer == nil {
+			continue
+		}
+		n, err := writer.WriteWithPriority(priority, b)
+		if err == nil {
+			return n, nil
+		}
+		backend.fail(writer, err)
+	}
+	return 0, errors.New("No syslog server available")
+}
+
+func (p *balancedPool) Flush() error {
+	var err error
+	for _, backend := range p.backends {
+		if writer := backend.current(); writer != nil {
+			if flushErr := flushWriter(writer); err == nil {
+				err = flushErr
+			}
+		}
+	}
+	return err
+}
+
+func (p *balancedPool) Close() error {
+	p.closeOnce.Do(func() { close(p.closing) })
+	for _, backend := range p.backends {
+		backend.mu.Lock()
+		if backend.writer != nil {
+			backend.writer.Close()
+			backend.writer = nil
+		}
+		backend.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"errors"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Balanced syslog servers", func() {
+	var (
+		writers map[string]*fakeSyslogWriter
+		down    map[string]bool
+	)
+
+	newPool := func(mode string) *balancedPool {
+		pool := &balancedPool{
+			mode: mode,
+			dial: func(addr string) (syslogWriter, error) {
+				if down[addr] {
+					return nil, errors.New("connection refused")
+				}
+				writers[addr] = &fakeSyslogWriter{}
+				return writers[addr], nil
+			},
+			closing: make(chan struct{}),
+		}
+		for _, addr := range []string{"primary:514", "secondary:514"} {
+			pool.backends = append(pool.backends, &syslogBackend{addr: addr})
+		}
+		return pool
+	}
+
+	write := func(pool *balancedPool, count int) {
+		for i := 0; i < count; i++ {
+			_, err := pool.WriteWithPriority(syslog.LOG_INFO, []byte("msg"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	BeforeEach(func() {
+		writers = make(map[string]*fakeSyslogWriter)
+		down = make(map[string]bool)
+	})
+
+	It("should parse comma separated servers", func() {
+		Expect(ParseSyslogServers(" a:514, b:514,")).To(Equal([]string{"a:514", "b:514"}))
+	})
+
+	It("should fail over to the next server and back once the first is dialed again", func() {
+		pool := newPool(SyslogBalanceFailover)
+		Expect(pool.start()).To(Succeed())
+		defer pool.Close()
+		write(pool, 3)
+		Expect(writers["primary:514"].messages).To(Equal(3))
+
+		primary := writers["primary:514"]
+		primary.err = errors.New("broken pipe")
+		write(pool, 2)
+		Expect(writers["secondary:514"].messages).To(Equal(2))
+		Expect(primary.closed).To(BeTrue())
+
+		pool.redial()
+		write(pool, 1)
+		Expect(writers["primary:514"].messages).To(Equal(1))
+		Expect(writers["secondary:514"].messages).To(Equal(2))
+	})
+
+	It("should spread messages over the servers in round robin", func() {
+		pool := newPool(SyslogBalanceRoundRobin)
+		Expect(pool.start()).To(Succeed())
+		defer pool.Close()
+		write(pool, 10)
+		Expect(writers["primary:514"].messages).To(Equal(5))
+		Expect(writers["secondary:514"].messages).To(Equal(5))
+	})
+
+	It("should start with a single reachable server", func() {
+		down["primary:514"] = true
+		pool := newPool(SyslogBalanceFailover)
+		Expect(pool.start()).To(Succeed())
+		defer pool.Close()
+		write(pool, 1)
+		Expect(writers["secondary:514"].messages).To(Equal(1))
+	})
+
+	It("should fail when no server is reachable", func() {
+		down["primary:514"], down["secondary:514"] = true, true
+		Expect(newPool(SyslogBalanceFailover).start()).To(MatchError(ContainSubstring("primary:514, secondary:514")))
+	})
+})
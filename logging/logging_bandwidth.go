@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/ratelimit"
+)
+
+const (
+	BandwidthPolicyBlock = "block"
+	BandwidthPolicyDrop  = "drop"
+)
+
+// DefaultShedPriority sheds metrics before logs before errors.
+const DefaultShedPriority = "ContainerMetric,ValueMetric,CounterEvent,HttpStartStop,LogMessage,Error"
+
+// ParseShedPriority splits a comma separated list of event types, ordered
+// from the first to shed to the last.
+func ParseShedPriority(shedPriority string) []string {
+	var eventTypes []string
+	for _, eventType := range strings.Split(shedPriority, ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	return eventTypes
+}
+
+// bandwidthLimiter shapes the outbound byte rate of the serialized stream.
+// With the block policy, writers wait for the bucket to refill (backpressure
+// up to the firehose consumer); with the drop policy, messages that don't
+// fit are shed and counted. Event types earlier in the shed priority keep a
+// larger part of the bucket in reserve for later ones, so that they are
+// shed first once the link saturates.
+type bandwidthLimiter struct {
+	bucket *ratelimit.TokenBucket
+	drop   bool
+	burst  float64
+	ranks  map[string]int
+
+	shed *metrics.Counter
+	rate *metrics.Gauge
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowBytes int
+}
+
+func newBandwidthLimiter(bytesPerSecond int, policy string, shedPriority []string) *bandwidthLimiter {
+	ranks := make(map[string]int, len(shedPriority))
+	for i, eventType := range shedPriority {
+		ranks[eventType] = len(shedPriority) - i
+	}
+	return &bandwidthLimiter{
+		bucket:      ratelimit.NewTokenBucket(float64(bytesPerSecond), 0),
+		drop:        policy == BandwidthPolicyDrop,
+		burst:       float64(bytesPerSecond),
+		ranks:       ranks,
+		shed:        metrics.NewCounter("bandwidth_shed_messages"),
+		rate:        metrics.NewGauge("outbound_bytes_per_second"),
+		windowStart: time.Now(),
+	}
+}
+
+// Allow reports whether a message of n bytes of the given event type may be
+// written now.
+func (b *bandwidthLimiter) Allow(n int, eventType string) bool {
+	if b.drop {
+		if !b.bucket.TakeAbove(float64(n), b.reserve(eventType)) {
+			b.shed.Inc()
+			return false
+		}
+	} else {
+		b.bucket.Wait(float64(n))
+	}
+	b.record(n)
+	return true
+}
+
+// reserve returns the tokens eventType must leave in the bucket. Event types
+// missing from the shed priority are never shed ahead of the others.
+func (b *bandwidthLimiter) reserve(eventType string) float64 {
+	rank, ok := b.ranks[eventType]
+	if !ok {
+		return 0
+	}
+	return b.burst * float64(rank) / float64(len(b.ranks)+1)
+}
+
+func (b *bandwidthLimiter) record(n int) {
+	now := time.Now()
+	b.mu.Lock()
+	if elapsed := now.Sub(b.windowStart); elapsed >= time.Second {
+		b.rate.Set(float64(b.windowBytes) / elapsed.Seconds())
+		b.windowStart = now
+		b.windowBytes = 0
+	}
+	b.windowBytes += n
+	b.mu.Unlock()
+}
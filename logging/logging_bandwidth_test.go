@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bandwidth limiter", func() {
+	Context("called with the drop policy", func() {
+		It("should shed messages over the limit and count them", func() {
+			limiter := newBandwidthLimiter(100, BandwidthPolicyDrop, nil)
+			before := limiter.shed.Value()
+			Expect(limiter.Allow(80, "LogMessage")).To(BeTrue())
+			Expect(limiter.Allow(80, "LogMessage")).To(BeFalse())
+			Expect(limiter.shed.Value()).To(Equal(before + 1))
+		})
+
+		It("should shed lower priority event types first", func() {
+			limiter := newBandwidthLimiter(100, BandwidthPolicyDrop, ParseShedPriority("ValueMetric, LogMessage"))
+			Expect(limiter.Allow(40, "LogMessage")).To(BeTrue())
+			// 60 tokens left: ValueMetric keeps 66 in reserve, LogMessage 33
+			Expect(limiter.Allow(10, "ValueMetric")).To(BeFalse())
+			Expect(limiter.Allow(10, "LogMessage")).To(BeTrue())
+			Expect(limiter.Allow(30, "LogMessage")).To(BeFalse())
+			Expect(limiter.Allow(30, "crash")).To(BeTrue())
+		})
+		It("should shed messages larger than one second of budget", func() {
+			limiter := newBandwidthLimiter(100, BandwidthPolicyDrop, nil)
+			before := limiter.shed.Value()
+			Expect(limiter.Allow(101, "LogMessage")).To(BeFalse())
+			Expect(limiter.shed.Value()).To(Equal(before + 1))
+		})
+	})
+
+	Context("called with the block policy", func() {
+		It("should never shed messages", func() {
+			limiter := newBandwidthLimiter(1000, BandwidthPolicyBlock, nil)
+			Expect(limiter.Allow(1000, "LogMessage")).To(BeTrue())
+			Expect(limiter.Allow(10, "LogMessage")).To(BeTrue())
+		})
+
+		It("should charge messages larger than one second of budget in full", func() {
+			limiter := newBandwidthLimiter(1000, BandwidthPolicyBlock, nil)
+			start := time.Now()
+			Expect(limiter.Allow(1500, "LogMessage")).To(BeTrue())
+			Expect(limiter.Allow(500, "LogMessage")).To(BeTrue())
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+	})
+})
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+const (
+	severityMask = 0x07
+	// batchBacklog is the number of batches kept while the server can't be
+	// written to, the oldest messages being dropped beyond it
+	batchBacklog = 10
+)
+
+// batchDropped counts the messages dropped because their batch couldn't be
+// written for too long
+var batchDropped = metrics.NewCounter("syslog_batch_dropped")
+
+// batchWriter accumulates messages, each framed with its own syslog header,
+// and sends them to the server in a single write once maxMessages are
+// buffered or every interval. It wraps a writer sending messages as they
+// are: framing the messages of a batch over a single write only makes sense
+// over stream connections.
+//
+// A batch that can't be written is kept and written again with the next
+// one, so a write failing half way may duplicate some messages.
+type batchWriter struct {
+	writer      syslogWriter
+	format      syslog.Formatter
+	facility    syslog.Priority
+	hostname    string
+	tag         string
+	maxMessages int
+
+	mu       sync.Mutex
+	messages []string
+	closed   chan struct{}
+}
+
+func newBatchWriter(writer syslogWriter, format syslog.Formatter, facility syslog.Priority, hostname string, tag string, maxMessages int, interval time.Duration) *batchWriter {
+	b := &batchWriter{
+		writer:      writer,
+		format:      format,
+		facility:    facility,
+		hostname:    hostname,
+		tag:         tag,
+		maxMessages: maxMessages,
+		closed:      make(chan struct{}),
+	}
+	if interval > 0 {
+		go b.flushEvery(interval)
+	}
+	return b
+}
+
+func (b *batchWriter) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to flush batched messages, %v\n", err)
+			}
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// WriteWithPriority frames the message like srslog would and adds it to the
+// batch, writing the batch when it is full.
+func (b *batchWriter) WriteWithPriority(p syslog.Priority, msg []byte) (int, error) {
+	line := string(msg)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	pri := b.facility&facilityMask | p&severityMask
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, b.format(pri, b.hostname, b.tag, line))
+	if len(b.messages) >= b.maxMessages {
+		return len(msg), b.flushLocked()
+	}
+	return len(msg), nil
+}
+
+func (b *batchWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flushLocked()
+}
+
+func (b *batchWriter) flushLocked() error {
+	if len(b.messages) == 0 {
+		return nil
+	}
+	if _, err := b.writer.WriteWithPriority(b.facility|syslog.LOG_INFO, []byte(strings.Join(b.messages, ""))); err != nil {
+		if backlog := batchBacklog * b.maxMessages; len(b.messages) > backlog {
+			dropped := len(b.messages) - backlog
+			b.messages = b.messages[dropped:]
+			batchDropped.Add(uint64(dropped))
+			return fmt.Errorf("%v, dropped the %d oldest batched messages", err, dropped)
+		}
+		return err
+	}
+	b.messages = b.messages[:0]
+	return nil
+}
+
+// Close writes the pending batch before closing the connection.
+func (b *batchWriter) Close() error {
+	close(b.closed)
+	err := b.Flush()
+	if closeErr := b.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
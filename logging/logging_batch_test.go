@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// failingWriter fails its writes until it is healed
+type failingWriter struct {
+	recordingWriter
+	failing bool
+}
+
+func (w *failingWriter) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	if w.failing {
+		return 0, errors.New("connection reset")
+	}
+	return w.recordingWriter.WriteWithPriority(p, b)
+}
+
+func rawFormat(p syslog.Priority, hostname, tag, content string) string {
+	return fmt.Sprintf("<%d>%s", p, content)
+}
+
+var _ = Describe("Batch writer", func() {
+	It("should write a full batch at once, each message keeping its header", func() {
+		writer := &recordingWriter{}
+		batch := newBatchWriter(writer, rawFormat, syslog.LOG_KERN, "nozzle-0", "doppler", 3, 0)
+
+		for _, message := range []string{"a", "b\n", "c", "d"} {
+			_, err := batch.WriteWithPriority(syslog.LOG_INFO, []byte(message))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(writer.received()).To(Equal([]string{"<6>a\n<6>b\n<6>c\n"}))
+
+		Expect(batch.Flush()).To(Succeed())
+		Expect(writer.received()).To(Equal([]string{"<6>a\n<6>b\n<6>c\n", "<6>d\n"}))
+	})
+
+	It("should flush a partial batch every interval", func() {
+		writer := &recordingWriter{}
+		batch := newBatchWriter(writer, rawFormat, syslog.LOG_KERN, "nozzle-0", "doppler", 100, 10*time.Millisecond)
+		defer batch.Close()
+
+		batch.WriteWithPriority(syslog.LOG_ERR, []byte("a"))
+		Eventually(writer.received).Should(Equal([]string{"<3>a\n"}))
+	})
+
+	It("should flush the pending batch when closed", func() {
+		writer := &recordingWriter{}
+		batch := newBatchWriter(writer, rawFormat, syslog.LOG_KERN, "nozzle-0", "doppler", 100, time.Hour)
+
+		batch.WriteWithPriority(syslog.LOG_INFO, []byte("a"))
+		Expect(batch.Close()).To(Succeed())
+		Expect(writer.received()).To(Equal([]string{"<6>a\n"}))
+	})
+
+	It("should keep a batch that failed to be written", func() {
+		writer := &failingWriter{failing: true}
+		batch := newBatchWriter(writer, rawFormat, syslog.LOG_KERN, "nozzle-0", "doppler", 2, 0)
+
+		batch.WriteWithPriority(syslog.LOG_INFO, []byte("a"))
+		_, err := batch.WriteWithPriority(syslog.LOG_INFO, []byte("b"))
+		Expect(err).To(HaveOccurred())
+
+		writer.failing = false
+		Expect(batch.Flush()).To(Succeed())
+		Expect(writer.received()).To(Equal([]string{"<6>a\n<6>b\n"}))
+	})
+
+	It("should drop the oldest messages beyond the backlog", func() {
+		writer := &failingWriter{failing: true}
+		batch := newBatchWriter(writer, rawFormat, syslog.LOG_KERN, "nozzle-0", "doppler", 1, 0)
+		dropped := batchDropped.Value()
+
+		for i := 0; i < batchBacklog+2; i++ {
+			batch.WriteWithPriority(syslog.LOG_INFO, []byte(fmt.Sprint(i)))
+		}
+		Expect(batchDropped.Value() - dropped).To(BeEquivalentTo(2))
+
+		writer.failing = false
+		Expect(batch.Flush()).To(Succeed())
+		Expect(writer.received()[0]).To(HavePrefix("<6>2\n"))
+	})
+
+	It("should only batch stream protocols", func() {
+		Expect(Batchable("tcp")).To(BeTrue())
+		Expect(Batchable(SecureProto)).To(BeTrue())
+		Expect(Batchable("udp")).To(BeFalse())
+	})
+})
@@ -0,0 +1,193 @@
+package logging
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+)
+
+// compressWriter sends syslog messages over a gzip compressed stream
+// connection. Messages are octet-counted (RFC 6587) inside the compressed
+// stream, so the receiver can split them once decompressed.
+//
+// gzip holds back what it is given until it has enough to compress, so the
+// stream is flushed every interval, or after every message without one, and
+// when Flush is called. A failed write closes the connection, the message
+// being written again over a new one, starting a new gzip stream.
+type compressWriter struct {
+	dial     func() (net.Conn, error)
+	format   syslog.Formatter
+	facility syslog.Priority
+	hostname string
+	tag      string
+	interval time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	gz     *gzip.Writer
+	closed chan struct{}
+}
+
+// dialCompressed connects to the syslog server of config, over TLS with
+// tcp+tls, the messages being compressed.
+func dialCompressed(config *LoggingConfig, format syslog.Formatter, hostname string, tag string) (*compressWriter, error) {
+	if !Batchable(config.SyslogProtocol) {
+		return nil, fmt.Errorf("Compression requires a stream syslog protocol, not %s", config.SyslogProtocol)
+	}
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", config.SyslogServer)
+	}
+	if config.SyslogProtocol == SecureProto {
+		tlsConfig := config.TLSConfig
+		if tlsConfig == nil {
+			var err error
+			if tlsConfig, err = NewSyslogTLSConfig(config.CertPath, "", "", "", ""); err != nil {
+				return nil, err
+			}
+		}
+		dial = func() (net.Conn, error) {
+			return tls.Dial("tcp", config.SyslogServer, tlsConfig)
+		}
+	}
+	w := newCompressWriter(dial, format, config.SyslogFacility, hostname, tag, config.BatchFlushInterval)
+	// connect right away, as srslog does, so that an unreachable server is
+	// reported at startup
+	w.mu.Lock()
+	err := w.connectLocked()
+	w.mu.Unlock()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func newCompressWriter(dial func() (net.Conn, error), format syslog.Formatter, facility syslog.Priority, hostname string, tag string, interval time.Duration) *compressWriter {
+	w := &compressWriter{
+		dial:     dial,
+		format:   format,
+		facility: facility,
+		hostname: hostname,
+		tag:      tag,
+		interval: interval,
+		closed:   make(chan struct{}),
+	}
+	if interval > 0 {
+		go w.flushEvery(interval)
+	}
+	return w
+}
+
+func (w *compressWriter) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to flush compressed messages, %v\n", err)
+			}
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// WriteWithPriority frames the message like srslog would, octet-counted,
+// and compresses it.
+func (w *compressWriter) WriteWithPriority(p syslog.Priority, msg []byte) (int, error) {
+	pri := w.facility&facilityMask | p&severityMask
+	line := strings.TrimRight(w.format(pri, w.hostname, w.tag, string(msg)), "\n")
+	framed := []byte(syslog.RFC5425MessageLengthFramer(line))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.closed:
+		return 0, errors.New("Compressed syslog writer closed")
+	default:
+	}
+	err := w.writeLocked(framed)
+	if err != nil {
+		// srslog retries once over a new connection as well
+		err = w.writeLocked(framed)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (w *compressWriter) writeLocked(framed []byte) error {
+	if err := w.connectLocked(); err != nil {
+		return err
+	}
+	_, err := w.gz.Write(framed)
+	if err == nil && w.interval <= 0 {
+		err = w.gz.Flush()
+	}
+	if err != nil {
+		w.disconnectLocked()
+	}
+	return err
+}
+
+// Flush sends the messages compressed since the last flush.
+func (w *compressWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Flush()
+	if err != nil {
+		w.disconnectLocked()
+	}
+	return err
+}
+
+// Close ends the gzip stream before closing the connection.
+func (w *compressWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.closed:
+		return nil
+	default:
+		close(w.closed)
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	if closeErr := w.conn.Close(); err == nil {
+		err = closeErr
+	}
+	w.conn, w.gz = nil, nil
+	return err
+}
+
+func (w *compressWriter) connectLocked() error {
+	if w.gz != nil {
+		return nil
+	}
+	conn, err := w.dial()
+	if err != nil {
+		return err
+	}
+	w.conn, w.gz = conn, gzip.NewWriter(conn)
+	return nil
+}
+
+func (w *compressWriter) disconnectLocked() {
+	w.conn.Close()
+	w.conn, w.gz = nil, nil
+}
@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// receiveCompressed decompresses the octet-counted messages sent over the
+// connections accepted by listener
+func receiveCompressed(listener net.Listener) chan string {
+	messages := make(chan string, 100)
+	go func() {
+		defer GinkgoRecover()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer GinkgoRecover()
+				defer conn.Close()
+				gz, err := gzip.NewReader(conn)
+				if err != nil {
+					return
+				}
+				r := bufio.NewReader(gz)
+				for {
+					var length int
+					if _, err := fmt.Fscanf(r, "%d ", &length); err != nil {
+						return
+					}
+					msg := make([]byte, length)
+					if _, err := io.ReadFull(r, msg); err != nil {
+						return
+					}
+					messages <- string(msg)
+				}
+			}()
+		}
+	}()
+	return messages
+}
+
+var _ = Describe("Compressed writer", func() {
+	var (
+		listener net.Listener
+		messages chan string
+	)
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		messages = receiveCompressed(listener)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	dial := func(interval time.Duration) *compressWriter {
+		writer, err := dialCompressed(&LoggingConfig{
+			SyslogProtocol:     "tcp",
+			SyslogServer:       listener.Addr().String(),
+			SyslogFacility:     syslog.LOG_LOCAL0,
+			BatchFlushInterval: interval,
+		}, rawFormat, "nozzle-0", "doppler")
+		Expect(err).NotTo(HaveOccurred())
+		return writer
+	}
+
+	It("should send octet-counted messages once flushed", func() {
+		writer := dial(time.Hour)
+		defer writer.Close()
+
+		_, err := writer.WriteWithPriority(syslog.LOG_INFO, []byte("hello\n"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = writer.WriteWithPriority(syslog.LOG_ERR, []byte("world"))
+		Expect(err).NotTo(HaveOccurred())
+		Consistently(messages, 100*time.Millisecond).ShouldNot(Receive())
+
+		Expect(writer.Flush()).To(Succeed())
+		Eventually(messages).Should(Receive(Equal(fmt.Sprintf("<%d>hello", 16*8+6))))
+		Eventually(messages).Should(Receive(Equal(fmt.Sprintf("<%d>world", 16*8+3))))
+	})
+
+	It("should flush every interval", func() {
+		writer := dial(10 * time.Millisecond)
+		defer writer.Close()
+
+		_, err := writer.WriteWithPriority(syslog.LOG_INFO, []byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(messages).Should(Receive(HaveSuffix("hello")))
+	})
+
+	It("should flush every message without interval", func() {
+		writer := dial(0)
+		defer writer.Close()
+
+		_, err := writer.WriteWithPriority(syslog.LOG_INFO, []byte("hello"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(messages).Should(Receive(HaveSuffix("hello")))
+	})
+
+	It("should refuse datagram protocols", func() {
+		_, err := dialCompressed(&LoggingConfig{SyslogProtocol: "udp", SyslogServer: listener.Addr().String()}, rawFormat, "nozzle-0", "doppler")
+		Expect(err).To(MatchError(ContainSubstring("stream syslog protocol")))
+	})
+})
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	EncodingUTF8   = "utf8"
+	EncodingLatin1 = "latin1"
+)
+
+// lineEncoder transcodes a formatted line right before it is written out.
+type lineEncoder func(line string) string
+
+func newLineEncoder(encoding string, replacement string) lineEncoder {
+	switch encoding {
+	case EncodingLatin1:
+		return func(line string) string {
+			return toLatin1(line, replacement)
+		}
+	default:
+		return func(line string) string {
+			return line
+		}
+	}
+}
+
+// encodingWriter transcodes what it writes to out, logrus writing one
+// formatted entry per write.
+type encodingWriter struct {
+	out    io.Writer
+	encode lineEncoder
+}
+
+func (w *encodingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.encode(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CheckOutputEncoding validates the output encoding and the replacement
+// used for runes it cannot represent.
+func CheckOutputEncoding(encoding string, replacement string) error {
+	switch encoding {
+	case EncodingUTF8:
+		return nil
+	case EncodingLatin1:
+		for _, r := range replacement {
+			if r > 0xff {
+				return fmt.Errorf("Replacement [%s] can't be encoded in %s", replacement, encoding)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported output encoding [%s]", encoding)
+	}
+}
+
+// toLatin1 encodes s as ISO-8859-1, substituting replacement for every rune
+// (or invalid UTF-8 byte) outside of the latin1 range.
+func toLatin1(s string, replacement string) string {
+	encodedReplacement := make([]byte, 0, len(replacement))
+	for _, r := range replacement {
+		encodedReplacement = append(encodedReplacement, byte(r))
+	}
+
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r <= 0xff {
+			encoded = append(encoded, byte(r))
+		} else {
+			encoded = append(encoded, encodedReplacement...)
+		}
+	}
+	return string(encoded)
+}
@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Output encoding", func() {
+	Context("called with utf8", func() {
+		It("should leave lines untouched", func() {
+			Expect(newLineEncoder(EncodingUTF8, "?")("héllo ☃")).To(Equal("héllo ☃"))
+		})
+	})
+
+	Context("called with latin1", func() {
+		It("should transcode latin1 runes to single bytes", func() {
+			Expect([]byte(newLineEncoder(EncodingLatin1, "?")("héllo"))).To(Equal([]byte{'h', 0xe9, 'l', 'l', 'o'}))
+		})
+
+		It("should replace runes outside of latin1", func() {
+			Expect(newLineEncoder(EncodingLatin1, "?")("snow☃man")).To(Equal("snow?man"))
+			Expect(newLineEncoder(EncodingLatin1, "")("snow☃man")).To(Equal("snowman"))
+		})
+
+		It("should replace invalid UTF-8", func() {
+			Expect(newLineEncoder(EncodingLatin1, "?")("a\xffb")).To(Equal("a?b"))
+		})
+	})
+
+	Context("called with latin1 on stdout", func() {
+		It("should transcode the events written to stdout", func() {
+			l := NewLogging(&LoggingConfig{
+				OutputType:          OutputStdout,
+				LogFormatterType:    "text",
+				OutputEncoding:      EncodingLatin1,
+				EncodingReplacement: "?",
+			}).(*LoggingLogrus)
+			Expect(l.Connect()).To(BeTrue())
+			writer, ok := l.Logger.Out.(*encodingWriter)
+			Expect(ok).To(BeTrue())
+			out := &bytes.Buffer{}
+			writer.out = out
+
+			l.ShipEvents(map[string]interface{}{"event_type": "LogMessage"}, "héllo ☃")
+			Expect(out.Bytes()).To(ContainSubstring("h\xe9llo ?"))
+		})
+	})
+
+	Context("CheckOutputEncoding", func() {
+		It("should reject unknown encodings", func() {
+			Expect(CheckOutputEncoding("ebcdic", "?")).ToNot(Succeed())
+		})
+
+		It("should reject a replacement that can't be encoded", func() {
+			Expect(CheckOutputEncoding(EncodingLatin1, "☃")).ToNot(Succeed())
+			Expect(CheckOutputEncoding(EncodingLatin1, "¿")).To(Succeed())
+		})
+	})
+})
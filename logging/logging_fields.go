@@ -0,0 +1,20 @@
+package logging
+
+import (
+	"regexp"
+)
+
+// filterFieldNames returns the fields whose names match allow. The original
+// map is left untouched as it may still be in use by the caller.
+func filterFieldNames(fields map[string]interface{}, allow *regexp.Regexp) map[string]interface{} {
+	if allow == nil {
+		return fields
+	}
+	filtered := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if allow.MatchString(name) {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Field name filtering", func() {
+	var fields map[string]interface{}
+
+	BeforeEach(func() {
+		fields = map[string]interface{}{
+			"cf_app_name":  "app",
+			"cf_org_name":  "org",
+			"tag_region_1": "eu",
+			"tag_region_2": "us",
+			"origin":       "rep",
+		}
+	})
+
+	It("should keep every field without a pattern", func() {
+		Expect(filterFieldNames(fields, nil)).To(Equal(fields))
+	})
+
+	It("should only keep matching field names", func() {
+		filtered := filterFieldNames(fields, regexp.MustCompile(`^cf_(app|org)_name$`))
+		Expect(filtered).To(Equal(map[string]interface{}{
+			"cf_app_name": "app",
+			"cf_org_name": "org",
+		}))
+		Expect(fields).To(HaveLen(5))
+	})
+})
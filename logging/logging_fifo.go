@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+// fifoReopenInterval throttles attempts to reopen the FIFO while no reader
+// is attached, so that every message doesn't pay for a failed open(2).
+const fifoReopenInterval = time.Second
+
+// FifoHook writes formatted entries, one per line, to a named pipe.
+//
+// Opening a FIFO for writing fails while no reader is attached: messages
+// are dropped (and counted) until a reader shows up. Once a reader is
+// attached, writes block when the pipe is full, applying backpressure. If
+// the reader goes away, the pipe is closed and reopened on a later write.
+type FifoHook struct {
+	path     string
+	mu       sync.Mutex
+	file     *os.File
+	lastOpen time.Time
+	encode   lineEncoder
+	dropped  *metrics.Counter
+}
+
+func newFifoHook(path string, encode lineEncoder) (*FifoHook, error) {
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return nil, fmt.Errorf("Unable to create FIFO %s: %s", path, err)
+		}
+	case err != nil:
+		return nil, err
+	case info.Mode()&os.ModeNamedPipe == 0:
+		return nil, fmt.Errorf("%s exists and is not a FIFO", path)
+	}
+
+	return &FifoHook{
+		path:    path,
+		encode:  encode,
+		dropped: metrics.NewCounter("fifo_dropped_messages"),
+	}, nil
+}
+
+func (hook *FifoHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read entry, %v", err)
+		return err
+	}
+	line = hook.encode(line)
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+
+	if hook.file == nil && !hook.open() {
+		hook.dropped.Inc()
+		return nil
+	}
+
+	// os.File.Write loops over partial writes until the whole line is out
+	if _, err := hook.file.WriteString(line); err != nil {
+		hook.file.Close()
+		hook.file = nil
+		hook.dropped.Inc()
+	}
+	return nil
+}
+
+func (hook *FifoHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *FifoHook) open() bool {
+	if time.Since(hook.lastOpen) < fifoReopenInterval {
+		return false
+	}
+	hook.lastOpen = time.Now()
+
+	// O_NONBLOCK makes open fail with ENXIO instead of hanging when there
+	// is no reader; writes are switched back to blocking afterwards.
+	fd, err := syscall.Open(hook.path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return false
+	}
+	hook.file = os.NewFile(uintptr(fd), hook.path)
+	LogStd(fmt.Sprintf("Reader attached to FIFO [%s]", hook.path), false)
+	return true
+}
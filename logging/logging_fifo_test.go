@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package logging
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FifoHook", func() {
+	var (
+		dir  string
+		path string
+		hook *FifoHook
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "fifo")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "events")
+		hook, err = newFifoHook(path, newLineEncoder(EncodingUTF8, ""))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	entry := func(msg string) *logrus.Entry {
+		logger := logrus.New()
+		logger.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+		return &logrus.Entry{Logger: logger, Data: logrus.Fields{}, Message: msg, Level: logrus.InfoLevel}
+	}
+
+	It("should create the FIFO", func() {
+		info, err := os.Stat(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode() & os.ModeNamedPipe).ToNot(BeZero())
+	})
+
+	It("should refuse a path that is not a FIFO", func() {
+		regular := filepath.Join(dir, "regular")
+		Expect(ioutil.WriteFile(regular, nil, 0600)).To(Succeed())
+		_, err := newFifoHook(regular, newLineEncoder(EncodingUTF8, ""))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should drop messages while no reader is attached", func() {
+		before := hook.dropped.Value()
+		Expect(hook.Fire(entry("nobody listens"))).To(Succeed())
+		Expect(hook.dropped.Value()).To(Equal(before + 1))
+	})
+
+	It("should write lines to an attached reader", func() {
+		fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+		Expect(err).ToNot(HaveOccurred())
+		reader := os.NewFile(uintptr(fd), path)
+		defer reader.Close()
+
+		Expect(hook.Fire(entry("hello"))).To(Succeed())
+		Expect(syscall.SetNonblock(fd, false)).To(Succeed())
+		line, err := bufio.NewReader(reader).ReadString('\n')
+		Expect(err).ToNot(HaveOccurred())
+		Expect(line).To(ContainSubstring("msg=hello"))
+	})
+})
@@ -0,0 +1,227 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+const (
+	OutputFile = "file"
+
+	// fileFlushInterval bounds how long lines wait in the write buffer
+	fileFlushInterval = time.Second
+	// fileBufferSize is the size of the write buffer
+	fileBufferSize = 64 * 1024
+	// fileBackupTimeFormat suffixes rotated files, sorting them by age
+	fileBackupTimeFormat = "20060102T150405.000000000"
+)
+
+// FileHook appends formatted entries, one per line, to a local file,
+// rotated once it grows over FileMaxBytes or gets older than FileMaxAge.
+// Rotated files are renamed with the rotation time as suffix, the oldest
+// being removed beyond FileMaxBackups. Lines are buffered and flushed every
+// fileFlushInterval, on rotation and on Flush.
+type FileHook struct {
+	outputHealth
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+	encode     lineEncoder
+
+	mu       sync.Mutex
+	file     *os.File
+	buffer   *bufio.Writer
+	size     int64
+	openedAt time.Time
+	closed   bool
+
+	rotations *metrics.Counter
+	dropped   *metrics.Counter
+	closing   chan struct{}
+}
+
+func newFileHook(config *LoggingConfig) (*FileHook, error) {
+	hook := &FileHook{
+		path:       config.FilePath,
+		maxBytes:   config.FileMaxBytes,
+		maxAge:     config.FileMaxAge,
+		maxBackups: config.FileMaxBackups,
+		encode:     newLineEncoder(config.OutputEncoding, config.EncodingReplacement),
+		rotations:  metrics.NewCounter("file_rotations"),
+		dropped:    metrics.NewCounter("file_dropped_messages"),
+		closing:    make(chan struct{}),
+	}
+	if err := hook.open(); err != nil {
+		return nil, err
+	}
+	go hook.flushEvery(fileFlushInterval)
+	return hook, nil
+}
+
+func (hook *FileHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read entry, %v", err)
+		return err
+	}
+	line = hook.encode(line)
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.closed {
+		hook.dropped.Inc()
+		return nil
+	}
+	if hook.due(int64(len(line))) {
+		if err := hook.rotate(); err != nil {
+			hook.record(err)
+			LogError(fmt.Sprintf("Unable to rotate file [%s]", hook.path), err.Error())
+		}
+	}
+	if hook.file == nil {
+		hook.dropped.Inc()
+		return nil
+	}
+	n, err := hook.buffer.WriteString(line)
+	hook.size += int64(n)
+	hook.record(err)
+	if err != nil {
+		hook.dropped.Inc()
+	}
+	return nil
+}
+
+func (hook *FileHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// due tells whether the file must be rotated before writing length more
+// bytes. A file is never rotated empty, whatever the length of the line.
+func (hook *FileHook) due(length int64) bool {
+	if hook.file == nil {
+		return true
+	}
+	if hook.size == 0 {
+		return false
+	}
+	if hook.maxBytes > 0 && hook.size+length > hook.maxBytes {
+		return true
+	}
+	return hook.maxAge > 0 && time.Since(hook.openedAt) >= hook.maxAge
+}
+
+// open opens the file for appending. The caller holds the lock, but while
+// constructing the hook.
+func (hook *FileHook) open() error {
+	file, err := os.OpenFile(hook.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("Unable to open file %s: %s", hook.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	hook.file = file
+	hook.buffer = bufio.NewWriterSize(file, fileBufferSize)
+	hook.size = info.Size()
+	hook.openedAt = time.Now()
+	return nil
+}
+
+// rotate closes the current file, renames it after the rotation time and
+// opens a new one, removing the oldest rotated files beyond maxBackups. The
+// caller holds the lock.
+func (hook *FileHook) rotate() error {
+	if hook.file != nil {
+		hook.closeFile()
+		backup := hook.path + "." + time.Now().Format(fileBackupTimeFormat)
+		if err := os.Rename(hook.path, backup); err != nil {
+			return err
+		}
+		hook.rotations.Inc()
+		hook.removeBackups()
+	}
+	return hook.open()
+}
+
+// removeBackups removes the oldest rotated files beyond maxBackups, 0
+// keeping them all.
+func (hook *FileHook) removeBackups() {
+	if hook.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(hook.path + ".[0-9]*")
+	if err != nil || len(backups) <= hook.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-hook.maxBackups] {
+		if err := os.Remove(backup); err != nil {
+			LogError(fmt.Sprintf("Unable to remove rotated file [%s]", backup), err.Error())
+		}
+	}
+}
+
+// closeFile flushes and closes the current file. The caller holds the lock.
+func (hook *FileHook) closeFile() error {
+	err := hook.buffer.Flush()
+	if closeErr := hook.file.Close(); err == nil {
+		err = closeErr
+	}
+	hook.file = nil
+	hook.buffer = nil
+	return err
+}
+
+func (hook *FileHook) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := hook.Flush(); err != nil {
+				LogError(fmt.Sprintf("Unable to flush file [%s]", hook.path), err.Error())
+			}
+		case <-hook.closing:
+			return
+		}
+	}
+}
+
+// Flush writes the buffered lines to the file.
+func (hook *FileHook) Flush() error {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.file == nil {
+		return nil
+	}
+	err := hook.buffer.Flush()
+	hook.record(err)
+	return err
+}
+
+// Close flushes and closes the file, the entries fired afterwards being
+// dropped.
+func (hook *FileHook) Close() error {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.closed {
+		return nil
+	}
+	hook.closed = true
+	close(hook.closing)
+	if hook.file == nil {
+		return nil
+	}
+	return hook.closeFile()
+}
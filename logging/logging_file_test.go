@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileHook", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "file")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "events.log")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	newHook := func(maxBytes int64, maxAge time.Duration, maxBackups int) *FileHook {
+		hook, err := newFileHook(&LoggingConfig{
+			FilePath:       path,
+			FileMaxBytes:   maxBytes,
+			FileMaxAge:     maxAge,
+			FileMaxBackups: maxBackups,
+			OutputEncoding: EncodingUTF8,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		return hook
+	}
+
+	entry := func(msg string) *logrus.Entry {
+		logger := logrus.New()
+		logger.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+		return &logrus.Entry{Logger: logger, Data: logrus.Fields{}, Message: msg, Level: logrus.InfoLevel}
+	}
+
+	lines := func(file string) []string {
+		content, err := ioutil.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+		return lines
+	}
+
+	backups := func() []string {
+		matches, err := filepath.Glob(path + ".*")
+		Expect(err).ToNot(HaveOccurred())
+		return matches
+	}
+
+	It("should append the lines to the file once flushed", func() {
+		hook := newHook(0, 0, 0)
+		Expect(hook.Fire(entry("first"))).To(Succeed())
+		Expect(hook.Fire(entry("second"))).To(Succeed())
+		Expect(hook.Close()).To(Succeed())
+
+		Expect(lines(path)).To(Equal([]string{"level=info msg=first", "level=info msg=second"}))
+	})
+
+	It("should rotate over the max size, keeping max backups", func() {
+		hook := newHook(50, 0, 2)
+		for i := 0; i < 10; i++ {
+			Expect(hook.Fire(entry(fmt.Sprintf("line-%d", i)))).To(Succeed())
+		}
+		Expect(hook.Close()).To(Succeed())
+
+		Expect(backups()).To(HaveLen(2))
+		Expect(hook.rotations.Value()).To(BeNumerically(">=", 4))
+		content, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(content)).To(BeNumerically("<=", 50))
+		Expect(lines(path)).To(ContainElement("level=info msg=line-9"))
+	})
+
+	It("should rotate once older than the max age", func() {
+		hook := newHook(0, 50*time.Millisecond, 0)
+		Expect(hook.Fire(entry("old"))).To(Succeed())
+		time.Sleep(100 * time.Millisecond)
+		Expect(hook.Fire(entry("new"))).To(Succeed())
+		Expect(hook.Close()).To(Succeed())
+
+		Expect(backups()).To(HaveLen(1))
+		Expect(lines(backups()[0])).To(Equal([]string{"level=info msg=old"}))
+	})
+
+	It("should keep every line whole under concurrent writes and rotations", func() {
+		hook := newHook(1024, 0, 0)
+		var wg sync.WaitGroup
+		for writer := 0; writer < 4; writer++ {
+			wg.Add(1)
+			go func(writer int) {
+				defer wg.Done()
+				for i := 0; i < 250; i++ {
+					hook.Fire(entry(fmt.Sprintf("writer-%d-%d", writer, i)))
+				}
+			}(writer)
+		}
+		wg.Wait()
+		Expect(hook.Close()).To(Succeed())
+
+		written := 0
+		for _, file := range append(backups(), path) {
+			for _, line := range lines(file) {
+				Expect(line).To(MatchRegexp(`^level=info msg=writer-\d-\d+$`))
+				written++
+			}
+		}
+		Expect(written).To(Equal(1000))
+	})
+
+	It("should drop entries fired once closed", func() {
+		hook := newHook(0, 0, 0)
+		Expect(hook.Close()).To(Succeed())
+		before := hook.dropped.Value()
+		Expect(hook.Fire(entry("late"))).To(Succeed())
+		Expect(hook.dropped.Value()).To(Equal(before + 1))
+	})
+})
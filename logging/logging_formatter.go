@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var formatterTypes = []string{"text", "json", "logfmt"}
+
+// ParseFormatOverrides parses a comma separated list of sourcetype:formatter
+// pairs, e.g. "RTR:logfmt,APP:json".
+func ParseFormatOverrides(formatOverrides string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, pair := range strings.Split(formatOverrides, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Format override [%s] must be sourcetype:formatter", pair)
+		}
+		sourceType, formatterType := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if !isFormatterType(formatterType) {
+			return nil, fmt.Errorf("Rejected formatter [%s] - Valid formatters: %s", formatterType, strings.Join(formatterTypes, ", "))
+		}
+		overrides[sourceType] = formatterType
+	}
+	return overrides, nil
+}
+
+// ParseExtraFormats parses a comma separated list of formatters every event
+// is additionally sent in, e.g. "text,logfmt".
+func ParseExtraFormats(extraFormats string) ([]string, error) {
+	var formats []string
+	for _, formatterType := range strings.Split(extraFormats, ",") {
+		if formatterType = strings.TrimSpace(formatterType); formatterType == "" {
+			continue
+		}
+		if !isFormatterType(formatterType) {
+			return nil, fmt.Errorf("Rejected formatter [%s] - Valid formatters: %s", formatterType, strings.Join(formatterTypes, ", "))
+		}
+		formats = append(formats, formatterType)
+	}
+	return formats, nil
+}
+
+func isFormatterType(formatterType string) bool {
+	for _, t := range formatterTypes {
+		if t == formatterType {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceTypeFormatter formats entries with the formatter configured for
+// their source_type field, falling back to the global formatter. A source
+// type such as APP/PROC/WEB also matches an override for APP.
+type sourceTypeFormatter struct {
+	defaultFormatter logrus.Formatter
+	overrides        map[string]logrus.Formatter
+}
+
+func newSourceTypeFormatter(defaultFormatter logrus.Formatter, overrides map[string]string, newFormatter func(string) logrus.Formatter) logrus.Formatter {
+	if len(overrides) == 0 {
+		return defaultFormatter
+	}
+	f := &sourceTypeFormatter{
+		defaultFormatter: defaultFormatter,
+		overrides:        make(map[string]logrus.Formatter, len(overrides)),
+	}
+	for sourceType, formatterType := range overrides {
+		f.overrides[sourceType] = newFormatter(formatterType)
+	}
+	return f
+}
+
+func (f *sourceTypeFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	sourceType, _ := entry.Data["source_type"].(string)
+	if formatter, ok := f.overrides[sourceType]; ok {
+		return formatter.Format(entry)
+	}
+	if i := strings.Index(sourceType, "/"); i > 0 {
+		if formatter, ok := f.overrides[sourceType[:i]]; ok {
+			return formatter.Format(entry)
+		}
+	}
+	return f.defaultFormatter.Format(entry)
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Format overrides", func() {
+	Context("ParseFormatOverrides", func() {
+		It("should parse source type and formatter pairs", func() {
+			overrides, err := ParseFormatOverrides("RTR:logfmt, APP/PROC/WEB:text")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(overrides).To(Equal(map[string]string{"RTR": "logfmt", "APP/PROC/WEB": "text"}))
+		})
+
+		It("should reject unknown formatters", func() {
+			_, err := ParseFormatOverrides("RTR:xml")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("called with an override", func() {
+		var formatter logrus.Formatter
+
+		BeforeEach(func() {
+			formatter = newSourceTypeFormatter(&logrus.JSONFormatter{}, map[string]string{"RTR": "logfmt", "APP": "text"}, GetLogFormatter)
+		})
+
+		format := func(sourceType string) string {
+			entry := logrus.NewEntry(logrus.New()).WithField("source_type", sourceType)
+			entry.Message = "hello"
+			line, err := formatter.Format(entry)
+			Expect(err).ToNot(HaveOccurred())
+			return string(line)
+		}
+
+		It("should use the override for the source type", func() {
+			Expect(format("RTR")).To(ContainSubstring("msg=hello"))
+		})
+
+		It("should match the source type prefix", func() {
+			Expect(format("APP/PROC/WEB")).To(ContainSubstring("msg=hello"))
+		})
+
+		It("should use the global formatter otherwise", func() {
+			Expect(format("CELL")).To(ContainSubstring(`"msg":"hello"`))
+		})
+	})
+
+	Context("extra formats", func() {
+		It("should parse a list of formatters", func() {
+			formats, err := ParseExtraFormats("text, logfmt")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(formats).To(Equal([]string{"text", "logfmt"}))
+		})
+
+		It("should reject unknown formatters", func() {
+			_, err := ParseExtraFormats("json,rfc5424")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should send one message per format", func() {
+			writer := &fakeSyslogWriter{}
+			hook := newSyslogHook(writer, &LoggingConfig{ExtraFormats: []string{"logfmt"}})
+			logger := logrus.New()
+			logger.Formatter = &logrus.JSONFormatter{}
+			entry := logrus.NewEntry(logger)
+			entry.Message = "hello"
+			Expect(hook.Fire(entry)).To(Succeed())
+			Expect(writer.messages).To(Equal(2))
+		})
+	})
+})
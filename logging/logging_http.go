@@ -0,0 +1,233 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/retry"
+)
+
+const (
+	OutputHTTP = "http"
+
+	// httpQueueSize is the number of events waiting to be posted
+	httpQueueSize = 10000
+	// httpFlushInterval bounds how long events wait for their batch
+	httpFlushInterval = time.Second
+	// httpMaxRetries is how many times retryable failures are retried
+	// under the drop policy
+	httpMaxRetries = 3
+	// httpRetryMaxDelay caps the backoff between retries
+	httpRetryMaxDelay = 30 * time.Second
+	// httpFlushTimeout bounds how long Flush waits for the queued events
+	httpFlushTimeout = 10 * time.Second
+)
+
+// ParseHTTPHeaders parses 'Name: value' headers.
+func ParseHTTPHeaders(headers []string) (http.Header, error) {
+	parsed := make(http.Header)
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid HTTP header [%s], expected 'Name: value'", header)
+		}
+		parsed.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return parsed, nil
+}
+
+// HTTPHook posts entries to an HTTP collector as JSON arrays of up to
+// HTTPBatchSize events, formatted by the json formatter whatever the log
+// formatter type, transcoded to the output encoding, the Content-Type
+// carrying its charset.
+//
+// Entries are queued and posted by a single goroutine. Failed posts are
+// retried with backoff: forever under the block policy, Fire blocking once
+// the queue is full, or up to httpMaxRetries times for timeouts, network
+// errors, 5xx, 408 and 429 under the drop policy, the batch being dropped
+// then, as are entries while the queue is full.
+type HTTPHook struct {
+	outputHealth
+	url       string
+	headers   http.Header
+	batchSize int
+	block     bool
+	client    *http.Client
+	formatter logrus.Formatter
+	encode    lineEncoder
+	mediaType string
+
+	events  chan []byte
+	flushes chan chan struct{}
+	errs    *metrics.Counter
+	dropped *metrics.Counter
+}
+
+func newHTTPHook(config *LoggingConfig) (*HTTPHook, error) {
+	u, err := url.Parse(config.HTTPURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid HTTP output URL [%s]", config.HTTPURL)
+	}
+	batchSize := config.HTTPBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	hook := &HTTPHook{
+		url:       config.HTTPURL,
+		headers:   config.HTTPHeaders,
+		batchSize: batchSize,
+		block:     config.HTTPOnError != OnErrorDrop,
+		client: &http.Client{
+			Timeout:   config.HTTPTimeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		},
+		formatter: newJSONFormatter(config),
+		encode:    newLineEncoder(config.OutputEncoding, config.EncodingReplacement),
+		mediaType: httpMediaType(config.OutputEncoding),
+		events:    make(chan []byte, httpQueueSize),
+		flushes:   make(chan chan struct{}),
+		errs:      metrics.NewCounter("http_errors"),
+		dropped:   metrics.NewCounter("http_dropped_messages"),
+	}
+	go hook.run()
+	return hook, nil
+}
+
+// httpMediaType is the Content-Type of batches in encoding, JSON being
+// UTF-8 unless told otherwise.
+func httpMediaType(encoding string) string {
+	if encoding == EncodingLatin1 {
+		return "application/json; charset=ISO-8859-1"
+	}
+	return "application/json"
+}
+
+func (hook *HTTPHook) Fire(entry *logrus.Entry) error {
+	event, err := hook.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	event = []byte(hook.encode(string(bytes.TrimSuffix(event, []byte("\n")))))
+
+	if hook.block {
+		hook.events <- event
+		return nil
+	}
+	select {
+	case hook.events <- event:
+	default:
+		hook.dropped.Inc()
+	}
+	return nil
+}
+
+func (hook *HTTPHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Flush posts the queued entries, waiting up to httpFlushTimeout
+func (hook *HTTPHook) Flush() error {
+	done := make(chan struct{})
+	timeout := time.After(httpFlushTimeout)
+	select {
+	case hook.flushes <- done:
+	case <-timeout:
+		return fmt.Errorf("Timed out posting %d events", len(hook.events))
+	}
+	select {
+	case <-done:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("Timed out posting %d events", len(hook.events))
+	}
+}
+
+// run posts the queued events once batchSize are pending, every
+// httpFlushInterval, or when flushed.
+func (hook *HTTPHook) run() {
+	var batch [][]byte
+	ticker := time.NewTicker(httpFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-hook.events:
+			if batch = append(batch, event); len(batch) >= hook.batchSize {
+				hook.post(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			hook.post(batch)
+			batch = nil
+		case done := <-hook.flushes:
+			for len(hook.events) > 0 {
+				if batch = append(batch, <-hook.events); len(batch) >= hook.batchSize {
+					hook.post(batch)
+					batch = nil
+				}
+			}
+			hook.post(batch)
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+// post sends batch as a JSON array, retrying failures
+func (hook *HTTPHook) post(batch [][]byte) {
+	if len(batch) == 0 {
+		return
+	}
+	body := append(append([]byte("["), bytes.Join(batch, []byte(","))...), ']')
+	delay := httpFlushInterval
+	for attempt := 0; ; attempt++ {
+		err := hook.send(body)
+		hook.record(err)
+		if err == nil {
+			return
+		}
+		hook.errs.Inc()
+		if !hook.block && (attempt >= httpMaxRetries || !retry.IsRetryable(err)) {
+			LogError(fmt.Sprintf("Unable to post %d events, dropping them", len(batch)), err)
+			hook.dropped.Add(uint64(len(batch)))
+			return
+		}
+		LogError(fmt.Sprintf("Unable to post %d events, retrying in %s", len(batch), delay), err)
+		time.Sleep(delay)
+		if delay *= 2; delay > httpRetryMaxDelay {
+			delay = httpRetryMaxDelay
+		}
+	}
+}
+
+func (hook *HTTPHook) send(body []byte) error {
+	req, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", hook.mediaType)
+	for name, values := range hook.headers {
+		req.Header[name] = values
+	}
+	resp, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so that the connection is reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &retry.HTTPError{Status: resp.StatusCode, URL: hook.url}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// collector records the JSON arrays posted to it, answering with the next
+// of statuses, 200 once they ran out
+type collector struct {
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]map[string]interface{}
+	headers  []http.Header
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers = append(c.headers, r.Header)
+	if len(c.statuses) > 0 {
+		status := c.statuses[0]
+		c.statuses = c.statuses[1:]
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var batch []map[string]interface{}
+	Expect(json.Unmarshal(body, &batch)).To(Succeed())
+	c.batches = append(c.batches, batch)
+}
+
+func (c *collector) received() [][]map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches
+}
+
+func httpEntry(message string) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New()).WithField("event_type", "LogMessage")
+	entry.Level = logrus.InfoLevel
+	entry.Message = message
+	return entry
+}
+
+var _ = Describe("HTTP output", func() {
+	It("should parse headers", func() {
+		headers, err := ParseHTTPHeaders([]string{"Authorization: Splunk token", "X-Index:main"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(headers.Get("Authorization")).To(Equal("Splunk token"))
+		Expect(headers.Get("X-Index")).To(Equal("main"))
+
+		_, err = ParseHTTPHeaders([]string{"no separator"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should post batches of JSON events with the headers", func() {
+		c := &collector{}
+		server := httptest.NewServer(c)
+		defer server.Close()
+		hook, err := newHTTPHook(&LoggingConfig{
+			HTTPURL:       server.URL,
+			HTTPHeaders:   http.Header{"Authorization": {"Splunk token"}},
+			HTTPBatchSize: 2,
+			HTTPTimeout:   time.Second,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, message := range []string{"one", "two", "three"} {
+			Expect(hook.Fire(httpEntry(message))).To(Succeed())
+		}
+		Expect(hook.Flush()).To(Succeed())
+
+		batches := c.received()
+		Expect(batches).To(HaveLen(2))
+		Expect(batches[0]).To(HaveLen(2))
+		Expect(batches[0][0]).To(HaveKeyWithValue("msg", "one"))
+		Expect(batches[0][0]).To(HaveKeyWithValue("event_type", "LogMessage"))
+		Expect(batches[1]).To(HaveLen(1))
+		Expect(c.headers[0].Get("Authorization")).To(Equal("Splunk token"))
+		Expect(c.headers[0].Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	It("should post latin1 events with the matching charset", func() {
+		var body []byte
+		var contentType string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			contentType = r.Header.Get("Content-Type")
+		}))
+		defer server.Close()
+		hook, err := newHTTPHook(&LoggingConfig{
+			HTTPURL:             server.URL,
+			HTTPTimeout:         time.Second,
+			OutputEncoding:      EncodingLatin1,
+			EncodingReplacement: "?",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hook.Fire(httpEntry("h\u00e9llo \u2603"))).To(Succeed())
+		Expect(hook.Flush()).To(Succeed())
+		Expect(contentType).To(Equal("application/json; charset=ISO-8859-1"))
+		Expect(string(body)).To(ContainSubstring("\"msg\":\"h\xe9llo ?\""))
+	})
+
+	It("should drop batches rejected by the collector with the drop policy", func() {
+		c := &collector{statuses: []int{http.StatusBadRequest}}
+		server := httptest.NewServer(c)
+		defer server.Close()
+		hook, err := newHTTPHook(&LoggingConfig{HTTPURL: server.URL, HTTPOnError: OnErrorDrop, HTTPTimeout: time.Second})
+		Expect(err).NotTo(HaveOccurred())
+		errsBefore, droppedBefore := hook.errs.Value(), hook.dropped.Value()
+
+		Expect(hook.Fire(httpEntry("rejected"))).To(Succeed())
+		Expect(hook.Flush()).To(Succeed())
+		Expect(hook.errs.Value() - errsBefore).To(BeEquivalentTo(1))
+		Expect(hook.dropped.Value() - droppedBefore).To(BeEquivalentTo(1))
+		Expect(c.received()).To(BeEmpty())
+	})
+
+	It("should retry server errors", func() {
+		c := &collector{statuses: []int{http.StatusServiceUnavailable}}
+		server := httptest.NewServer(c)
+		defer server.Close()
+		hook, err := newHTTPHook(&LoggingConfig{HTTPURL: server.URL, HTTPOnError: OnErrorDrop, HTTPTimeout: time.Second})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hook.Fire(httpEntry("retried"))).To(Succeed())
+		Expect(hook.Flush()).To(Succeed())
+		Expect(c.received()).To(HaveLen(1))
+	})
+
+	It("should reject invalid URLs", func() {
+		_, err := newHTTPHook(&LoggingConfig{HTTPURL: "collector:8088"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// requiredJSONFields are the fields every JSON event keeps, whatever the
+// field selection
+var requiredJSONFields = []string{logrus.FieldKeyTime, logrus.FieldKeyMsg}
+
+// ParseJSONFieldMap parses a comma separated list of from=to pairs renaming
+// JSON output fields, e.g. "cf_app_id=app_id,msg=message".
+func ParseJSONFieldMap(fieldMap string) (map[string]string, error) {
+	renames := make(map[string]string)
+	renamed := make(map[string]string)
+	for _, pair := range strings.Split(fieldMap, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("JSON field map entry [%s] must be from=to", pair)
+		}
+		from, to := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if _, ok := renames[from]; ok {
+			return nil, fmt.Errorf("JSON field [%s] is renamed twice", from)
+		}
+		if other, ok := renamed[to]; ok {
+			return nil, fmt.Errorf("JSON fields [%s] and [%s] are both renamed to [%s]", other, from, to)
+		}
+		renames[from], renamed[to] = to, from
+	}
+	return renames, nil
+}
+
+// ParseJSONFields parses a comma separated list of JSON field names.
+func ParseJSONFields(fields string) []string {
+	var names []string
+	for _, name := range strings.Split(fields, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CheckJSONFields rejects excluding the fields every JSON event needs.
+func CheckJSONFields(exclude []string) error {
+	for _, name := range exclude {
+		for _, required := range requiredJSONFields {
+			if name == required {
+				return fmt.Errorf("JSON field [%s] is required and can't be excluded", name)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFieldsFormatter formats entries as the logrus JSON formatter does,
+// emitting the fields of include only when set, except the required ones,
+// without the fields of exclude, and renaming them following renames.
+// Fields are selected by their name before renaming.
+type jsonFieldsFormatter struct {
+	renames map[string]string
+	include map[string]bool
+	exclude map[string]bool
+}
+
+// newJSONFormatter returns the JSON formatter of the field selection and
+// renaming of config
+func newJSONFormatter(config *LoggingConfig) logrus.Formatter {
+	if len(config.JSONFieldMap) == 0 && len(config.JSONIncludeFields) == 0 && len(config.JSONExcludeFields) == 0 {
+		return &logrus.JSONFormatter{}
+	}
+	f := &jsonFieldsFormatter{renames: config.JSONFieldMap, exclude: make(map[string]bool)}
+	if len(config.JSONIncludeFields) > 0 {
+		f.include = make(map[string]bool)
+		for _, name := range append(config.JSONIncludeFields, requiredJSONFields...) {
+			f.include[name] = true
+		}
+	}
+	for _, name := range config.JSONExcludeFields {
+		f.exclude[name] = true
+	}
+	return f
+}
+
+func (f *jsonFieldsFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(entry.Data)+3)
+	for name, value := range entry.Data {
+		switch name {
+		case logrus.FieldKeyTime, logrus.FieldKeyMsg, logrus.FieldKeyLevel:
+			name = "fields." + name
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		f.set(data, name, value)
+	}
+	f.set(data, logrus.FieldKeyTime, entry.Time.Format(logrus.DefaultTimestampFormat))
+	f.set(data, logrus.FieldKeyMsg, entry.Message)
+	f.set(data, logrus.FieldKeyLevel, entry.Level.String())
+
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal fields to JSON, %v", err)
+	}
+	return append(serialized, '\n'), nil
+}
+
+func (f *jsonFieldsFormatter) set(data logrus.Fields, name string, value interface{}) {
+	if f.exclude[name] || (f.include != nil && !f.include[name]) {
+		return
+	}
+	if to, ok := f.renames[name]; ok {
+		name = to
+	}
+	data[name] = value
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON fields", func() {
+	format := func(config *LoggingConfig, fields logrus.Fields) map[string]interface{} {
+		entry := logrus.NewEntry(logrus.New()).WithFields(fields)
+		entry.Time = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+		entry.Level = logrus.InfoLevel
+		entry.Message = "hello"
+		line, err := config.logFormatter("json").Format(entry)
+		Expect(err).NotTo(HaveOccurred())
+		var event map[string]interface{}
+		Expect(json.Unmarshal(line, &event)).To(Succeed())
+		return event
+	}
+
+	It("should parse field maps", func() {
+		renames, err := ParseJSONFieldMap("cf_app_id=app_id, msg=message")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(renames).To(Equal(map[string]string{"cf_app_id": "app_id", "msg": "message"}))
+
+		_, err = ParseJSONFieldMap("cf_app_id")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseJSONFieldMap("cf_app_id=app,cf_space_id=app")
+		Expect(err).To(MatchError(ContainSubstring("both renamed")))
+	})
+
+	It("should reject excluding required fields", func() {
+		Expect(CheckJSONFields([]string{"cf_org_id", "level"})).To(Succeed())
+		Expect(CheckJSONFields([]string{"time"})).To(MatchError(ContainSubstring("required")))
+		Expect(CheckJSONFields([]string{"msg"})).To(HaveOccurred())
+	})
+
+	It("should keep the logrus JSON formatter without field settings", func() {
+		Expect((&LoggingConfig{}).logFormatter("json")).To(Equal(&logrus.JSONFormatter{}))
+	})
+
+	It("should rename event fields and the message", func() {
+		event := format(&LoggingConfig{JSONFieldMap: map[string]string{"cf_app_id": "app_id", "msg": "message"}},
+			logrus.Fields{"cf_app_id": "guid", "event_type": "LogMessage"})
+		Expect(event).To(Equal(map[string]interface{}{
+			"app_id":     "guid",
+			"event_type": "LogMessage",
+			"message":    "hello",
+			"level":      "info",
+			"time":       "2017-06-01T12:00:00Z",
+		}))
+	})
+
+	It("should only emit included fields, along with the required ones", func() {
+		event := format(&LoggingConfig{JSONIncludeFields: []string{"cf_app_id"}, JSONFieldMap: map[string]string{"time": "@timestamp"}},
+			logrus.Fields{"cf_app_id": "guid", "event_type": "LogMessage"})
+		Expect(event).To(Equal(map[string]interface{}{
+			"cf_app_id":  "guid",
+			"msg":        "hello",
+			"@timestamp": "2017-06-01T12:00:00Z",
+		}))
+	})
+
+	It("should drop excluded fields", func() {
+		event := format(&LoggingConfig{JSONExcludeFields: []string{"level", "origin"}},
+			logrus.Fields{"origin": "rep", "event_type": "LogMessage"})
+		Expect(event).NotTo(HaveKey("level"))
+		Expect(event).NotTo(HaveKey("origin"))
+		Expect(event).To(HaveKeyWithValue("event_type", "LogMessage"))
+	})
+
+	It("should apply to source type overrides in json", func() {
+		config := &LoggingConfig{JSONFieldMap: map[string]string{"msg": "message"}}
+		formatter := newSourceTypeFormatter(config.logFormatter("text"), map[string]string{"RTR": "json"}, config.logFormatter)
+		entry := logrus.NewEntry(logrus.New()).WithField("source_type", "RTR")
+		entry.Message = "hello"
+		line, err := formatter.Format(entry)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(line)).To(ContainSubstring(`"message":"hello"`))
+	})
+})
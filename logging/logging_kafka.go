@@ -0,0 +1,186 @@
+package logging
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+const (
+	OutputKafka = "kafka"
+
+	// kafkaQueueSize is the number of events waiting to be produced
+	kafkaQueueSize = 10000
+	// kafkaBatchSize and kafkaFlushInterval bound how many events are
+	// produced at once and how long they wait for it
+	kafkaBatchSize     = 500
+	kafkaFlushInterval = time.Second
+	// kafkaRetryMaxDelay caps the backoff between retries in block mode
+	kafkaRetryMaxDelay = 30 * time.Second
+	// kafkaFlushTimeout bounds how long Flush waits for the queued events
+	kafkaFlushTimeout = 10 * time.Second
+)
+
+// KafkaHook produces formatted entries to a Kafka topic. Entries are keyed
+// by app GUID, hashed to pick their partition so that the events of an app
+// stay in order; the other events are spread over the partitions.
+//
+// Entries are queued and produced in batches by a single goroutine. When
+// producing fails, the batch is retried with backoff under the block
+// policy, Fire blocking once the queue is full, or dropped under the drop
+// policy, Fire then also dropping entries while the queue is full.
+type KafkaHook struct {
+	outputHealth
+	client *kafkaClient
+	encode lineEncoder
+	block  bool
+
+	records chan kafkaRecord
+	flushes chan chan struct{}
+	next    uint32
+	errs    *metrics.Counter
+	dropped *metrics.Counter
+}
+
+func newKafkaHook(config *LoggingConfig) (*KafkaHook, error) {
+	client := newKafkaClient(config)
+	if err := client.refreshMetadata(); err != nil {
+		return nil, err
+	}
+	hook := &KafkaHook{
+		client:  client,
+		encode:  newLineEncoder(config.OutputEncoding, config.EncodingReplacement),
+		block:   config.KafkaOnError != OnErrorDrop,
+		records: make(chan kafkaRecord, kafkaQueueSize),
+		flushes: make(chan chan struct{}),
+		errs:    metrics.NewCounter("kafka_errors"),
+		dropped: metrics.NewCounter("kafka_dropped_messages"),
+	}
+	go hook.run()
+	return hook, nil
+}
+
+func (hook *KafkaHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read entry, %v", err)
+		return err
+	}
+	record := kafkaRecord{
+		value:     []byte(strings.TrimSuffix(hook.encode(line), "\n")),
+		timestamp: entry.Time,
+	}
+	if appID, _ := entry.Data["cf_app_id"].(string); appID != "" {
+		record.key = []byte(appID)
+	}
+
+	if hook.block {
+		hook.records <- record
+		return nil
+	}
+	select {
+	case hook.records <- record:
+	default:
+		hook.dropped.Inc()
+	}
+	return nil
+}
+
+func (hook *KafkaHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Flush produces the queued entries, waiting up to kafkaFlushTimeout
+func (hook *KafkaHook) Flush() error {
+	done := make(chan struct{})
+	timeout := time.After(kafkaFlushTimeout)
+	select {
+	case hook.flushes <- done:
+	case <-timeout:
+		return fmt.Errorf("Timed out flushing %d events to Kafka", len(hook.records))
+	}
+	select {
+	case <-done:
+		return nil
+	case <-timeout:
+		return fmt.Errorf("Timed out flushing %d events to Kafka", len(hook.records))
+	}
+}
+
+// run batches the queued records by partition, producing them every
+// kafkaFlushInterval, once kafkaBatchSize are pending, or when flushed.
+func (hook *KafkaHook) run() {
+	pending := make(map[int32][]kafkaRecord)
+	count := 0
+	ticker := time.NewTicker(kafkaFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record := <-hook.records:
+			partition := hook.partition(record.key)
+			pending[partition] = append(pending[partition], record)
+			if count++; count >= kafkaBatchSize {
+				hook.produce(pending)
+				count = 0
+			}
+		case <-ticker.C:
+			hook.produce(pending)
+			count = 0
+		case done := <-hook.flushes:
+			for len(hook.records) > 0 {
+				record := <-hook.records
+				partition := hook.partition(record.key)
+				pending[partition] = append(pending[partition], record)
+			}
+			hook.produce(pending)
+			count = 0
+			close(done)
+		}
+	}
+}
+
+// partition hashes keyed records, and spreads the others round-robin
+func (hook *KafkaHook) partition(key []byte) int32 {
+	partitions := uint32(hook.client.partitions())
+	if partitions == 0 {
+		partitions = 1
+	}
+	if key == nil {
+		hook.next++
+		return int32(hook.next % partitions)
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int32(h.Sum32() % partitions)
+}
+
+// produce sends and clears the pending records, a partition at a time
+func (hook *KafkaHook) produce(pending map[int32][]kafkaRecord) {
+	for partition, records := range pending {
+		delay := kafkaFlushInterval
+		for {
+			err := hook.client.produce(partition, records)
+			hook.record(err)
+			if err == nil {
+				break
+			}
+			hook.errs.Inc()
+			if !hook.block {
+				LogError(fmt.Sprintf("Unable to produce %d events to Kafka, dropping them", len(records)), err)
+				hook.dropped.Add(uint64(len(records)))
+				break
+			}
+			LogError(fmt.Sprintf("Unable to produce %d events to Kafka, retrying in %s", len(records), delay), err)
+			time.Sleep(delay)
+			if delay *= 2; delay > kafkaRetryMaxDelay {
+				delay = kafkaRetryMaxDelay
+			}
+		}
+		delete(pending, partition)
+	}
+}
@@ -0,0 +1,449 @@
+package logging
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// kafkaTimeout bounds dialing and every request
+const kafkaTimeout = 10 * time.Second
+
+const (
+	kafkaClientID = "firehose-to-syslog"
+
+	kafkaProduce          int16 = 0
+	kafkaMetadata         int16 = 3
+	kafkaSaslHandshake    int16 = 17
+	kafkaSaslAuthenticate int16 = 36
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaError is an error code returned by a broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return "Kafka error code " + strconv.Itoa(int(e))
+}
+
+// kafkaRecord is a message produced to the topic
+type kafkaRecord struct {
+	key       []byte
+	value     []byte
+	timestamp time.Time
+}
+
+// kafkaClient speaks enough of the Kafka protocol to produce to a topic:
+// Metadata v4 to find the partition leaders, Produce v3 with v2 record
+// batches, and SASL/PLAIN authentication. A connection is kept per broker,
+// dialed again after any failure.
+type kafkaClient struct {
+	seeds     []string
+	topic     string
+	tlsConfig *tls.Config
+	saslUser  string
+	saslPass  string
+
+	brokers     map[int32]string
+	leaders     []int32
+	stale       bool
+	conns       map[int32]*kafkaConn
+	correlation int32
+}
+
+type kafkaConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newKafkaClient(config *LoggingConfig) *kafkaClient {
+	return &kafkaClient{
+		seeds:     config.KafkaBrokers,
+		topic:     config.KafkaTopic,
+		tlsConfig: config.KafkaTLSConfig,
+		saslUser:  config.KafkaSASLUser,
+		saslPass:  config.KafkaSASLPassword,
+		conns:     make(map[int32]*kafkaConn),
+	}
+}
+
+// refreshMetadata reads the brokers and the partition leaders of the topic
+// from the first seed broker answering.
+func (c *kafkaClient) refreshMetadata() error {
+	err := errors.New("No Kafka broker given")
+	for _, seed := range c.seeds {
+		var conn *kafkaConn
+		if conn, err = c.dial(seed); err != nil {
+			continue
+		}
+		err = c.readMetadata(conn)
+		conn.conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *kafkaClient) readMetadata(conn *kafkaConn) error {
+	req := &kafkaEncoder{}
+	req.int32(1)
+	req.string(c.topic)
+	req.int8(0) // allow_auto_topic_creation
+	resp, err := c.roundTrip(conn, kafkaMetadata, 4, req)
+	if err != nil {
+		return err
+	}
+
+	resp.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for i := resp.int32(); i > 0; i-- {
+		id, host, port := resp.int32(), resp.string(), resp.int32()
+		resp.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	resp.string() // cluster_id
+	resp.int32()  // controller_id
+	var leaders []int32
+	for i := resp.int32(); i > 0; i-- {
+		topicErr, name := resp.int16(), resp.string()
+		resp.int8() // is_internal
+		partitions := resp.int32()
+		if resp.err == nil && name == c.topic && topicErr != 0 {
+			return fmt.Errorf("Unable to produce to Kafka topic %s: %v", c.topic, kafkaError(topicErr))
+		}
+		leaders = make([]int32, partitions)
+		for ; partitions > 0; partitions-- {
+			resp.int16() // error_code
+			partition, leader := resp.int32(), resp.int32()
+			resp.int32s() // replica_nodes
+			resp.int32s() // isr_nodes
+			if partition >= 0 && int(partition) < len(leaders) {
+				leaders[partition] = leader
+			}
+		}
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("Kafka topic %s has no partition", c.topic)
+	}
+	c.brokers, c.leaders, c.stale = brokers, leaders, false
+	return nil
+}
+
+// partitions is the number of partitions of the topic, as last read
+func (c *kafkaClient) partitions() int {
+	return len(c.leaders)
+}
+
+// produce writes records to a partition, waiting for all in-sync replicas
+// to acknowledge them. Connections are closed and the metadata marked stale
+// on failures, so that the leaders are looked up again on the next call.
+func (c *kafkaClient) produce(partition int32, records []kafkaRecord) error {
+	if c.stale || c.partitions() == 0 {
+		if err := c.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	if int(partition) >= c.partitions() {
+		partition %= int32(c.partitions())
+	}
+	leader := c.leaders[partition]
+	conn, err := c.leaderConn(leader)
+	if err != nil {
+		c.stale = true
+		return err
+	}
+
+	req := &kafkaEncoder{}
+	req.nullString() // transactional_id
+	req.int16(-1)    // acks
+	req.int32(int32(kafkaTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(c.topic)
+	req.int32(1)
+	req.int32(partition)
+	req.bytes(encodeRecordBatch(records))
+	resp, err := c.roundTrip(conn, kafkaProduce, 3, req)
+	if err != nil {
+		conn.conn.Close()
+		delete(c.conns, leader)
+		c.stale = true
+		return err
+	}
+
+	for i := resp.int32(); i > 0; i-- {
+		resp.string() // name
+		for j := resp.int32(); j > 0; j-- {
+			resp.int32() // partition_index
+			if code := resp.int16(); code != 0 && resp.err == nil {
+				c.stale = true
+				return kafkaError(code)
+			}
+			resp.int64() // base_offset
+			resp.int64() // log_append_time_ms
+		}
+	}
+	return resp.err
+}
+
+func (c *kafkaClient) leaderConn(leader int32) (*kafkaConn, error) {
+	if conn, ok := c.conns[leader]; ok {
+		return conn, nil
+	}
+	addr, ok := c.brokers[leader]
+	if !ok {
+		return nil, fmt.Errorf("Unknown Kafka broker %d", leader)
+	}
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[leader] = conn
+	return conn, nil
+}
+
+func (c *kafkaClient) dial(addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: kafkaTimeout}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kconn := &kafkaConn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.saslUser != "" {
+		if err := c.authenticate(kconn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Kafka SASL authentication failed on %s: %v", addr, err)
+		}
+	}
+	return kconn, nil
+}
+
+// authenticate runs the SASL/PLAIN exchange
+func (c *kafkaClient) authenticate(conn *kafkaConn) error {
+	req := &kafkaEncoder{}
+	req.string("PLAIN")
+	resp, err := c.roundTrip(conn, kafkaSaslHandshake, 1, req)
+	if err != nil {
+		return err
+	}
+	if code := resp.int16(); code != 0 {
+		return kafkaError(code)
+	}
+
+	req = &kafkaEncoder{}
+	req.bytes([]byte("\x00" + c.saslUser + "\x00" + c.saslPass))
+	resp, err = c.roundTrip(conn, kafkaSaslAuthenticate, 0, req)
+	if err != nil {
+		return err
+	}
+	code, message := resp.int16(), resp.string()
+	if code != 0 {
+		return fmt.Errorf("%v: %s", kafkaError(code), message)
+	}
+	return resp.err
+}
+
+// roundTrip sends a request and returns a decoder of its response body
+func (c *kafkaClient) roundTrip(conn *kafkaConn, apiKey int16, apiVersion int16, body *kafkaEncoder) (*kafkaDecoder, error) {
+	c.correlation++
+	req := &kafkaEncoder{}
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(c.correlation)
+	req.string(kafkaClientID)
+	req.buf = append(req.buf, body.buf...)
+	binary.BigEndian.PutUint32(req.buf, uint32(len(req.buf)-4))
+
+	conn.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := conn.conn.Write(req.buf); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if correlation := int32(binary.BigEndian.Uint32(header[4:])); correlation != c.correlation || size < 4 {
+		return nil, errors.New("Unexpected Kafka response")
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn.reader, resp); err != nil {
+		return nil, err
+	}
+	return &kafkaDecoder{buf: resp}, nil
+}
+
+// encodeRecordBatch encodes records as a v2 record batch, without
+// compression nor idempotence
+func encodeRecordBatch(records []kafkaRecord) []byte {
+	first, last := records[0].timestamp, records[0].timestamp
+	for _, record := range records {
+		if record.timestamp.After(last) {
+			last = record.timestamp
+		}
+	}
+
+	// the CRC covers the batch from the attributes on
+	batch := &kafkaEncoder{}
+	batch.int16(0) // attributes
+	batch.int32(int32(len(records) - 1))
+	batch.int64(millis(first))
+	batch.int64(millis(last))
+	batch.int64(-1) // producer_id
+	batch.int16(-1) // producer_epoch
+	batch.int32(-1) // base_sequence
+	batch.int32(int32(len(records)))
+	for i, record := range records {
+		r := &kafkaEncoder{}
+		r.int8(0) // attributes
+		r.varint(millis(record.timestamp) - millis(first))
+		r.varint(int64(i))
+		if record.key == nil {
+			r.varint(-1)
+		} else {
+			r.varint(int64(len(record.key)))
+			r.buf = append(r.buf, record.key...)
+		}
+		r.varint(int64(len(record.value)))
+		r.buf = append(r.buf, record.value...)
+		r.varint(0) // headers
+		batch.varint(int64(len(r.buf)))
+		batch.buf = append(batch.buf, r.buf...)
+	}
+
+	header := &kafkaEncoder{}
+	header.int64(0) // base_offset
+	header.int32(int32(len(batch.buf) + 9))
+	header.int32(-1) // partition_leader_epoch
+	header.int8(2)   // magic
+	header.int32(int32(crc32.Checksum(batch.buf, crc32c)))
+	return append(header.buf, batch.buf...)
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// kafkaEncoder appends the big endian encoding of the protocol types
+type kafkaEncoder struct {
+	buf []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.int32(int32(v >> 32))
+	e.int32(int32(v))
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *kafkaEncoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// kafkaDecoder reads the protocol types, the first error sticking: reads
+// past it return zero values.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32s() []int32 {
+	var values []int32
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		values = append(values, d.int32())
+	}
+	return values
+}
+
+// string reads a nullable string, null being read as empty
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
@@ -0,0 +1,285 @@
+package logging
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// kafkaBroker is a single broker cluster recording the records produced to
+// its topic by partition
+type kafkaBroker struct {
+	listener   net.Listener
+	topic      string
+	partitions int32
+	password   string
+	produceErr int16
+	mu         sync.Mutex
+	produced   map[int32][]kafkaRecord
+}
+
+func newKafkaBroker(topic string, partitions int32) *kafkaBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	broker := &kafkaBroker{
+		listener:   listener,
+		topic:      topic,
+		partitions: partitions,
+		produced:   make(map[int32][]kafkaRecord),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *kafkaBroker) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *kafkaBroker) records(partition int32) []kafkaRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.produced[partition]
+}
+
+func (b *kafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := &kafkaDecoder{buf: make([]byte, binary.BigEndian.Uint32(size[:]))}
+		if _, err := io.ReadFull(conn, req.buf); err != nil {
+			return
+		}
+		apiKey, _, correlation := req.int16(), req.int16(), req.int32()
+		req.string() // client_id
+
+		resp := &kafkaEncoder{}
+		resp.int32(0)
+		resp.int32(correlation)
+		switch apiKey {
+		case kafkaMetadata:
+			b.metadata(req, resp)
+		case kafkaProduce:
+			b.produce(req, resp)
+		case kafkaSaslHandshake:
+			resp.int16(0)
+			resp.int32(1)
+			resp.string("PLAIN")
+		case kafkaSaslAuthenticate:
+			req.int32()
+			if string(req.buf) == "\x00nozzle\x00"+b.password {
+				resp.int16(0)
+				resp.nullString()
+			} else {
+				resp.int16(58)
+				resp.string("Authentication failed")
+			}
+			resp.bytes(nil)
+		}
+		binary.BigEndian.PutUint32(resp.buf, uint32(len(resp.buf)-4))
+		conn.Write(resp.buf)
+	}
+}
+
+func (b *kafkaBroker) metadata(req *kafkaDecoder, resp *kafkaEncoder) {
+	req.int32()
+	topic := req.string()
+	host, port, _ := net.SplitHostPort(b.addr())
+	portNumber, _ := strconv.Atoi(port)
+
+	resp.int32(0) // throttle_time_ms
+	resp.int32(1)
+	resp.int32(1)
+	resp.string(host)
+	resp.int32(int32(portNumber))
+	resp.nullString()
+	resp.nullString() // cluster_id
+	resp.int32(1)
+	resp.int32(1)
+	if topic != b.topic {
+		resp.int16(3) // UNKNOWN_TOPIC_OR_PARTITION
+		resp.string(topic)
+		resp.int8(0)
+		resp.int32(0)
+		return
+	}
+	resp.int16(0)
+	resp.string(topic)
+	resp.int8(0)
+	resp.int32(b.partitions)
+	for i := int32(0); i < b.partitions; i++ {
+		resp.int16(0)
+		resp.int32(i)
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+		resp.int32(1)
+	}
+}
+
+func (b *kafkaBroker) produce(req *kafkaDecoder, resp *kafkaEncoder) {
+	req.string() // transactional_id
+	req.int16()  // acks
+	req.int32()  // timeout_ms
+	req.int32()  // topics
+	topic := req.string()
+	req.int32() // partitions
+	partition := req.int32()
+	batch := req.next(int(req.int32()))
+	Expect(req.err).NotTo(HaveOccurred())
+
+	if b.produceErr == 0 {
+		b.mu.Lock()
+		b.produced[partition] = append(b.produced[partition], decodeRecordBatch(batch)...)
+		b.mu.Unlock()
+	}
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(partition)
+	resp.int16(b.produceErr)
+	resp.int64(0)
+	resp.int64(-1)
+	resp.int32(0) // throttle_time_ms
+}
+
+func decodeRecordBatch(batch []byte) []kafkaRecord {
+	d := &kafkaDecoder{buf: batch}
+	d.int64() // base_offset
+	Expect(int(d.int32())).To(Equal(len(d.buf)))
+	d.int32() // partition_leader_epoch
+	Expect(d.int8()).To(BeEquivalentTo(2))
+	Expect(uint32(d.int32())).To(Equal(crc32.Checksum(d.buf, crc32c)))
+	d.next(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	count := d.int32()
+
+	varint := func() int64 {
+		v, n := binary.Varint(d.buf)
+		d.buf = d.buf[n:]
+		return v
+	}
+	var records []kafkaRecord
+	for i := int32(0); i < count; i++ {
+		varint() // length
+		d.int8() // attributes
+		varint() // timestamp_delta
+		varint() // offset_delta
+		var record kafkaRecord
+		if keyLength := varint(); keyLength >= 0 {
+			record.key = d.next(int(keyLength))
+		}
+		record.value = d.next(int(varint()))
+		varint() // headers
+		records = append(records, record)
+	}
+	Expect(d.err).NotTo(HaveOccurred())
+	return records
+}
+
+func kafkaEntry(appID string, message string) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Logger.Formatter = &logrus.JSONFormatter{DisableTimestamp: true}
+	entry.Level = logrus.InfoLevel
+	entry.Message = message
+	if appID != "" {
+		entry.Data["cf_app_id"] = appID
+	}
+	return entry
+}
+
+var _ = Describe("Kafka output", func() {
+	It("should produce the events of an app to a single partition, in order", func() {
+		broker := newKafkaBroker("events", 4)
+		defer broker.listener.Close()
+		hook, err := newKafkaHook(&LoggingConfig{KafkaBrokers: []string{broker.addr()}, KafkaTopic: "events"})
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 5; i++ {
+			Expect(hook.Fire(kafkaEntry("app-1", "line "+strconv.Itoa(i)))).To(Succeed())
+		}
+		Expect(hook.Fire(kafkaEntry("", "platform event"))).To(Succeed())
+		Expect(hook.Flush()).To(Succeed())
+
+		var appRecords []kafkaRecord
+		total := 0
+		for partition := int32(0); partition < 4; partition++ {
+			for _, record := range broker.records(partition) {
+				total++
+				if string(record.key) == "app-1" {
+					appRecords = append(appRecords, record)
+				}
+			}
+			if records := broker.records(partition); len(records) > 0 && string(records[0].key) == "app-1" {
+				Expect(records).To(HaveLen(5))
+			}
+		}
+		Expect(total).To(Equal(6))
+		Expect(appRecords).To(HaveLen(5))
+		Expect(string(appRecords[0].value)).To(Equal(`{"cf_app_id":"app-1","level":"info","msg":"line 0"}`))
+		Expect(string(appRecords[4].value)).To(ContainSubstring(`"msg":"line 4"`))
+	})
+
+	It("should count and drop events the broker rejects with the drop policy", func() {
+		broker := newKafkaBroker("events", 1)
+		defer broker.listener.Close()
+		broker.produceErr = 6 // NOT_LEADER_OR_FOLLOWER
+		hook, err := newKafkaHook(&LoggingConfig{
+			KafkaBrokers: []string{broker.addr()},
+			KafkaTopic:   "events",
+			KafkaOnError: OnErrorDrop,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		errsBefore, droppedBefore := hook.errs.Value(), hook.dropped.Value()
+
+		Expect(hook.Fire(kafkaEntry("app-1", "lost"))).To(Succeed())
+		Expect(hook.Flush()).To(Succeed())
+		Expect(hook.errs.Value() - errsBefore).To(BeEquivalentTo(1))
+		Expect(hook.dropped.Value() - droppedBefore).To(BeEquivalentTo(1))
+		Expect(broker.records(0)).To(BeEmpty())
+	})
+
+	It("should authenticate with SASL/PLAIN", func() {
+		broker := newKafkaBroker("events", 1)
+		defer broker.listener.Close()
+		broker.password = "secret"
+
+		_, err := newKafkaHook(&LoggingConfig{KafkaBrokers: []string{broker.addr()}, KafkaTopic: "events", KafkaSASLUser: "nozzle", KafkaSASLPassword: "wrong"})
+		Expect(err).To(MatchError(ContainSubstring("Kafka SASL authentication failed")))
+
+		hook, err := newKafkaHook(&LoggingConfig{KafkaBrokers: []string{broker.addr()}, KafkaTopic: "events", KafkaSASLUser: "nozzle", KafkaSASLPassword: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hook.Fire(kafkaEntry("app-1", "authenticated"))).To(Succeed())
+		Expect(hook.Flush()).To(Succeed())
+		Expect(broker.records(0)).To(HaveLen(1))
+	})
+
+	It("should fail to connect to a missing topic", func() {
+		broker := newKafkaBroker("events", 1)
+		defer broker.listener.Close()
+
+		logging := NewLogging(&LoggingConfig{
+			OutputType:   OutputKafka,
+			KafkaBrokers: []string{broker.addr()},
+			KafkaTopic:   "missing",
+		})
+		Expect(logging.Connect()).To(BeFalse())
+	})
+})
@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/Sirupsen/logrus"
+)
+
+// laneDepth is the number of messages a write lane queues before Fire
+// blocks, applying backpressure instead of dropping.
+const laneDepth = 1024
+
+type laneMessage struct {
+	severity syslog.Priority
+	line     string
+	// flushed marks a flush rather than a message, closed once the
+	// messages queued on the lane before it are written
+	flushed chan struct{}
+}
+
+// writeLane writes the messages of its queue over its own connection. The
+// error of a failed write is kept until the next message is queued.
+type writeLane struct {
+	messages chan laneMessage
+	writer   syslogWriter
+
+	mu  sync.Mutex
+	err error
+}
+
+// takeErr returns and clears the error of the last failed write
+func (lane *writeLane) takeErr() error {
+	lane.mu.Lock()
+	defer lane.mu.Unlock()
+	err := lane.err
+	lane.err = nil
+	return err
+}
+
+// writeLanes writes to one destination over several connections
+// concurrently. Messages are partitioned over the lanes by source, so the
+// messages of one source are always written by the same lane, in order;
+// the order across sources is not preserved.
+type writeLanes struct {
+	lanes []*writeLane
+}
+
+func newWriteLanes(writers []syslogWriter, write func(syslogWriter, syslog.Priority, string) error) *writeLanes {
+	l := &writeLanes{}
+	for _, writer := range writers {
+		lane := &writeLane{messages: make(chan laneMessage, laneDepth), writer: writer}
+		l.lanes = append(l.lanes, lane)
+		go func(lane *writeLane) {
+			for message := range lane.messages {
+				if message.flushed != nil {
+					close(message.flushed)
+					continue
+				}
+				if err := write(lane.writer, message.severity, message.line); err != nil {
+					lane.mu.Lock()
+					lane.err = err
+					lane.mu.Unlock()
+				}
+			}
+		}(lane)
+	}
+	return l
+}
+
+// send queues a message on the lane of source. As lanes write
+// asynchronously, it returns the error of the last write the lane failed
+// since the previous message, if any, as the hook would have for its own.
+func (l *writeLanes) send(source string, severity syslog.Priority, line string) error {
+	h := fnv.New32a()
+	h.Write([]byte(source))
+	lane := l.lanes[h.Sum32()%uint32(len(l.lanes))]
+	err := lane.takeErr()
+	lane.messages <- laneMessage{severity: severity, line: line}
+	return err
+}
+
+// flush waits until every lane wrote the messages queued so far.
+func (l *writeLanes) flush() {
+	flushed := make([]chan struct{}, len(l.lanes))
+	for i, lane := range l.lanes {
+		flushed[i] = make(chan struct{})
+		lane.messages <- laneMessage{flushed: flushed[i]}
+	}
+	for _, done := range flushed {
+		<-done
+	}
+}
+
+// writers returns the connection of every lane
+func (l *writeLanes) writers() []syslogWriter {
+	writers := make([]syslogWriter, len(l.lanes))
+	for i, lane := range l.lanes {
+		writers[i] = lane.writer
+	}
+	return writers
+}
+
+// err returns and clears the first error of the lanes' failed writes
+func (l *writeLanes) err() error {
+	var first error
+	for _, lane := range l.lanes {
+		if err := lane.takeErr(); first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// sourceKey identifies the source of an event: an app instance, or the
+// platform component that emitted it.
+func sourceKey(fields logrus.Fields) string {
+	return fmt.Sprint(fields["cf_app_id"], "/", fields["source_instance"], "/", fields["instance_index"], "/",
+		fields["origin"], "/", fields["job"], "/", fields["job_index"])
+}
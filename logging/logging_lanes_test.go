@@ -0,0 +1,166 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// recordingWriter keeps the messages it was sent, taking delay per write to
+// stand for the network round trip
+type recordingWriter struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	messages []string
+}
+
+func (w *recordingWriter) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, string(b))
+	return len(b), nil
+}
+
+func (w *recordingWriter) Close() error {
+	return nil
+}
+
+func (w *recordingWriter) received() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.messages...)
+}
+
+var laneMessagePattern = regexp.MustCompile(`msg="?([a-d])-(\d\d)`)
+
+func laneEntry(app string, message string) *logrus.Entry {
+	logger := logrus.New()
+	logger.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+	entry := logrus.NewEntry(logger).WithField("cf_app_id", app)
+	entry.Message = message
+	return entry
+}
+
+var _ = Describe("Write lanes", func() {
+	It("should write every message of a source over the same lane, in order", func() {
+		writers := []*recordingWriter{{}, {}, {}}
+		hook := newSyslogHook(writers[0], &LoggingConfig{})
+		hook.useLanes([]syslogWriter{writers[1], writers[2]})
+
+		for i := 0; i < 50; i++ {
+			for _, app := range []string{"a", "b", "c", "d"} {
+				Expect(hook.Fire(laneEntry(app, fmt.Sprintf("%s-%02d", app, i)))).To(Succeed())
+			}
+		}
+
+		total := func() int {
+			n := 0
+			for _, w := range writers {
+				n += len(w.received())
+			}
+			return n
+		}
+		Eventually(total).Should(Equal(200))
+
+		for _, w := range writers {
+			last := map[string]string{}
+			for _, message := range w.received() {
+				match := laneMessagePattern.FindStringSubmatch(message)
+				Expect(match).To(HaveLen(3))
+				app, seq := match[1], match[2]
+				Expect(seq > last[app]).To(BeTrue())
+				last[app] = seq
+			}
+		}
+	})
+
+	It("should return the errors of the failed lane writes", func() {
+		writers := []*failingWriter{{failing: true}, {failing: true}}
+		hook := newSyslogHook(writers[0], &LoggingConfig{})
+		hook.useLanes([]syslogWriter{writers[1]})
+
+		Expect(hook.Fire(laneEntry("a", "a-00"))).To(Succeed())
+		Eventually(func() error { return hook.Fire(laneEntry("a", "a-01")) }).Should(MatchError("connection reset"))
+		Expect(hook.healthy()).To(BeFalse())
+
+		Eventually(hook.Flush).Should(MatchError("connection reset"))
+	})
+})
+
+func benchmarkLanes(b *testing.B, lanes int) {
+	writers := []syslogWriter{&recordingWriter{delay: 20 * time.Microsecond}}
+	hook := newSyslogHook(writers[0], &LoggingConfig{})
+	for i := 1; i < lanes; i++ {
+		writers = append(writers, &recordingWriter{delay: 20 * time.Microsecond})
+	}
+	if lanes > 1 {
+		hook.useLanes(writers[1:])
+	}
+
+	entries := make([]*logrus.Entry, 64)
+	for i := range entries {
+		entries[i] = laneEntry(fmt.Sprintf("app-%d", i), "hello")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hook.Fire(entries[i%len(entries)])
+	}
+	// lanes write asynchronously: wait until every message is out
+	for {
+		written := 0
+		for _, w := range writers {
+			written += len(w.(*recordingWriter).received())
+		}
+		if written == b.N {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkSyslogHookOneLane(b *testing.B)   { benchmarkLanes(b, 1) }
+func BenchmarkSyslogHookFourLanes(b *testing.B) { benchmarkLanes(b, 4) }
+
+// BenchmarkWriteLanes measures the lanes alone, without formatting entries.
+func BenchmarkWriteLanes(b *testing.B) {
+	for _, lanes := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("%d", lanes), func(b *testing.B) {
+			var writers []syslogWriter
+			for i := 0; i < lanes; i++ {
+				writers = append(writers, &recordingWriter{delay: 20 * time.Microsecond})
+			}
+			l := newWriteLanes(writers, func(writer syslogWriter, severity syslog.Priority, line string) error {
+				return write(writer, severity, line)
+			})
+
+			sources := make([]string, 64)
+			for i := range sources {
+				sources[i] = fmt.Sprintf("app-%d", i)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.send(sources[i%len(sources)], syslog.LOG_INFO, "hello")
+			}
+			for {
+				written := 0
+				for _, w := range writers {
+					written += len(w.(*recordingWriter).received())
+				}
+				if written == b.N {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
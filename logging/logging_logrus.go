@@ -1,74 +1,430 @@
 package logging
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"time"
 
 	syslog "github.com/RackSec/srslog"
 	"github.com/Sirupsen/logrus"
-	logrus_syslog "github.com/shinji62/logrus-syslog-ng"
 )
 
+const (
+	OutputSyslog = "syslog"
+	OutputStdout = "stdout"
+	OutputBoth   = "both"
+
+	// OnErrorBlock retries the events the Kafka and HTTP outputs fail to
+	// send, holding back the events behind them, OnErrorDrop drops them
+	OnErrorBlock = "block"
+	OnErrorDrop  = "drop"
+)
+
+// highSeverityEventTypes are shipped at error level so they stand out
+// downstream from the regular info-level stream.
+var highSeverityEventTypes = map[string]bool{
+	"crash":               true,
+	"loggregator_dropped": true,
+}
+
+type LoggingConfig struct {
+	SyslogServer        string
+	SyslogProtocol      string
+	SyslogFormat        string
+	SyslogSRV           string
+	SRVRefreshInterval  time.Duration
+	LogFormatterType    string
+	FormatOverrides     map[string]string
+	ExtraFormats        []string
+	CertPath            string
+	TLSConfig           *tls.Config
+	Debug               bool
+	MaxBytesPerSecond   int
+	BandwidthPolicy     string
+	ShedPriority        []string
+	FifoPath            string
+	OutputEncoding      string
+	EncodingReplacement string
+	FieldNameAllow      *regexp.Regexp
+	IncludeSyslogPri    bool
+	PackEvents          int
+	PackMaxBytes        int
+	PackFlushInterval   time.Duration
+	ProfileLatency      bool
+	WriteLanes          int
+	PriorityLevels      int
+	OutputType          string
+	BatchSize           int
+	BatchFlushInterval  time.Duration
+	Routes              map[string]string
+	MaxMessageBytes     int
+	TruncationMarker    string
+	// SyslogFacility is the facility messages are sent with, SeverityMap
+	// the severity of event types, overriding the defaults
+	SyslogFacility syslog.Priority
+	SeverityMap    map[string]syslog.Priority
+	// KafkaBrokers are the seed brokers of the kafka output, producing to
+	// KafkaTopic over TLS when KafkaTLSConfig is set, authenticating with
+	// SASL/PLAIN when KafkaSASLUser is set. KafkaOnError is the policy of
+	// failed produce requests, block or drop.
+	KafkaBrokers      []string
+	KafkaTopic        string
+	KafkaTLSConfig    *tls.Config
+	KafkaSASLUser     string
+	KafkaSASLPassword string
+	KafkaOnError      string
+	// HTTPURL is where the http output posts batches of up to
+	// HTTPBatchSize events with HTTPHeaders, each post timing out after
+	// HTTPTimeout. HTTPOnError is the policy of failed posts, block or drop.
+	HTTPURL       string
+	HTTPHeaders   http.Header
+	HTTPBatchSize int
+	HTTPTimeout   time.Duration
+	HTTPOnError   string
+	// JSONFieldMap renames the fields of the json formatter, which only
+	// emits JSONIncludeFields when set, and never JSONExcludeFields
+	JSONFieldMap      map[string]string
+	JSONIncludeFields []string
+	JSONExcludeFields []string
+	// SyslogHostname is the HOSTNAME of syslog messages, the OS hostname
+	// when empty, SyslogTag their RFC 3164 TAG, doppler when empty, and
+	// SyslogAppName their RFC 5424 APP-NAME, the app GUID when empty
+	SyslogHostname string
+	SyslogTag      string
+	SyslogAppName  string
+	// Compress sends syslog messages over tcp and tcp+tls in a gzip stream,
+	// flushed every BatchFlushInterval
+	Compress bool
+	// UDPMaxDatagram bounds the size of udp syslog datagrams, header
+	// included, longer messages being cut with TruncationMarker or skipped
+	// following UDPOversizePolicy. 0 sends them whole.
+	UDPMaxDatagram    int
+	UDPOversizePolicy string
+	// SyslogBalance spreads messages over the servers when SyslogServer
+	// lists several, SyslogBalanceFailover or SyslogBalanceRoundRobin.
+	// Servers that failed are dialed again every SyslogFailback.
+	SyslogBalance  string
+	SyslogFailback time.Duration
+	// FilePath is where the file output appends events, the file being
+	// rotated over FileMaxBytes or once older than FileMaxAge, keeping
+	// FileMaxBackups rotated files. 0 doesn't bound them.
+	FilePath       string
+	FileMaxBytes   int64
+	FileMaxAge     time.Duration
+	FileMaxBackups int
+	// SpoolDir persists the messages the syslog server fails to accept
+	// when set, replaying them in order once it is back, up to
+	// SpoolMaxBytes of messages being kept. 0 doesn't bound them.
+	SpoolDir      string
+	SpoolMaxBytes int64
+}
+
 type LoggingLogrus struct {
-	Logger           *logrus.Logger
-	syslogServer     string
-	debugFlag        bool
-	logFormatterType string
-	certPath         string
-	syslogProtocol   string
+	Logger *logrus.Logger
+	config *LoggingConfig
+	// connected is set once Connect succeeded, lastEvent is the time in
+	// nanoseconds an event was last shipped while connected
+	connected int32
+	lastEvent int64
+	// connectErr is why the last Connect failed
+	connectErr error
 }
 
-func NewLogging(SyslogServerFlag string, SysLogProtocolFlag string, LogFormatterFlag string, certP string, DebugFlag bool) Logging {
+func NewLogging(config *LoggingConfig) Logging {
 	return &LoggingLogrus{
-		Logger:           logrus.New(),
-		syslogServer:     SyslogServerFlag,
-		logFormatterType: LogFormatterFlag,
-		syslogProtocol:   SysLogProtocolFlag,
-		certPath:         certP,
-		debugFlag:        DebugFlag,
+		Logger: logrus.New(),
+		config: config,
 	}
 }
 
 func (l *LoggingLogrus) Connect() bool {
 
 	success := false
-	l.Logger.Formatter = GetLogFormatter(l.logFormatterType)
+	l.connectErr = nil
+	l.Logger.Formatter = newSourceTypeFormatter(l.config.logFormatter(l.config.LogFormatterType), l.config.FormatOverrides, l.config.logFormatter)
 
-	if !l.debugFlag {
+	toStdout := l.config.OutputType == OutputStdout || l.config.OutputType == OutputBoth
+	if !l.config.Debug && !toStdout {
 		l.Logger.Out = ioutil.Discard
+	} else if l.config.OutputEncoding != "" && l.config.OutputEncoding != EncodingUTF8 {
+		l.Logger.Out = &encodingWriter{out: os.Stdout, encode: newLineEncoder(l.config.OutputEncoding, l.config.EncodingReplacement)}
 	} else {
 		l.Logger.Out = os.Stdout
 	}
 
-	if l.syslogServer != "" {
-		var hook logrus.Hook
-		var err error
-		if l.syslogProtocol == logrus_syslog.SecureProto {
-			hook, err = logrus_syslog.NewSyslogHookTls(l.syslogServer, syslog.LOG_INFO, "doppler", l.certPath)
+	if toStdout {
+		LogStd("Writing events to stdout\n", false)
+		success = true
+	}
 
+	switch l.config.OutputType {
+	case OutputStdout:
+	case OutputKafka:
+		hook, err := newKafkaHook(l.config)
+		if err != nil {
+			l.connectErr = err
+			LogError(fmt.Sprintf("Unable to connect to Kafka brokers %v!\n", l.config.KafkaBrokers), err.Error())
 		} else {
-			hook, err = logrus_syslog.NewSyslogHook(l.syslogProtocol, l.syslogServer, syslog.LOG_INFO, "doppler")
+			LogStd(fmt.Sprintf("Producing events to Kafka topic [%s]\n", l.config.KafkaTopic), false)
+			l.Logger.Hooks.Add(hook)
+			success = true
 		}
+	case OutputFile:
+		hook, err := newFileHook(l.config)
 		if err != nil {
-			LogError(fmt.Sprintf("Unable to connect to syslog server [%s]!\n", l.syslogServer), err.Error())
+			l.connectErr = err
+			LogError(fmt.Sprintf("Unable to write to file [%s]!\n", l.config.FilePath), err.Error())
 		} else {
-			LogStd(fmt.Sprintf("Received hook to syslog server [%s]!\n", l.syslogServer), false)
+			LogStd(fmt.Sprintf("Writing events to file [%s]\n", l.config.FilePath), false)
 			l.Logger.Hooks.Add(hook)
 			success = true
 		}
+	case OutputHTTP:
+		hook, err := newHTTPHook(l.config)
+		if err != nil {
+			l.connectErr = err
+			LogError("Unable to set up the HTTP output!\n", err.Error())
+		} else {
+			LogStd(fmt.Sprintf("Posting events to [%s]\n", l.config.HTTPURL), false)
+			l.Logger.Hooks.Add(hook)
+			success = true
+		}
+	default:
+		if l.connectSyslog() {
+			success = true
+		}
+	}
+
+	if l.config.FifoPath != "" {
+		hook, err := newFifoHook(l.config.FifoPath, newLineEncoder(l.config.OutputEncoding, l.config.EncodingReplacement))
+		if err != nil {
+			LogError(fmt.Sprintf("Unable to use FIFO [%s]!\n", l.config.FifoPath), err.Error())
+		} else {
+			LogStd(fmt.Sprintf("Writing events to FIFO [%s]\n", l.config.FifoPath), false)
+			l.Logger.Hooks.Add(hook)
+			success = true
+		}
+	}
+	if success {
+		atomic.StoreInt32(&l.connected, 1)
 	}
 	return success
 }
 
+// ConnectError returns the error of the output that failed to connect
+// during the last Connect, if any.
+func (l *LoggingLogrus) ConnectError() error {
+	return l.connectErr
+}
+
+// connectSyslog hooks the syslog server, the servers it lists or the
+// servers of the SRV record to the logger, along with the destinations of the route map.
+func (l *LoggingLogrus) connectSyslog() bool {
+	var hook *SyslogHook
+	var lanes []syslogWriter
+	if l.config.SyslogSRV != "" {
+		pool, err := newSRVPool(l.config)
+		if err != nil {
+			l.connectErr = err
+			LogError(fmt.Sprintf("Unable to connect to syslog servers of SRV record [%s]!\n", l.config.SyslogSRV), err.Error())
+		} else {
+			hook = newSyslogHook(pool, l.config)
+			lanes = l.dialLanes(func() (syslogWriter, error) { return newSRVPool(l.config) })
+		}
+	} else if addrs := ParseSyslogServers(l.config.SyslogServer); len(addrs) > 1 {
+		pool, err := newBalancedPool(l.config, addrs)
+		if err != nil {
+			l.connectErr = err
+			LogError(fmt.Sprintf("Unable to connect to syslog servers [%s]!\n", l.config.SyslogServer), err.Error())
+		} else {
+			hook = newSyslogHook(pool, l.config)
+			lanes = l.dialLanes(func() (syslogWriter, error) { return newBalancedPool(l.config, addrs) })
+		}
+	} else if l.config.SyslogServer != "" {
+		writer, err := dialSyslog(l.config)
+		if err != nil {
+			l.connectErr = err
+			LogError(fmt.Sprintf("Unable to connect to syslog server [%s]!\n", l.config.SyslogServer), err.Error())
+		} else {
+			LogStd(fmt.Sprintf("Received hook to syslog server [%s]!\n", l.config.SyslogServer), false)
+			hook = newSyslogHook(writer, l.config)
+			lanes = l.dialLanes(func() (syslogWriter, error) { return dialSyslog(l.config) })
+		}
+	}
+	if hook == nil {
+		return false
+	}
+	if l.config.SpoolDir != "" {
+		writers, err := l.spool(append([]syslogWriter{hook.writer}, lanes...))
+		if err != nil {
+			l.connectErr = err
+			return false
+		}
+		hook.writer, lanes = writers[0], writers[1:]
+	}
+	if len(lanes) > 0 {
+		hook.useLanes(lanes)
+	}
+
+	routeHooks, err := l.routeHooks()
+	if err != nil {
+		l.connectErr = err
+		LogError("Unable to connect to the syslog servers of the route map", err.Error())
+		hook.closeWriters()
+		return false
+	}
+	if len(routeHooks) > 0 {
+		hook.excludedTypes = make(map[string]bool, len(l.config.Routes))
+		for eventType := range l.config.Routes {
+			hook.excludedTypes[eventType] = true
+		}
+	}
+	l.Logger.Hooks.Add(hook)
+	for _, routeHook := range routeHooks {
+		l.Logger.Hooks.Add(routeHook)
+	}
+	return true
+}
+
+// dialLanes opens the additional connections of the write lanes. The hook
+// keeps writing over its single connection when one of them fails.
+func (l *LoggingLogrus) dialLanes(dial func() (syslogWriter, error)) []syslogWriter {
+	var writers []syslogWriter
+	for i := 1; i < l.config.WriteLanes; i++ {
+		writer, err := dial()
+		if err != nil {
+			LogError("Unable to open the syslog write lanes, writing over a single connection", err.Error())
+			for _, w := range writers {
+				w.Close()
+			}
+			return nil
+		}
+		writers = append(writers, writer)
+	}
+	return writers
+}
+
+// spool wraps every writer in a spool of its own, the first one in the
+// spool directory and those of the other write lanes in a lane-N
+// subdirectory, so that each lane replays its messages in order. The lanes
+// share SpoolMaxBytes evenly. The writers are closed when a spool can't be
+// opened.
+func (l *LoggingLogrus) spool(writers []syslogWriter) ([]syslogWriter, error) {
+	maxBytes := l.config.SpoolMaxBytes / int64(len(writers))
+	spools := make([]syslogWriter, 0, len(writers))
+	for i, writer := range writers {
+		dir := l.config.SpoolDir
+		if i > 0 {
+			dir = filepath.Join(dir, fmt.Sprintf("lane-%d", i))
+		}
+		spool, err := newSpoolWriter(writer, dir, maxBytes, spoolReplayInterval)
+		if err != nil {
+			LogError(fmt.Sprintf("Unable to open the spool in [%s]", dir), err.Error())
+			for _, w := range append(spools, writers[i:]...) {
+				w.Close()
+			}
+			return nil, err
+		}
+		spools = append(spools, spool)
+	}
+	return spools, nil
+}
+
+// Flush writes the events batched by the syslog, Kafka, HTTP and file hooks.
+func (l *LoggingLogrus) Flush() {
+	for _, hook := range l.Logger.Hooks[logrus.InfoLevel] {
+		switch hook := hook.(type) {
+		case *SyslogHook:
+			if err := hook.Flush(); err != nil {
+				LogError("Unable to flush the syslog writes", err.Error())
+			}
+		case *KafkaHook:
+			if err := hook.Flush(); err != nil {
+				LogError("Unable to flush the Kafka producer", err.Error())
+			}
+		case *HTTPHook:
+			if err := hook.Flush(); err != nil {
+				LogError("Unable to flush the HTTP output", err.Error())
+			}
+		case *FileHook:
+			if err := hook.Flush(); err != nil {
+				LogError("Unable to flush the file output", err.Error())
+			}
+		}
+	}
+}
+
+// Close flushes and closes the file output, and flushes the syslog hook
+// before closing its spool.
+func (l *LoggingLogrus) Close() {
+	for _, hook := range l.Logger.Hooks[logrus.InfoLevel] {
+		switch hook := hook.(type) {
+		case *FileHook:
+			if err := hook.Close(); err != nil {
+				LogError("Unable to close the file output", err.Error())
+			}
+		case *SyslogHook:
+			if err := hook.Flush(); err != nil {
+				LogError("Unable to flush the syslog writes", err.Error())
+			}
+			for _, writer := range hook.writers() {
+				if spool, ok := writer.(*spoolWriter); ok {
+					if err := spool.Close(); err != nil {
+						LogError("Unable to close the syslog spool", err.Error())
+					}
+				}
+			}
+		}
+	}
+}
+
 func (l *LoggingLogrus) ShipEvents(eventFields map[string]interface{}, Message string) {
-	l.Logger.WithFields(eventFields).Info(Message)
+	level := GetLogLevel(eventFields)
+	entry := l.Logger.WithFields(filterFieldNames(eventFields, l.config.FieldNameAllow))
+	if l.config.IncludeSyslogPri {
+		entry = entry.WithField("syslog_pri", newPriorities(l.config).pri(level, eventFields))
+	}
+	switch level {
+	case logrus.ErrorLevel:
+		entry.Error(Message)
+	default:
+		entry.Info(Message)
+	}
+	if l.outputsHealthy() {
+		atomic.StoreInt64(&l.lastEvent, time.Now().UnixNano())
+	}
+}
+
+func GetLogLevel(eventFields map[string]interface{}) logrus.Level {
+	if eventType, ok := eventFields["event_type"].(string); ok && highSeverityEventTypes[eventType] {
+		return logrus.ErrorLevel
+	}
+	return logrus.InfoLevel
+}
+
+// logFormatter returns the formatter of logFormatterType, the json one
+// selecting and renaming fields as configured
+func (config *LoggingConfig) logFormatter(logFormatterType string) logrus.Formatter {
+	switch logFormatterType {
+	case "text", "logfmt":
+		return GetLogFormatter(logFormatterType)
+	default:
+		return newJSONFormatter(config)
+	}
 }
 
 func GetLogFormatter(logFormatterType string) logrus.Formatter {
 	switch logFormatterType {
 	case "text":
 		return &logrus.TextFormatter{}
+	case "logfmt":
+		return &logrus.TextFormatter{DisableColors: true}
 	default:
 		return &logrus.JSONFormatter{}
 	}
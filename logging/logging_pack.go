@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+)
+
+// eventPacker packs formatted lines into a single newline separated payload,
+// sent with one syslog header. A pack is flushed when it holds maxEvents
+// lines, when the next line would push it over maxBytes, when the severity
+// changes (the pack is sent with a single one) or every interval.
+type eventPacker struct {
+	maxEvents int
+	maxBytes  int
+	flush     func(severity syslog.Priority, payload string) error
+
+	mu       sync.Mutex
+	lines    []string
+	size     int
+	severity syslog.Priority
+}
+
+func newEventPacker(maxEvents int, maxBytes int, interval time.Duration, flush func(syslog.Priority, string) error) *eventPacker {
+	p := &eventPacker{
+		maxEvents: maxEvents,
+		maxBytes:  maxBytes,
+		flush:     flush,
+	}
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				if err := p.Flush(); err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to flush packed events, %v\n", err)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+func (p *eventPacker) Add(severity syslog.Priority, line string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.lines) > 0 && (severity != p.severity || (p.maxBytes > 0 && p.size+len(line) > p.maxBytes)) {
+		if err := p.flushLocked(); err != nil {
+			return err
+		}
+	}
+	p.lines = append(p.lines, line)
+	p.size += len(line)
+	p.severity = severity
+	if len(p.lines) >= p.maxEvents {
+		return p.flushLocked()
+	}
+	return nil
+}
+
+func (p *eventPacker) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushLocked()
+}
+
+func (p *eventPacker) flushLocked() error {
+	if len(p.lines) == 0 {
+		return nil
+	}
+	payload := strings.Join(p.lines, "")
+	p.lines = p.lines[:0]
+	p.size = 0
+	return p.flush(p.severity, payload)
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event packer", func() {
+	var (
+		packer     *eventPacker
+		payloads   []string
+		severities []syslog.Priority
+	)
+
+	BeforeEach(func() {
+		payloads = nil
+		severities = nil
+		packer = newEventPacker(3, 20, 0, func(severity syslog.Priority, payload string) error {
+			severities = append(severities, severity)
+			payloads = append(payloads, payload)
+			return nil
+		})
+	})
+
+	It("should flush once the event count is reached", func() {
+		for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+			Expect(packer.Add(syslog.LOG_INFO, line)).To(Succeed())
+		}
+		Expect(payloads).To(Equal([]string{"a\nb\nc\n"}))
+
+		Expect(packer.Flush()).To(Succeed())
+		Expect(payloads).To(Equal([]string{"a\nb\nc\n", "d\n"}))
+	})
+
+	It("should flush before going over the byte limit", func() {
+		Expect(packer.Add(syslog.LOG_INFO, "0123456789\n")).To(Succeed())
+		Expect(packer.Add(syslog.LOG_INFO, "0123456789\n")).To(Succeed())
+		Expect(payloads).To(Equal([]string{"0123456789\n"}))
+	})
+
+	It("should not mix severities in a pack", func() {
+		Expect(packer.Add(syslog.LOG_INFO, "a\n")).To(Succeed())
+		Expect(packer.Add(syslog.LOG_ERR, "crash\n")).To(Succeed())
+		Expect(packer.Flush()).To(Succeed())
+		Expect(payloads).To(Equal([]string{"a\n", "crash\n"}))
+		Expect(severities).To(Equal([]syslog.Priority{syslog.LOG_INFO, syslog.LOG_ERR}))
+	})
+})
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+// priorityQueueDepth is the number of messages the priority queue holds
+// before Fire blocks, applying backpressure instead of dropping.
+const priorityQueueDepth = 1024
+
+type queuedMessage struct {
+	severity syslog.Priority
+	source   string
+	line     string
+	// flushed marks a flush rather than a message, closed once the
+	// messages queued before it are delivered
+	flushed chan struct{}
+}
+
+// priorityQueue hands messages to the sink from the highest priority level
+// first, in order within a level, so that errors and crashes don't wait
+// behind a backlog of metrics. Event types are spread over the levels
+// following the shed priority, the last to shed getting the highest level;
+// event types missing from it get the highest level too.
+type priorityQueue struct {
+	levels int
+	ranks  map[string]int
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queues   [][]queuedMessage
+	size     int
+
+	depth *metrics.Gauge
+}
+
+func newPriorityQueue(levels int, shedPriority []string) *priorityQueue {
+	q := &priorityQueue{
+		levels: levels,
+		ranks:  make(map[string]int, len(shedPriority)),
+		queues: make([][]queuedMessage, levels),
+		depth:  metrics.NewGauge("sink_priority_queue_depth"),
+	}
+	for i, eventType := range shedPriority {
+		q.ranks[eventType] = i * levels / len(shedPriority)
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// levelOf returns the priority level of eventType, 0 being the lowest.
+func (q *priorityQueue) levelOf(eventType string) int {
+	if level, ok := q.ranks[eventType]; ok {
+		return level
+	}
+	return q.levels - 1
+}
+
+func (q *priorityQueue) push(eventType string, message queuedMessage) {
+	q.pushLevel(q.levelOf(eventType), message)
+}
+
+func (q *priorityQueue) pushLevel(level int, message queuedMessage) {
+	q.mu.Lock()
+	for q.size == priorityQueueDepth {
+		q.notFull.Wait()
+	}
+	q.queues[level] = append(q.queues[level], message)
+	q.size++
+	q.depth.Set(float64(q.size))
+	q.mu.Unlock()
+	q.notEmpty.Signal()
+}
+
+func (q *priorityQueue) pop() queuedMessage {
+	q.mu.Lock()
+	for q.size == 0 {
+		q.notEmpty.Wait()
+	}
+	var message queuedMessage
+	for level := q.levels - 1; level >= 0; level-- {
+		if len(q.queues[level]) > 0 {
+			message = q.queues[level][0]
+			q.queues[level] = q.queues[level][1:]
+			break
+		}
+	}
+	q.size--
+	q.depth.Set(float64(q.size))
+	q.mu.Unlock()
+	q.notFull.Signal()
+	return message
+}
+
+// flush waits until the messages queued so far are delivered. Its marker
+// goes last in the lowest level, which is only popped once the higher
+// levels are empty.
+func (q *priorityQueue) flush() {
+	flushed := make(chan struct{})
+	q.pushLevel(0, queuedMessage{flushed: flushed})
+	<-flushed
+}
+
+// drain hands the queued messages to deliver, one at a time.
+func (q *priorityQueue) drain(deliver func(syslog.Priority, string, string) error) {
+	for {
+		message := q.pop()
+		if message.flushed != nil {
+			close(message.flushed)
+			continue
+		}
+		if err := deliver(message.severity, message.source, message.line); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fire hook: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"fmt"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Priority queue", func() {
+	var queue *priorityQueue
+
+	BeforeEach(func() {
+		queue = newPriorityQueue(3, ParseShedPriority(DefaultShedPriority))
+	})
+
+	It("should spread the shed priority over the levels", func() {
+		Expect(queue.levelOf("ContainerMetric")).To(Equal(0))
+		Expect(queue.levelOf("ValueMetric")).To(Equal(0))
+		Expect(queue.levelOf("CounterEvent")).To(Equal(1))
+		Expect(queue.levelOf("HttpStartStop")).To(Equal(1))
+		Expect(queue.levelOf("LogMessage")).To(Equal(2))
+		Expect(queue.levelOf("Error")).To(Equal(2))
+		Expect(queue.levelOf("crash")).To(Equal(2))
+	})
+
+	It("should deliver higher levels first, in order within a level", func() {
+		push := func(eventType string, line string) {
+			queue.push(eventType, queuedMessage{severity: syslog.LOG_INFO, line: line})
+		}
+		push("ContainerMetric", "metric-1")
+		push("HttpStartStop", "http-1")
+		push("ValueMetric", "metric-2")
+		push("crash", "crash-1")
+		push("LogMessage", "log-1")
+
+		var lines []string
+		for i := 0; i < 5; i++ {
+			lines = append(lines, queue.pop().line)
+		}
+		Expect(lines).To(Equal([]string{"crash-1", "log-1", "http-1", "metric-1", "metric-2"}))
+	})
+
+	It("should block pushes once full until a message is delivered", func() {
+		for i := 0; i < priorityQueueDepth; i++ {
+			queue.push("ValueMetric", queuedMessage{line: "metric"})
+		}
+		pushed := make(chan struct{})
+		go func() {
+			queue.push("Error", queuedMessage{line: "error"})
+			close(pushed)
+		}()
+		Consistently(pushed).ShouldNot(BeClosed())
+
+		queue.pop()
+		Eventually(pushed).Should(BeClosed())
+		Expect(queue.pop().line).To(Equal("error"))
+	})
+
+	It("should write every queued message once the hook is flushed", func() {
+		writers := []*recordingWriter{{delay: time.Millisecond}, {delay: time.Millisecond}}
+		hook := newSyslogHook(writers[0], &LoggingConfig{PriorityLevels: 3, ShedPriority: ParseShedPriority(DefaultShedPriority)})
+		hook.useLanes([]syslogWriter{writers[1]})
+
+		for i := 0; i < 50; i++ {
+			for _, eventType := range []string{"ValueMetric", "HttpStartStop", "LogMessage"} {
+				entry := laneEntry(fmt.Sprintf("app-%d", i%4), eventType).WithField("event_type", eventType)
+				entry.Message = eventType
+				Expect(hook.Fire(entry)).To(Succeed())
+			}
+		}
+
+		Expect(hook.Flush()).To(Succeed())
+		Expect(len(writers[0].received()) + len(writers[1].received())).To(Equal(150))
+	})
+})
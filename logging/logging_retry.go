@@ -0,0 +1,130 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/retry"
+)
+
+const (
+	UnreachableExit   = "exit"
+	UnreachableRetry  = "retry"
+	UnreachableBuffer = "buffer"
+)
+
+type bufferedEvent struct {
+	fields  map[string]interface{}
+	message string
+}
+
+// RetryingLogging keeps reconnecting a Logging that couldn't connect at
+// startup in the background, so that the firehose is consumed meanwhile.
+// Until the connection succeeds, events are buffered, the oldest being
+// dropped beyond bufferSize, or all dropped when bufferSize is 0. Errors
+// that retrying won't fix, such as an untrusted certificate, stop the
+// retries.
+type RetryingLogging struct {
+	logging    Logging
+	interval   time.Duration
+	bufferSize int
+
+	mu        sync.Mutex
+	connected bool
+	buffer    []bufferedEvent
+	dropped   *metrics.Counter
+}
+
+func NewRetryingLogging(logging Logging, interval time.Duration, bufferSize int) *RetryingLogging {
+	return &RetryingLogging{
+		logging:    logging,
+		interval:   interval,
+		bufferSize: bufferSize,
+		dropped:    metrics.NewCounter("syslog_unreachable_dropped"),
+	}
+}
+
+// Connect always succeeds: a failed connection is retried in the background.
+func (r *RetryingLogging) Connect() bool {
+	if r.logging.Connect() {
+		r.setConnected()
+		return true
+	}
+
+	if r.fatal() {
+		return true
+	}
+	LogError(fmt.Sprintf("Syslog server unreachable, retrying every %s", r.interval), nil)
+	go func() {
+		for {
+			time.Sleep(r.interval)
+			if r.logging.Connect() {
+				LogStd("Connected to Syslog Server!", true)
+				r.setConnected()
+				return
+			}
+			if r.fatal() {
+				return
+			}
+		}
+	}()
+	return true
+}
+
+// fatal tells whether the last connection failed with an error retrying
+// won't fix, logging its category then.
+func (r *RetryingLogging) fatal() bool {
+	errorer, ok := r.logging.(connectErrorer)
+	if !ok || !retry.IsFatal(errorer.ConnectError()) {
+		return false
+	}
+	category, _ := retry.Classify(errorer.ConnectError())
+	LogError(fmt.Sprintf("Syslog server unreachable after a fatal %s error, not retrying until the nozzle restarts", category), errorer.ConnectError())
+	return true
+}
+
+// setConnected ships the buffered events before any new one.
+func (r *RetryingLogging) setConnected() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, event := range r.buffer {
+		r.logging.ShipEvents(event.fields, event.message)
+	}
+	r.buffer = nil
+	r.connected = true
+}
+
+func (r *RetryingLogging) Flush() {
+	if flusher, ok := r.logging.(Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *RetryingLogging) Close() {
+	if closer, ok := r.logging.(Closer); ok {
+		closer.Close()
+	}
+}
+
+func (r *RetryingLogging) ShipEvents(eventFields map[string]interface{}, message string) {
+	r.mu.Lock()
+	if r.connected {
+		r.mu.Unlock()
+		r.logging.ShipEvents(eventFields, message)
+		return
+	}
+	defer r.mu.Unlock()
+
+	if r.bufferSize == 0 {
+		r.dropped.Inc()
+		return
+	}
+	if len(r.buffer) == r.bufferSize {
+		r.buffer = r.buffer[1:]
+		r.dropped.Inc()
+	}
+	r.buffer = append(r.buffer, bufferedEvent{fields: eventFields, message: message})
+}
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"crypto/x509"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeLogging struct {
+	mu         sync.Mutex
+	reachable  bool
+	connectErr error
+	connects   int
+	messages   []string
+}
+
+func (f *fakeLogging) Connect() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connects++
+	return f.reachable
+}
+
+func (f *fakeLogging) ConnectError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connectErr
+}
+
+func (f *fakeLogging) connectCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects
+}
+
+func (f *fakeLogging) ShipEvents(fields map[string]interface{}, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, message)
+}
+
+func (f *fakeLogging) setReachable() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reachable = true
+}
+
+func (f *fakeLogging) shipped() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+var _ = Describe("RetryingLogging", func() {
+	var inner *fakeLogging
+
+	BeforeEach(func() {
+		inner = &fakeLogging{}
+	})
+
+	It("should ship directly once connected", func() {
+		inner.setReachable()
+		retrying := NewRetryingLogging(inner, time.Millisecond, 0)
+		Expect(retrying.Connect()).To(BeTrue())
+		retrying.ShipEvents(nil, "hello")
+		Expect(inner.shipped()).To(Equal([]string{"hello"}))
+	})
+
+	It("should not retry fatal errors", func() {
+		inner.connectErr = x509.UnknownAuthorityError{}
+		retrying := NewRetryingLogging(inner, time.Millisecond, 0)
+		Expect(retrying.Connect()).To(BeTrue())
+		Consistently(inner.connectCount, 50*time.Millisecond).Should(Equal(1))
+	})
+
+	It("should keep retrying network errors", func() {
+		inner.connectErr = &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}
+		retrying := NewRetryingLogging(inner, time.Millisecond, 0)
+		Expect(retrying.Connect()).To(BeTrue())
+		Eventually(inner.connectCount).Should(BeNumerically(">", 1))
+	})
+
+	It("should drop events until connected without a buffer", func() {
+		retrying := NewRetryingLogging(inner, 10*time.Millisecond, 0)
+		Expect(retrying.Connect()).To(BeTrue())
+		retrying.ShipEvents(nil, "lost")
+
+		inner.setReachable()
+		Eventually(func() bool { retrying.mu.Lock(); defer retrying.mu.Unlock(); return retrying.connected }).Should(BeTrue())
+		retrying.ShipEvents(nil, "hello")
+		Expect(inner.shipped()).To(Equal([]string{"hello"}))
+	})
+
+	It("should flush the buffered events on connection, dropping the oldest", func() {
+		retrying := NewRetryingLogging(inner, 10*time.Millisecond, 2)
+		Expect(retrying.Connect()).To(BeTrue())
+		for _, message := range []string{"one", "two", "three"} {
+			retrying.ShipEvents(nil, message)
+		}
+
+		inner.setReachable()
+		Eventually(inner.shipped).Should(Equal([]string{"two", "three"}))
+	})
+})
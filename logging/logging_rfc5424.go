@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// SyslogFormatRFC3164 keeps the BSD style header srslog adds to every
+	// message
+	SyslogFormatRFC3164 = "rfc3164"
+	// SyslogFormatRFC5424 frames messages following RFC 5424, event fields
+	// becoming structured data
+	SyslogFormatRFC5424 = "rfc5424"
+
+	// rfc5424SDID is the structured data element event fields are sent in
+	rfc5424SDID = "cf@47450"
+	// rfc5424Timestamp is RFC 3339 with microseconds
+	rfc5424Timestamp = "2006-01-02T15:04:05.000000Z07:00"
+	rfc5424Nil       = "-"
+)
+
+// rawSyslogFormatter sends messages as they are, for messages carrying their
+// own header
+func rawSyslogFormatter(p syslog.Priority, hostname, tag, content string) string {
+	return content
+}
+
+// rfc5424Formatter frames entries as
+// PRI VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG,
+// with the app GUID as APP-NAME unless appName is set, the source instance
+// as PROCID and the event type as MSGID.
+type rfc5424Formatter struct {
+	hostname   string
+	appName    string
+	priorities priorities
+}
+
+func newRFC5424Formatter(hostname string, appName string, priorities priorities) *rfc5424Formatter {
+	f := &rfc5424Formatter{hostname: headerField(hostname, 255), priorities: priorities}
+	if appName != "" {
+		f.appName = headerField(appName, 48)
+	}
+	return f
+}
+
+// Format frames the entry message, every field of the entry being sent as a
+// structured data parameter.
+func (f *rfc5424Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return []byte(f.frame(entry, structuredData(entry.Data), entry.Message)), nil
+}
+
+// frame builds the line of an entry with the given structured data and
+// message.
+func (f *rfc5424Formatter) frame(entry *logrus.Entry, sd string, msg string) string {
+	line := fmt.Sprintf("<%d>1 %s %s %s %s %s %s",
+		f.priorities.pri(entry.Level, entry.Data),
+		entry.Time.Format(rfc5424Timestamp),
+		f.hostname,
+		f.appNameOf(entry),
+		headerField(fmt.Sprint(entry.Data["source_instance"]), 128),
+		headerField(fmt.Sprint(entry.Data["event_type"]), 32),
+		sd)
+	if msg = strings.TrimRight(msg, "\n"); msg != "" {
+		line += " " + msg
+	}
+	return line + "\n"
+}
+
+func (f *rfc5424Formatter) appNameOf(entry *logrus.Entry) string {
+	if f.appName != "" {
+		return f.appName
+	}
+	return headerField(fmt.Sprint(entry.Data["cf_app_id"]), 48)
+}
+
+func structuredData(fields logrus.Fields) string {
+	if len(fields) == 0 {
+		return rfc5424Nil
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sd := "[" + rfc5424SDID
+	for _, k := range keys {
+		sd += fmt.Sprintf(` %s="%s"`, paramName(k), paramValueEscaper.Replace(fmt.Sprint(fields[k])))
+	}
+	return sd + "]"
+}
+
+var paramValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// headerField makes a header field printable US-ASCII without spaces, cut
+// to max characters. Missing values are sent as the NILVALUE.
+func headerField(value string, max int) string {
+	if value == "" || value == "<nil>" {
+		return rfc5424Nil
+	}
+	return sanitize(value, max, "")
+}
+
+// paramName makes a field name a valid SD-NAME.
+func paramName(name string) string {
+	return sanitize(name, 32, `=]"`)
+}
+
+func sanitize(value string, max int, forbidden string) string {
+	b := []byte(value)
+	if len(b) > max {
+		b = b[:max]
+	}
+	for i, c := range b {
+		if c < 33 || c > 126 || strings.IndexByte(forbidden, c) >= 0 {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
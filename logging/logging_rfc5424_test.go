@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"fmt"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RFC 5424 formatter", func() {
+	var (
+		formatter *rfc5424Formatter
+		entry     *logrus.Entry
+	)
+
+	BeforeEach(func() {
+		formatter = &rfc5424Formatter{hostname: "nozzle-0"}
+		entry = logrus.NewEntry(logrus.New()).WithFields(logrus.Fields{
+			"cf_app_id":       "eea38ba5-53a5-4173-9617-b442d35ec2fd",
+			"source_instance": "0",
+			"event_type":      "LogMessage",
+			"cf_org_name":     "my-org",
+		})
+		entry.Time = time.Date(2017, 3, 14, 15, 9, 26, 535897000, time.UTC)
+		entry.Level = logrus.InfoLevel
+		entry.Message = "hello world"
+	})
+
+	format := func() string {
+		line, err := formatter.Format(entry)
+		Expect(err).ToNot(HaveOccurred())
+		return string(line)
+	}
+
+	It("should frame the entry with the RFC 5424 header and structured data", func() {
+		Expect(format()).To(Equal(`<6>1 2017-03-14T15:09:26.535897Z nozzle-0 eea38ba5-53a5-4173-9617-b442d35ec2fd 0 LogMessage ` +
+			`[cf@47450 cf_app_id="eea38ba5-53a5-4173-9617-b442d35ec2fd" cf_org_name="my-org" event_type="LogMessage" source_instance="0"] hello world` + "\n"))
+	})
+
+	It("should escape backslashes, quotes and closing brackets in values", func() {
+		entry = entry.WithField("cf_space_name", `a\b"c]d`)
+		Expect(format()).To(ContainSubstring(`cf_space_name="a\\b\"c\]d"`))
+	})
+
+	It("should send missing header fields as the NILVALUE", func() {
+		entry = logrus.NewEntry(logrus.New())
+		entry.Time = time.Date(2017, 3, 14, 15, 9, 26, 0, time.UTC)
+		entry.Message = "hi"
+		Expect(format()).To(HaveSuffix(">1 2017-03-14T15:09:26.000000Z nozzle-0 - - - - hi\n"))
+	})
+
+	It("should sanitize field names and header fields", func() {
+		entry = entry.WithField("bad name=x", "v").WithField("source_instance", "web 1")
+		line := format()
+		Expect(line).To(ContainSubstring(` bad_name_x="v"`))
+		Expect(line).To(ContainSubstring(` web_1 LogMessage `))
+	})
+
+	It("should use the error severity for high severity events", func() {
+		entry.Level = logrus.ErrorLevel
+		Expect(format()).To(HavePrefix("<3>1 "))
+	})
+
+	It("should send the configured app name instead of the app GUID", func() {
+		formatter = newRFC5424Formatter("nozzle-0", "prod nozzle", priorities{})
+		Expect(format()).To(HavePrefix("<6>1 2017-03-14T15:09:26.535897Z nozzle-0 prod_nozzle 0 LogMessage "))
+	})
+
+	It("should use the configured facility and severities", func() {
+		formatter.priorities = priorities{facility: syslog.LOG_LOCAL0, severities: map[string]syslog.Priority{"LogMessage": syslog.LOG_NOTICE}}
+		Expect(format()).To(HavePrefix(fmt.Sprintf("<%d>1 ", 16*8+5)))
+	})
+})
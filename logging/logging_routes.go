@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// ParseDestination splits a syslog destination such as tcp://siem:514 into
+// its protocol and address.
+func ParseDestination(destination string) (string, string, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "tcp", "udp", SecureProto:
+	default:
+		return "", "", fmt.Errorf("Unsupported syslog protocol [%s] in %s", u.Scheme, destination)
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("Missing syslog server address in %s", destination)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// routeHooks dials a hook per destination of the route map, shipping the
+// event types routed to it. Each destination has its own connection,
+// reconnected independently of the others.
+func (l *LoggingLogrus) routeHooks() ([]*SyslogHook, error) {
+	typesByDestination := make(map[string]map[string]bool)
+	for eventType, destination := range l.config.Routes {
+		if typesByDestination[destination] == nil {
+			typesByDestination[destination] = make(map[string]bool)
+		}
+		typesByDestination[destination][eventType] = true
+	}
+	destinations := make([]string, 0, len(typesByDestination))
+	for destination := range typesByDestination {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+
+	var hooks []*SyslogHook
+	for _, destination := range destinations {
+		protocol, addr, err := ParseDestination(destination)
+		if err == nil {
+			routeConfig := *l.config
+			routeConfig.SyslogServer = addr
+			routeConfig.SyslogProtocol = protocol
+			routeConfig.SyslogSRV = ""
+			var writer syslogWriter
+			if writer, err = dialSyslog(&routeConfig); err == nil {
+				LogStd(fmt.Sprintf("Received hook to syslog server [%s]!\n", destination), false)
+				hook := newSyslogHook(writer, &routeConfig)
+				hook.eventTypes = typesByDestination[destination]
+				hooks = append(hooks, hook)
+				continue
+			}
+		}
+		for _, hook := range hooks {
+			hook.writer.Close()
+		}
+		return nil, fmt.Errorf("Unable to connect to syslog server [%s]: %v", destination, err)
+	}
+	return hooks, nil
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// udpServer returns the messages a UDP syslog server received
+type udpServer struct {
+	conn net.PacketConn
+}
+
+func newUDPServer() *udpServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	return &udpServer{conn: conn}
+}
+
+func (s *udpServer) received() []string {
+	var messages []string
+	buf := make([]byte, 4096)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return messages
+		}
+		// skip the empty datagram probing the server when dialing
+		if n > 0 {
+			messages = append(messages, string(buf[:n]))
+		}
+	}
+}
+
+var _ = Describe("Route map", func() {
+	It("should parse syslog destinations", func() {
+		protocol, addr, err := ParseDestination("tcp+tls://siem:6514")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(protocol).To(Equal(SecureProto))
+		Expect(addr).To(Equal("siem:6514"))
+
+		_, _, err = ParseDestination("http://siem:514")
+		Expect(err).To(HaveOccurred())
+		_, _, err = ParseDestination("tcp://")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should ship routed event types to their destination only", func() {
+		defaultServer, siem := newUDPServer(), newUDPServer()
+		defer defaultServer.conn.Close()
+		defer siem.conn.Close()
+
+		logging := NewLogging(&LoggingConfig{
+			SyslogServer:   defaultServer.conn.LocalAddr().String(),
+			SyslogProtocol: "udp",
+			Routes:         map[string]string{"LogMessage": "udp://" + siem.conn.LocalAddr().String()},
+		})
+		Expect(logging.Connect()).To(BeTrue())
+		logging.ShipEvents(map[string]interface{}{"event_type": "LogMessage"}, "app log")
+		logging.ShipEvents(map[string]interface{}{"event_type": "ValueMetric"}, "metric")
+
+		siemMessages := siem.received()
+		Expect(siemMessages).To(HaveLen(1))
+		Expect(siemMessages[0]).To(ContainSubstring("app log"))
+		defaultMessages := defaultServer.received()
+		Expect(defaultMessages).To(HaveLen(1))
+		Expect(defaultMessages[0]).To(ContainSubstring("metric"))
+	})
+
+	It("should fail to connect when a destination can't be reached", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		closedAddr := listener.Addr().String()
+		listener.Close()
+		defaultServer := newUDPServer()
+		defer defaultServer.conn.Close()
+
+		logging := NewLogging(&LoggingConfig{
+			SyslogServer:   defaultServer.conn.LocalAddr().String(),
+			SyslogProtocol: "udp",
+			Routes:         map[string]string{"LogMessage": "tcp://" + closedAddr},
+		}).(*LoggingLogrus)
+		Expect(logging.Connect()).To(BeFalse())
+		Expect(logging.Logger.Hooks).To(BeEmpty())
+	})
+})
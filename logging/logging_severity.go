@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/Sirupsen/logrus"
+)
+
+// facilities are the syslog facilities by name
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// severities are the syslog severities by name
+var severities = map[string]syslog.Priority{
+	"emerg":   syslog.LOG_EMERG,
+	"alert":   syslog.LOG_ALERT,
+	"crit":    syslog.LOG_CRIT,
+	"err":     syslog.LOG_ERR,
+	"warning": syslog.LOG_WARNING,
+	"notice":  syslog.LOG_NOTICE,
+	"info":    syslog.LOG_INFO,
+	"debug":   syslog.LOG_DEBUG,
+}
+
+// defaultSeverities are the severities of the event types the severity map
+// doesn't list, other events being sent with the severity of their level
+var defaultSeverities = map[string]syslog.Priority{
+	"Error": syslog.LOG_CRIT,
+}
+
+// ParseFacility returns the syslog facility named facility, such as local0
+func ParseFacility(facility string) (syslog.Priority, error) {
+	if p, ok := facilities[strings.ToLower(facility)]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("Unknown syslog facility [%s], valid options are %s", facility, names(facilities))
+}
+
+// ParseSeverityMap parses comma separated EventType=severity pairs, such as
+// 'Error=crit,ValueMetric=debug', into the syslog severity of each event
+// type.
+func ParseSeverityMap(severityMap string) (map[string]syslog.Priority, error) {
+	mapping := make(map[string]syslog.Priority)
+	for _, pair := range strings.Split(severityMap, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		eventType := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || eventType == "" {
+			return nil, fmt.Errorf("Malformed severity [%s], expected EventType=severity", pair)
+		}
+		severity, ok := severities[strings.ToLower(strings.TrimSpace(parts[1]))]
+		if !ok {
+			return nil, fmt.Errorf("Unknown syslog severity in [%s], valid options are %s", pair, names(severities))
+		}
+		mapping[eventType] = severity
+	}
+	return mapping, nil
+}
+
+func names(priorities map[string]syslog.Priority) string {
+	sorted := make([]string, 0, len(priorities))
+	for name := range priorities {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+// priorities computes the PRI of messages: the configured facility, and the
+// severity of their event.
+type priorities struct {
+	facility   syslog.Priority
+	severities map[string]syslog.Priority
+}
+
+func newPriorities(config *LoggingConfig) priorities {
+	return priorities{facility: config.SyslogFacility, severities: config.SeverityMap}
+}
+
+// severity returns the severity mapped to the event type, err for app logs
+// written to stderr, or the default severity of the event type or level.
+func (p priorities) severity(level logrus.Level, fields map[string]interface{}) syslog.Priority {
+	eventType, _ := fields["event_type"].(string)
+	if severity, ok := p.severities[eventType]; ok {
+		return severity
+	}
+	if eventType == "LogMessage" && fields["message_type"] == "ERR" {
+		return syslog.LOG_ERR
+	}
+	if severity, ok := defaultSeverities[eventType]; ok {
+		return severity
+	}
+	return levelSeverities[level]
+}
+
+// pri returns the PRI value (facility*8+severity) of a message.
+func (p priorities) pri(level logrus.Level, fields map[string]interface{}) int {
+	return int(p.facility | p.severity(level, fields))
+}
@@ -0,0 +1,304 @@
+package logging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/boltdb/bolt"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/retry"
+)
+
+const (
+	// spoolFile is the Bolt file of the spool in the spool directory
+	spoolFile   = "spool.db"
+	spoolBucket = "SpoolBucket"
+	// spoolReplayInterval is how often spooled messages are replayed, and
+	// the spool synced to disk
+	spoolReplayInterval = time.Second
+	// spoolReplayBatch bounds the messages replayed per transaction
+	spoolReplayBatch = 100
+)
+
+var (
+	spoolDepth    = metrics.NewGauge("spool_depth")
+	spoolBytes    = metrics.NewGauge("spool_bytes")
+	spoolReplayed = metrics.NewCounter("spool_replayed_messages")
+	spoolDropped  = metrics.NewCounter("spool_dropped_messages")
+)
+
+// spoolWriter persists in a Bolt file the messages its writer fails to
+// send, along with every message following them, and replays them in order
+// every interval until the writer accepts them again. Spooled messages are
+// bounded by maxBytes, the oldest being dropped when full, 0 not bounding
+// them. Messages still spooled on shutdown are replayed on the next start.
+// A replay failing with an error that retrying won't fix, such as an
+// untrusted certificate, stops the replays until then. Each write lane has
+// its own spool, the gauges adding up the spools of the nozzle.
+type spoolWriter struct {
+	writer   syslogWriter
+	db       *bolt.DB
+	dir      string
+	maxBytes int64
+	interval time.Duration
+
+	mu sync.Mutex
+	// next is the key of the next spooled message, depth and bytes the
+	// number and size of the spooled messages
+	next  uint64
+	depth int
+	bytes int64
+	// reportedDepth and reportedBytes are the share of the gauges
+	reportedDepth int
+	reportedBytes int64
+	// dirty is set when the spool changed since it was last synced
+	dirty bool
+	// replayErr is why the last replay failed
+	replayErr error
+
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSpoolWriter(writer syslogWriter, dir string, maxBytes int64, interval time.Duration) (*spoolWriter, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, spoolFile), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open spool in %s: %s", dir, err)
+	}
+	// the spool is synced every interval rather than on every message
+	db.NoSync = true
+
+	w := &spoolWriter{
+		writer:   writer,
+		db:       db,
+		dir:      dir,
+		maxBytes: maxBytes,
+		interval: interval,
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(spoolBucket))
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			w.next = binary.BigEndian.Uint64(k) + 1
+			w.depth++
+			w.bytes += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if w.depth > 0 {
+		LogStd(fmt.Sprintf("Replaying %d messages spooled in [%s]", w.depth, dir), true)
+	}
+	w.updateMetrics()
+	go w.replayEvery()
+	return w, nil
+}
+
+// WriteWithPriority writes the message unless messages are spooled, in
+// which case it is spooled after them, as it is when the write fails.
+func (w *spoolWriter) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.depth == 0 {
+		n, err := w.writer.WriteWithPriority(p, b)
+		if err == nil {
+			return n, nil
+		}
+		LogError(fmt.Sprintf("Syslog server unreachable, spooling messages in [%s]", w.dir), err.Error())
+	}
+	if err := w.push(p, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// push appends a message to the spool, dropping the oldest messages beyond
+// maxBytes. The caller holds the lock.
+func (w *spoolWriter) push(p syslog.Priority, b []byte) error {
+	value := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(value, uint32(p))
+	copy(value[4:], b)
+	if w.maxBytes > 0 && int64(len(value)) > w.maxBytes {
+		spoolDropped.Inc()
+		return nil
+	}
+
+	var dropped int
+	var freed int64
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(spoolBucket))
+		dropped, freed = 0, 0
+		for w.maxBytes > 0 && w.bytes-freed+int64(len(value)) > w.maxBytes {
+			k, v := bucket.Cursor().First()
+			if k == nil {
+				break
+			}
+			freed += int64(len(v))
+			dropped++
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, w.next)
+		return bucket.Put(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	w.next++
+	w.depth += 1 - dropped
+	w.bytes += int64(len(value)) - freed
+	w.dirty = true
+	spoolDropped.Add(uint64(dropped))
+	w.updateMetrics()
+	return nil
+}
+
+// replayBatch writes up to spoolReplayBatch spooled messages, oldest first,
+// removing the ones sent. It returns false once the spool is empty or the
+// writer failed.
+func (w *spoolWriter) replayBatch() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.depth == 0 {
+		return false
+	}
+
+	var sent int
+	var freed int64
+	var writeErr error
+	err := w.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(spoolBucket))
+		var keys [][]byte
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil && len(keys) < spoolReplayBatch; k, v = c.Next() {
+			if _, writeErr = w.writer.WriteWithPriority(syslog.Priority(binary.BigEndian.Uint32(v)), v[4:]); writeErr != nil {
+				break
+			}
+			keys = append(keys, k)
+			freed += int64(len(v))
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		sent = len(keys)
+		return nil
+	})
+	w.replayErr = writeErr
+	if err != nil {
+		LogError(fmt.Sprintf("Unable to remove replayed messages from spool [%s]", w.dir), err.Error())
+		return false
+	}
+	if sent > 0 {
+		w.depth -= sent
+		w.bytes -= freed
+		w.dirty = true
+		spoolReplayed.Add(uint64(sent))
+		w.updateMetrics()
+		if w.depth == 0 {
+			LogStd(fmt.Sprintf("Replayed the messages spooled in [%s]", w.dir), true)
+		}
+	}
+	return writeErr == nil && w.depth > 0
+}
+
+func (w *spoolWriter) replayEvery() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for w.replayBatch() {
+			}
+			if err := w.sync(); err != nil {
+				LogError(fmt.Sprintf("Unable to sync spool [%s]", w.dir), err.Error())
+			}
+			if err := w.lastReplayError(); retry.IsFatal(err) {
+				category, _ := retry.Classify(err)
+				LogError(fmt.Sprintf("Unable to replay the messages spooled in [%s] after a fatal %s error, keeping them spooled until the nozzle restarts", w.dir, category), err.Error())
+				return
+			}
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+// lastReplayError returns why the last replay failed, nil if it didn't
+func (w *spoolWriter) lastReplayError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.replayErr
+}
+
+// sync writes the spool to disk if it changed since the last sync.
+func (w *spoolWriter) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	// committing a transaction with NoSync unset syncs the whole file
+	w.db.NoSync = false
+	defer func() { w.db.NoSync = true }()
+	return w.db.Update(func(*bolt.Tx) error { return nil })
+}
+
+// updateMetrics exposes the depth of the spool, adding its change to the
+// gauges. The caller holds the lock.
+func (w *spoolWriter) updateMetrics() {
+	spoolDepth.Add(float64(w.depth - w.reportedDepth))
+	spoolBytes.Add(float64(w.bytes - w.reportedBytes))
+	w.reportedDepth, w.reportedBytes = w.depth, w.bytes
+}
+
+func (w *spoolWriter) Flush() error {
+	err := flushWriter(w.writer)
+	if syncErr := w.sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// Close stops the replay and closes the spool and the writer, the messages
+// still spooled being kept for the next start.
+func (w *spoolWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		<-w.done
+	})
+	if err := w.sync(); err != nil {
+		LogError(fmt.Sprintf("Unable to sync spool [%s]", w.dir), err.Error())
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the messages still spooled are reported again on the next start
+	spoolDepth.Add(-float64(w.reportedDepth))
+	spoolBytes.Add(-float64(w.reportedBytes))
+	w.reportedDepth, w.reportedBytes = 0, 0
+	if err := w.db.Close(); err != nil {
+		LogError(fmt.Sprintf("Unable to close spool [%s]", w.dir), err.Error())
+	}
+	return w.writer.Close()
+}
@@ -0,0 +1,196 @@
+package logging
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// outageWriter fails its writes while the syslog server is down
+type outageWriter struct {
+	recordingWriter
+	downMu sync.Mutex
+	down   bool
+	// downErr is the error of the failed writes, a refused connection by
+	// default
+	downErr error
+}
+
+func (w *outageWriter) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	w.downMu.Lock()
+	down, downErr := w.down, w.downErr
+	w.downMu.Unlock()
+	if down && downErr != nil {
+		return 0, downErr
+	}
+	if down {
+		return 0, errors.New("connection refused")
+	}
+	return w.recordingWriter.WriteWithPriority(p, b)
+}
+
+func (w *outageWriter) setDown(down bool) {
+	w.downMu.Lock()
+	defer w.downMu.Unlock()
+	w.down = down
+}
+
+var _ = Describe("Spool", func() {
+	var (
+		dir    string
+		writer *outageWriter
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).ToNot(HaveOccurred())
+		writer = &outageWriter{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	send := func(spool *spoolWriter, from, to int) {
+		for i := from; i < to; i++ {
+			_, err := spool.WriteWithPriority(syslog.LOG_INFO, []byte(fmt.Sprintf("message-%03d", i)))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	messages := func(from, to int) []string {
+		var messages []string
+		for i := from; i < to; i++ {
+			messages = append(messages, fmt.Sprintf("message-%03d", i))
+		}
+		return messages
+	}
+
+	It("should replay the messages of an outage in order, before the new ones", func() {
+		spool, err := newSpoolWriter(writer, dir, 0, 20*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		defer spool.Close()
+		replayed := spoolReplayed.Value()
+
+		send(spool, 0, 10)
+		writer.setDown(true)
+		send(spool, 10, 250)
+		Expect(spoolDepth.Value()).To(BeEquivalentTo(240))
+		Expect(writer.received()).To(Equal(messages(0, 10)))
+
+		writer.setDown(false)
+		send(spool, 250, 260)
+		Eventually(writer.received).Should(HaveLen(260))
+		send(spool, 260, 270)
+		Expect(writer.received()).To(Equal(messages(0, 270)))
+		Expect(spoolDepth.Value()).To(BeZero())
+		Expect(spoolReplayed.Value() - replayed).To(BeEquivalentTo(250))
+	})
+
+	It("should drop the oldest messages beyond its max bytes", func() {
+		// every spooled message takes 4 bytes of priority and 11 of message
+		spool, err := newSpoolWriter(writer, dir, 150, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		defer spool.Close()
+		dropped := spoolDropped.Value()
+
+		writer.setDown(true)
+		send(spool, 0, 25)
+		Expect(spoolDepth.Value()).To(BeEquivalentTo(10))
+		Expect(spoolBytes.Value()).To(BeEquivalentTo(150))
+		Expect(spoolDropped.Value() - dropped).To(BeEquivalentTo(15))
+
+		writer.setDown(false)
+		for spool.replayBatch() {
+		}
+		Expect(writer.received()).To(Equal(messages(15, 25)))
+	})
+
+	It("should stop replaying after a fatal error, keeping the messages spooled", func() {
+		writer.downErr = x509.UnknownAuthorityError{}
+		writer.setDown(true)
+		spool, err := newSpoolWriter(writer, dir, 0, 10*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		defer spool.Close()
+
+		send(spool, 0, 5)
+		Eventually(spool.done).Should(BeClosed())
+		writer.setDown(false)
+		Consistently(writer.received, 50*time.Millisecond).Should(BeEmpty())
+		Expect(spoolDepth.Value()).To(BeEquivalentTo(5))
+	})
+
+	It("should replay the messages spooled before a restart", func() {
+		writer.setDown(true)
+		spool, err := newSpoolWriter(writer, dir, 0, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		send(spool, 0, 5)
+		Expect(spool.Close()).To(Succeed())
+
+		restarted := &outageWriter{}
+		spool, err = newSpoolWriter(restarted, dir, 0, time.Hour)
+		Expect(err).ToNot(HaveOccurred())
+		defer spool.Close()
+		Expect(spoolDepth.Value()).To(BeEquivalentTo(5))
+		send(spool, 5, 8)
+		for spool.replayBatch() {
+		}
+		Expect(restarted.received()).To(Equal(messages(0, 8)))
+	})
+
+	It("should spool and replay the messages of every write lane, in order", func() {
+		writers := []*outageWriter{writer, {}, {}}
+		for _, w := range writers {
+			w.setDown(true)
+		}
+		l := NewLogging(&LoggingConfig{SpoolDir: dir}).(*LoggingLogrus)
+		spools, err := l.spool([]syslogWriter{writers[0], writers[1], writers[2]})
+		Expect(err).ToNot(HaveOccurred())
+		hook := newSyslogHook(spools[0], l.config)
+		hook.useLanes(spools[1:])
+		defer l.Close()
+		l.Logger.Hooks.Add(hook)
+
+		for i := 0; i < 20; i++ {
+			for _, app := range []string{"a", "b", "c", "d"} {
+				Expect(hook.Fire(laneEntry(app, fmt.Sprintf("%s-%02d", app, i)))).To(Succeed())
+			}
+		}
+		Expect(hook.Flush()).To(Succeed())
+		Expect(spoolDepth.Value()).To(BeEquivalentTo(80))
+		Expect(filepath.Join(dir, "lane-2", spoolFile)).To(BeAnExistingFile())
+
+		for _, w := range writers {
+			w.setDown(false)
+		}
+		total := func() int {
+			n := 0
+			for _, w := range writers {
+				n += len(w.received())
+			}
+			return n
+		}
+		Eventually(total, 3*time.Second).Should(Equal(80))
+		Expect(spoolDepth.Value()).To(BeZero())
+		for _, w := range writers {
+			last := map[string]string{}
+			for _, message := range w.received() {
+				match := laneMessagePattern.FindStringSubmatch(message)
+				Expect(match).To(HaveLen(3))
+				app, seq := match[1], match[2]
+				Expect(seq > last[app]).To(BeTrue())
+				last[app] = seq
+			}
+		}
+	})
+})
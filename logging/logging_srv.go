@@ -0,0 +1,186 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+)
+
+// syslogWriter is the part of srslog.Writer the hooks rely on.
+type syslogWriter interface {
+	WriteWithPriority(p syslog.Priority, b []byte) (int, error)
+	Close() error
+}
+
+type srvTarget struct {
+	addr     string
+	priority uint16
+	weight   uint16
+	writer   syslogWriter
+}
+
+// srvPool balances messages over the syslog servers published in a DNS SRV
+// record. Following RFC 2782, only the reachable targets with the lowest
+// priority value are used, picked at random in proportion to their weight.
+// The record is resolved again periodically, dialing new targets and
+// closing the ones that went away.
+type srvPool struct {
+	name   string
+	lookup func(service, proto, name string) (string, []*net.SRV, error)
+	dial   func(addr string) (syslogWriter, error)
+
+	mu      sync.RWMutex
+	targets []srvTarget
+}
+
+func newSRVPool(config *LoggingConfig) (*srvPool, error) {
+	p := &srvPool{
+		name:   config.SyslogSRV,
+		lookup: net.LookupSRV,
+		dial: func(addr string) (syslogWriter, error) {
+			targetConfig := *config
+			targetConfig.SyslogServer = addr
+			return dialSyslog(&targetConfig)
+		},
+	}
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	if config.SRVRefreshInterval > 0 {
+		go func() {
+			for range time.Tick(config.SRVRefreshInterval) {
+				if err := p.refresh(); err != nil {
+					LogError(fmt.Sprintf("Unable to resolve syslog SRV record [%s], keeping the current servers", p.name), err.Error())
+				}
+			}
+		}()
+	}
+	return p, nil
+}
+
+// refresh resolves the SRV record and updates the pool. The pool is left
+// untouched when the record can't be resolved or none of its targets can be
+// dialed.
+func (p *srvPool) refresh() error {
+	_, records, err := p.lookup("", "", p.name)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	current := make(map[string]srvTarget, len(p.targets))
+	for _, target := range p.targets {
+		current[target.addr] = target
+	}
+	p.mu.RUnlock()
+
+	var targets []srvTarget
+	for _, record := range records {
+		addr := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		target, ok := current[addr]
+		if ok {
+			delete(current, addr)
+		} else {
+			writer, err := p.dial(addr)
+			if err != nil {
+				LogError(fmt.Sprintf("Unable to connect to syslog server [%s]!\n", addr), err.Error())
+				continue
+			}
+			LogStd(fmt.Sprintf("Received hook to syslog server [%s]!\n", addr), false)
+			target = srvTarget{addr: addr, writer: writer}
+		}
+		target.priority = record.Priority
+		target.weight = record.Weight
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("No reachable syslog server in SRV record [%s]", p.name)
+	}
+	sort.Sort(byPriority(targets))
+
+	p.mu.Lock()
+	p.targets = targets
+	p.mu.Unlock()
+
+	for _, gone := range current {
+		gone.writer.Close()
+	}
+	return nil
+}
+
+func (p *srvPool) pick() (syslogWriter, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.targets) == 0 {
+		return nil, errors.New("No syslog server available")
+	}
+
+	// targets are sorted by priority, keep the lowest ones only
+	candidates := p.targets
+	for i := range candidates {
+		if candidates[i].priority != candidates[0].priority {
+			candidates = candidates[:i]
+			break
+		}
+	}
+
+	total := 0
+	for _, target := range candidates {
+		total += int(target.weight)
+	}
+	if total == 0 {
+		return candidates[rand.Intn(len(candidates))].writer, nil
+	}
+	n := rand.Intn(total)
+	for _, target := range candidates {
+		if n < int(target.weight) {
+			return target.writer, nil
+		}
+		n -= int(target.weight)
+	}
+	return candidates[len(candidates)-1].writer, nil
+}
+
+func (p *srvPool) WriteWithPriority(priority syslog.Priority, b []byte) (int, error) {
+	writer, err := p.pick()
+	if err != nil {
+		return 0, err
+	}
+	return writer.WriteWithPriority(priority, b)
+}
+
+func (p *srvPool) Flush() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var err error
+	for _, target := range p.targets {
+		if flushErr := flushWriter(target.writer); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (p *srvPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, target := range p.targets {
+		target.writer.Close()
+	}
+	p.targets = nil
+	return nil
+}
+
+type byPriority []srvTarget
+
+func (t byPriority) Len() int           { return len(t) }
+func (t byPriority) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byPriority) Less(i, j int) bool { return t[i].priority < t[j].priority }
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeSyslogWriter struct {
+	mu       sync.Mutex
+	messages int
+	closed   bool
+	// err fails the writes when set
+	err error
+}
+
+func (w *fakeSyslogWriter) WriteWithPriority(p syslog.Priority, b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.messages++
+	return len(b), nil
+}
+
+func (w *fakeSyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+var _ = Describe("SRV pool", func() {
+	var (
+		records []*net.SRV
+		writers map[string]*fakeSyslogWriter
+		pool    *srvPool
+	)
+
+	BeforeEach(func() {
+		writers = make(map[string]*fakeSyslogWriter)
+		pool = &srvPool{
+			name: "_syslog._tcp.collectors.example.com",
+			lookup: func(service, proto, name string) (string, []*net.SRV, error) {
+				if records == nil {
+					return "", nil, errors.New("no such host")
+				}
+				return "", records, nil
+			},
+			dial: func(addr string) (syslogWriter, error) {
+				if addr == "down:514" {
+					return nil, errors.New("connection refused")
+				}
+				writers[addr] = &fakeSyslogWriter{}
+				return writers[addr], nil
+			},
+		}
+		records = []*net.SRV{
+			{Target: "a.", Port: 514, Priority: 10, Weight: 1},
+			{Target: "b.", Port: 514, Priority: 10, Weight: 3},
+			{Target: "backup.", Port: 514, Priority: 20, Weight: 1},
+			{Target: "down.", Port: 514, Priority: 0, Weight: 1},
+		}
+		Expect(pool.refresh()).To(Succeed())
+	})
+
+	It("should balance over the reachable targets of the lowest priority by weight", func() {
+		for i := 0; i < 400; i++ {
+			_, err := pool.WriteWithPriority(syslog.LOG_INFO, []byte("msg"))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Expect(writers["backup:514"].messages).To(Equal(0))
+		Expect(writers["a:514"].messages + writers["b:514"].messages).To(Equal(400))
+		Expect(writers["b:514"].messages).To(BeNumerically(">", writers["a:514"].messages))
+	})
+
+	It("should close targets removed from the record on refresh", func() {
+		records = records[1:3]
+		Expect(pool.refresh()).To(Succeed())
+		Expect(writers["a:514"].closed).To(BeTrue())
+		Expect(writers["b:514"].closed).To(BeFalse())
+	})
+
+	It("should keep the current targets when the record can't be resolved", func() {
+		records = nil
+		Expect(pool.refresh()).ToNot(Succeed())
+		_, err := pool.WriteWithPriority(syslog.LOG_INFO, []byte("msg"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Status describes the outputs a Logging client ships events to.
+type Status struct {
+	// Connected tells whether the client connected to its outputs, their
+	// last writes having succeeded
+	Connected bool
+	// LastEvent is when an event was last shipped while connected, zero
+	// when none was
+	LastEvent time.Time
+}
+
+// StatusReporter is implemented by the Logging clients reporting the status
+// of their outputs.
+type StatusReporter interface {
+	Status() Status
+}
+
+// outputHealth tracks whether the last write of an output failed. Hooks
+// embed it to be accounted for in the status of the client.
+type outputHealth struct {
+	failing int32
+}
+
+func (h *outputHealth) record(err error) {
+	if err != nil {
+		atomic.StoreInt32(&h.failing, 1)
+	} else if atomic.LoadInt32(&h.failing) != 0 {
+		atomic.StoreInt32(&h.failing, 0)
+	}
+}
+
+func (h *outputHealth) healthy() bool {
+	return atomic.LoadInt32(&h.failing) == 0
+}
+
+// Status reports the client connected once Connect succeeded, as long as
+// the last writes of every output succeeded.
+func (l *LoggingLogrus) Status() Status {
+	status := Status{Connected: l.outputsHealthy()}
+	if lastEvent := atomic.LoadInt64(&l.lastEvent); lastEvent != 0 {
+		status.LastEvent = time.Unix(0, lastEvent)
+	}
+	return status
+}
+
+func (l *LoggingLogrus) outputsHealthy() bool {
+	if atomic.LoadInt32(&l.connected) == 0 {
+		return false
+	}
+	for _, hook := range l.Logger.Hooks[logrus.InfoLevel] {
+		if output, ok := hook.(interface {
+			healthy() bool
+		}); ok && !output.healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// Status reports the client disconnected until the background connection
+// succeeded.
+func (r *RetryingLogging) Status() Status {
+	var status Status
+	if reporter, ok := r.logging.(StatusReporter); ok {
+		status = reporter.Status()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status.Connected = status.Connected && r.connected
+	return status
+}
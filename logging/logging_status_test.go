@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Status", func() {
+	It("should report outputs healthy after a successful write", func() {
+		var health outputHealth
+		Expect(health.healthy()).To(BeTrue())
+		health.record(errors.New("connection reset"))
+		Expect(health.healthy()).To(BeFalse())
+		health.record(nil)
+		Expect(health.healthy()).To(BeTrue())
+	})
+
+	It("should report the client connected with the time of the last event", func() {
+		l := NewLogging(&LoggingConfig{OutputType: OutputStdout}).(*LoggingLogrus)
+		Expect(l.Status()).To(Equal(Status{}))
+
+		Expect(l.Connect()).To(BeTrue())
+		Expect(l.Status().Connected).To(BeTrue())
+		l.ShipEvents(map[string]interface{}{"event_type": "LogMessage"}, "hello")
+		Expect(l.Status().LastEvent).To(BeTemporally("~", time.Now(), time.Second))
+	})
+
+	It("should report a retrying client disconnected until it connected", func() {
+		r := NewRetryingLogging(NewLogging(&LoggingConfig{OutputType: OutputStdout}), time.Hour, 0)
+		Expect(r.Status().Connected).To(BeFalse())
+		Expect(r.Connect()).To(BeTrue())
+		Expect(r.Status().Connected).To(BeTrue())
+	})
+})
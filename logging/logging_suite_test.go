@@ -1,9 +1,11 @@
 package logging
 
 import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/Sirupsen/logrus"
 	"testing"
 )
 
@@ -35,4 +37,73 @@ var _ = Describe("Logging", func() {
 			})
 		})
 	})
+	Describe("Connect", func() {
+		Context("called with the stdout output and no syslog server", func() {
+			It("should succeed and write events to stdout", func() {
+				logging := NewLogging(&LoggingConfig{OutputType: OutputStdout}).(*LoggingLogrus)
+				Expect(logging.Connect()).To(BeTrue())
+				Expect(logging.Logger.Out).To(Equal(os.Stdout))
+			})
+		})
+
+		Context("called with both outputs and no syslog server", func() {
+			It("should succeed", func() {
+				Expect(NewLogging(&LoggingConfig{OutputType: OutputBoth}).Connect()).To(BeTrue())
+			})
+		})
+
+		Context("called with the syslog output and no syslog server", func() {
+			It("should fail", func() {
+				Expect(NewLogging(&LoggingConfig{OutputType: OutputSyslog}).Connect()).To(BeFalse())
+			})
+		})
+	})
+	Describe("GetLogLevel", func() {
+		Context("called with a crash event", func() {
+			It("should return the error level", func() {
+				Expect(GetLogLevel(map[string]interface{}{"event_type": "crash"})).To(Equal(logrus.ErrorLevel))
+			})
+		})
+
+		Context("called with a regular event", func() {
+			It("should return the info level", func() {
+				Expect(GetLogLevel(map[string]interface{}{"event_type": "LogMessage"})).To(Equal(logrus.InfoLevel))
+				Expect(GetLogLevel(map[string]interface{}{})).To(Equal(logrus.InfoLevel))
+			})
+		})
+	})
+	Describe("Syslog priorities", func() {
+		Context("called with the default facility and severities", func() {
+			It("should return facility*8+severity", func() {
+				p := priorities{}
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "LogMessage", "message_type": "OUT"})).To(Equal(6))
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "LogMessage", "message_type": "ERR"})).To(Equal(3))
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "Error"})).To(Equal(2))
+				Expect(p.pri(logrus.ErrorLevel, map[string]interface{}{"event_type": "crash"})).To(Equal(3))
+			})
+		})
+
+		Context("called with a facility and a severity map", func() {
+			It("should override the defaults", func() {
+				facility, err := ParseFacility("local3")
+				Expect(err).NotTo(HaveOccurred())
+				severities, err := ParseSeverityMap("Error=alert, ValueMetric=debug, LogMessage=notice")
+				Expect(err).NotTo(HaveOccurred())
+				p := newPriorities(&LoggingConfig{SyslogFacility: facility, SeverityMap: severities})
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "Error"})).To(Equal(19*8 + 1))
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "ValueMetric"})).To(Equal(19*8 + 7))
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "LogMessage", "message_type": "ERR"})).To(Equal(19*8 + 5))
+				Expect(p.pri(logrus.InfoLevel, map[string]interface{}{"event_type": "HttpStartStop"})).To(Equal(19*8 + 6))
+			})
+
+			It("should reject unknown names", func() {
+				_, err := ParseFacility("local9")
+				Expect(err).To(MatchError(ContainSubstring("Unknown syslog facility [local9]")))
+				_, err = ParseSeverityMap("Error=fatal")
+				Expect(err).To(MatchError(ContainSubstring("Unknown syslog severity")))
+				_, err = ParseSeverityMap("Error")
+				Expect(err).To(MatchError(ContainSubstring("Malformed severity")))
+			})
+		})
+	})
 })
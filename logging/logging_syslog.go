@@ -0,0 +1,398 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/Sirupsen/logrus"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/utils"
+)
+
+const (
+	SecureProto = "tcp+tls"
+
+	// DefaultSyslogTag is the RFC 3164 TAG of messages unless configured
+	DefaultSyslogTag = "doppler"
+
+	facilityMask = 0xf8
+)
+
+// levelSeverities maps logrus levels to the syslog severity they are sent with
+var levelSeverities = map[logrus.Level]syslog.Priority{
+	logrus.PanicLevel: syslog.LOG_CRIT,
+	logrus.FatalLevel: syslog.LOG_CRIT,
+	logrus.ErrorLevel: syslog.LOG_ERR,
+	logrus.WarnLevel:  syslog.LOG_WARNING,
+	logrus.InfoLevel:  syslog.LOG_INFO,
+	logrus.DebugLevel: syslog.LOG_DEBUG,
+}
+
+// dialSyslog connects to the syslog server, batching the writes when
+// configured to over stream connections.
+func dialSyslog(config *LoggingConfig) (syslogWriter, error) {
+	var writer *syslog.Writer
+	var err error
+	// the severity is given by every write, the facility is the writer's
+	priority := config.SyslogFacility | syslog.LOG_INFO
+	tag := config.syslogTag()
+	hostname := config.syslogHostname()
+	var format syslog.Formatter = withHostname(syslog.DefaultFormatter, hostname)
+	if config.SyslogFormat == SyslogFormatRFC5424 {
+		format = rawSyslogFormatter
+	}
+	if config.Compress {
+		// compressed messages are neither batched, gzip buffering them
+		// already, nor written by srslog
+		return dialCompressed(config, format, hostname, tag)
+	}
+	if config.SyslogProtocol == SecureProto && config.TLSConfig != nil {
+		writer, err = syslog.DialWithTLSConfig(SecureProto, config.SyslogServer, priority, tag, config.TLSConfig)
+	} else if config.SyslogProtocol == SecureProto {
+		writer, err = syslog.DialWithTLSCertPath(SecureProto, config.SyslogServer, priority, tag, config.CertPath)
+	} else if config.SyslogProtocol == "udp" {
+		// dialing UDP succeeds whatever the server, a probe at least
+		// tells when nothing listens on the port
+		if err = probeUDP(config.SyslogServer); err != nil {
+			return nil, fmt.Errorf("UDP syslog server %s unreachable: %v", config.SyslogServer, err)
+		}
+		writer, err = syslog.Dial(config.SyslogProtocol, config.SyslogServer, priority, tag)
+	} else {
+		writer, err = syslog.Dial(config.SyslogProtocol, config.SyslogServer, priority, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	writer.SetFormatter(format)
+	if config.SyslogProtocol == "udp" && config.UDPMaxDatagram > 0 {
+		// datagrams are formatted by the datagram writer to be measured
+		writer.SetFormatter(rawSyslogFormatter)
+		return newDatagramWriter(writer, format, config.SyslogFacility, hostname, tag, config.UDPMaxDatagram, config.UDPOversizePolicy, config.TruncationMarker), nil
+	}
+	if config.BatchSize > 1 && Batchable(config.SyslogProtocol) {
+		// batched messages are formatted by the batch writer
+		writer.SetFormatter(rawSyslogFormatter)
+		return newBatchWriter(writer, format, config.SyslogFacility, hostname, tag, config.BatchSize, config.BatchFlushInterval), nil
+	}
+	return writer, nil
+}
+
+// ExpandSyslogHeader substitutes the {name} variables of a syslog header
+// template, such as "{foundation}-nozzle", with their values.
+func ExpandSyslogHeader(template string, vars map[string]string) (string, error) {
+	var expanded []string
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated variable in syslog header template [%s]", template)
+		}
+		name := rest[start+1 : start+end]
+		value, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("Unknown variable {%s} in syslog header template [%s]", name, template)
+		}
+		expanded = append(expanded, rest[:start], value)
+		rest = rest[start+end+1:]
+	}
+	return strings.Join(append(expanded, rest), ""), nil
+}
+
+// syslogHostname is the HOSTNAME messages are sent with, the OS hostname
+// unless configured
+func (config *LoggingConfig) syslogHostname() string {
+	if config.SyslogHostname != "" {
+		return config.SyslogHostname
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// syslogTag is the RFC 3164 TAG messages are sent with
+func (config *LoggingConfig) syslogTag() string {
+	if config.SyslogTag != "" {
+		return config.SyslogTag
+	}
+	return DefaultSyslogTag
+}
+
+// withHostname makes format send hostname whatever the writer's
+func withHostname(format syslog.Formatter, hostname string) syslog.Formatter {
+	return func(p syslog.Priority, _, tag, content string) string {
+		return format(p, hostname, tag, content)
+	}
+}
+
+// Batchable tells whether the writes of a syslog protocol can be batched:
+// only stream protocols can carry several messages per write.
+func Batchable(protocol string) bool {
+	return protocol == "tcp" || protocol == SecureProto
+}
+
+// SyslogHook ships every formatted logrus entry to a syslog writer.
+type SyslogHook struct {
+	outputHealth
+	writer  syslogWriter
+	limiter *bandwidthLimiter
+	encode  lineEncoder
+	packer  *eventPacker
+	lanes   *writeLanes
+	queue   *priorityQueue
+	// extraFormatters each send one more message per event, after the one
+	// formatted by the logger's formatter
+	extraFormatters []logrus.Formatter
+	// rfc5424 frames messages itself when set
+	rfc5424    *rfc5424Formatter
+	priorities priorities
+	// eventTypes restricts the hook to some event types when set, the hook
+	// shipping every event type but excludedTypes otherwise
+	eventTypes    map[string]bool
+	excludedTypes map[string]bool
+	// messages longer than maxBytes are cut, marker being appended
+	maxBytes int
+	marker   string
+
+	// Only set when profiling event latency
+	formatLatency *metrics.Histogram
+	writeLatency  *metrics.Histogram
+}
+
+func newSyslogHook(writer syslogWriter, config *LoggingConfig) *SyslogHook {
+	hook := &SyslogHook{
+		writer:     writer,
+		encode:     newLineEncoder(config.OutputEncoding, config.EncodingReplacement),
+		priorities: newPriorities(config),
+		maxBytes:   config.MaxMessageBytes,
+		marker:     config.TruncationMarker,
+	}
+	if config.MaxBytesPerSecond > 0 {
+		hook.limiter = newBandwidthLimiter(config.MaxBytesPerSecond, config.BandwidthPolicy, config.ShedPriority)
+	}
+	if config.PackEvents > 1 {
+		hook.packer = newEventPacker(config.PackEvents, config.PackMaxBytes, config.PackFlushInterval, hook.timedWrite)
+	}
+	if config.PriorityLevels > 1 {
+		hook.queue = newPriorityQueue(config.PriorityLevels, config.ShedPriority)
+		go hook.queue.drain(hook.deliver)
+	}
+	if config.ProfileLatency {
+		hook.formatLatency = metrics.NewHistogram("latency_format_us", metrics.LatencyBuckets)
+		hook.writeLatency = metrics.NewHistogram("latency_sink_write_us", metrics.LatencyBuckets)
+	}
+	if config.SyslogFormat == SyslogFormatRFC5424 {
+		hook.rfc5424 = newRFC5424Formatter(config.syslogHostname(), config.SyslogAppName, hook.priorities)
+	}
+	for _, formatterType := range config.ExtraFormats {
+		hook.extraFormatters = append(hook.extraFormatters, config.logFormatter(formatterType))
+	}
+	return hook
+}
+
+func (hook *SyslogHook) Fire(entry *logrus.Entry) error {
+	if !hook.ships(entry) {
+		return nil
+	}
+
+	start := time.Now()
+	line, err := hook.format(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read entry, %v", err)
+		return err
+	}
+	hook.formatLatency.ObserveSince(start)
+	if err := hook.send(entry, hook.truncate(entry, line, false)); err != nil {
+		return err
+	}
+
+	for _, formatter := range hook.extraFormatters {
+		serialized, err := formatter.Format(entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read entry, %v", err)
+			return err
+		}
+		line := string(serialized)
+		if hook.rfc5424 != nil {
+			// extra formats travel as the message of a header of their own
+			line = hook.rfc5424.frame(entry, rfc5424Nil, line)
+		}
+		if err := hook.send(entry, hook.truncate(entry, line, true)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ships tells whether the hook ships entry, following the route map.
+func (hook *SyslogHook) ships(entry *logrus.Entry) bool {
+	eventType, _ := entry.Data["event_type"].(string)
+	if hook.eventTypes != nil {
+		return hook.eventTypes[eventType]
+	}
+	return !hook.excludedTypes[eventType]
+}
+
+// truncated counts the messages cut to the maximum message size
+var truncated = metrics.NewCounter("syslog_truncated_messages")
+
+// truncate cuts line to the maximum message size. RFC 5424 lines keep their
+// header and structured data whole, only their message being cut; the lines
+// of extra formats carry no structured data.
+func (hook *SyslogHook) truncate(entry *logrus.Entry, line string, extra bool) string {
+	if hook.maxBytes <= 0 || len(line) <= hook.maxBytes {
+		return line
+	}
+	keep := 0
+	if hook.rfc5424 != nil {
+		sd := rfc5424Nil
+		if !extra {
+			sd = structuredData(entry.Data)
+		}
+		keep = len(strings.TrimSuffix(hook.rfc5424.frame(entry, sd, ""), "\n"))
+	}
+	truncated.Inc()
+	return truncateLine(line, hook.maxBytes, keep, hook.marker)
+}
+
+// truncateLine cuts line to max bytes including marker and the trailing
+// newline, without splitting a multi-byte character nor cutting into the
+// first keep bytes.
+func truncateLine(line string, max int, keep int, marker string) string {
+	newline := ""
+	if strings.HasSuffix(line, "\n") {
+		newline = "\n"
+		line = line[:len(line)-1]
+	}
+	limit := max - len(marker) - len(newline)
+	if limit < keep {
+		limit = keep
+	}
+	return utils.TruncateUTF8(line, limit) + marker + newline
+}
+
+// format serializes entry with the logger's formatter, or frames it
+// following RFC 5424
+func (hook *SyslogHook) format(entry *logrus.Entry) (string, error) {
+	if hook.rfc5424 != nil {
+		serialized, err := hook.rfc5424.Format(entry)
+		return string(serialized), err
+	}
+	return entry.String()
+}
+
+func (hook *SyslogHook) send(entry *logrus.Entry, line string) error {
+	line = hook.encode(line)
+
+	eventType, _ := entry.Data["event_type"].(string)
+	if hook.limiter != nil && !hook.limiter.Allow(len(line), eventType) {
+		return nil
+	}
+
+	severity := hook.priorities.severity(entry.Level, entry.Data)
+	if hook.queue != nil {
+		hook.queue.push(eventType, queuedMessage{severity: severity, source: sourceKey(entry.Data), line: line})
+		return nil
+	}
+	return hook.deliver(severity, sourceKey(entry.Data), line)
+}
+
+// deliver hands a message to the packer, the write lanes or the writer.
+func (hook *SyslogHook) deliver(severity syslog.Priority, source string, line string) error {
+	if hook.packer != nil {
+		return hook.packer.Add(severity, line)
+	}
+	if hook.lanes != nil {
+		return hook.lanes.send(source, severity, line)
+	}
+	return hook.timedWrite(severity, line)
+}
+
+func (hook *SyslogHook) timedWrite(severity syslog.Priority, line string) error {
+	return hook.timedWriteTo(hook.writer, severity, line)
+}
+
+func (hook *SyslogHook) timedWriteTo(writer syslogWriter, severity syslog.Priority, line string) error {
+	start := time.Now()
+	err := write(writer, severity, line)
+	hook.writeLatency.ObserveSince(start)
+	hook.record(err)
+	return err
+}
+
+// Flush writes the messages the hook's priority queue, packer, write lanes
+// and writers hold, in that order.
+func (hook *SyslogHook) Flush() error {
+	if hook.queue != nil {
+		hook.queue.flush()
+	}
+	var err error
+	if hook.packer != nil {
+		err = hook.packer.Flush()
+	}
+	if hook.lanes != nil {
+		hook.lanes.flush()
+		if laneErr := hook.lanes.err(); err == nil {
+			err = laneErr
+		}
+	}
+	for _, writer := range hook.writers() {
+		if flushErr := flushWriter(writer); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// writers returns the writer of the hook, or those of its write lanes.
+func (hook *SyslogHook) writers() []syslogWriter {
+	if hook.lanes != nil {
+		return hook.lanes.writers()
+	}
+	return []syslogWriter{hook.writer}
+}
+
+// closeWriters closes every writer of the hook.
+func (hook *SyslogHook) closeWriters() {
+	for _, writer := range hook.writers() {
+		writer.Close()
+	}
+}
+
+// flushWriter writes the messages batched by writer, if any.
+func flushWriter(writer syslogWriter) error {
+	if flusher, ok := writer.(interface {
+		Flush() error
+	}); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// useLanes writes over the hook's writer and the additional ones
+// concurrently, partitioned by source. The lanes own the writers from then
+// on, the hook's writer being the first lane's.
+func (hook *SyslogHook) useLanes(writers []syslogWriter) {
+	hook.lanes = newWriteLanes(append([]syslogWriter{hook.writer}, writers...), hook.timedWriteTo)
+	hook.writer = nil
+}
+
+// writeErrors counts the messages the syslog writers failed to send
+var writeErrors = metrics.NewCounter("syslog_write_errors")
+
+func write(writer syslogWriter, severity syslog.Priority, line string) error {
+	_, err := writer.WriteWithPriority(severity, []byte(line))
+	if err != nil {
+		writeErrors.Inc()
+	}
+	return err
+}
+
+func (hook *SyslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
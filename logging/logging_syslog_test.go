@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"os"
+
+	syslog "github.com/RackSec/srslog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Syslog header", func() {
+	vars := map[string]string{"foundation": "prod-eu", "subscription_id": "firehose-a"}
+
+	It("should expand template variables", func() {
+		Expect(ExpandSyslogHeader("{foundation}-{subscription_id}", vars)).To(Equal("prod-eu-firehose-a"))
+		Expect(ExpandSyslogHeader("nozzle", vars)).To(Equal("nozzle"))
+		Expect(ExpandSyslogHeader("", vars)).To(Equal(""))
+	})
+
+	It("should reject unknown and unterminated variables", func() {
+		_, err := ExpandSyslogHeader("{space}", vars)
+		Expect(err).To(MatchError(ContainSubstring("Unknown variable {space}")))
+		_, err = ExpandSyslogHeader("{foundation", vars)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should default to the OS hostname and the doppler tag", func() {
+		hostname, _ := os.Hostname()
+		config := &LoggingConfig{}
+		Expect(config.syslogHostname()).To(Equal(hostname))
+		Expect(config.syslogTag()).To(Equal(DefaultSyslogTag))
+
+		config = &LoggingConfig{SyslogHostname: "prod-eu", SyslogTag: "cf"}
+		Expect(config.syslogHostname()).To(Equal("prod-eu"))
+		Expect(config.syslogTag()).To(Equal("cf"))
+	})
+
+	It("should send the configured hostname in RFC 3164 headers", func() {
+		format := withHostname(func(p syslog.Priority, hostname, tag, content string) string {
+			return hostname + " " + tag + ": " + content
+		}, "prod-eu")
+		Expect(format(syslog.LOG_INFO, "localhost", "doppler", "hello")).To(Equal("prod-eu doppler: hello"))
+	})
+})
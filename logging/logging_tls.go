@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+var tlsVersions = map[string]uint16{
+	TLSVersion12: tls.VersionTLS12,
+	TLSVersion13: tls.VersionTLS13,
+}
+
+// NewSyslogTLSConfig builds the configuration syslog over TLS connections
+// are dialed with, so that unreadable or mismatched certificates are
+// reported at startup rather than on the first connection. caPath holds
+// the PEM encoded CA the server certificate is verified against, the system
+// roots being used when empty. clientCertPath and clientKeyPath hold the PEM
+// encoded certificate and key presented to servers requiring client
+// authentication. serverName overrides the host name used for SNI and
+// verification, which otherwise comes from the dial address.
+func NewSyslogTLSConfig(caPath, clientCertPath, clientKeyPath, serverName, minVersion string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported TLS version %s", minVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if caPath != "" {
+		serverCert, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(serverCert) {
+			return nil, fmt.Errorf("No PEM encoded certificate found in %s", caPath)
+		}
+	}
+
+	switch {
+	case clientCertPath != "" && clientKeyPath == "":
+		return nil, errors.New("A client certificate was given without its key")
+	case clientCertPath == "" && clientKeyPath != "":
+		return nil, errors.New("A client key was given without its certificate")
+	case clientCertPath != "":
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load the client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
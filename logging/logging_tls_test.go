@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to dir
+func writeKeyPair(dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	Expect(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+	return certPath, keyPath
+}
+
+var _ = Describe("Syslog TLS config", func() {
+	var (
+		dir               string
+		caPath            string
+		certPath, keyPath string
+		otherKeyPath      string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "syslog-tls")
+		Expect(err).ToNot(HaveOccurred())
+		caPath, _ = writeKeyPair(dir, "ca")
+		certPath, keyPath = writeKeyPair(dir, "client")
+		_, otherKeyPath = writeKeyPair(dir, "other")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load the CA, the client certificate, the server name and the minimum version", func() {
+		config, err := NewSyslogTLSConfig(caPath, certPath, keyPath, "syslog.example.com", TLSVersion13)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.RootCAs).ToNot(BeNil())
+		Expect(config.Certificates).To(HaveLen(1))
+		Expect(config.ServerName).To(Equal("syslog.example.com"))
+		Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+	})
+
+	It("should use the system roots and no client certificate by default", func() {
+		config, err := NewSyslogTLSConfig("", "", "", "", TLSVersion12)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.RootCAs).To(BeNil())
+		Expect(config.Certificates).To(BeEmpty())
+		Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+	})
+
+	It("should fail on a client certificate without key", func() {
+		_, err := NewSyslogTLSConfig(caPath, certPath, "", "", TLSVersion12)
+		Expect(err).To(MatchError("A client certificate was given without its key"))
+	})
+
+	It("should fail on a client key without certificate", func() {
+		_, err := NewSyslogTLSConfig(caPath, "", keyPath, "", TLSVersion12)
+		Expect(err).To(MatchError("A client key was given without its certificate"))
+	})
+
+	It("should fail on a key not matching the client certificate", func() {
+		_, err := NewSyslogTLSConfig(caPath, certPath, otherKeyPath, "", TLSVersion12)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("Unable to load the client certificate"))
+	})
+
+	It("should fail on a CA file without certificate", func() {
+		_, err := NewSyslogTLSConfig(keyPath, "", "", "", TLSVersion12)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail on an unsupported version", func() {
+		_, err := NewSyslogTLSConfig("", "", "", "", "1.0")
+		Expect(err).To(MatchError("Unsupported TLS version 1.0"))
+	})
+})
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Message truncation", func() {
+	It("should cut lines to the limit, marker and newline included", func() {
+		line := truncateLine("0123456789abcdef\n", 12, 0, "...")
+		Expect(line).To(Equal("01234567...\n"))
+		Expect(line).To(HaveLen(12))
+	})
+
+	It("should not split multi-byte characters", func() {
+		Expect(truncateLine("abcdéf", 7, 0, "..")).To(Equal("abcd.."))
+	})
+
+	It("should keep the protected prefix whole", func() {
+		Expect(truncateLine("[prefix] message", 6, 8, "~")).To(Equal("[prefix]~"))
+	})
+
+	It("should only cut the message of RFC 5424 lines", func() {
+		writer := &recordingWriter{}
+		hook := newSyslogHook(writer, &LoggingConfig{
+			SyslogFormat:     SyslogFormatRFC5424,
+			MaxMessageBytes:  160,
+			TruncationMarker: "...[truncated]",
+		})
+		hook.rfc5424.hostname = "nozzle-0"
+		entry := logrus.NewEntry(logrus.New()).WithField("event_type", "LogMessage")
+		entry.Level = logrus.InfoLevel
+		entry.Message = strings.Repeat("x", 500)
+		truncatedBefore := truncated.Value()
+
+		Expect(hook.Fire(entry)).To(Succeed())
+		received := writer.received()
+		Expect(received).To(HaveLen(1))
+		Expect(received[0]).To(HaveLen(160))
+		Expect(received[0]).To(ContainSubstring(`[cf@47450 event_type="LogMessage"] xxx`))
+		Expect(received[0]).To(HaveSuffix("x...[truncated]\n"))
+		Expect(truncated.Value() - truncatedBefore).To(BeEquivalentTo(1))
+	})
+
+	It("should leave short lines untouched", func() {
+		writer := &recordingWriter{}
+		hook := newSyslogHook(writer, &LoggingConfig{MaxMessageBytes: 1024, TruncationMarker: "..."})
+		entry := logrus.NewEntry(logrus.New())
+		entry.Logger.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+		entry.Level = logrus.InfoLevel
+		entry.Message = "short"
+
+		Expect(hook.Fire(entry)).To(Succeed())
+		Expect(writer.received()[0]).NotTo(ContainSubstring("..."))
+	})
+})
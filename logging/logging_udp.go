@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	syslog "github.com/RackSec/srslog"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+const (
+	UDPOversizeTruncate = "truncate"
+	UDPOversizeSkip     = "skip"
+
+	// udpProbeTimeout is how long dialing waits for the server to refuse
+	// a probe datagram
+	udpProbeTimeout = 250 * time.Millisecond
+	// udpOversizeLogInterval bounds how often oversized messages are logged
+	udpOversizeLogInterval = time.Minute
+)
+
+var (
+	udpTruncated = metrics.NewCounter("syslog_udp_truncated_messages")
+	udpSkipped   = metrics.NewCounter("syslog_udp_skipped_messages")
+)
+
+// datagramWriter sends each syslog message in a datagram of up to
+// maxBytes, header included, messages being framed like srslog would.
+// Longer messages are cut, marker being appended, or skipped following
+// policy, rather than fragmented at the IP layer, fragments being lost
+// along with the whole message.
+type datagramWriter struct {
+	writer   syslogWriter
+	format   syslog.Formatter
+	facility syslog.Priority
+	hostname string
+	tag      string
+	maxBytes int
+	policy   string
+	marker   string
+
+	mu        sync.Mutex
+	oversized int
+	loggedAt  time.Time
+}
+
+func newDatagramWriter(writer syslogWriter, format syslog.Formatter, facility syslog.Priority, hostname string, tag string, maxBytes int, policy string, marker string) *datagramWriter {
+	return &datagramWriter{
+		writer:   writer,
+		format:   format,
+		facility: facility,
+		hostname: hostname,
+		tag:      tag,
+		maxBytes: maxBytes,
+		policy:   policy,
+		marker:   marker,
+	}
+}
+
+func (w *datagramWriter) WriteWithPriority(p syslog.Priority, msg []byte) (int, error) {
+	line := string(msg)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	pri := w.facility&facilityMask | p&severityMask
+	datagram := w.format(pri, w.hostname, w.tag, line)
+	if len(datagram) > w.maxBytes {
+		w.logOversized(len(datagram))
+		if w.policy == UDPOversizeSkip {
+			udpSkipped.Inc()
+			return len(msg), nil
+		}
+		udpTruncated.Inc()
+		datagram = truncateLine(datagram, w.maxBytes, 0, w.marker)
+	}
+	if _, err := w.writer.WriteWithPriority(p, []byte(datagram)); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// logOversized logs the first oversized message, then how many there were
+// every udpOversizeLogInterval at most.
+func (w *datagramWriter) logOversized(size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.oversized++
+	if time.Since(w.loggedAt) < udpOversizeLogInterval {
+		return
+	}
+	action := "truncated"
+	if w.policy == UDPOversizeSkip {
+		action = "skipped"
+	}
+	LogStd(fmt.Sprintf("%d syslog messages over the UDP datagram limit of %d bytes were %s, the last one of %d bytes", w.oversized, w.maxBytes, action, size), true)
+	w.oversized = 0
+	w.loggedAt = time.Now()
+}
+
+func (w *datagramWriter) Close() error {
+	return w.writer.Close()
+}
+
+// probeUDP sends an empty datagram to addr, failing when the host answers
+// that nothing listens on the port. UDP being connectionless, silence
+// proves nothing: the server may be down or the answer filtered.
+func probeUDP(addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(udpProbeTimeout))
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
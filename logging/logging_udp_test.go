@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"net"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("UDP datagrams", func() {
+	var server *udpServer
+
+	BeforeEach(func() {
+		server = newUDPServer()
+	})
+
+	AfterEach(func() {
+		server.conn.Close()
+	})
+
+	dial := func(policy string) syslogWriter {
+		writer, err := dialSyslog(&LoggingConfig{
+			SyslogServer:      server.conn.LocalAddr().String(),
+			SyslogProtocol:    "udp",
+			SyslogHostname:    "nozzle-0",
+			UDPMaxDatagram:    200,
+			UDPOversizePolicy: policy,
+			TruncationMarker:  "...[truncated]",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return writer
+	}
+
+	It("should cut datagrams to the limit, header included", func() {
+		writer := dial(UDPOversizeTruncate)
+		defer writer.Close()
+		before := udpTruncated.Value()
+
+		_, err := writer.WriteWithPriority(0, []byte(strings.Repeat("x", 500)))
+		Expect(err).NotTo(HaveOccurred())
+		received := server.received()
+		Expect(received).To(HaveLen(1))
+		Expect(received[0]).To(HaveLen(200))
+		Expect(received[0]).To(ContainSubstring("nozzle-0 doppler"))
+		Expect(received[0]).To(HaveSuffix("x...[truncated]\n"))
+		Expect(udpTruncated.Value() - before).To(BeEquivalentTo(1))
+	})
+
+	It("should skip and count oversized messages when asked to", func() {
+		writer := dial(UDPOversizeSkip)
+		defer writer.Close()
+		before := udpSkipped.Value()
+
+		_, err := writer.WriteWithPriority(0, []byte(strings.Repeat("x", 500)))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = writer.WriteWithPriority(0, []byte("short"))
+		Expect(err).NotTo(HaveOccurred())
+		received := server.received()
+		Expect(received).To(HaveLen(1))
+		Expect(received[0]).To(HaveSuffix("short\n"))
+		Expect(udpSkipped.Value() - before).To(BeEquivalentTo(1))
+	})
+
+	It("should fail to dial a port nothing listens on", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		closedAddr := conn.LocalAddr().String()
+		conn.Close()
+
+		_, err = dialSyslog(&LoggingConfig{SyslogServer: closedAddr, SyslogProtocol: "udp"})
+		Expect(err).To(MatchError(ContainSubstring("unreachable")))
+	})
+})
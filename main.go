@@ -1,77 +1,455 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	"github.com/cloudfoundry-community/firehose-to-syslog/config"
 	"github.com/cloudfoundry-community/firehose-to-syslog/eventRouting"
+	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
+	"github.com/cloudfoundry-community/firehose-to-syslog/extrafields"
 	"github.com/cloudfoundry-community/firehose-to-syslog/firehoseclient"
+	"github.com/cloudfoundry-community/firehose-to-syslog/health"
 	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/retry"
+	"github.com/cloudfoundry-community/firehose-to-syslog/transforms"
 	"github.com/cloudfoundry-community/firehose-to-syslog/uaatokenrefresher"
+	"github.com/cloudfoundry-community/firehose-to-syslog/utils"
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/pkg/profile"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
+	configFile         = kingpin.Flag("config", "YAML or JSON file of option values keyed by flag name, such as 'syslog-server: syslog:514', environment variables and flags taking precedence").Default("").Envar("CONFIG_FILE").String()
+	validate           = kingpin.Flag("validate", "Check that the api, UAA, firehose and syslog endpoints can be reached with the given credentials, then exit without forwarding events").Default("false").Envar("VALIDATE").Bool()
 	debug              = kingpin.Flag("debug", "Enable debug mode. This disables forwarding to syslog").Default("false").Envar("DEBUG").Bool()
 	apiEndpoint        = kingpin.Flag("api-endpoint", "Api endpoint address. For bosh-lite installation of CF: https://api.10.244.0.34.xip.io").Envar("API_ENDPOINT").Required().String()
 	dopplerEndpoint    = kingpin.Flag("doppler-endpoint", "Overwrite default doppler endpoint return by /v2/info").Envar("DOPPLER_ENDPOINT").String()
-	syslogServer       = kingpin.Flag("syslog-server", "Syslog server.").Envar("SYSLOG_ENDPOINT").String()
+	outputType         = kingpin.Flag("output-type", "Where events are written: syslog, stdout, both (syslog and stdout), kafka, http or file").Default(logging.OutputSyslog).Envar("OUTPUT_TYPE").Enum(logging.OutputSyslog, logging.OutputStdout, logging.OutputBoth, logging.OutputKafka, logging.OutputHTTP, logging.OutputFile)
+	filePath           = kingpin.Flag("file-path", "File events are appended to with --output-type=file").Default("").Envar("FILE_PATH").String()
+	fileMaxSize        = kingpin.Flag("file-max-size", "Size in MB over which the file of --output-type=file is rotated, 0 doesn't bound it").Default("100").Envar("FILE_MAX_SIZE").Int64()
+	fileMaxAge         = kingpin.Flag("file-max-age", "Age after which the file of --output-type=file is rotated, 0 doesn't bound it").Default("0s").Envar("FILE_MAX_AGE").Duration()
+	fileMaxBackups     = kingpin.Flag("file-max-backups", "Number of rotated files kept with --output-type=file, the oldest being removed, 0 keeps them all").Default("5").Envar("FILE_MAX_BACKUPS").Int()
+	kafkaBrokers       = kingpin.Flag("kafka-brokers", "Comma separated host:port Kafka brokers the cluster is discovered from with --output-type=kafka").Default("").Envar("KAFKA_BROKERS").String()
+	kafkaTopic         = kingpin.Flag("kafka-topic", "Kafka topic events are produced to").Default("firehose").Envar("KAFKA_TOPIC").String()
+	kafkaTLS           = kingpin.Flag("kafka-tls", "Connect to the Kafka brokers over TLS").Default("false").Envar("KAFKA_TLS").Bool()
+	kafkaCACert        = kingpin.Flag("kafka-ca-cert", "PEM encoded CA the Kafka broker certificates are verified against, defaults to the system roots").Default("").Envar("KAFKA_CA_CERT").String()
+	kafkaSASLUser      = kingpin.Flag("kafka-sasl-user", "Authenticate to the Kafka brokers with SASL/PLAIN as this user").Default("").Envar("KAFKA_SASL_USER").String()
+	kafkaSASLPassword  = kingpin.Flag("kafka-sasl-password", "Password of --kafka-sasl-user").Default("").Envar("KAFKA_SASL_PASSWORD").String()
+	kafkaOnError       = kingpin.Flag("kafka-on-error", "What to do with events Kafka fails to accept, one of [block, drop]").Default(logging.OnErrorBlock).Envar("KAFKA_ON_ERROR").Enum(logging.OnErrorBlock, logging.OnErrorDrop)
+	httpURL            = kingpin.Flag("http-url", "URL events are posted to as JSON arrays with --output-type=http").Default("").Envar("HTTP_URL").String()
+	httpHeaders        = kingpin.Flag("http-header", "'Name: value' header added to the posts of the http output, repeatable").Envar("HTTP_HEADER").Strings()
+	httpBatchSize      = kingpin.Flag("http-batch-size", "Maximum number of events posted in a request").Default("100").Envar("HTTP_BATCH_SIZE").Int()
+	httpTimeout        = kingpin.Flag("http-timeout", "Timeout of the posts of the http output").Default("10s").Envar("HTTP_TIMEOUT").Duration()
+	httpOnError        = kingpin.Flag("http-on-error", "What to do with events the HTTP collector keeps failing to accept, one of [block, drop]").Default(logging.OnErrorBlock).Envar("HTTP_ON_ERROR").Enum(logging.OnErrorBlock, logging.OnErrorDrop)
+	consumerType       = kingpin.Flag("consumer-type", "Where envelopes are consumed from: the firehose through doppler, or the RLP gateway").Default(firehoseclient.ConsumerFirehose).Envar("CONSUMER_TYPE").Enum(firehoseclient.ConsumerFirehose, firehoseclient.ConsumerRLPGateway)
+	rlpGatewayURL      = kingpin.Flag("rlp-gateway-url", "RLP gateway URL used with --consumer-type=rlp-gateway, defaults to the log-stream host next to the api endpoint").Default("").Envar("RLP_GATEWAY_URL").String()
+	syslogServer       = kingpin.Flag("syslog-server", "Syslog server, or comma separated syslog servers balanced following --syslog-balance").Envar("SYSLOG_ENDPOINT").String()
+	syslogBalance      = kingpin.Flag("syslog-balance", "How messages are spread over several --syslog-server: failover to the next server when one fails, or roundrobin over the servers").Default(logging.SyslogBalanceFailover).Envar("SYSLOG_BALANCE").Enum(logging.SyslogBalanceFailover, logging.SyslogBalanceRoundRobin)
+	syslogFailback     = kingpin.Flag("syslog-failback-interval", "How often syslog servers that failed are connected again with several --syslog-server, failover then moving back to the first one").Default("30s").Envar("SYSLOG_FAILBACK_INTERVAL").Duration()
+	syslogSRV          = kingpin.Flag("syslog-srv", "DNS SRV record publishing the syslog servers, used instead of --syslog-server").Default("").Envar("SYSLOG_SRV").String()
+	srvRefresh         = kingpin.Flag("syslog-srv-refresh", "How often the syslog SRV record is resolved again").Default("60s").Envar("SYSLOG_SRV_REFRESH").Duration()
+	onUnreachable      = kingpin.Flag("on-syslog-unreachable", "What to do when syslog can't be reached at startup, one of [exit, retry, buffer]").Default(logging.UnreachableExit).Envar("ON_SYSLOG_UNREACHABLE").Enum(logging.UnreachableExit, logging.UnreachableRetry, logging.UnreachableBuffer)
+	syslogRetry        = kingpin.Flag("syslog-retry-interval", "How often an unreachable syslog is connected again with --on-syslog-unreachable=retry|buffer").Default("10s").Envar("SYSLOG_RETRY_INTERVAL").Duration()
+	syslogBufferSize   = kingpin.Flag("syslog-buffer-size", "Number of events kept until syslog is reached with --on-syslog-unreachable=buffer").Default("10000").Envar("SYSLOG_BUFFER_SIZE").Int()
+	spoolDir           = kingpin.Flag("spool-dir", "Directory where messages the syslog server fails to accept are persisted, to be replayed in order once it is back").Default("").Envar("SPOOL_DIR").String()
+	spoolMaxBytes      = kingpin.Flag("spool-max-bytes", "Size in bytes of the messages kept in --spool-dir, the oldest being dropped beyond it, 0 doesn't bound it").Default("1073741824").Envar("SPOOL_MAX_BYTES").Int64()
+	sampleRates        = kingpin.Flag("sample-rate", "Comma separated EventType=rate pairs forwarding only this fraction of the events of a type, picked at random, from 0 (none) to 1 (all), example: 'LogMessage=0.1,ContainerMetric=1.0'").Default("").Envar("SAMPLE_RATE").String()
+	rateLimits         = kingpin.Flag("rate-limit", "Comma separated EventType=rate pairs capping the events per second of a type, example: 'LogMessage=5000,HttpStartStop=1000'. Unlisted event types are unlimited").Default("").Envar("RATE_LIMIT").String()
+	rateLimitPolicy    = kingpin.Flag("rate-limit-policy", "What to do with events over --rate-limit: drop them, or block the consumer until the limit lets them through").Default(eventRouting.RateLimitDrop).Envar("RATE_LIMIT_POLICY").Enum(eventRouting.RateLimitDrop, eventRouting.RateLimitBlock)
+	dedupWindow        = kingpin.Flag("dedup-window", "Suppress events identical to one shipped less than this long ago, shipping their count when the window closes, 0 disables it").Default("0s").Envar("DEDUP_WINDOW").Duration()
+	dedupKey           = kingpin.Flag("dedup-key", "Comma separated fields identifying identical events with --dedup-window, msg standing for the message").Default(eventRouting.DefaultDedupKey).Envar("DEDUP_KEY").String()
+	dedupMaxKeys       = kingpin.Flag("dedup-max-keys", "Maximum number of distinct events tracked at once with --dedup-window").Default("10000").Envar("DEDUP_MAX_KEYS").Int()
+	routeMap           = kingpin.Flag("route-map", "Comma separated EventType=protocol://host:port pairs sending some event types to their own syslog server instead of --syslog-server, example: 'LogMessage=tcp://siem:514,ValueMetric=udp://metrics:514'").Default("").Envar("ROUTE_MAP").String()
 	syslogProtocol     = kingpin.Flag("syslog-protocol", "Syslog protocol (tcp/udp/tcp+tls).").Default("tcp").Envar("SYSLOG_PROTOCOL").String()
+	syslogFacility     = kingpin.Flag("syslog-facility", "Syslog facility messages are sent with, such as user or local0").Default("kern").Envar("SYSLOG_FACILITY").String()
+	severityMap        = kingpin.Flag("severity-map", "Comma separated EventType=severity pairs overriding the syslog severity of event types, example: 'Error=crit,ValueMetric=debug'").Default("").Envar("SEVERITY_MAP").String()
+	syslogFormat       = kingpin.Flag("syslog-format", "Syslog message format: rfc3164, or rfc5424 with event fields as structured data").Default(logging.SyslogFormatRFC3164).Envar("SYSLOG_FORMAT").Enum(logging.SyslogFormatRFC3164, logging.SyslogFormatRFC5424)
+	syslogHostname     = kingpin.Flag("syslog-hostname", "HOSTNAME of syslog messages, which may use the {foundation}, {subscription_id} and {hostname} variables, defaults to the OS hostname").Default("").Envar("SYSLOG_HOSTNAME").String()
+	syslogTag          = kingpin.Flag("syslog-tag", "TAG of RFC 3164 syslog messages, which may use the same variables as --syslog-hostname").Default(logging.DefaultSyslogTag).Envar("SYSLOG_TAG").String()
+	syslogAppName      = kingpin.Flag("syslog-app-name", "APP-NAME of RFC 5424 syslog messages, which may use the same variables as --syslog-hostname, defaults to the app GUID").Default("").Envar("SYSLOG_APP_NAME").String()
+	foundation         = kingpin.Flag("foundation", "Name of the Cloud Foundry foundation, substituted for {foundation} in the syslog header").Default("").Envar("FOUNDATION").String()
 	subscriptionId     = kingpin.Flag("subscription-id", "Id for the subscription.").Default("firehose").Envar("FIREHOSE_SUBSCRIPTION_ID").String()
+	includeSubID       = kingpin.Flag("include-subscription-id", "Add the firehose subscription id events were delivered through as a subscription_id field").Default("false").Envar("INCLUDE_SUBSCRIPTION_ID").Bool()
+	timestampFormat    = kingpin.Flag("timestamp-format", "Format of the timestamp and received_at fields of events: rfc3339nano or epoch-millis").Default(fevents.TimestampRFC3339Nano).Envar("TIMESTAMP_FORMAT").Enum(fevents.TimestampRFC3339Nano, fevents.TimestampEpochMillis)
+	includeSchemaVer   = kingpin.Flag("include-schema-version", "Add the events schema version and the nozzle version as schema_version and nozzle_version fields").Default("false").Envar("INCLUDE_SCHEMA_VERSION").Bool()
 	clientID           = kingpin.Flag("client-id", "Client ID.").Envar("FIREHOSE_CLIENT_ID").Required().String()
 	clientSecret       = kingpin.Flag("client-secret", "Client secret.").Envar("FIREHOSE_CLIENT_SECRET").Required().String()
+	uaaRefreshToken    = kingpin.Flag("uaa-refresh-token", "Connect to the firehose with tokens obtained through the UAA refresh_token grant").Envar("UAA_REFRESH_TOKEN").String()
+	requiredScopes     = kingpin.Flag("required-scopes", "Comma separated scopes the UAA token must hold, '|' separating alternatives. Empty skips the check").Default(uaatokenrefresher.DefaultRequiredScopes).Envar("REQUIRED_SCOPES").String()
+	tokenRefreshAt     = kingpin.Flag("token-refresh-leeway", "Fraction of the UAA token lifetime after which it is refreshed in the background, 0 only refreshes it once rejected").Default("0.8").Envar("TOKEN_REFRESH_LEEWAY").Float64()
 	skipSSLValidation  = kingpin.Flag("skip-ssl-validation", "Please don't").Default("false").Envar("SKIP_SSL_VALIDATION").Bool()
+	httpProxy          = kingpin.Flag("http-proxy", "Proxy of the http connections to the api, UAA and doppler, defaults to http_proxy").Default("").Envar("HTTP_PROXY").String()
+	httpsProxy         = kingpin.Flag("https-proxy", "Proxy of the https and wss connections to the api, UAA and doppler, defaults to https_proxy").Default("").Envar("HTTPS_PROXY").String()
+	noProxy            = kingpin.Flag("no-proxy", "Comma separated hosts, domains, IP addresses and CIDR ranges reached without proxy, defaults to no_proxy").Default("").Envar("NO_PROXY").String()
 	keepAlive          = kingpin.Flag("fh-keep-alive", "Keep Alive duration for the firehose consumer").Default("25s").Envar("FH_KEEP_ALIVE").Duration()
+	shardCount         = kingpin.Flag("shard-count", "Number of parallel firehose connections opened with the subscription id, Loggregator spreading the envelopes over them").Default("1").Envar("SHARD_COUNT").Int()
+	staleTimeout       = kingpin.Flag("stale-stream-timeout", "Refresh the UAA token and resubscribe to the firehose when no envelope arrived for this long, 0 disables it").Default("5m").Envar("STALE_STREAM_TIMEOUT").Duration()
+	resubscribeEvery   = kingpin.Flag("resubscribe-interval", "Periodically tear down and re-establish the firehose subscription to rebalance Loggregator sharding, 0 disables it").Default("0s").Envar("RESUBSCRIBE_INTERVAL").Duration()
+	resubscribeJitter  = kingpin.Flag("resubscribe-jitter", "Random delay added to every --resubscribe-interval, so that instances don't resubscribe together").Default("5m").Envar("RESUBSCRIBE_JITTER").Duration()
+	conflictResolve    = kingpin.Flag("auto-resolve-subscription-conflict", "Append a random suffix to the subscription id after that many disconnects in a row right after subscribing, resubscribing following --reconnect-max-retries; 0 keeps the id").Default("0").Envar("AUTO_RESOLVE_SUBSCRIPTION_CONFLICT").Int()
+	reconnectRetries   = kingpin.Flag("reconnect-max-retries", "Reconnect to the firehose after a disconnect up to this many times in a row with exponential backoff, 0 exits on the first disconnect, -1 (the default) retries forever").Default("-1").Envar("RECONNECT_MAX_RETRIES").Int()
+	reconnectBase      = kingpin.Flag("reconnect-base-delay", "Delay before the first firehose reconnect, doubled on every following attempt").Default("1s").Envar("RECONNECT_BASE_DELAY").Duration()
+	reconnectMax       = kingpin.Flag("reconnect-max-delay", "Maximum delay between firehose reconnects").Default("1m").Envar("RECONNECT_MAX_DELAY").Duration()
+	shutdownTimeout    = kingpin.Flag("shutdown-timeout", "How long the firehose consumer is given to stop on SIGINT or SIGTERM before the nozzle exits anyway").Default("10s").Envar("SHUTDOWN_TIMEOUT").Duration()
 	logEventTotals     = kingpin.Flag("log-event-totals", "Logs the counters for all selected events since nozzle was last started.").Default("false").Envar("LOG_EVENT_TOTALS").Bool()
 	logEventTotalsTime = kingpin.Flag("log-event-totals-time", "How frequently the event totals are calculated (in sec).").Default("30s").Envar("LOG_EVENT_TOTALS_TIME").Duration()
-	wantedEvents       = kingpin.Flag("events", fmt.Sprintf("Comma separated list of events you would like. Valid options are %s", eventRouting.GetListAuthorizedEventEvents())).Default("LogMessage").Envar("EVENTS").String()
+	emitSelfMetrics    = kingpin.Flag("emit-self-metrics", "Periodically ship the nozzle's own CPU, memory, goroutines and event throughput as firehose_to_syslog_self events").Default("false").Envar("EMIT_SELF_METRICS").Bool()
+	selfMetricsTime    = kingpin.Flag("self-metrics-interval", "How often the nozzle's own resource usage is shipped").Default("60s").Envar("SELF_METRICS_INTERVAL").Duration()
+	emitInternal       = kingpin.Flag("emit-internal-metrics", "Ship the routed, dropped, reconnect and cache counters as nozzle_internal events every --log-event-totals-time").Default("false").Envar("EMIT_INTERNAL_METRICS").Bool()
+	healthAddr         = kingpin.Flag("health-addr", "Address of an HTTP server answering liveness probes at /healthz and readiness probes at /readyz, e.g. ':8080'. Empty disables it").Default("").Envar("HEALTH_ADDR").String()
+	metricsAddr        = kingpin.Flag("metrics-addr", "Address of an HTTP server exposing Prometheus metrics at /metrics, e.g. ':9090'. Empty disables it").Default("").Envar("METRICS_ADDR").String()
+	wantedEvents       = kingpin.Flag("events", fmt.Sprintf("Comma separated list of events you would like. Valid options are %s, or all for every one of them and all-metrics for the metric ones", eventRouting.GetListAuthorizedEventEvents())).Default("LogMessage").Envar("EVENTS").String()
+	filterAppGUIDs     = kingpin.Flag("filter-app-guids", "Comma separated app GUIDs whose events are the only ones shipped, empty ships every app").Default("").Envar("FILTER_APP_GUIDS").String()
+	excludeAppGUIDs    = kingpin.Flag("exclude-app-guids", "Comma separated app GUIDs whose events are dropped, winning over --filter-app-guids").Default("").Envar("EXCLUDE_APP_GUIDS").String()
+	filterOrgs         = kingpin.Flag("filter-orgs", "Comma separated org names whose app events are the only ones shipped, empty ships every org").Default("").Envar("FILTER_ORGS").String()
+	filterSpaces       = kingpin.Flag("filter-spaces", "Comma separated space names whose app events are the only ones shipped, empty ships every space").Default("").Envar("FILTER_SPACES").String()
+	logSourceTypes     = kingpin.Flag("log-source-types", "Comma separated LogMessage streams forwarded, STDOUT and/or STDERR, empty forwards both").Default("").Envar("LOG_SOURCE_TYPES").String()
+	httpStatusFilter   = kingpin.Flag("http-status-filter", "Comma separated HTTP status classes, codes or ranges of the HttpStartStop events forwarded, example: '4xx,5xx' or '404,500-504', empty forwards them all").Default("").Envar("HTTP_STATUS_FILTER").String()
+	messageInclude     = kingpin.Flag("message-include-regex", "Regular expression LogMessage texts have to match to be forwarded, empty forwards every message").Default("").Envar("MESSAGE_INCLUDE_REGEX").String()
+	messageExclude     = kingpin.Flag("message-exclude-regex", "Regular expression dropping the LogMessage texts matching it, example: 'GET /healthz .* 200'").Default("").Envar("MESSAGE_EXCLUDE_REGEX").String()
+	missingMetadata    = kingpin.Flag("filter-on-missing-metadata", "What --filter-orgs and --filter-spaces do with app events whose org or space can't be resolved: drop or pass").Default(eventRouting.MissingMetadataDrop).Envar("FILTER_ON_MISSING_METADATA").Enum(eventRouting.MissingMetadataDrop, eventRouting.MissingMetadataPass)
+	includeLabels      = kingpin.Flag("include-labels", "Comma separated keys of the app labels added to app events as cf_app_label_<key> fields, resolved through the v3 API").Default("").Envar("INCLUDE_LABELS").String()
+	includeAnnotations = kingpin.Flag("include-annotations", "Comma separated keys of the app annotations added to app events as cf_app_annotation_<key> fields, resolved through the v3 API").Default("").Envar("INCLUDE_ANNOTATIONS").String()
 	boltDatabasePath   = kingpin.Flag("boltdb-path", "Bolt Database path ").Default("my.db").Envar("BOLTDB_PATH").String()
+	boltDatabaseShards = kingpin.Flag("boltdb-shards", "Number of Bolt files the cache is sharded over by app GUID").Default("1").Envar("BOLTDB_SHARDS").Int()
+	cacheBackend       = kingpin.Flag("cache-backend", "Where apps are cached: bolt files local to the instance, a redis server shared by instances, or memory only").Default(caching.CacheBackendBolt).Envar("CACHE_BACKEND").Enum(caching.CacheBackendBolt, caching.CacheBackendRedis, caching.CacheBackendMemory)
+	cacheMaxEntries    = kingpin.Flag("cache-max-entries", "Number of apps the memory cache holds, the least recently used being evicted beyond it, 0 is unbounded").Default("100000").Envar("CACHE_MAX_ENTRIES").Int()
+	redisAddr          = kingpin.Flag("redis-addr", "Address of the redis server used with --cache-backend=redis").Default("localhost:6379").Envar("REDIS_ADDR").String()
+	redisPassword      = kingpin.Flag("redis-password", "Password of the redis server").Default("").Envar("REDIS_PASSWORD").String()
+	redisDB            = kingpin.Flag("redis-db", "Redis database number").Default("0").Envar("REDIS_DB").Int()
 	tickerTime         = kingpin.Flag("cc-pull-time", "CloudController Polling time in sec").Default("60s").Envar("CF_PULL_TIME").Duration()
-	extraFields        = kingpin.Flag("extra-fields", "Extra fields you want to annotate your events with, example: '--extra-fields=env:dev,something:other ").Default("").Envar("EXTRA_FIELDS").String()
+	deletedEntity      = kingpin.Flag("deleted-entity-policy", "Handling of events of apps whose space or org was deleted, one of [none, drop, placeholder, last-known]").Default(caching.DeletedEntityNone).Envar("DELETED_ENTITY_POLICY").Enum(caching.DeletedEntityNone, caching.DeletedEntityDrop, caching.DeletedEntityPlaceholder, caching.DeletedEntityLastKnown)
+	cacheUnavailable   = kingpin.Flag("cache-unavailable-policy", "Handling of the cache failing mid-run (Bolt writes or CC refreshes), one of [degrade, stop]").Default(caching.CacheUnavailableDegrade).Envar("CACHE_UNAVAILABLE_POLICY").Enum(caching.CacheUnavailableDegrade, caching.CacheUnavailableStop)
+	cacheWarmup        = kingpin.Flag("cache-warmup", "Load every app from the Cloud Controller into the Bolt cache at startup, before subscribing to the firehose").Default("false").Envar("CACHE_WARMUP").Bool()
+	cacheWarmupTimeout = kingpin.Flag("cache-warmup-timeout", "Give up the cache warmup after this long, apps being then resolved on their first event, 0 waits for it").Default("2m").Envar("CACHE_WARMUP_TIMEOUT").Duration()
+	cacheMaxAge        = kingpin.Flag("cache-max-entry-age", "Evict cached apps neither refreshed nor resolved for this long, so that they are resolved again, 0 disables it").Default("0s").Envar("CACHE_MAX_ENTRY_AGE").Duration()
+	ccHTTPTimeout      = kingpin.Flag("cc-http-timeout", "Timeout of each CloudController request, 0 waits forever").Default("30s").Envar("CC_HTTP_TIMEOUT").Duration()
+	ccMaxRetries       = kingpin.Flag("cc-max-retries", "Number of times CloudController requests failing with a timeout, a network error, 5xx or 429 are retried with backoff, honoring Retry-After").Default("3").Envar("CC_MAX_RETRIES").Int()
+	ccAPIVersion       = kingpin.Flag("cc-api-version", "CloudController API version used to resolve apps, spaces and orgs, one of [v2, v3]").Default("v3").Envar("CC_API_VERSION").Enum(caching.CCAPIv2, caching.CCAPIv3)
+	extraFields        = kingpin.Flag("extra-fields", "Extra fields you want to annotate your events with, values holding {token} being filled from each event, example: '--extra-fields=env:dev,instance:{source_instance},app:{app_name}'").Default("").Envar("EXTRA_FIELDS").String()
+	extraFieldsWin     = kingpin.Flag("extra-fields-override", "Let extra fields win over resolved event metadata on key collision").Default("false").Envar("EXTRA_FIELDS_OVERRIDE").Bool()
+	extraFieldsStrict  = kingpin.Flag("extra-fields-strict", "On malformed extra fields or unknown tokens in their values: fail to refuse starting, skip to ignore them, or leave the tokens literal, with a warning").Default(extrafields.StrictFail).Envar("EXTRA_FIELDS_STRICT").Enum(extrafields.StrictFail, extrafields.StrictSkip)
 	modeProf           = kingpin.Flag("mode-prof", "Enable profiling mode, one of [cpu, mem, block]").Default("").Envar("MODE_PROF").String()
 	pathProf           = kingpin.Flag("path-prof", "Set the Path to write profiling file").Default("").Envar("PATH_PROF").String()
-	logFormatterType   = kingpin.Flag("log-formatter-type", "Log formatter type to use. Valid options are text, json. If none provided, defaults to json.").Envar("LOG_FORMATTER_TYPE").String()
+	logFormatterType   = kingpin.Flag("log-formatter-type", "Log formatter type to use. Valid options are text, json, logfmt. If none provided, defaults to json.").Envar("LOG_FORMATTER_TYPE").String()
+	jsonFieldMap       = kingpin.Flag("json-field-map", "Comma separated from=to pairs renaming the fields of the json formatter, example: 'cf_app_id=app_id,msg=message'").Default("").Envar("JSON_FIELD_MAP").String()
+	jsonIncludeFields  = kingpin.Flag("json-include-fields", "Comma separated fields the json formatter only emits, along with time and msg, empty emits every field").Default("").Envar("JSON_INCLUDE_FIELDS").String()
+	jsonExcludeFields  = kingpin.Flag("json-exclude-fields", "Comma separated fields the json formatter doesn't emit").Default("").Envar("JSON_EXCLUDE_FIELDS").String()
+	formatOverrides    = kingpin.Flag("format-override", "Comma separated sourcetype:formatter pairs overriding the log formatter for some source types, example: 'RTR:logfmt'").Default("").Envar("FORMAT_OVERRIDE").String()
+	extraFormats       = kingpin.Flag("extra-formats", "Comma separated formatters every event is additionally sent to the syslog server in, multiplying the output volume, example: 'logfmt'").Default("").Envar("EXTRA_FORMATS").String()
 	certPath           = kingpin.Flag("cert-pem-syslog", "Certificate Pem file").Envar("CERT_PEM").Default("").String()
+	tlsClientCert      = kingpin.Flag("tls-client-cert", "PEM encoded client certificate presented to tcp+tls syslog servers requiring client authentication").Default("").Envar("TLS_CLIENT_CERT").String()
+	tlsClientKey       = kingpin.Flag("tls-client-key", "PEM encoded key of --tls-client-cert").Default("").Envar("TLS_CLIENT_KEY").String()
+	tlsServerName      = kingpin.Flag("tls-server-name", "Host name the tcp+tls syslog server certificate is verified against and sent as SNI, defaults to the dialed host").Default("").Envar("TLS_SERVER_NAME").String()
+	tlsMinVersion      = kingpin.Flag("tls-min-version", "Minimum TLS version of tcp+tls syslog connections (1.2/1.3)").Default(logging.TLSVersion12).Envar("TLS_MIN_VERSION").Enum(logging.TLSVersion12, logging.TLSVersion13)
 	ignoreMissingApps  = kingpin.Flag("ignore-missing-apps", "Enable throttling on cache lookup for missing apps").Envar("IGNORE_MISSING_APPS").Default("false").Bool()
+	missingAppsTTL     = kingpin.Flag("missing-apps-ttl", "How long the redis and memory caches remember missing apps with --ignore-missing-apps, 0 until evicted").Default("1h").Envar("MISSING_APPS_TTL").Duration()
+	collapseWhitespace = kingpin.Flag("collapse-whitespace", "Collapse runs of whitespace in message bodies to a single space").Default("false").Envar("COLLAPSE_WHITESPACE").Bool()
+	surfaceDrops       = kingpin.Flag("surface-loggregator-drops", "Ship Loggregator dropped messages notifications as high severity loggregator_dropped events").Default("true").Envar("SURFACE_LOGGREGATOR_DROPS").Bool()
+	detectCrashes      = kingpin.Flag("detect-crashes", "Emit a high severity crash event whenever an app instance crashes").Default("false").Envar("DETECT_CRASHES").Bool()
+	maxBytesPerSecond  = kingpin.Flag("max-bytes-per-second", "Limit the outbound syslog bandwidth in bytes per second, 0 means unlimited").Default("0").Envar("MAX_BYTES_PER_SECOND").Int()
+	bandwidthPolicy    = kingpin.Flag("bandwidth-limit-policy", "What to do when the outbound bandwidth limit is hit, one of [block, drop]").Default(logging.BandwidthPolicyBlock).Envar("BANDWIDTH_LIMIT_POLICY").Enum(logging.BandwidthPolicyBlock, logging.BandwidthPolicyDrop)
+	shedPriority       = kingpin.Flag("shed-priority", "Comma separated event types, ordered from the first to the last to shed when the bandwidth limit drops messages").Default(logging.DefaultShedPriority).Envar("SHED_PRIORITY").String()
+	packEvents         = kingpin.Flag("pack-events", "Pack up to this many events in a single newline separated syslog message, 0 or 1 disables packing").Default("0").Envar("PACK_EVENTS").Int()
+	writeLanes         = kingpin.Flag("sink-write-lanes", "Number of concurrent connections writing to the syslog server, the events of a source always using the same one").Default("1").Envar("SINK_WRITE_LANES").Int()
+	priorityLevels     = kingpin.Flag("sink-priority-levels", "Number of priority levels of the sink queue, event types being ranked by --shed-priority; 0 or 1 writes in arrival order").Default("1").Envar("SINK_PRIORITY_LEVELS").Int()
+	packMaxBytes       = kingpin.Flag("pack-max-bytes", "Maximum size of a packed syslog message payload").Default("8192").Envar("PACK_MAX_BYTES").Int()
+	packFlushInterval  = kingpin.Flag("pack-flush-interval", "Send a partial pack after this long").Default("1s").Envar("PACK_FLUSH_INTERVAL").Duration()
+	batchSize          = kingpin.Flag("batch-size", "Write up to this many syslog messages, each with its own header, in a single network write over tcp and tcp+tls, 0 or 1 disables batching").Default("0").Envar("BATCH_SIZE").Int()
+	batchFlushInterval = kingpin.Flag("batch-flush-interval", "Write a partial batch of syslog messages after this long").Default("1s").Envar("BATCH_FLUSH_INTERVAL").Duration()
+	compress           = kingpin.Flag("compress", "Send syslog messages over tcp and tcp+tls in a gzip stream, octet-counted and flushed every --batch-flush-interval, the receiver having to decompress it").Default("false").Envar("COMPRESS").Bool()
+	udpMaxDatagram     = kingpin.Flag("udp-max-datagram", "Maximum size of udp syslog datagrams, header included, 1472 fitting an Ethernet MTU unfragmented, 0 disables it").Default("1472").Envar("UDP_MAX_DATAGRAM").Int()
+	udpOversize        = kingpin.Flag("udp-oversize-policy", "What to do with udp syslog messages over --udp-max-datagram, one of [truncate, skip]").Default(logging.UDPOversizeTruncate).Envar("UDP_OVERSIZE_POLICY").Enum(logging.UDPOversizeTruncate, logging.UDPOversizeSkip)
+	fifoPath           = kingpin.Flag("fifo-path", "Also write formatted events to this named pipe (created if missing)").Default("").Envar("FIFO_PATH").String()
+	outputEncoding     = kingpin.Flag("output-encoding", "Encoding of the formatted output, one of [utf8, latin1]").Default("utf8").Envar("OUTPUT_ENCODING").Enum(logging.EncodingUTF8, logging.EncodingLatin1)
+	encodingReplace    = kingpin.Flag("output-encoding-replacement", "Replacement for characters that can't be represented in the output encoding").Default("?").Envar("OUTPUT_ENCODING_REPLACEMENT").String()
+	retryableStatuses  = kingpin.Flag("retryable-http-statuses", "Comma separated list of extra HTTP statuses to treat as retryable (5xx, 408 and 429 always are)").Default("").Envar("RETRYABLE_HTTP_STATUSES").String()
+	fieldNameAllow     = kingpin.Flag("field-name-allow", "Only ship event fields whose name matches this regular expression").Default("").Envar("FIELD_NAME_ALLOW").String()
+	includeSyslogPri   = kingpin.Flag("include-syslog-pri", "Add the computed syslog priority (facility*8+severity) as a syslog_pri field").Default("false").Envar("INCLUDE_SYSLOG_PRI").Bool()
+	profileLatency     = kingpin.Flag("profile-event-latency", "Record per-event time spent in cache lookup, transforms, formatting and syslog write").Default("false").Envar("PROFILE_EVENT_LATENCY").Bool()
+	clampMetrics       = kingpin.Flag("container-metric-clamp", "What to do with ContainerMetric values out of range, one of [off, cap, drop]").Default("off").Envar("CONTAINER_METRIC_CLAMP").Enum("off", "cap", "drop")
+	clampMaxCPU        = kingpin.Flag("container-metric-max-cpu", "Highest sane ContainerMetric cpu_percentage").Default("6400").Envar("CONTAINER_METRIC_MAX_CPU").Float64()
+	cpuSmoothing       = kingpin.Flag("container-cpu-smoothing", "Derived ContainerMetric CPU fields to add, one of [off, average, cumulative, both]").Default("off").Envar("CONTAINER_CPU_SMOOTHING").Enum("off", "average", "cumulative", "both")
+	cpuWindow          = kingpin.Flag("container-cpu-window", "Number of ContainerMetric samples cpu_percentage_avg is averaged over").Default("6").Envar("CONTAINER_CPU_WINDOW").Int()
+	extractTraceID     = kingpin.Flag("extract-trace-id", "Add a trace_id field from the request ID of HttpStartStop events and from LogMessage bodies").Default("false").Envar("EXTRACT_TRACE_ID").Bool()
+	traceIDPattern     = kingpin.Flag("trace-id-pattern", "Regular expression whose first non-empty group is the trace ID of a LogMessage body").Default(transforms.DefaultTraceIDPattern).Envar("TRACE_ID_PATTERN").String()
+	maxMessageBytes    = kingpin.Flag("max-message-bytes", "Cut syslog messages longer than this many bytes, the RFC 5424 header and structured data being kept whole, 0 disables it").Default("0").Envar("MAX_MESSAGE_BYTES").Int()
+	truncationMarker   = kingpin.Flag("truncation-marker", "Appended to the syslog messages cut to --max-message-bytes").Default("...[truncated]").Envar("TRUNCATION_MARKER").String()
+	maxMessageLength   = kingpin.Flag("max-message-length", "Comma separated EventType:bytes limits the message body is truncated to, 'default' applying to the other types, example: 'LogMessage:8192,default:2048'").Default("").Envar("MAX_MESSAGE_LENGTH").String()
+	regionCIDRMap      = kingpin.Flag("region-cidr-map", "Comma separated CIDR:region pairs tagging events with the region of their emitter IP, example: '10.0.0.0/8:us-east,10.1.0.0/16:eu-west'").Default("").Envar("REGION_CIDR_MAP").String()
+	defaultRegion      = kingpin.Flag("region", "Region of events whose emitter IP is outside --region-cidr-map").Default("").Envar("REGION").String()
+	sourceTypeMap      = kingpin.Flag("source-type-map", "Rename source types, example: '--source-type-map=RTR:gorouter,CELL:diego'").Default("").Envar("SOURCE_TYPE_MAP").String()
+	wantedTransforms   = kingpin.Flag("transforms", fmt.Sprintf("Comma separated, ordered list of transforms applied to every event. Valid options are %s", transforms.GetListAuthorizedTransforms())).Default("").Envar("TRANSFORMS").String()
 )
 
 var (
 	version = "0.0.0"
 )
 
+// validateTimeout is how long --validate waits for the firehose subscription
+// to fail
+const validateTimeout = 10 * time.Second
+
+// ccRetryBaseDelay and ccRetryMaxDelay bound the backoff between retried
+// CloudController requests
+const (
+	ccRetryBaseDelay = time.Second
+	ccRetryMaxDelay  = 30 * time.Second
+)
+
 func main() {
 	kingpin.Version(version)
+	if err := config.Apply(kingpin.CommandLine, os.Args[1:], "config"); err != nil {
+		log.Fatal("Error loading config file: ", err)
+	}
 	kingpin.Parse()
+	if *configFile != "" {
+		logging.LogStd(fmt.Sprintf("Loaded options from %s", *configFile), false)
+	}
+
+	statuses, err := retry.ParseStatuses(*retryableStatuses)
+	if err != nil {
+		log.Fatal("Error parsing retryable HTTP statuses: ", err)
+	}
+	retry.SetRetryableStatuses(statuses)
 
 	//Setup Logging
-	loggingClient := logging.NewLogging(*syslogServer, *syslogProtocol, *logFormatterType, *certPath, *debug)
+	formatOverridesBySourceType, err := logging.ParseFormatOverrides(*formatOverrides)
+	if err != nil {
+		log.Fatal("Error parsing format overrides: ", err)
+	}
+	extraFormatTypes, err := logging.ParseExtraFormats(*extraFormats)
+	if err != nil {
+		log.Fatal("Error parsing extra formats: ", err)
+	}
+	if len(extraFormatTypes) > 0 {
+		logging.LogStd(fmt.Sprintf("Sending every event in %d formats, multiplying the syslog volume", len(extraFormatTypes)+1), true)
+	}
+	jsonRenames, err := logging.ParseJSONFieldMap(*jsonFieldMap)
+	if err != nil {
+		log.Fatal("Error parsing JSON field map: ", err)
+	}
+	jsonExcluded := logging.ParseJSONFields(*jsonExcludeFields)
+	if err := logging.CheckJSONFields(jsonExcluded); err != nil {
+		log.Fatal("Error setting up JSON fields: ", err)
+	}
+	osHostname, _ := os.Hostname()
+	headerVars := map[string]string{"foundation": *foundation, "subscription_id": *subscriptionId, "hostname": osHostname}
+	headerHostname, err := logging.ExpandSyslogHeader(*syslogHostname, headerVars)
+	if err != nil {
+		log.Fatal("Error parsing --syslog-hostname: ", err)
+	}
+	headerTag, err := logging.ExpandSyslogHeader(*syslogTag, headerVars)
+	if err != nil {
+		log.Fatal("Error parsing --syslog-tag: ", err)
+	}
+	headerAppName, err := logging.ExpandSyslogHeader(*syslogAppName, headerVars)
+	if err != nil {
+		log.Fatal("Error parsing --syslog-app-name: ", err)
+	}
+	shedPriorityTypes := logging.ParseShedPriority(*shedPriority)
+	for _, eventType := range shedPriorityTypes {
+		if !eventRouting.IsAuthorizedEvent(eventType) {
+			log.Fatalf("Rejected shed priority Event Name [%s] - Valid events: %s", eventType, eventRouting.GetListAuthorizedEventEvents())
+		}
+	}
+	if _, err := utils.NewProxyFunc(*httpProxy, *httpsProxy, *noProxy); err != nil {
+		log.Fatal("Error parsing proxy settings: ", err)
+	}
+	if err := logging.CheckOutputEncoding(*outputEncoding, *encodingReplace); err != nil {
+		log.Fatal("Error setting up output encoding: ", err)
+	}
+	var fieldNameAllowRegexp *regexp.Regexp
+	if *fieldNameAllow != "" {
+		fieldNameAllowRegexp, err = regexp.Compile(*fieldNameAllow)
+		if err != nil {
+			log.Fatal("Error parsing field name allow pattern: ", err)
+		}
+	}
+	if *writeLanes > 1 && *packEvents > 1 {
+		log.Fatal("--sink-write-lanes can't be combined with --pack-events")
+	}
+	if *batchSize > 1 && !logging.Batchable(*syslogProtocol) {
+		logging.LogStd(fmt.Sprintf("--batch-size is ignored with the %s syslog protocol, messages are written one by one", *syslogProtocol), true)
+	}
+	if *compress && !logging.Batchable(*syslogProtocol) {
+		log.Fatal("--compress requires the tcp or tcp+tls syslog protocol, not ", *syslogProtocol)
+	}
+	if *compress && *batchSize > 1 {
+		logging.LogStd("--batch-size is ignored with --compress, the gzip stream buffering messages until --batch-flush-interval", true)
+	}
+	facility, err := logging.ParseFacility(*syslogFacility)
+	if err != nil {
+		log.Fatal("Error parsing syslog facility: ", err)
+	}
+	severities, err := logging.ParseSeverityMap(*severityMap)
+	if err != nil {
+		log.Fatal("Error parsing severity map: ", err)
+	}
+	if (*includeLabels != "" || *includeAnnotations != "") && *ccAPIVersion != caching.CCAPIv3 {
+		log.Fatal("--include-labels and --include-annotations require --cc-api-version=v3")
+	}
+	if _, err := eventRouting.ExpandEvents(*wantedEvents); err != nil {
+		log.Fatal("Error parsing events: ", err)
+	}
+	routes, err := eventRouting.ParseRouteMap(*routeMap)
+	if err != nil {
+		log.Fatal("Error parsing route map: ", err)
+	}
+	usesTLS := *syslogProtocol == logging.SecureProto
+	for _, destination := range routes {
+		if strings.HasPrefix(destination, logging.SecureProto+"://") {
+			usesTLS = true
+		}
+		if *compress && strings.HasPrefix(destination, "udp://") {
+			log.Fatal("--compress can't be combined with the udp route ", destination)
+		}
+	}
+	var syslogTLSConfig *tls.Config
+	if usesTLS {
+		syslogTLSConfig, err = logging.NewSyslogTLSConfig(*certPath, *tlsClientCert, *tlsClientKey, *tlsServerName, *tlsMinVersion)
+		if err != nil {
+			log.Fatal("Error setting up syslog TLS: ", err)
+		}
+	}
+	var kafkaTLSConfig *tls.Config
+	if *kafkaTLS {
+		kafkaTLSConfig, err = logging.NewSyslogTLSConfig(*kafkaCACert, "", "", "", *tlsMinVersion)
+		if err != nil {
+			log.Fatal("Error setting up Kafka TLS: ", err)
+		}
+	}
+	if *outputType == logging.OutputKafka && *kafkaBrokers == "" {
+		log.Fatal("--output-type=kafka requires --kafka-brokers")
+	}
+	if *outputType == logging.OutputHTTP && *httpURL == "" {
+		log.Fatal("--output-type=http requires --http-url")
+	}
+	if *outputType == logging.OutputFile && *filePath == "" {
+		log.Fatal("--output-type=file requires --file-path")
+	}
+	headers, err := logging.ParseHTTPHeaders(*httpHeaders)
+	if err != nil {
+		log.Fatal("Error parsing HTTP headers: ", err)
+	}
+	loggingConfig := &logging.LoggingConfig{
+		SyslogServer:        *syslogServer,
+		SyslogProtocol:      *syslogProtocol,
+		SyslogFormat:        *syslogFormat,
+		SyslogSRV:           *syslogSRV,
+		SRVRefreshInterval:  *srvRefresh,
+		LogFormatterType:    *logFormatterType,
+		FormatOverrides:     formatOverridesBySourceType,
+		ExtraFormats:        extraFormatTypes,
+		CertPath:            *certPath,
+		TLSConfig:           syslogTLSConfig,
+		Debug:               *debug,
+		MaxBytesPerSecond:   *maxBytesPerSecond,
+		BandwidthPolicy:     *bandwidthPolicy,
+		ShedPriority:        shedPriorityTypes,
+		FifoPath:            *fifoPath,
+		OutputEncoding:      *outputEncoding,
+		EncodingReplacement: *encodingReplace,
+		FieldNameAllow:      fieldNameAllowRegexp,
+		IncludeSyslogPri:    *includeSyslogPri,
+		PackEvents:          *packEvents,
+		PackMaxBytes:        *packMaxBytes,
+		PackFlushInterval:   *packFlushInterval,
+		ProfileLatency:      *profileLatency,
+		WriteLanes:          *writeLanes,
+		PriorityLevels:      *priorityLevels,
+		OutputType:          *outputType,
+		BatchSize:           *batchSize,
+		BatchFlushInterval:  *batchFlushInterval,
+		Routes:              routes,
+		MaxMessageBytes:     *maxMessageBytes,
+		TruncationMarker:    *truncationMarker,
+		SyslogFacility:      facility,
+		SeverityMap:         severities,
+		KafkaBrokers:        strings.Split(*kafkaBrokers, ","),
+		KafkaTopic:          *kafkaTopic,
+		KafkaTLSConfig:      kafkaTLSConfig,
+		KafkaSASLUser:       *kafkaSASLUser,
+		KafkaSASLPassword:   *kafkaSASLPassword,
+		KafkaOnError:        *kafkaOnError,
+		HTTPURL:             *httpURL,
+		HTTPHeaders:         headers,
+		HTTPBatchSize:       *httpBatchSize,
+		HTTPTimeout:         *httpTimeout,
+		HTTPOnError:         *httpOnError,
+		JSONFieldMap:        jsonRenames,
+		JSONIncludeFields:   logging.ParseJSONFields(*jsonIncludeFields),
+		JSONExcludeFields:   jsonExcluded,
+		SyslogHostname:      headerHostname,
+		SyslogTag:           headerTag,
+		SyslogAppName:       headerAppName,
+		Compress:            *compress,
+		UDPMaxDatagram:      *udpMaxDatagram,
+		UDPOversizePolicy:   *udpOversize,
+		SyslogBalance:       *syslogBalance,
+		SyslogFailback:      *syslogFailback,
+		FilePath:            *filePath,
+		FileMaxBytes:        *fileMaxSize * 1024 * 1024,
+		FileMaxAge:          *fileMaxAge,
+		FileMaxBackups:      *fileMaxBackups,
+		SpoolDir:            *spoolDir,
+		SpoolMaxBytes:       *spoolMaxBytes,
+	}
+	loggingClient := logging.NewLogging(loggingConfig)
+	switch *onUnreachable {
+	case logging.UnreachableRetry:
+		loggingClient = logging.NewRetryingLogging(loggingClient, *syslogRetry, 0)
+	case logging.UnreachableBuffer:
+		loggingClient = logging.NewRetryingLogging(loggingClient, *syslogRetry, *syslogBufferSize)
+	}
 	logging.LogStd(fmt.Sprintf("Starting firehose-to-syslog %s ", version), true)
 
+	c := cfclient.Config{
+		ApiAddress:        *apiEndpoint,
+		ClientID:          *clientID,
+		ClientSecret:      *clientSecret,
+		SkipSslValidation: *skipSSLValidation,
+		UserAgent:         "firehose-to-syslog/" + version,
+	}
+	if *validate {
+		os.Exit(validateSetup(&c, loggingConfig))
+	}
+
+	// signals are handled by stopOnSignal, stopping the profiler
+	var profiler interface {
+		Stop()
+	}
 	if *modeProf != "" {
 		switch *modeProf {
 		case "cpu":
-			defer profile.Start(profile.CPUProfile, profile.ProfilePath(*pathProf)).Stop()
+			profiler = profile.Start(profile.CPUProfile, profile.ProfilePath(*pathProf), profile.NoShutdownHook)
 		case "mem":
-			defer profile.Start(profile.MemProfile, profile.ProfilePath(*pathProf)).Stop()
+			profiler = profile.Start(profile.MemProfile, profile.ProfilePath(*pathProf), profile.NoShutdownHook)
 		case "block":
-			defer profile.Start(profile.BlockProfile, profile.ProfilePath(*pathProf)).Stop()
+			profiler = profile.Start(profile.BlockProfile, profile.ProfilePath(*pathProf), profile.NoShutdownHook)
 		default:
 			// do nothing
 		}
 	}
 
-	c := cfclient.Config{
-		ApiAddress:        *apiEndpoint,
-		ClientID:          *clientID,
-		ClientSecret:      *clientSecret,
-		SkipSslValidation: *skipSSLValidation,
-		UserAgent:         "firehose-to-syslog/" + version,
-	}
-	cfClient, err := cfclient.NewClient(&c)
+	cfClient, uaaRefresher, err := newCFClient(&c)
 	if err != nil {
 		log.Fatal("New Client: ", err)
 		os.Exit(1)
@@ -85,22 +463,177 @@ func main() {
 
 	//Creating Caching
 	var cachingClient caching.Caching
-	if caching.IsNeeded(*wantedEvents) {
+	if cacheNeeded() && *cacheBackend == caching.CacheBackendRedis {
+		appClient, err := caching.NewAppClient(cfClient, *ccAPIVersion)
+		if err != nil {
+			log.Fatal("Failed to create app client", err)
+		}
+		cachingClient = caching.NewCachingRedis(appClient, &caching.CachingRedisConfig{
+			Addr:               *redisAddr,
+			Password:           *redisPassword,
+			DB:                 *redisDB,
+			IgnoreMissingApps:  *ignoreMissingApps,
+			MissingAppsTTL:     *missingAppsTTL,
+			CacheInvalidateTTL: *tickerTime,
+		})
+	} else if cacheNeeded() && *cacheBackend == caching.CacheBackendMemory {
+		appClient, err := caching.NewAppClient(cfClient, *ccAPIVersion)
+		if err != nil {
+			log.Fatal("Failed to create app client", err)
+		}
+		cachingClient = caching.NewCachingMemory(appClient, &caching.CachingMemoryConfig{
+			MaxEntries:         *cacheMaxEntries,
+			IgnoreMissingApps:  *ignoreMissingApps,
+			MissingAppsTTL:     *missingAppsTTL,
+			CacheInvalidateTTL: *tickerTime,
+		})
+	} else if cacheNeeded() {
 		config := &caching.CachingBoltConfig{
-			Path: *boltDatabasePath,
-			IgnoreMissingApps: *ignoreMissingApps,
-			CacheInvalidateTTL:*tickerTime,
+			Path:                   *boltDatabasePath,
+			Shards:                 *boltDatabaseShards,
+			IgnoreMissingApps:      *ignoreMissingApps,
+			CacheInvalidateTTL:     *tickerTime,
+			DeletedEntityPolicy:    *deletedEntity,
+			CacheUnavailablePolicy: *cacheUnavailable,
+			MaxEntryAge:            *cacheMaxAge,
+			Warmup:                 *cacheWarmup,
+			WarmupTimeout:          *cacheWarmupTimeout,
+		}
+		appClient, err := caching.NewAppClient(cfClient, *ccAPIVersion)
+		if err != nil {
+			log.Fatal("Failed to create app client", err)
 		}
-		cachingClient, err = caching.NewCachingBolt(cfClient, config)
+		cachingClient, err = caching.NewCachingBolt(appClient, config)
 		if err != nil {
 			log.Fatal("Failed to create boltdb cache", err)
 		}
 	} else {
 		cachingClient = caching.NewCachingEmpty()
 	}
+	if cacheNeeded() {
+		exposeCacheStats(cachingClient)
+	}
+
+	//Creating Transforms
+	var impliedTransforms []string
+	if *collapseWhitespace {
+		impliedTransforms = append(impliedTransforms, "collapse-whitespace")
+	}
+	if *clampMetrics != "off" {
+		transforms.Register("container-metric-clamp", transforms.ContainerMetricClamp(*clampMaxCPU, *clampMetrics == "drop"))
+		impliedTransforms = append(impliedTransforms, "container-metric-clamp")
+	}
+	if *cpuSmoothing != "off" {
+		if *cpuWindow < 1 {
+			log.Fatal("Error setting up CPU smoothing: the window must hold at least one sample")
+		}
+		average := *cpuSmoothing == "average" || *cpuSmoothing == "both"
+		cumulative := *cpuSmoothing == "cumulative" || *cpuSmoothing == "both"
+		transforms.Register("container-cpu-smoothing", transforms.ContainerCPUSmoothing(*cpuWindow, average, cumulative))
+		impliedTransforms = append(impliedTransforms, "container-cpu-smoothing")
+	}
+	if *extractTraceID {
+		pattern, err := regexp.Compile(*traceIDPattern)
+		if err != nil || pattern.NumSubexp() == 0 {
+			log.Fatalf("Error parsing trace ID pattern [%s]: it must be a regular expression with a group", *traceIDPattern)
+		}
+		transforms.Register("trace-id", transforms.TraceID(pattern))
+		impliedTransforms = append(impliedTransforms, "trace-id")
+	}
+	if *maxMessageLength != "" {
+		limits, err := transforms.ParseMaxMessageLength(*maxMessageLength)
+		if err != nil {
+			log.Fatal("Error parsing max message length: ", err)
+		}
+		for eventType := range limits {
+			if eventType != transforms.DefaultLengthKey && !eventRouting.IsAuthorizedEvent(eventType) {
+				log.Fatalf("Rejected max message length Event Name [%s] - Valid events: %s", eventType, eventRouting.GetListAuthorizedEventEvents())
+			}
+		}
+		transforms.Register("max-message-length", transforms.MaxMessageLength(limits))
+		impliedTransforms = append(impliedTransforms, "max-message-length")
+	}
+	if *regionCIDRMap != "" || *defaultRegion != "" {
+		stage, err := transforms.RegionCIDRMap(*regionCIDRMap, *defaultRegion)
+		if err != nil {
+			log.Fatal("Error parsing region CIDR map: ", err)
+		}
+		transforms.Register("region", stage)
+		impliedTransforms = append(impliedTransforms, "region")
+	}
+	if *sourceTypeMap != "" {
+		mapping, err := extrafields.ParseExtraFields(*sourceTypeMap)
+		if err != nil {
+			log.Fatal("Error parsing source type map: ", err)
+		}
+		transforms.Register("source-type-map", transforms.SourceTypeMap(mapping))
+		impliedTransforms = append(impliedTransforms, "source-type-map")
+	}
+	pipeline, err := transforms.NewPipeline(*wantedTransforms, impliedTransforms...)
+	if err != nil {
+		log.Fatal("Error setting up transforms: ", err)
+	}
+
+	sourceTypes, err := eventRouting.ParseLogSourceTypes(*logSourceTypes)
+	if err != nil {
+		log.Fatal("Error parsing log source types: ", err)
+	}
+	httpStatuses, err := eventRouting.ParseHTTPStatusFilter(*httpStatusFilter)
+	if err != nil {
+		log.Fatal("Error parsing --http-status-filter: ", err)
+	}
+	includeRegex, err := eventRouting.ParseMessageRegex(*messageInclude)
+	if err != nil {
+		log.Fatal("Error parsing --message-include-regex: ", err)
+	}
+	excludeRegex, err := eventRouting.ParseMessageRegex(*messageExclude)
+	if err != nil {
+		log.Fatal("Error parsing --message-exclude-regex: ", err)
+	}
+	rates, err := eventRouting.ParseSampleRates(*sampleRates)
+	if err != nil {
+		log.Fatal("Error parsing sample rates: ", err)
+	}
+	limits, err := eventRouting.ParseRateLimits(*rateLimits)
+	if err != nil {
+		log.Fatal("Error parsing rate limits: ", err)
+	}
+	dedupFields, err := eventRouting.ParseDedupKey(*dedupKey)
+	if err != nil {
+		log.Fatal("Error parsing dedup key: ", err)
+	}
 
 	//Creating Events
-	events := eventRouting.NewEventRouting(cachingClient, loggingClient)
+	eventRoutingConfig := &eventRouting.EventRoutingConfig{
+		Transforms:              pipeline,
+		DetectCrashes:           *detectCrashes,
+		ProfileLatency:          *profileLatency,
+		ExtraFieldsOverride:     *extraFieldsWin,
+		ExtraFieldsStrict:       *extraFieldsStrict,
+		SurfaceLoggregatorDrops: *surfaceDrops,
+		IncludeSubscriptionID:   *includeSubID,
+		IncludeSchemaVersion:    *includeSchemaVer,
+		NozzleVersion:           version,
+		AppAllowlist:            eventRouting.ParseAppGUIDs(*filterAppGUIDs),
+		AppDenylist:             eventRouting.ParseAppGUIDs(*excludeAppGUIDs),
+		IncludeLabels:           logging.ParseJSONFields(*includeLabels),
+		IncludeAnnotations:      logging.ParseJSONFields(*includeAnnotations),
+		OrgFilter:               eventRouting.ParseNames(*filterOrgs),
+		SpaceFilter:             eventRouting.ParseNames(*filterSpaces),
+		MissingMetadataPolicy:   *missingMetadata,
+		LogSourceTypes:          sourceTypes,
+		HTTPStatuses:            httpStatuses,
+		MessageInclude:          includeRegex,
+		MessageExclude:          excludeRegex,
+		SampleRates:             rates,
+		RateLimits:              limits,
+		RateLimitPolicy:         *rateLimitPolicy,
+		DedupWindow:             *dedupWindow,
+		DedupKey:                dedupFields,
+		DedupMaxKeys:            *dedupMaxKeys,
+		TimestampFormat:         *timestampFormat,
+	}
+	events := eventRouting.NewEventRouting(cachingClient, loggingClient, eventRoutingConfig)
 	err = events.SetupEventRouting(*wantedEvents)
 	if err != nil {
 		log.Fatal("Error setting up event routing: ", err)
@@ -117,43 +650,408 @@ func main() {
 		events.LogEventTotals(*logEventTotalsTime)
 	}
 
+	if *emitSelfMetrics {
+		events.LogSelfMetrics(*selfMetricsTime)
+	}
+
+	if *emitInternal {
+		events.LogInternalMetrics(*logEventTotalsTime)
+	}
+
+	if *profileLatency {
+		go logLatencySummary(*logEventTotalsTime)
+	}
+
+	if *cacheBackend == caching.CacheBackendBolt {
+		recordLifecycle()
+	}
+
+	if *metricsAddr != "" {
+		server, err := serveMetrics(*metricsAddr)
+		if err != nil {
+			log.Fatal("Error serving metrics: ", err)
+		}
+		defer shutdownServer(server)
+	}
+
+	var checker *health.Checker
+	if *healthAddr != "" {
+		components := []string{"firehose", outputComponent()}
+		if cacheNeeded() {
+			components = append(components, "cache")
+		}
+		checker = health.NewChecker(components...)
+		server, err := serveHealth(*healthAddr, checker)
+		if err != nil {
+			log.Fatal("Error serving health checks: ", err)
+		}
+		defer shutdownServer(server)
+	}
+
 	if err := cachingClient.Open(); err != nil {
 		log.Fatal("Error open cache: ", err)
 	}
 
-	uaaRefresher, err := uaatokenrefresher.NewUAATokenRefresher(
-		cfClient.Endpoint.AuthEndpoint,
-		*clientID,
-		*clientSecret,
-		*skipSSLValidation,
-	)
+	if *tokenRefreshAt < 0 || *tokenRefreshAt >= 1 {
+		log.Fatal("--token-refresh-leeway must be between 0 and 1")
+	} else if *tokenRefreshAt > 0 {
+		uaaRefresher.RefreshBeforeExpiry(*tokenRefreshAt)
+	}
+	if *requiredScopes != "" {
+		authToken, err := uaaRefresher.RefreshAuthToken()
+		if err != nil {
+			log.Fatal("Failed to get a token from UAA: ", err)
+		}
+		if err := uaatokenrefresher.CheckScopes(authToken, uaatokenrefresher.ParseRequiredScopes(*requiredScopes)); err != nil {
+			log.Fatal("Client is not allowed to read the firehose: ", err)
+		}
+	}
 
-	if err != nil {
-		logging.LogError(fmt.Sprint("Failed connecting to Get token from UAA..", err), "")
+	var cleanupOnce sync.Once
+	cleanup := func() {
+		cleanupOnce.Do(func() {
+			flushLogging(loggingClient)
+			cachingClient.Close()
+			if profiler != nil {
+				profiler.Stop()
+			}
+		})
 	}
 
-	firehoseConfig := &firehoseclient.FirehoseConfig{
-		TrafficControllerURL:   cfClient.Endpoint.DopplerEndpoint,
-		InsecureSSLSkipVerify:  *skipSSLValidation,
-		IdleTimeoutSeconds:     *keepAlive,
-		FirehoseSubscriptionID: *subscriptionId,
+	firehoseClient := newNozzle(uaaRefresher, events, cfClient.Endpoint.DopplerEndpoint)
+	go stopOnSignal(firehoseClient, *shutdownTimeout, cleanup)
+
+	if checker != nil {
+		setHealthChecks(checker, firehoseClient, loggingClient, cachingClient)
 	}
 
 	if loggingClient.Connect() || *debug {
 
 		logging.LogStd("Connected to Syslog Server! Connecting to Firehose...", true)
-		firehoseClient := firehoseclient.NewFirehoseNozzle(uaaRefresher, events, firehoseConfig)
 		err = firehoseClient.Start()
 		if err != nil {
 			logging.LogError("Failed connecting to Firehose...Please check settings and try again!", "")
 
 		} else {
-			logging.LogStd("Firehose Subscription Succesfull! Routing events...", true)
+			logging.LogStd("Firehose nozzle stopped", true)
 		}
 
 	} else {
 		logging.LogError("Failed connecting to the Fluentd Server...Please check settings and try again!", "")
 	}
 
-	defer cachingClient.Close()
+	cleanup()
+}
+
+// newNozzle returns the consumer of --consumer-type, reading envelopes from
+// the doppler endpoint or the RLP gateway
+func newNozzle(uaaRefresher *uaatokenrefresher.UAATokenRefresher, events eventRouting.EventRouting, dopplerEndpoint string) firehoseclient.Nozzle {
+	firehoseConfig := &firehoseclient.FirehoseConfig{
+		TrafficControllerURL:   dopplerEndpoint,
+		InsecureSSLSkipVerify:  *skipSSLValidation,
+		IdleTimeoutSeconds:     *keepAlive,
+		FirehoseSubscriptionID: *subscriptionId,
+		StallTimeout:           *staleTimeout,
+		Connections:            *shardCount,
+		ResubscribeInterval:    *resubscribeEvery,
+		ResubscribeJitter:      *resubscribeJitter,
+		ConflictResolveAfter:   *conflictResolve,
+		ReconnectMaxRetries:    *reconnectRetries,
+		ReconnectBaseDelay:     *reconnectBase,
+		ReconnectMaxDelay:      *reconnectMax,
+		RLPGatewayURL:          *rlpGatewayURL,
+		Proxy:                  outboundProxy(),
+	}
+	if *consumerType == firehoseclient.ConsumerRLPGateway {
+		if firehoseConfig.RLPGatewayURL == "" {
+			firehoseConfig.RLPGatewayURL = strings.Replace(*apiEndpoint, "://api.", "://log-stream.", 1)
+		}
+		logging.LogStd(fmt.Sprintf("Using %s as RLP gateway", firehoseConfig.RLPGatewayURL), true)
+		return firehoseclient.NewRLPGatewayNozzle(uaaRefresher, events, firehoseConfig)
+	}
+	return firehoseclient.NewFirehoseNozzle(uaaRefresher, events, firehoseConfig)
+}
+
+// validateSetup connects to syslog, logs in to the api and UAA and
+// subscribes to the firehose once, without forwarding any event, logging
+// the outcome of every component. It returns the exit code, non-zero when
+// any component failed.
+func validateSetup(c *cfclient.Config, loggingConfig *logging.LoggingConfig) int {
+	exitCode := 0
+	check := func(component string, err error) bool {
+		if err != nil {
+			logging.LogError(fmt.Sprintf("Validation of %s failed", component), err)
+			exitCode = 1
+			return false
+		}
+		logging.LogStd(fmt.Sprintf("Validation of %s succeeded", component), true)
+		return true
+	}
+
+	switch *outputType {
+	case logging.OutputStdout:
+	case logging.OutputKafka:
+		kafkaConfig := *loggingConfig
+		kafkaConfig.FifoPath = ""
+		var err error
+		if !logging.NewLogging(&kafkaConfig).Connect() {
+			err = fmt.Errorf("Unable to produce to Kafka topic [%s] of brokers [%s]", *kafkaTopic, *kafkaBrokers)
+		}
+		check("kafka", err)
+	case logging.OutputHTTP:
+		logging.LogStd("Skipping the validation of the http output, events would be posted to check it", true)
+	case logging.OutputFile:
+		fileConfig := *loggingConfig
+		fileConfig.FifoPath = ""
+		fileClient := logging.NewLogging(&fileConfig)
+		var err error
+		if !fileClient.Connect() {
+			err = fmt.Errorf("Unable to write to file [%s]", *filePath)
+		}
+		flushLogging(fileClient)
+		check("file", err)
+	default:
+		syslogConfig := *loggingConfig
+		syslogConfig.OutputType = logging.OutputSyslog
+		syslogConfig.FifoPath = ""
+		syslogConfig.SpoolDir = ""
+		server := *syslogServer
+		if *syslogSRV != "" {
+			server = *syslogSRV
+		}
+		var err error
+		if !logging.NewLogging(&syslogConfig).Connect() {
+			err = fmt.Errorf("Unable to connect to syslog server [%s]", server)
+		}
+		check("syslog", err)
+	}
+
+	cfClient, uaaRefresher, err := newCFClient(c)
+	if !check("api", err) {
+		logging.LogStd("Skipping the validation of UAA and the firehose, their endpoints come from the api", true)
+		return exitCode
+	}
+	if len(*dopplerEndpoint) > 0 {
+		cfClient.Endpoint.DopplerEndpoint = *dopplerEndpoint
+	}
+
+	authToken, err := uaaRefresher.RefreshAuthToken()
+	if err == nil && *requiredScopes != "" {
+		err = uaatokenrefresher.CheckScopes(authToken, uaatokenrefresher.ParseRequiredScopes(*requiredScopes))
+	}
+	if !check("UAA", err) {
+		logging.LogStd("Skipping the validation of the firehose, it needs a UAA token", true)
+		return exitCode
+	}
+
+	check(*consumerType, newNozzle(uaaRefresher, nil, cfClient.Endpoint.DopplerEndpoint).Probe(validateTimeout))
+	return exitCode
+}
+
+// newCFClient creates the Cloud Controller client and the UAA token
+// refresher of the firehose, cfclient sharing the tokens of the refresher
+// rather than fetching its own.
+func newCFClient(c *cfclient.Config) (*cfclient.Client, *uaatokenrefresher.UAATokenRefresher, error) {
+	transport := &retry.Transport{
+		Base: &http.Transport{
+			Proxy:           outboundProxy(),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.SkipSslValidation},
+		},
+		Timeout:    *ccHTTPTimeout,
+		MaxRetries: *ccMaxRetries,
+		BaseDelay:  ccRetryBaseDelay,
+		MaxDelay:   ccRetryMaxDelay,
+		Retries:    metrics.NewCounter("cc_request_retries"),
+	}
+	cfClient, err := cfclient.NewClient(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	uaaRefresher, err := uaatokenrefresher.NewUAATokenRefresher(
+		cfClient.Endpoint.AuthEndpoint,
+		*clientID,
+		*clientSecret,
+		*skipSSLValidation,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed connecting to Get token from UAA: %v", err)
+	}
+	uaaRefresher.SetProxy(outboundProxy())
+	// the refresher needs the UAA endpoint cfclient discovers. NewClient
+	// sets c.HttpClient to the client cfclient sends its requests through,
+	// its own client credentials token being only fetched once it sends one:
+	// its transport is replaced so that the requests go through the proxy
+	// and the token of the refresher is the only one asked for.
+	c.HttpClient.Transport = uaaRefresher.Transport(transport)
+	if *uaaRefreshToken != "" {
+		uaaRefresher.SetRefreshToken(*uaaRefreshToken)
+	}
+	return cfClient, uaaRefresher, nil
+}
+
+// outboundProxy picks the proxy of the connections to the api, UAA and
+// doppler following --http-proxy, --https-proxy and --no-proxy, validated
+// at startup
+func outboundProxy() utils.ProxyFunc {
+	proxy, _ := utils.NewProxyFunc(*httpProxy, *httpsProxy, *noProxy)
+	return proxy
+}
+
+// cacheNeeded tells whether the selected events are decorated with app
+// metadata, the --events selectors being expanded
+func cacheNeeded() bool {
+	selectedEvents, _ := eventRouting.ExpandEvents(*wantedEvents)
+	return caching.IsNeeded(selectedEvents)
+}
+
+// stopOnSignal stops the firehose nozzle on SIGINT or SIGTERM, main then
+// cleaning up and exiting. A nozzle not stopped within timeout is cleaned up
+// here before exiting.
+func stopOnSignal(firehoseClient firehoseclient.Nozzle, timeout time.Duration, cleanup func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	logging.LogStd(fmt.Sprintf("Received %s, shutting down", sig), true)
+	if err := firehoseClient.Stop(timeout); err != nil {
+		logging.LogError("Unable to stop consuming the firehose", err)
+		cleanup()
+		os.Exit(0)
+	}
+}
+
+func flushLogging(loggingClient logging.Logging) {
+	if flusher, ok := loggingClient.(logging.Flusher); ok {
+		flusher.Flush()
+	}
+	if closer, ok := loggingClient.(logging.Closer); ok {
+		closer.Close()
+	}
+}
+
+// recordLifecycle exposes the nozzle start time, uptime and the number of
+// restarts, persisted in the Bolt store, as metrics
+func recordLifecycle() {
+	startTime := time.Now()
+	metrics.NewGauge("nozzle_start_timestamp").Set(float64(startTime.Unix()))
+	metrics.NewGaugeFunc("nozzle_uptime_seconds", func() float64 {
+		return time.Since(startTime).Seconds()
+	})
+
+	startCount, err := caching.RecordStart(caching.ShardPaths(*boltDatabasePath, *boltDatabaseShards)[0])
+	if err != nil {
+		logging.LogError("Unable to record nozzle start: ", err)
+		return
+	}
+	metrics.NewCounter("nozzle_restarts").Add(startCount - 1)
+}
+
+// exposeCacheStats exposes the number of cached apps and the time of the
+// last full refresh as metrics
+func exposeCacheStats(cachingClient caching.Caching) {
+	metrics.NewGaugeFunc("cache_apps", func() float64 {
+		return float64(cachingClient.Stats().Apps)
+	})
+	metrics.NewGaugeFunc("cache_last_refresh_timestamp", func() float64 {
+		if lastRefresh := cachingClient.Stats().LastRefresh; !lastRefresh.IsZero() {
+			return float64(lastRefresh.Unix())
+		}
+		return 0
+	})
+}
+
+// serveMetrics exposes the metrics to Prometheus at /metrics
+func serveMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler("firehose_to_syslog"))
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.LogError("Metrics server stopped: ", err)
+		}
+	}()
+	logging.LogStd(fmt.Sprintf("Serving metrics at http://%s/metrics", listener.Addr()), true)
+	return server, nil
+}
+
+// serveHealth answers the liveness and readiness probes at /healthz and
+// /readyz
+func serveHealth(addr string, checker *health.Checker) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: checker.Handler()}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logging.LogError("Health server stopped: ", err)
+		}
+	}()
+	logging.LogStd(fmt.Sprintf("Serving health checks at http://%s/healthz and /readyz", listener.Addr()), true)
+	return server, nil
+}
+
+// outputComponent names the output events are forwarded to in the health
+// checks
+func outputComponent() string {
+	if *outputType == logging.OutputBoth {
+		return logging.OutputSyslog
+	}
+	return *outputType
+}
+
+// setHealthChecks makes the readiness follow the connection status of the
+// nozzle, the output and the cache
+func setHealthChecks(checker *health.Checker, nozzle firehoseclient.Nozzle, loggingClient logging.Logging, cachingClient caching.Caching) {
+	checker.Set("firehose", func() error {
+		if !nozzle.Connected() {
+			return errors.New("not receiving envelopes")
+		}
+		return nil
+	})
+	if reporter, ok := loggingClient.(logging.StatusReporter); ok {
+		checker.Set(outputComponent(), func() error {
+			if !reporter.Status().Connected {
+				return errors.New("not connected or failing to write")
+			}
+			return nil
+		})
+		checker.SetLastEvent(func() time.Time {
+			return reporter.Status().LastEvent
+		})
+	}
+	if cacheNeeded() {
+		checker.Set("cache", func() error {
+			if !cachingClient.Stats().Open {
+				return errors.New("not open or unavailable")
+			}
+			return nil
+		})
+	}
+}
+
+// shutdownServer lets in-flight requests complete before exiting
+func shutdownServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// logLatencySummary periodically prints the event latency histograms in debug mode
+func logLatencySummary(interval time.Duration) {
+	for range time.Tick(interval) {
+		histograms := metrics.Histograms()
+		names := make([]string, 0, len(histograms))
+		for name := range histograms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			h := histograms[name]
+			logging.LogStd(fmt.Sprintf("%s: count=%d p50=%.0f p99=%.0f max=%.0f", name, h.Count(), h.Quantile(0.5), h.Quantile(0.99), h.Max()), *debug)
+		}
+	}
 }
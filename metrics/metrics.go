@@ -0,0 +1,293 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing value safe for concurrent use.
+type Counter struct {
+	value uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// Gauge is a value that can go up and down, safe for concurrent use.
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// Add moves the gauge by delta, so that several sources can share it.
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		if atomic.CompareAndSwapUint64(&g.bits, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// LatencyBuckets are upper bounds, in microseconds, suited to per-event
+// latencies ranging from in-memory lookups to remote calls.
+var LatencyBuckets = []float64{10, 50, 100, 500, 1000, 5000, 10000, 50000, 100000, 500000, 1000000}
+
+// Histogram counts observations in buckets of fixed upper bounds, safe for
+// concurrent use. Observations above the last bound land in an overflow
+// bucket.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+
+	mutex sync.Mutex
+	sum   float64
+	max   float64
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	h.mutex.Lock()
+	h.sum += value
+	if value > h.max {
+		h.max = value
+	}
+	h.mutex.Unlock()
+}
+
+// ObserveDuration records d in microseconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(float64(d) / float64(time.Microsecond))
+}
+
+// ObserveSince records the time elapsed since start. It is a no-op on a nil
+// histogram so that optional instrumentation needs no guard.
+func (h *Histogram) ObserveSince(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.ObserveDuration(time.Since(start))
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) Sum() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sum
+}
+
+func (h *Histogram) Max() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.max
+}
+
+// Buckets returns the upper bounds and the cumulative count of
+// observations less than or equal to each of them.
+func (h *Histogram) Buckets() ([]float64, []uint64) {
+	cumulative := make([]uint64, len(h.bounds))
+	total := uint64(0)
+	for i := range h.bounds {
+		total += atomic.LoadUint64(&h.counts[i])
+		cumulative[i] = total
+	}
+	return h.bounds, cumulative
+}
+
+// Quantile estimates the q quantile as the upper bound of the bucket it
+// falls in. Quantiles in the overflow bucket report the largest observation.
+func (h *Histogram) Quantile(q float64) float64 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(count)))
+	bounds, cumulative := h.Buckets()
+	for i := range bounds {
+		if cumulative[i] >= rank {
+			return bounds[i]
+		}
+	}
+	return h.Max()
+}
+
+// CounterVec is a family of counters told apart by the value of a single
+// label, e.g. the event type.
+type CounterVec struct {
+	label string
+
+	mutex    sync.RWMutex
+	counters map[string]*Counter
+}
+
+// With returns the counter of the given label value, creating it if needed.
+func (v *CounterVec) With(value string) *Counter {
+	v.mutex.RLock()
+	c, ok := v.counters[value]
+	v.mutex.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if c, ok := v.counters[value]; ok {
+		return c
+	}
+	c = &Counter{}
+	v.counters[value] = c
+	return c
+}
+
+// Values returns the counters by label value.
+func (v *CounterVec) Values() map[string]uint64 {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	values := make(map[string]uint64, len(v.counters))
+	for value, c := range v.counters {
+		values[value] = c.Value()
+	}
+	return values
+}
+
+var (
+	lock        sync.RWMutex
+	counters    = make(map[string]*Counter)
+	counterVecs = make(map[string]*CounterVec)
+	gauges      = make(map[string]*Gauge)
+	gaugeFuncs  = make(map[string]func() float64)
+	histograms  = make(map[string]*Histogram)
+)
+
+// NewCounter returns the counter registered under name, creating it if
+// needed, so that components sharing a metric name share its value.
+func NewCounter(name string) *Counter {
+	lock.Lock()
+	defer lock.Unlock()
+	if c, ok := counters[name]; ok {
+		return c
+	}
+	c := &Counter{}
+	counters[name] = c
+	return c
+}
+
+// NewCounterVec returns the counter family registered under name, creating
+// it with the given label if needed. Counter families are only exposed to
+// Prometheus, not in Snapshot.
+func NewCounterVec(name string, label string) *CounterVec {
+	lock.Lock()
+	defer lock.Unlock()
+	if v, ok := counterVecs[name]; ok {
+		return v
+	}
+	v := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	counterVecs[name] = v
+	return v
+}
+
+// NewGauge returns the gauge registered under name, creating it if needed.
+func NewGauge(name string) *Gauge {
+	lock.Lock()
+	defer lock.Unlock()
+	if g, ok := gauges[name]; ok {
+		return g
+	}
+	g := &Gauge{}
+	gauges[name] = g
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by f whenever it is
+// read, replacing any function previously registered under name.
+func NewGaugeFunc(name string, f func() float64) {
+	lock.Lock()
+	defer lock.Unlock()
+	gaugeFuncs[name] = f
+}
+
+// NewHistogram returns the histogram registered under name, creating it with
+// the given sorted bucket bounds if needed.
+func NewHistogram(name string, bounds []float64) *Histogram {
+	lock.Lock()
+	defer lock.Unlock()
+	if h, ok := histograms[name]; ok {
+		return h
+	}
+	h := &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+	histograms[name] = h
+	return h
+}
+
+// Histograms returns every registered histogram by name.
+func Histograms() map[string]*Histogram {
+	lock.RLock()
+	defer lock.RUnlock()
+	all := make(map[string]*Histogram, len(histograms))
+	for name, h := range histograms {
+		all[name] = h
+	}
+	return all
+}
+
+// Snapshot returns the current value of every registered metric. Histograms
+// are summarized as <name>_count, <name>_p50 and <name>_p99.
+func Snapshot() map[string]interface{} {
+	lock.RLock()
+	defer lock.RUnlock()
+	snapshot := make(map[string]interface{}, len(counters)+len(gauges)+3*len(histograms))
+	for name, c := range counters {
+		snapshot[name] = c.Value()
+	}
+	for name, g := range gauges {
+		snapshot[name] = g.Value()
+	}
+	for name, f := range gaugeFuncs {
+		snapshot[name] = f()
+	}
+	for name, h := range histograms {
+		snapshot[name+"_count"] = h.Count()
+		snapshot[name+"_p50"] = h.Quantile(0.5)
+		snapshot[name+"_p99"] = h.Quantile(0.99)
+	}
+	return snapshot
+}
+
+// Names returns the sorted names of every registered metric.
+func Names() []string {
+	snapshot := Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
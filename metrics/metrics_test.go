@@ -0,0 +1,131 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	Context("called with the same counter name twice", func() {
+		It("should share the counter", func() {
+			NewCounter("shared_counter").Inc()
+			NewCounter("shared_counter").Add(2)
+			Expect(NewCounter("shared_counter").Value()).To(Equal(uint64(3)))
+		})
+	})
+
+	Context("called with a gauge", func() {
+		It("should keep the last value set", func() {
+			g := NewGauge("some_gauge")
+			g.Set(12.5)
+			g.Set(3)
+			Expect(g.Value()).To(Equal(float64(3)))
+		})
+
+		It("should add up the deltas", func() {
+			g := NewGauge("added_gauge")
+			g.Add(2)
+			g.Add(3.5)
+			g.Add(-1)
+			Expect(g.Value()).To(Equal(4.5))
+		})
+	})
+
+	Context("called with a gauge function", func() {
+		It("should compute the value when read", func() {
+			value := 1.0
+			NewGaugeFunc("func_gauge", func() float64 { return value })
+			value = 2
+			Expect(Snapshot()["func_gauge"]).To(Equal(float64(2)))
+		})
+	})
+
+	Context("Snapshot", func() {
+		It("should report every registered metric", func() {
+			NewCounter("snapshot_counter").Inc()
+			NewGauge("snapshot_gauge").Set(1.5)
+			snapshot := Snapshot()
+			Expect(snapshot["snapshot_counter"]).To(Equal(uint64(1)))
+			Expect(snapshot["snapshot_gauge"]).To(Equal(1.5))
+			Expect(Names()).To(ContainElement("snapshot_gauge"))
+		})
+	})
+
+	Context("called with a histogram", func() {
+		It("should bucket observations", func() {
+			h := NewHistogram("some_histogram", []float64{1, 10, 100})
+			for _, v := range []float64{0.5, 5, 5, 50, 500} {
+				h.Observe(v)
+			}
+			bounds, cumulative := h.Buckets()
+			Expect(bounds).To(Equal([]float64{1, 10, 100}))
+			Expect(cumulative).To(Equal([]uint64{1, 3, 4}))
+			Expect(h.Count()).To(Equal(uint64(5)))
+			Expect(h.Sum()).To(Equal(float64(560.5)))
+		})
+
+		It("should estimate quantiles from bucket bounds", func() {
+			h := NewHistogram("quantile_histogram", []float64{1, 10})
+			for i := 0; i < 98; i++ {
+				h.Observe(0.5)
+			}
+			h.Observe(5)
+			h.Observe(42)
+			Expect(h.Quantile(0.5)).To(Equal(float64(1)))
+			Expect(h.Quantile(0.99)).To(Equal(float64(10)))
+			Expect(h.Quantile(1)).To(Equal(float64(42)))
+
+			snapshot := Snapshot()
+			Expect(snapshot["quantile_histogram_count"]).To(Equal(uint64(100)))
+			Expect(snapshot["quantile_histogram_p50"]).To(Equal(float64(1)))
+		})
+	})
+
+	Context("called with a counter family", func() {
+		It("should count per label value, outside of the snapshot", func() {
+			v := NewCounterVec("family_counter", "event_type")
+			v.With("LogMessage").Inc()
+			NewCounterVec("family_counter", "event_type").With("LogMessage").Add(2)
+			Expect(v.With("LogMessage").Value()).To(Equal(uint64(3)))
+			Expect(v.With("Error").Value()).To(Equal(uint64(0)))
+			Expect(Snapshot()).ToNot(HaveKey("family_counter"))
+			Expect(v.Values()).To(Equal(map[string]uint64{"LogMessage": 3, "Error": 0}))
+		})
+	})
+
+	Context("called to write Prometheus metrics", func() {
+		It("should write every metric family in the text format", func() {
+			NewCounter("prom_counter").Add(7)
+			NewCounterVec("prom_family", "reason").With(`odd"value`).Inc()
+			NewGauge("prom_gauge").Set(1.5)
+			h := NewHistogram("prom_histogram", []float64{1, 10})
+			h.Observe(0.5)
+			h.Observe(20)
+
+			b := &bytes.Buffer{}
+			WritePrometheus(b, "test")
+			Expect(b.String()).To(ContainSubstring("# TYPE test_prom_counter_total counter\ntest_prom_counter_total 7\n"))
+			Expect(b.String()).To(ContainSubstring("# TYPE test_prom_family_total counter\ntest_prom_family_total{reason=\"odd\\\"value\"} 1\n"))
+			Expect(b.String()).To(ContainSubstring("# TYPE test_prom_gauge gauge\ntest_prom_gauge 1.5\n"))
+			Expect(b.String()).To(ContainSubstring(`# TYPE test_prom_histogram histogram
+test_prom_histogram_bucket{le="1"} 1
+test_prom_histogram_bucket{le="10"} 1
+test_prom_histogram_bucket{le="+Inf"} 2
+test_prom_histogram_sum 20.5
+test_prom_histogram_count 2
+`))
+		})
+
+		It("should serve them over HTTP", func() {
+			NewCounter("served_counter").Inc()
+			recorder := httptest.NewRecorder()
+			Handler("test").ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+			Expect(recorder.Body.String()).To(ContainSubstring("test_served_counter_total 1\n"))
+		})
+	})
+})
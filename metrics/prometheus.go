@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prometheusContentType is the version 0.0.4 text exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes every registered metric in the Prometheus text
+// exposition format, sorted by name and prefixed with namespace. Counters
+// get the _total suffix, histograms are written with their buckets, sum and
+// count.
+func WritePrometheus(w io.Writer, namespace string) {
+	lock.RLock()
+	families := make(map[string]*bytes.Buffer)
+	family := func(name string, kind string) *bytes.Buffer {
+		b := &bytes.Buffer{}
+		fmt.Fprintf(b, "# TYPE %s_%s %s\n", namespace, name, kind)
+		families[name] = b
+		return b
+	}
+
+	for name, c := range counters {
+		name += "_total"
+		fmt.Fprintf(family(name, "counter"), "%s_%s %d\n", namespace, name, c.Value())
+	}
+	for name, v := range counterVecs {
+		name += "_total"
+		b := family(name, "counter")
+		values := v.Values()
+		for _, value := range sortedKeys(values) {
+			fmt.Fprintf(b, "%s_%s{%s=\"%s\"} %d\n", namespace, name, v.label, labelValueEscaper.Replace(value), values[value])
+		}
+	}
+	for name, g := range gauges {
+		fmt.Fprintf(family(name, "gauge"), "%s_%s %s\n", namespace, name, formatFloat(g.Value()))
+	}
+	for name, f := range gaugeFuncs {
+		fmt.Fprintf(family(name, "gauge"), "%s_%s %s\n", namespace, name, formatFloat(f()))
+	}
+	for name, h := range histograms {
+		b := family(name, "histogram")
+		bounds, cumulative := h.Buckets()
+		for i, bound := range bounds {
+			fmt.Fprintf(b, "%s_%s_bucket{le=\"%s\"} %d\n", namespace, name, formatFloat(bound), cumulative[i])
+		}
+		fmt.Fprintf(b, "%s_%s_bucket{le=\"+Inf\"} %d\n", namespace, name, h.Count())
+		fmt.Fprintf(b, "%s_%s_sum %s\n", namespace, name, formatFloat(h.Sum()))
+		fmt.Fprintf(b, "%s_%s_count %d\n", namespace, name, h.Count())
+	}
+	lock.RUnlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		families[name].WriteTo(w)
+	}
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler(namespace string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		WritePrometheus(w, namespace)
+	})
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket refills continuously at rate tokens per second, holding at
+// most burst tokens. It is safe for concurrent use.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket. A burst lower than or equal to
+// zero defaults to one second worth of tokens.
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Take removes n tokens if they are available right now. Requests larger
+// than the burst never are.
+func (b *TokenBucket) Take(n float64) bool {
+	return b.TakeAbove(n, 0)
+}
+
+// TakeAbove removes n tokens only if at least reserve tokens are left
+// afterwards, keeping them for more important callers. The reserve is capped
+// so that n can still go through on a full bucket. Requests larger than the
+// burst are refused.
+func (b *TokenBucket) TakeAbove(n float64, reserve float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n > b.burst {
+		return false
+	}
+	if reserve > b.burst-n {
+		reserve = b.burst - n
+	}
+	b.refill()
+	if b.tokens-n >= reserve {
+		b.tokens -= n
+		return true
+	}
+	return false
+}
+
+// Wait blocks until n tokens are available and removes them.
+func (b *TokenBucket) Wait(n float64) {
+	for {
+		wait := b.Reserve(n)
+		if wait == 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Reserve removes n tokens and returns zero if they are available,
+// otherwise it leaves the bucket untouched and returns how long to wait
+// before trying again. Requests larger than the burst go through once the
+// bucket is full, leaving it in debt for the excess, so that they are
+// charged in full and wait n/rate overall.
+func (b *TokenBucket) Reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	needed := n
+	if needed > b.burst {
+		needed = b.burst
+	}
+	b.refill()
+	if b.tokens >= needed {
+		b.tokens -= n
+		return 0
+	}
+	missing := needed - b.tokens
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+// Tokens returns the number of tokens currently available.
+func (b *TokenBucket) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
@@ -0,0 +1,77 @@
+package ratelimit_test
+
+import (
+	"time"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/ratelimit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TokenBucket", func() {
+	var bucket *TokenBucket
+
+	BeforeEach(func() {
+		bucket = NewTokenBucket(100, 0)
+	})
+
+	Context("called on a full bucket", func() {
+		It("should allow a whole burst", func() {
+			Expect(bucket.Take(100)).To(BeTrue())
+		})
+	})
+
+	Context("called on an empty bucket", func() {
+		It("should refuse and report how long to wait", func() {
+			Expect(bucket.Take(100)).To(BeTrue())
+			Expect(bucket.Take(50)).To(BeFalse())
+			wait := bucket.Reserve(50)
+			Expect(wait).To(BeNumerically(">", 400*time.Millisecond))
+			Expect(wait).To(BeNumerically("<=", 500*time.Millisecond))
+		})
+
+		It("should refill over time", func() {
+			Expect(bucket.Take(100)).To(BeTrue())
+			time.Sleep(50 * time.Millisecond)
+			Expect(bucket.Take(4)).To(BeTrue())
+		})
+	})
+
+	Context("called with a request larger than the burst", func() {
+		It("should refuse to take it", func() {
+			Expect(bucket.Take(1000)).To(BeFalse())
+			Expect(bucket.TakeAbove(1000, 0)).To(BeFalse())
+			Expect(bucket.Tokens()).To(BeNumerically("~", 100, 1))
+		})
+
+		It("should reserve it in full once the bucket is full", func() {
+			Expect(bucket.Reserve(300)).To(BeZero())
+			Expect(bucket.Tokens()).To(BeNumerically("~", -200, 1))
+			wait := bucket.Reserve(100)
+			Expect(wait).To(BeNumerically(">", 2900*time.Millisecond))
+			Expect(wait).To(BeNumerically("<=", 3*time.Second))
+		})
+
+		It("should wait for the time it is worth", func() {
+			bucket = NewTokenBucket(1000, 0)
+			start := time.Now()
+			bucket.Wait(1500)
+			bucket.Wait(500)
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+	})
+
+	Context("called with a reserve", func() {
+		It("should only take tokens above the reserve", func() {
+			bucket = NewTokenBucket(1, 100)
+			Expect(bucket.TakeAbove(30, 50)).To(BeTrue())
+			Expect(bucket.TakeAbove(30, 50)).To(BeFalse())
+			Expect(bucket.TakeAbove(30, 0)).To(BeTrue())
+		})
+
+		It("should let requests through on a full bucket whatever the reserve", func() {
+			bucket = NewTokenBucket(1, 100)
+			Expect(bucket.TakeAbove(60, 90)).To(BeTrue())
+		})
+	})
+})
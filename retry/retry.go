@@ -0,0 +1,183 @@
+package retry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+)
+
+// Categories an error can be classified into.
+const (
+	CategoryTimeout      = "timeout"
+	CategoryNetwork      = "network"
+	CategoryDNS          = "dns"
+	CategoryTLS          = "tls"
+	CategoryServerError  = "5xx"
+	CategoryClientError  = "4xx"
+	CategoryUnauthorized = "unauthorized"
+	CategoryUnknown      = "unknown"
+)
+
+var (
+	statusInMessage = regexp.MustCompile(`status code:? (\d{3})`)
+	// noaa only keeps the message of the dial errors it wraps
+	unauthorizedInMessage = regexp.MustCompile(`Unauthorized error`)
+	tlsInMessage          = regexp.MustCompile(`\b(x509|tls): `)
+)
+
+var (
+	overridesLock     sync.RWMutex
+	retryableStatuses = map[int]bool{}
+)
+
+// StatusCoder is implemented by errors carrying an HTTP status code.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// HTTPError reports a non successful HTTP response.
+type HTTPError struct {
+	Status int
+	URL    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("Request to %s failed with status code %d", e.URL, e.Status)
+}
+
+func (e *HTTPError) StatusCode() int {
+	return e.Status
+}
+
+// SetRetryableStatuses marks extra HTTP statuses as retryable, on top of
+// 5xx, 408 and 429 which always are.
+func SetRetryableStatuses(statuses []int) {
+	overrides := make(map[int]bool, len(statuses))
+	for _, status := range statuses {
+		overrides[status] = true
+	}
+	overridesLock.Lock()
+	retryableStatuses = overrides
+	overridesLock.Unlock()
+}
+
+// ParseStatuses parses a comma separated list of HTTP status codes.
+func ParseStatuses(statuses string) ([]int, error) {
+	var parsed []int
+	for _, status := range strings.Split(statuses, ",") {
+		status = strings.TrimSpace(status)
+		if status == "" {
+			continue
+		}
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("Invalid HTTP status [%s]", status)
+		}
+		parsed = append(parsed, code)
+	}
+	return parsed, nil
+}
+
+// IsRetryable reports whether the operation that failed with err is worth
+// retrying.
+func IsRetryable(err error) bool {
+	_, retryable := Classify(err)
+	return retryable
+}
+
+// IsFatal reports whether err is known not to go away by retrying, such as
+// a rejected token or an untrusted certificate. Unlike for IsRetryable,
+// errors that can't be classified aren't fatal.
+func IsFatal(err error) bool {
+	category, retryable := Classify(err)
+	return category != CategoryUnknown && !retryable
+}
+
+// Classify returns the category of err and whether it is retryable.
+// Timeouts, transient network and DNS failures, 5xx, 408 and 429 are
+// retryable; TLS/certificate problems, authorization failures and other
+// 4xx are fatal since retrying won't fix a misconfiguration.
+func Classify(err error) (string, bool) {
+	if err == nil {
+		return CategoryUnknown, false
+	}
+
+	switch e := err.(type) {
+	case StatusCoder:
+		return classifyStatus(e.StatusCode())
+	case *noaa_errors.UnauthorizedError:
+		return CategoryUnauthorized, false
+	case *url.Error:
+		return Classify(e.Err)
+	case *net.DNSError:
+		return CategoryDNS, e.Timeout() || e.Temporary()
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError,
+		*x509.UnknownAuthorityError, *x509.CertificateInvalidError, *x509.HostnameError,
+		tls.RecordHeaderError, *tls.RecordHeaderError:
+		return CategoryTLS, false
+	case *net.OpError:
+		if e.Timeout() {
+			return CategoryTimeout, true
+		}
+		if category, retryable := Classify(e.Err); category != CategoryUnknown {
+			return category, retryable
+		}
+		return CategoryNetwork, true
+	case syscall.Errno:
+		switch e {
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE,
+			syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return CategoryNetwork, true
+		}
+		return CategoryUnknown, false
+	case net.Error:
+		if e.Timeout() {
+			return CategoryTimeout, true
+		}
+		return CategoryNetwork, e.Temporary()
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return CategoryNetwork, true
+	}
+
+	// Some clients (e.g. the UAA token requests) only report the status in the message
+	if match := statusInMessage.FindStringSubmatch(err.Error()); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		return classifyStatus(status)
+	}
+	if unauthorizedInMessage.MatchString(err.Error()) {
+		return CategoryUnauthorized, false
+	}
+	if tlsInMessage.MatchString(err.Error()) {
+		return CategoryTLS, false
+	}
+
+	return CategoryUnknown, false
+}
+
+func classifyStatus(status int) (string, bool) {
+	overridesLock.RLock()
+	overridden := retryableStatuses[status]
+	overridesLock.RUnlock()
+
+	switch {
+	case status >= 500:
+		return CategoryServerError, true
+	case status == 401 || status == 403:
+		return CategoryUnauthorized, overridden
+	case status >= 400:
+		return CategoryClientError, overridden || status == 408 || status == 429
+	}
+	return CategoryUnknown, overridden
+}
@@ -0,0 +1,123 @@
+package retry_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/retry"
+	noaa_errors "github.com/cloudfoundry/noaa/errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ = Describe("Classify", func() {
+	AfterEach(func() {
+		SetRetryableStatuses(nil)
+	})
+
+	expectClass := func(err error, category string, retryable bool) {
+		c, r := Classify(err)
+		Expect(c).To(Equal(category))
+		Expect(r).To(Equal(retryable))
+	}
+
+	Context("called with network errors", func() {
+		It("should retry timeouts", func() {
+			expectClass(timeoutError{}, CategoryTimeout, true)
+			expectClass(&net.OpError{Op: "dial", Err: timeoutError{}}, CategoryTimeout, true)
+		})
+
+		It("should retry refused and reset connections", func() {
+			expectClass(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, CategoryNetwork, true)
+			expectClass(&url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, CategoryNetwork, true)
+			expectClass(io.EOF, CategoryNetwork, true)
+		})
+	})
+
+	Context("called with DNS errors", func() {
+		It("should retry temporary failures only", func() {
+			expectClass(&net.DNSError{Err: "server misbehaving", IsTemporary: true}, CategoryDNS, true)
+			expectClass(&net.DNSError{Err: "no such host"}, CategoryDNS, false)
+		})
+	})
+
+	Context("called with TLS errors", func() {
+		It("should be fatal", func() {
+			expectClass(&url.Error{Op: "Get", URL: "https://x", Err: x509.UnknownAuthorityError{}}, CategoryTLS, false)
+			expectClass(x509.HostnameError{Host: "x"}, CategoryTLS, false)
+		})
+	})
+
+	Context("called with HTTP errors", func() {
+		It("should retry 5xx, 408 and 429", func() {
+			expectClass(&HTTPError{Status: 503}, CategoryServerError, true)
+			expectClass(&HTTPError{Status: 429}, CategoryClientError, true)
+			expectClass(&HTTPError{Status: 408}, CategoryClientError, true)
+		})
+
+		It("should not retry other 4xx", func() {
+			expectClass(&HTTPError{Status: 404}, CategoryClientError, false)
+			expectClass(&HTTPError{Status: 401}, CategoryUnauthorized, false)
+		})
+
+		It("should honor retryable status overrides", func() {
+			SetRetryableStatuses([]int{404})
+			expectClass(&HTTPError{Status: 404}, CategoryClientError, true)
+		})
+
+		It("should read wrapped unauthorized and TLS errors from messages", func() {
+			expectClass(errors.New("Error dialing trafficcontroller server: Unauthorized error: bad token."), CategoryUnauthorized, false)
+			expectClass(errors.New("Error dialing trafficcontroller server: x509: certificate signed by unknown authority."), CategoryTLS, false)
+		})
+
+		It("should read the status from error messages", func() {
+			expectClass(errors.New("Received a status code 502 Bad Gateway"), CategoryServerError, true)
+			expectClass(errors.New("Received a status code 400 Bad Request"), CategoryClientError, false)
+		})
+	})
+
+	Context("called with noaa errors", func() {
+		It("should not retry unauthorized errors", func() {
+			expectClass(noaa_errors.NewUnauthorizedError("bad token"), CategoryUnauthorized, false)
+		})
+	})
+
+	Context("called with unknown errors", func() {
+		It("should be fatal", func() {
+			expectClass(errors.New("boom"), CategoryUnknown, false)
+			Expect(IsRetryable(nil)).To(BeFalse())
+		})
+	})
+})
+
+var _ = Describe("IsFatal", func() {
+	It("should only tell known non retryable errors", func() {
+		Expect(IsFatal(noaa_errors.NewUnauthorizedError("bad token"))).To(BeTrue())
+		Expect(IsFatal(&HTTPError{Status: 404})).To(BeTrue())
+		Expect(IsFatal(&HTTPError{Status: 503})).To(BeFalse())
+		Expect(IsFatal(errors.New("websocket: close 1006 (abnormal closure)"))).To(BeFalse())
+	})
+})
+
+var _ = Describe("ParseStatuses", func() {
+	It("should parse a list of statuses", func() {
+		Expect(ParseStatuses("404, 409")).To(Equal([]int{404, 409}))
+	})
+
+	It("should reject invalid statuses", func() {
+		_, err := ParseStatuses("40x")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseStatuses("700")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+)
+
+// Transport sends requests through Base, each attempt timing out after
+// Timeout when set. Attempts failing with a retryable error or status, see
+// Classify, are retried up to MaxRetries times, waiting from BaseDelay,
+// doubled on every attempt, up to MaxDelay, or as long as the Retry-After
+// header of a 429 or 503 response asks. Requests whose body can't be sent
+// again are not retried.
+type Transport struct {
+	Base       http.RoundTripper
+	Timeout    time.Duration
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// Retries counts the retried attempts when set
+	Retries *metrics.Counter
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	replayable := req.Body == nil || req.GetBody != nil
+	delay := t.BaseDelay
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			// the caller's request is left untouched
+			attemptReq = new(http.Request)
+			*attemptReq = *req
+			attemptReq.Body = body
+		}
+		resp, err := t.attempt(base, attemptReq)
+		if err == nil && resp.StatusCode < 400 {
+			return resp, nil
+		}
+		if err == nil {
+			err = &HTTPError{Status: resp.StatusCode, URL: req.URL.String()}
+		}
+		if attempt >= t.MaxRetries || !replayable || !IsRetryable(err) {
+			if resp != nil {
+				return resp, nil
+			}
+			return nil, err
+		}
+
+		wait := delay
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp); ok {
+				wait = retryAfter
+			}
+			// drain the body so that the connection is reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		if t.Retries != nil {
+			t.Retries.Inc()
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if delay *= 2; t.MaxDelay > 0 && delay > t.MaxDelay {
+			delay = t.MaxDelay
+		}
+	}
+}
+
+// attempt sends req once, the response body releasing the timeout when
+// closed.
+func (t *Transport) attempt(base http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if t.Timeout <= 0 {
+		return base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.Timeout)
+	resp, err := base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// parseRetryAfter reads the delay the Retry-After header of a 429 or 503
+// response asks for, in seconds or as an HTTP date.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
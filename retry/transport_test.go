@@ -0,0 +1,131 @@
+package retry_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	. "github.com/cloudfoundry-community/firehose-to-syslog/retry"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transport", func() {
+	var (
+		attempts  int32
+		responses []func(w http.ResponseWriter, r *http.Request)
+		server    *httptest.Server
+		client    *http.Client
+		retries   *metrics.Counter
+	)
+
+	BeforeEach(func() {
+		attempts = 0
+		responses = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempt := int(atomic.AddInt32(&attempts, 1)) - 1
+			if attempt >= len(responses) {
+				attempt = len(responses) - 1
+			}
+			responses[attempt](w, r)
+		}))
+		retries = metrics.NewCounter("transport_test_retries")
+		client = &http.Client{Transport: &Transport{
+			Timeout:    200 * time.Millisecond,
+			MaxRetries: 3,
+			BaseDelay:  10 * time.Millisecond,
+			MaxDelay:   20 * time.Millisecond,
+			Retries:    retries,
+		}}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	status := func(code int) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+			w.Write([]byte(http.StatusText(code)))
+		}
+	}
+
+	get := func() (int, string) {
+		resp, err := client.Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return resp.StatusCode, string(body)
+	}
+
+	It("should retry 5xx until the request succeeds", func() {
+		before := retries.Value()
+		responses = append(responses, status(502), status(503), status(200))
+		code, body := get()
+		Expect(code).To(Equal(200))
+		Expect(body).To(Equal("OK"))
+		Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(3))
+		Expect(retries.Value() - before).To(BeEquivalentTo(2))
+	})
+
+	It("should return the last response once out of retries", func() {
+		responses = append(responses, status(500))
+		code, _ := get()
+		Expect(code).To(Equal(500))
+		Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(4))
+	})
+
+	It("should not retry other 4xx", func() {
+		responses = append(responses, status(404))
+		code, _ := get()
+		Expect(code).To(Equal(404))
+		Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(1))
+	})
+
+	It("should wait as long as the Retry-After of a 429 asks", func() {
+		responses = append(responses, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}, status(200))
+		start := time.Now()
+		code, _ := get()
+		Expect(code).To(Equal(200))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("should time out every attempt on its own", func() {
+		responses = append(responses, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+		}, status(200))
+		start := time.Now()
+		code, _ := get()
+		Expect(code).To(Equal(200))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(atomic.LoadInt32(&attempts)).To(BeEquivalentTo(2))
+	})
+
+	It("should send the body again on retries", func() {
+		var bodies []string
+		responses = append(responses, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}, func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+		})
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(bodies).To(Equal([]string{"payload", "payload"}))
+	})
+})
@@ -0,0 +1,293 @@
+package transforms
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
+	"github.com/cloudfoundry-community/firehose-to-syslog/metrics"
+	"github.com/cloudfoundry-community/firehose-to-syslog/utils"
+)
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// CollapseWhitespace compresses runs of whitespace in the message body.
+var CollapseWhitespace = TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+	event.Msg = utils.CollapseWhitespace(event.Msg)
+	return event, true
+})
+
+// StripANSI removes terminal color and cursor escape sequences from the
+// message body.
+var StripANSI = TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+	event.Msg = ansiEscape.ReplaceAllString(event.Msg, "")
+	return event, true
+})
+
+func init() {
+	Register("collapse-whitespace", CollapseWhitespace)
+	Register("strip-ansi", StripANSI)
+}
+
+// SourceTypeMap renames the source_type field of events according to
+// mapping, keeping the platform label in source_type_raw. A source type
+// such as APP/PROC/WEB falls back to the mapping of APP.
+func SourceTypeMap(mapping map[string]string) Transform {
+	return TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+		sourceType, ok := event.Fields["source_type"].(string)
+		if !ok {
+			return event, true
+		}
+		label, ok := mapping[sourceType]
+		if !ok {
+			if i := strings.Index(sourceType, "/"); i > 0 {
+				label, ok = mapping[sourceType[:i]]
+			}
+		}
+		if ok {
+			event.Fields["source_type_raw"] = sourceType
+			event.Fields["source_type"] = label
+		}
+		return event, true
+	})
+}
+
+// ContainerMetricClamp validates ContainerMetric events: cpu_percentage must
+// lie within [0, maxCPU] and memory_bytes and disk_bytes must not exceed
+// their quota. Out of range values are capped, or the whole event dropped
+// when drop is set, and counted as container_metric_anomalies.
+func ContainerMetricClamp(maxCPU float64, drop bool) Transform {
+	anomalies := metrics.NewCounter("container_metric_anomalies")
+	return TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+		if event.Type != "ContainerMetric" {
+			return event, true
+		}
+
+		anomaly := false
+		if cpu, ok := event.Fields["cpu_percentage"].(float64); ok && (cpu < 0 || cpu > maxCPU) {
+			anomaly = true
+			if cpu < 0 {
+				event.Fields["cpu_percentage"] = float64(0)
+			} else {
+				event.Fields["cpu_percentage"] = maxCPU
+			}
+		}
+		for _, field := range []string{"memory_bytes", "disk_bytes"} {
+			value, ok := event.Fields[field].(uint64)
+			quota, hasQuota := event.Fields[field+"_quota"].(uint64)
+			if ok && hasQuota && quota > 0 && value > quota {
+				anomaly = true
+				event.Fields[field] = quota
+			}
+		}
+
+		if !anomaly {
+			return event, true
+		}
+		anomalies.Inc()
+		return event, !drop
+	})
+}
+
+// DefaultLengthKey holds the limit of event types without one of their own
+// in a max message length map.
+const DefaultLengthKey = "default"
+
+// ParseMaxMessageLength parses a comma separated list of EventType:bytes
+// pairs, e.g. "LogMessage:8192,default:2048".
+func ParseMaxMessageLength(maxMessageLength string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(maxMessageLength, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Max message length [%s] must be EventType:bytes", pair)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(pair[i+1:]))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Max message length [%s] must be a positive number of bytes", pair)
+		}
+		limits[strings.TrimSpace(pair[:i])] = limit
+	}
+	return limits, nil
+}
+
+// MaxMessageLength truncates the message body of events to the limit of
+// their type, or the default one, never splitting a UTF-8 character.
+// Truncated events are counted as truncated_messages.
+func MaxMessageLength(limits map[string]int) Transform {
+	truncated := metrics.NewCounter("truncated_messages")
+	return TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+		limit, ok := limits[event.Type]
+		if !ok {
+			limit, ok = limits[DefaultLengthKey]
+		}
+		if ok && len(event.Msg) > limit {
+			event.Msg = utils.TruncateUTF8(event.Msg, limit)
+			truncated.Inc()
+		}
+		return event, true
+	})
+}
+
+// DefaultTraceIDPattern finds a W3C traceparent trace ID or a gorouter
+// vcap_request_id in log message bodies.
+const DefaultTraceIDPattern = `traceparent[=:]\s*"?[0-9a-f]{2}-([0-9a-f]{32})-|vcap_request_id[=:]\s*"?([0-9a-f-]{36})`
+
+// TraceID sets a trace_id field: the request ID of HttpStartStop events,
+// and the first non-empty submatch of pattern in LogMessage bodies.
+func TraceID(pattern *regexp.Regexp) Transform {
+	return TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+		switch event.Type {
+		case "HttpStartStop":
+			if requestID, ok := event.Fields["request_id"].(string); ok && requestID != "" {
+				event.Fields["trace_id"] = requestID
+			}
+		case "LogMessage":
+			matches := pattern.FindStringSubmatch(event.Msg)
+			for i := 1; i < len(matches); i++ {
+				if matches[i] != "" {
+					event.Fields["trace_id"] = matches[i]
+					break
+				}
+			}
+		}
+		return event, true
+	})
+}
+
+type regionRange struct {
+	network *net.IPNet
+	region  string
+}
+
+// bySpecificity sorts region ranges from the longest prefix to the shortest
+type bySpecificity []regionRange
+
+func (r bySpecificity) Len() int      { return len(r) }
+func (r bySpecificity) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r bySpecificity) Less(i, j int) bool {
+	iOnes, _ := r[i].network.Mask.Size()
+	jOnes, _ := r[j].network.Mask.Size()
+	return iOnes > jOnes
+}
+
+// RegionCIDRMap sets a region field from the ip field of events (the cell
+// or VM that emitted them) according to mapping, a comma separated list of
+// CIDR:region pairs, e.g. "10.0.0.0/8:us-east,10.1.0.0/16:eu-west". The most
+// specific range wins. Events outside every range get defaultRegion, unless
+// it is empty.
+func RegionCIDRMap(mapping string, defaultRegion string) (Transform, error) {
+	var ranges []regionRange
+	for _, pair := range strings.Split(mapping, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Region range [%s] must be CIDR:region", pair)
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(pair[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("Region range [%s]: %s", pair, err)
+		}
+		ranges = append(ranges, regionRange{network: network, region: strings.TrimSpace(pair[i+1:])})
+	}
+	sort.Stable(bySpecificity(ranges))
+
+	return TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+		region := defaultRegion
+		if address, ok := event.Fields["ip"].(string); ok {
+			if ip := net.ParseIP(address); ip != nil {
+				for _, r := range ranges {
+					if r.network.Contains(ip) {
+						region = r.region
+						break
+					}
+				}
+			}
+		}
+		if region != "" {
+			event.Fields["region"] = region
+		}
+		return event, true
+	}), nil
+}
+
+// cpuStaleAfter is how long the CPU history of an app instance that stopped
+// reporting is kept.
+const cpuStaleAfter = 10 * time.Minute
+
+type cpuHistory struct {
+	samples    []float64
+	next       int
+	sum        float64
+	cpuSeconds float64
+	lastSeen   time.Time
+}
+
+// ContainerCPUSmoothing adds derived CPU fields to ContainerMetric events,
+// tracked per app instance: cpu_percentage_avg, the moving average of the
+// last window samples, when average is set, and cpu_seconds_total, the CPU
+// time consumed since the nozzle started estimated from the samples, when
+// cumulative is set.
+func ContainerCPUSmoothing(window int, average bool, cumulative bool) Transform {
+	var mu sync.Mutex
+	histories := make(map[string]*cpuHistory)
+	lastSweep := time.Now()
+
+	return TransformFunc(func(event *fevents.Event) (*fevents.Event, bool) {
+		cpu, ok := event.Fields["cpu_percentage"].(float64)
+		if event.Type != "ContainerMetric" || !ok {
+			return event, true
+		}
+		key := fmt.Sprintf("%v/%v", event.Fields["cf_app_id"], event.Fields["instance_index"])
+		now := time.Now()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if now.Sub(lastSweep) > cpuStaleAfter {
+			for k, h := range histories {
+				if now.Sub(h.lastSeen) > cpuStaleAfter {
+					delete(histories, k)
+				}
+			}
+			lastSweep = now
+		}
+
+		h, seen := histories[key]
+		if !seen {
+			h = &cpuHistory{}
+			histories[key] = h
+		}
+
+		if average {
+			if len(h.samples) < window {
+				h.samples = append(h.samples, cpu)
+			} else {
+				h.sum -= h.samples[h.next]
+				h.samples[h.next] = cpu
+				h.next = (h.next + 1) % window
+			}
+			h.sum += cpu
+			event.Fields["cpu_percentage_avg"] = h.sum / float64(len(h.samples))
+		}
+		if cumulative {
+			if seen {
+				h.cpuSeconds += cpu / 100 * now.Sub(h.lastSeen).Seconds()
+			}
+			event.Fields["cpu_seconds_total"] = h.cpuSeconds
+		}
+		h.lastSeen = now
+		return event, true
+	})
+}
@@ -0,0 +1,108 @@
+package transforms
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
+)
+
+// Transform is a single stage of the event pipeline. It returns the
+// (possibly rewritten) event and whether the event should be kept.
+type Transform interface {
+	Transform(event *fevents.Event) (*fevents.Event, bool)
+}
+
+// TransformFunc adapts a plain function to the Transform interface.
+type TransformFunc func(event *fevents.Event) (*fevents.Event, bool)
+
+func (f TransformFunc) Transform(event *fevents.Event) (*fevents.Event, bool) {
+	return f(event)
+}
+
+// Pipeline runs its stages in order and stops as soon as one of them
+// drops the event.
+type Pipeline []Transform
+
+func (p Pipeline) Apply(event *fevents.Event) (*fevents.Event, bool) {
+	for _, stage := range p {
+		var keep bool
+		event, keep = stage.Transform(event)
+		if !keep {
+			return nil, false
+		}
+	}
+	return event, true
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Transform)
+)
+
+// Register makes a transform selectable by name through NewPipeline.
+// Registering an existing name replaces the previous transform.
+func Register(name string, transform Transform) {
+	registryLock.Lock()
+	registry[name] = transform
+	registryLock.Unlock()
+}
+
+func IsAuthorizedTransform(name string) bool {
+	registryLock.RLock()
+	_, ok := registry[name]
+	registryLock.RUnlock()
+	return ok
+}
+
+func GetListAuthorizedTransforms() string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return strings.Join(sortedNames(), ", ")
+}
+
+// NewPipeline builds a pipeline from a comma separated list of transform
+// names, in the given order. Implied transforms (typically enabled by their
+// own dedicated flag) are appended unless already listed explicitly.
+func NewPipeline(wantedTransforms string, implied ...string) (Pipeline, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(wantedTransforms, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		names = append(names, name)
+		seen[name] = true
+	}
+	for _, name := range implied {
+		if !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}
+
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	pipeline := make(Pipeline, 0, len(names))
+	for _, name := range names {
+		transform, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("Rejected Transform Name [%s] - Valid transforms: %s", name, strings.Join(sortedNames(), ", "))
+		}
+		pipeline = append(pipeline, transform)
+	}
+	return pipeline, nil
+}
+
+func sortedNames() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
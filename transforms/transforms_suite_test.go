@@ -0,0 +1,13 @@
+package transforms_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Transforms Suite")
+}
@@ -0,0 +1,239 @@
+package transforms_test
+
+import (
+	"regexp"
+	"time"
+
+	fevents "github.com/cloudfoundry-community/firehose-to-syslog/events"
+	. "github.com/cloudfoundry-community/firehose-to-syslog/transforms"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Transforms", func() {
+	var event *fevents.Event
+
+	BeforeEach(func() {
+		event = &fevents.Event{
+			Fields: map[string]interface{}{},
+			Msg:    "\x1b[31mred\x1b[0m   text",
+		}
+	})
+
+	Context("called with an empty list", func() {
+		It("should return an empty pipeline that keeps events untouched", func() {
+			pipeline, err := NewPipeline("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pipeline).To(BeEmpty())
+
+			out, keep := pipeline.Apply(event)
+			Expect(keep).To(BeTrue())
+			Expect(out.Msg).To(Equal("\x1b[31mred\x1b[0m   text"))
+		})
+	})
+
+	Context("called with a bogus transform name", func() {
+		It("should err out", func() {
+			_, err := NewPipeline("strip-ansi,bogus")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("called with built-in transforms", func() {
+		It("should run them in the given order", func() {
+			pipeline, err := NewPipeline("strip-ansi, collapse-whitespace")
+			Expect(err).ToNot(HaveOccurred())
+
+			out, keep := pipeline.Apply(event)
+			Expect(keep).To(BeTrue())
+			Expect(out.Msg).To(Equal("red text"))
+		})
+	})
+
+	Context("called with implied transforms", func() {
+		It("should append them only once", func() {
+			pipeline, err := NewPipeline("collapse-whitespace", "collapse-whitespace", "strip-ansi")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pipeline).To(HaveLen(2))
+		})
+	})
+
+	Context("called with a stage that drops the event", func() {
+		It("should stop the pipeline", func() {
+			called := false
+			Register("drop-all", TransformFunc(func(e *fevents.Event) (*fevents.Event, bool) {
+				return e, false
+			}))
+			Register("spy", TransformFunc(func(e *fevents.Event) (*fevents.Event, bool) {
+				called = true
+				return e, true
+			}))
+			pipeline, err := NewPipeline("drop-all,spy")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, keep := pipeline.Apply(event)
+			Expect(keep).To(BeFalse())
+			Expect(called).To(BeFalse())
+		})
+	})
+
+	Context("called with a source type map", func() {
+		It("should rename mapped source types and keep the raw label", func() {
+			stage := SourceTypeMap(map[string]string{"RTR": "gorouter", "APP": "app"})
+
+			event.Fields["source_type"] = "RTR"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["source_type"]).To(Equal("gorouter"))
+			Expect(event.Fields["source_type_raw"]).To(Equal("RTR"))
+
+			event.Fields["source_type"] = "APP/PROC/WEB"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["source_type"]).To(Equal("app"))
+
+			event.Fields["source_type"] = "CELL"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["source_type"]).To(Equal("CELL"))
+		})
+	})
+
+	Context("called with container metric clamping", func() {
+		BeforeEach(func() {
+			event.Type = "ContainerMetric"
+			event.Fields["cpu_percentage"] = 12000.0
+			event.Fields["memory_bytes"] = uint64(2048)
+			event.Fields["memory_bytes_quota"] = uint64(1024)
+			event.Fields["disk_bytes"] = uint64(10)
+			event.Fields["disk_bytes_quota"] = uint64(1024)
+		})
+
+		It("should cap out of range values", func() {
+			event, keep := ContainerMetricClamp(6400, false).Transform(event)
+			Expect(keep).To(BeTrue())
+			Expect(event.Fields["cpu_percentage"]).To(Equal(6400.0))
+			Expect(event.Fields["memory_bytes"]).To(Equal(uint64(1024)))
+			Expect(event.Fields["disk_bytes"]).To(Equal(uint64(10)))
+		})
+
+		It("should drop events with out of range values", func() {
+			_, keep := ContainerMetricClamp(6400, true).Transform(event)
+			Expect(keep).To(BeFalse())
+		})
+
+		It("should keep sane events untouched", func() {
+			event.Fields["cpu_percentage"] = 50.0
+			event.Fields["memory_bytes"] = uint64(512)
+			_, keep := ContainerMetricClamp(6400, true).Transform(event)
+			Expect(keep).To(BeTrue())
+		})
+	})
+
+	Context("called with max message lengths", func() {
+		It("should parse event type and byte limits", func() {
+			limits, err := ParseMaxMessageLength("LogMessage:8192, default:2048")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(limits).To(Equal(map[string]int{"LogMessage": 8192, "default": 2048}))
+
+			_, err = ParseMaxMessageLength("LogMessage:0")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should truncate to the limit of the event type or the default one", func() {
+			stage := MaxMessageLength(map[string]int{"LogMessage": 6, "default": 3})
+
+			event.Type = "LogMessage"
+			event.Msg = "hello world"
+			event, _ = stage.Transform(event)
+			Expect(event.Msg).To(Equal("hello "))
+
+			event.Type = "ValueMetric"
+			event.Msg = "hello world"
+			event, _ = stage.Transform(event)
+			Expect(event.Msg).To(Equal("hel"))
+		})
+	})
+
+	Context("called with trace ID extraction", func() {
+		var stage Transform
+
+		BeforeEach(func() {
+			stage = TraceID(regexp.MustCompile(DefaultTraceIDPattern))
+		})
+
+		It("should use the request ID of HttpStartStop events", func() {
+			event.Type = "HttpStartStop"
+			event.Fields["request_id"] = "4ee9d4b6-2d73-4ff1-8c69-bff6a3d2e0c4"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["trace_id"]).To(Equal("4ee9d4b6-2d73-4ff1-8c69-bff6a3d2e0c4"))
+		})
+
+		It("should extract a W3C trace ID from log messages", func() {
+			event.Type = "LogMessage"
+			event.Msg = `GET /health traceparent:"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"`
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["trace_id"]).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		})
+
+		It("should extract a vcap request ID from log messages", func() {
+			event.Type = "LogMessage"
+			event.Msg = `GET /health vcap_request_id:"4ee9d4b6-2d73-4ff1-8c69-bff6a3d2e0c4"`
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["trace_id"]).To(Equal("4ee9d4b6-2d73-4ff1-8c69-bff6a3d2e0c4"))
+		})
+
+		It("should leave log messages without trace ID untouched", func() {
+			event.Type = "LogMessage"
+			event.Msg = "hello"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields).ToNot(HaveKey("trace_id"))
+		})
+	})
+
+	Context("called with a region CIDR map", func() {
+		It("should reject bogus ranges", func() {
+			_, err := RegionCIDRMap("10.0.0.0:us-east", "")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should tag events with the region of the most specific range", func() {
+			stage, err := RegionCIDRMap("10.0.0.0/8:us-east, 10.1.0.0/16:eu-west", "on-prem")
+			Expect(err).ToNot(HaveOccurred())
+
+			event.Fields["ip"] = "10.1.2.3"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["region"]).To(Equal("eu-west"))
+
+			event.Fields["ip"] = "10.2.2.3"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["region"]).To(Equal("us-east"))
+
+			event.Fields["ip"] = "192.168.1.1"
+			event, _ = stage.Transform(event)
+			Expect(event.Fields["region"]).To(Equal("on-prem"))
+		})
+	})
+
+	Context("called with container CPU smoothing", func() {
+		sample := func(stage Transform, cpu float64) *fevents.Event {
+			event := &fevents.Event{
+				Type:   "ContainerMetric",
+				Fields: map[string]interface{}{"cf_app_id": "app", "instance_index": int32(0), "cpu_percentage": cpu},
+			}
+			event, _ = stage.Transform(event)
+			return event
+		}
+
+		It("should average the last samples of the instance", func() {
+			stage := ContainerCPUSmoothing(2, true, false)
+			Expect(sample(stage, 10).Fields["cpu_percentage_avg"]).To(Equal(10.0))
+			Expect(sample(stage, 20).Fields["cpu_percentage_avg"]).To(Equal(15.0))
+			Expect(sample(stage, 40).Fields["cpu_percentage_avg"]).To(Equal(30.0))
+		})
+
+		It("should estimate the cumulative CPU time", func() {
+			stage := ContainerCPUSmoothing(2, false, true)
+			Expect(sample(stage, 100).Fields["cpu_seconds_total"]).To(Equal(0.0))
+			time.Sleep(100 * time.Millisecond)
+			Expect(sample(stage, 100).Fields["cpu_seconds_total"]).To(BeNumerically("~", 0.1, 0.05))
+		})
+	})
+})
@@ -15,6 +15,13 @@ type FakeUAA struct {
 	accessToken string
 
 	requested bool
+	requests  int
+	fail      bool
+
+	nextRefreshToken string
+	rejectRefresh    bool
+	grantType        string
+	refreshToken     string
 }
 
 func NewFakeUAA(tokenType string, accessToken string) *FakeUAA {
@@ -43,20 +50,87 @@ func (f *FakeUAA) Requested() bool {
 	return f.requested
 }
 
+// Requests returns the number of token requests received.
+func (f *FakeUAA) Requests() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+// SetAccessToken makes the fake hand out accessToken from now on.
+func (f *FakeUAA) SetAccessToken(accessToken string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.accessToken = accessToken
+}
+
+// Fail makes the fake answer token requests with a server error.
+func (f *FakeUAA) Fail(fail bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fail = fail
+}
+
+// RotateRefreshToken makes the fake hand out next as the new refresh token.
+func (f *FakeUAA) RotateRefreshToken(next string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.nextRefreshToken = next
+}
+
+// RejectRefreshToken makes the fake reject refresh_token grants.
+func (f *FakeUAA) RejectRefreshToken(reject bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.rejectRefresh = reject
+}
+
+func (f *FakeUAA) GrantType() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.grantType
+}
+
+func (f *FakeUAA) ReceivedRefreshToken() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.refreshToken
+}
+
 func (f *FakeUAA) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	r.ParseForm()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requested = true
+	f.requests++
+	f.grantType = r.PostForm.Get("grant_type")
+	f.refreshToken = r.PostForm.Get("refresh_token")
+
+	if f.fail {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if f.grantType == "refresh_token" && f.rejectRefresh {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+
 	rw.Write([]byte(fmt.Sprintf(`
 		{
 			"token_type": "%s",
-			"access_token": "%s"
+			"access_token": "%s",
+			"refresh_token": "%s"
 		}
-	`, f.tokenType, f.accessToken)))
-	f.lock.Lock()
-	f.requested = true
-	f.lock.Unlock()
+	`, f.tokenType, f.accessToken, f.nextRefreshToken)))
 }
 
 func (f *FakeUAA) AuthToken() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	if f.tokenType == "" && f.accessToken == "" {
 		return ""
 	}
@@ -0,0 +1,106 @@
+package uaatokenrefresher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultRequiredScopes grants access to the firehose.
+const DefaultRequiredScopes = "doppler.firehose|logs.admin"
+
+// ParseRequiredScopes splits a comma separated list of required scopes.
+// Each entry may list alternatives separated by '|', any of which is enough.
+func ParseRequiredScopes(requiredScopes string) [][]string {
+	var required [][]string
+	for _, entry := range strings.Split(requiredScopes, ",") {
+		var alternatives []string
+		for _, scope := range strings.Split(entry, "|") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				alternatives = append(alternatives, scope)
+			}
+		}
+		if len(alternatives) > 0 {
+			required = append(required, alternatives)
+		}
+	}
+	return required
+}
+
+type tokenClaims struct {
+	Scope []string `json:"scope"`
+	Exp   int64    `json:"exp"`
+}
+
+// decodeClaims decodes the claims of a JWT access token, optionally prefixed
+// by its type as returned by RefreshAuthToken. The signature is not checked.
+func decodeClaims(authToken string) (*tokenClaims, error) {
+	fields := strings.Fields(authToken)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Empty token")
+	}
+	parts := strings.Split(fields[len(fields)-1], ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode token payload: %s", err)
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("Unable to decode token claims: %s", err)
+	}
+	return &claims, nil
+}
+
+// TokenScopes decodes the scopes of a JWT access token.
+func TokenScopes(authToken string) ([]string, error) {
+	claims, err := decodeClaims(authToken)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Scope, nil
+}
+
+// TokenExpiry decodes the expiration time of a JWT access token.
+func TokenExpiry(authToken string) (time.Time, error) {
+	claims, err := decodeClaims(authToken)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("Token has no expiration time")
+	}
+	return time.Unix(claims.Exp, 0), nil
+}
+
+// CheckScopes returns an error naming the first required scope missing from
+// the token.
+func CheckScopes(authToken string, required [][]string) error {
+	scopes, err := TokenScopes(authToken)
+	if err != nil {
+		return err
+	}
+	granted := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+
+	for _, alternatives := range required {
+		found := false
+		for _, scope := range alternatives {
+			if granted[scope] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Token is missing scope %s, granted scopes: %s", strings.Join(alternatives, " or "), strings.Join(scopes, ", "))
+		}
+	}
+	return nil
+}
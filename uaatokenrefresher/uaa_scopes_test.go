@@ -0,0 +1,54 @@
+package uaatokenrefresher_test
+
+import (
+	"encoding/base64"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/uaatokenrefresher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func tokenWithClaims(claims string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return "bearer " + encode([]byte(`{"alg":"none"}`)) + "." + encode([]byte(claims)) + ".signature"
+}
+
+var _ = Describe("Scopes", func() {
+	var required [][]string
+
+	BeforeEach(func() {
+		required = ParseRequiredScopes(DefaultRequiredScopes)
+	})
+
+	It("accepts a token with doppler.firehose", func() {
+		Expect(CheckScopes(tokenWithClaims(`{"scope":["openid","doppler.firehose"]}`), required)).To(Succeed())
+	})
+
+	It("accepts a token with logs.admin", func() {
+		Expect(CheckScopes(tokenWithClaims(`{"scope":["logs.admin"]}`), required)).To(Succeed())
+	})
+
+	It("rejects a token without any firehose scope", func() {
+		err := CheckScopes(tokenWithClaims(`{"scope":["cloud_controller.read"]}`), required)
+		Expect(err).To(MatchError(ContainSubstring("doppler.firehose or logs.admin")))
+	})
+
+	It("requires every listed scope", func() {
+		required = ParseRequiredScopes("doppler.firehose, cloud_controller.admin_read_only")
+		Expect(CheckScopes(tokenWithClaims(`{"scope":["doppler.firehose"]}`), required)).ToNot(Succeed())
+		Expect(CheckScopes(tokenWithClaims(`{"scope":["doppler.firehose","cloud_controller.admin_read_only"]}`), required)).To(Succeed())
+	})
+
+	It("rejects tokens that are not JWTs", func() {
+		Expect(CheckScopes("bearer 123456789", required)).ToNot(Succeed())
+	})
+
+	It("decodes the token expiration time", func() {
+		expiresAt, err := TokenExpiry(tokenWithClaims(`{"exp":1500000000}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expiresAt.Unix()).To(BeEquivalentTo(1500000000))
+
+		_, err = TokenExpiry(tokenWithClaims(`{"scope":["logs.admin"]}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
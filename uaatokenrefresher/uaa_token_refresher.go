@@ -1,18 +1,57 @@
 package uaatokenrefresher
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudfoundry-community/firehose-to-syslog/logging"
-	"github.com/cloudfoundry-incubator/uaago"
+	"github.com/cloudfoundry-community/firehose-to-syslog/retry"
+	"golang.org/x/oauth2"
 )
 
+const (
+	// refreshRetryMin and refreshRetryMax bound the backoff between failed
+	// background refreshes
+	refreshRetryMin = time.Second
+	refreshRetryMax = time.Minute
+	// refreshPollInterval is how often the background refresh checks for a
+	// token of known lifetime
+	refreshPollInterval = time.Minute
+)
+
+// ErrRefreshTokenExpired is returned when UAA rejects the refresh token,
+// either because it expired or because it was revoked.
+var ErrRefreshTokenExpired = errors.New("refresh token expired or revoked")
+
 type UAATokenRefresher struct {
 	url               string
 	clientID          string
 	clientSecret      string
 	skipSSLValidation bool
-	client            *uaago.Client
+	proxy             func(*http.Request) (*url.URL, error)
+
+	mutex        sync.Mutex
+	refreshToken string
+
+	// the last access token fetched, and when it expires if known
+	tokenMutex sync.RWMutex
+	token      string
+	fetchedAt  time.Time
+	expiresAt  time.Time
+}
+
+type tokenResponse struct {
+	TokenType    string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
 }
 
 func NewUAATokenRefresher(authEndpoint string,
@@ -20,8 +59,10 @@ func NewUAATokenRefresher(authEndpoint string,
 	clientSecret string,
 	skipSSLValidation bool,
 ) (*UAATokenRefresher, error) {
-	client, err := uaago.NewClient(authEndpoint)
-	if err != nil {
+	if authEndpoint == "" {
+		return &UAATokenRefresher{}, errors.New("Missing UAA url")
+	}
+	if _, err := url.Parse(authEndpoint); err != nil {
 		return &UAATokenRefresher{}, err
 	}
 
@@ -30,16 +71,238 @@ func NewUAATokenRefresher(authEndpoint string,
 		clientID:          clientID,
 		clientSecret:      clientSecret,
 		skipSSLValidation: skipSSLValidation,
-		client:            client,
 	}, nil
 }
 
+// SetRefreshToken switches the refresher to the refresh_token grant.
+// The token is rotated whenever UAA hands out a new one.
+func (uaa *UAATokenRefresher) SetRefreshToken(refreshToken string) {
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+	uaa.refreshToken = refreshToken
+}
+
+// SetProxy sends the requests to UAA through the proxy picked by proxy,
+// directly when it returns nil.
+func (uaa *UAATokenRefresher) SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+	uaa.proxy = proxy
+}
+
+// RefreshToken returns the refresh token currently in use.
+func (uaa *UAATokenRefresher) RefreshToken() string {
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+	return uaa.refreshToken
+}
+
+// RefreshAuthToken fetches a new access token from UAA.
 func (uaa *UAATokenRefresher) RefreshAuthToken() (string, error) {
-	authToken, err := uaa.client.GetAuthToken(uaa.clientID, uaa.clientSecret, uaa.skipSSLValidation)
+	authToken, err := uaa.fetchAuthToken()
 	if err != nil {
-		logging.LogStd(fmt.Sprint("Error getting oauth token: %s. Please check your Client ID and Secret.", err.Error()), false)
 		return "", err
 	}
 
+	expiresAt, _ := TokenExpiry(authToken)
+	uaa.tokenMutex.Lock()
+	defer uaa.tokenMutex.Unlock()
+	uaa.token = authToken
+	uaa.fetchedAt = time.Now()
+	uaa.expiresAt = expiresAt
 	return authToken, nil
 }
+
+// GetToken returns the last access token fetched while it is valid, and a
+// new one otherwise. Tokens whose expiration time is unknown are fetched
+// every time.
+func (uaa *UAATokenRefresher) GetToken() (string, error) {
+	uaa.tokenMutex.RLock()
+	authToken, expiresAt := uaa.token, uaa.expiresAt
+	uaa.tokenMutex.RUnlock()
+	if authToken != "" && time.Now().Before(expiresAt) {
+		return authToken, nil
+	}
+	return uaa.RefreshAuthToken()
+}
+
+// TokenSource hands out the access tokens of the refresher as an oauth2
+// TokenSource, so that cfclient shares them rather than fetching its own.
+func (uaa *UAATokenRefresher) TokenSource() oauth2.TokenSource {
+	return TokenSourceFunc(uaa.GetToken)
+}
+
+// Transport authenticates the requests sent through base with the tokens
+// of the refresher, e.g. as the transport of the HttpClient cfclient sets
+// up, so that it shares them rather than fetching its own.
+func (uaa *UAATokenRefresher) Transport(base http.RoundTripper) http.RoundTripper {
+	return &oauth2.Transport{Source: uaa.TokenSource(), Base: base}
+}
+
+// TokenSourceFunc turns a function returning access tokens prefixed by
+// their type, such as GetToken, into an oauth2 TokenSource. Tokens are
+// handed out as expired, so that oauth2 asks for one on every request,
+// caching and refreshing being left to the function.
+type TokenSourceFunc func() (string, error)
+
+func (f TokenSourceFunc) Token() (*oauth2.Token, error) {
+	authToken, err := f()
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{AccessToken: authToken, Expiry: time.Now()}
+	if fields := strings.Fields(authToken); len(fields) == 2 {
+		token.TokenType, token.AccessToken = fields[0], fields[1]
+	}
+	return token, nil
+}
+
+// RefreshBeforeExpiry refreshes the access token in the background once
+// fraction of its lifetime elapsed. A failed refresh is retried with
+// backoff, GetToken returning the current token until it expires. Errors
+// that retrying won't fix, such as rejected credentials, stop the
+// background refresh, GetToken fetching a token again once it expired.
+func (uaa *UAATokenRefresher) RefreshBeforeExpiry(fraction float64) {
+	go func() {
+		delay := refreshRetryMin
+		for {
+			wait, ok := uaa.untilRefresh(fraction)
+			if !ok {
+				time.Sleep(refreshPollInterval)
+				continue
+			}
+			time.Sleep(wait)
+			_, err := uaa.RefreshAuthToken()
+			if err == nil {
+				delay = refreshRetryMin
+				continue
+			}
+			if category, fatal := classify(err); fatal {
+				logging.LogError(fmt.Sprintf("Failed to refresh the UAA token after a fatal %s error, no longer refreshing it in the background", category), err)
+				return
+			}
+			logging.LogError(fmt.Sprintf("Failed to refresh the UAA token, retrying in %s", delay), err)
+			time.Sleep(delay)
+			if delay *= 2; delay > refreshRetryMax {
+				delay = refreshRetryMax
+			}
+		}
+	}()
+}
+
+// classify returns the category of a failed token request and whether it
+// is fatal, a rejected refresh token being.
+func classify(err error) (string, bool) {
+	if err == ErrRefreshTokenExpired {
+		return retry.CategoryUnauthorized, true
+	}
+	category, _ := retry.Classify(err)
+	return category, retry.IsFatal(err)
+}
+
+// untilRefresh returns how long until the current token is due for a
+// refresh, or false when no token of known lifetime was fetched yet.
+func (uaa *UAATokenRefresher) untilRefresh(fraction float64) (time.Duration, bool) {
+	uaa.tokenMutex.RLock()
+	defer uaa.tokenMutex.RUnlock()
+	if uaa.token == "" || uaa.expiresAt.IsZero() {
+		return 0, false
+	}
+	lifetime := uaa.expiresAt.Sub(uaa.fetchedAt)
+	refreshAt := uaa.fetchedAt.Add(time.Duration(float64(lifetime) * fraction))
+	return refreshAt.Sub(time.Now()), true
+}
+
+func (uaa *UAATokenRefresher) fetchAuthToken() (string, error) {
+	if uaa.RefreshToken() != "" {
+		return uaa.refreshAuthTokenWithRefreshToken()
+	}
+
+	authToken, err := uaa.clientCredentialsToken()
+	if err != nil {
+		logging.LogStd(fmt.Sprintf("Error getting oauth token: %s. Please check your Client ID and Secret.", err.Error()), false)
+		return "", err
+	}
+
+	return authToken, nil
+}
+
+func (uaa *UAATokenRefresher) clientCredentialsToken() (string, error) {
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+
+	resp, token, err := uaa.postToken(url.Values{
+		"client_id":  {uaa.clientID},
+		"grant_type": {"client_credentials"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Received a status code %v", resp.Status)
+	}
+	return fmt.Sprintf("%s %s", token.TokenType, token.AccessToken), nil
+}
+
+func (uaa *UAATokenRefresher) refreshAuthTokenWithRefreshToken() (string, error) {
+	uaa.mutex.Lock()
+	defer uaa.mutex.Unlock()
+
+	resp, token, err := uaa.postToken(url.Values{
+		"client_id":     {uaa.clientID},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {uaa.refreshToken},
+	})
+	if err != nil {
+		logging.LogStd(fmt.Sprintf("Error getting oauth token: %s.", err.Error()), false)
+		return "", err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized,
+		resp.StatusCode == http.StatusBadRequest && token.Error == "invalid_grant",
+		resp.StatusCode == http.StatusBadRequest && token.Error == "invalid_token":
+		logging.LogStd("Error getting oauth token: the refresh token expired or was revoked. Please provision a new one.", false)
+		return "", ErrRefreshTokenExpired
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("Received a status code %v", resp.Status)
+	}
+
+	if token.RefreshToken != "" && token.RefreshToken != uaa.refreshToken {
+		logging.LogStd("Rotating UAA refresh token", false)
+		uaa.refreshToken = token.RefreshToken
+	}
+
+	return fmt.Sprintf("%s %s", token.TokenType, token.AccessToken), nil
+}
+
+// postToken posts the grant of data to the token endpoint of UAA, through
+// the proxy, returning the response and its decoded body. The body of
+// error responses may not decode, only the error field being of interest.
+// The caller holds mutex.
+func (uaa *UAATokenRefresher) postToken(data url.Values) (*http.Response, tokenResponse, error) {
+	var token tokenResponse
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s/oauth/token", strings.TrimRight(uaa.url, "/")), strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, token, err
+	}
+	request.SetBasicAuth(uaa.clientID, uaa.clientSecret)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           uaa.proxy,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: uaa.skipSSLValidation},
+		},
+	}
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return nil, token, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, token, err
+	}
+	return resp, token, nil
+}
@@ -1,8 +1,17 @@
 package uaatokenrefresher_test
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
 	. "github.com/cloudfoundry-community/firehose-to-syslog/uaatokenrefresher"
 	"github.com/cloudfoundry-community/firehose-to-syslog/uaatokenrefresher/fakes"
+	"github.com/cloudfoundry-community/go-cfclient"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -24,6 +33,7 @@ var _ = Describe("UAATokenRefresher", func() {
 		authTokenRefresher, err = NewUAATokenRefresher(
 			fakeUAA.URL(), "client-id", "client-secret", true,
 		)
+		Expect(err).ToNot(HaveOccurred())
 	})
 
 	AfterEach(func() {
@@ -35,5 +45,159 @@ var _ = Describe("UAATokenRefresher", func() {
 		Expect(fakeUAA.Requested()).To(BeTrue())
 		Expect(authToken).To(Equal(fakeToken))
 		Expect(err).ToNot(HaveOccurred())
+		Expect(fakeUAA.GrantType()).To(Equal("client_credentials"))
+	})
+
+	It("fetches the token through the proxy", func() {
+		var proxied []string
+		proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied = append(proxied, r.URL.Host)
+			r.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+		defer proxyServer.Close()
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		authTokenRefresher.SetProxy(http.ProxyURL(proxyURL))
+
+		authToken, err := authTokenRefresher.RefreshAuthToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(authToken).To(Equal(fakeToken))
+		Expect(proxied).To(Equal([]string{strings.TrimPrefix(fakeUAA.URL(), "http://")}))
+	})
+
+	Context("with tokens expiring", func() {
+		accessToken := func(lifetime time.Duration) string {
+			claims := fmt.Sprintf(`{"exp":%d}`, time.Now().Add(lifetime).Unix())
+			return strings.TrimPrefix(tokenWithClaims(claims), "bearer ")
+		}
+
+		It("keeps handing out a valid token", func() {
+			fakeUAA.SetAccessToken(accessToken(time.Hour))
+			first, err := authTokenRefresher.GetToken()
+			Expect(err).ToNot(HaveOccurred())
+			second, err := authTokenRefresher.GetToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(Equal(first))
+			Expect(fakeUAA.Requests()).To(Equal(1))
+		})
+
+		It("fetches a new token once expired", func() {
+			fakeUAA.SetAccessToken(accessToken(-time.Minute))
+			authTokenRefresher.GetToken()
+			fakeUAA.SetAccessToken(accessToken(time.Hour))
+			authToken, err := authTokenRefresher.GetToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authToken).To(Equal(fakeUAA.AuthToken()))
+			Expect(fakeUAA.Requests()).To(Equal(2))
+		})
+
+		It("keeps the current token when a refresh fails", func() {
+			fakeUAA.SetAccessToken(accessToken(time.Hour))
+			current, _ := authTokenRefresher.GetToken()
+			fakeUAA.Fail(true)
+			_, err := authTokenRefresher.RefreshAuthToken()
+			Expect(err).To(HaveOccurred())
+
+			authToken, err := authTokenRefresher.GetToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authToken).To(Equal(current))
+		})
+
+		It("shares its token with cfclient, UAA being asked once", func() {
+			fakeUAA.SetAccessToken(accessToken(time.Hour))
+			var authorization string
+			cc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/info" {
+					fmt.Fprintf(w, `{"authorization_endpoint":%q,"token_endpoint":%q}`, fakeUAA.URL(), fakeUAA.URL())
+					return
+				}
+				authorization = r.Header.Get("Authorization")
+				fmt.Fprint(w, `{}`)
+			}))
+			defer cc.Close()
+
+			config := &cfclient.Config{
+				ApiAddress:   cc.URL,
+				ClientID:     "client-id",
+				ClientSecret: "client-secret",
+			}
+			client, err := cfclient.NewClient(config)
+			Expect(err).ToNot(HaveOccurred())
+			config.HttpClient.Transport = authTokenRefresher.Transport(http.DefaultTransport)
+			authToken, err := authTokenRefresher.GetToken()
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.DoRequest(client.NewRequest("GET", "/v2/apps"))
+			Expect(err).ToNot(HaveOccurred())
+
+			// oauth2 capitalizes the token type
+			Expect(authorization).To(Equal("Bearer " + strings.TrimPrefix(authToken, "bearer ")))
+			Expect(fakeUAA.Requests()).To(Equal(1))
+		})
+
+		It("refreshes the token in the background before it expires", func() {
+			fakeUAA.SetAccessToken(accessToken(2 * time.Second))
+			authTokenRefresher.GetToken()
+			authTokenRefresher.RefreshBeforeExpiry(0.5)
+
+			fakeUAA.SetAccessToken(accessToken(time.Hour))
+			Eventually(func() string {
+				authToken, _ := authTokenRefresher.GetToken()
+				return authToken
+			}, 2*time.Second).Should(Equal(fakeUAA.AuthToken()))
+			Expect(fakeUAA.Requests()).To(Equal(2))
+		})
+	})
+
+	Context("with a refresh token expiring", func() {
+		It("stops refreshing in the background once the refresh token is rejected", func() {
+			authTokenRefresher.SetRefreshToken("refresh-1")
+			claims := fmt.Sprintf(`{"exp":%d}`, time.Now().Add(2*time.Second).Unix())
+			fakeUAA.SetAccessToken(strings.TrimPrefix(tokenWithClaims(claims), "bearer "))
+			authTokenRefresher.GetToken()
+			fakeUAA.RejectRefreshToken(true)
+			authTokenRefresher.RefreshBeforeExpiry(0.25)
+
+			Eventually(fakeUAA.Requests, 2*time.Second).Should(Equal(2))
+			Consistently(fakeUAA.Requests, 1500*time.Millisecond).Should(Equal(2))
+		})
+	})
+
+	Context("with a refresh token", func() {
+		BeforeEach(func() {
+			authTokenRefresher.SetRefreshToken("refresh-1")
+		})
+
+		It("uses the refresh_token grant", func() {
+			authToken, err := authTokenRefresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authToken).To(Equal(fakeToken))
+			Expect(fakeUAA.GrantType()).To(Equal("refresh_token"))
+			Expect(fakeUAA.ReceivedRefreshToken()).To(Equal("refresh-1"))
+		})
+
+		It("rotates the refresh token when UAA issues a new one", func() {
+			fakeUAA.RotateRefreshToken("refresh-2")
+			_, err := authTokenRefresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(authTokenRefresher.RefreshToken()).To(Equal("refresh-2"))
+
+			_, err = authTokenRefresher.RefreshAuthToken()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeUAA.ReceivedRefreshToken()).To(Equal("refresh-2"))
+		})
+
+		It("reports an expired refresh token", func() {
+			fakeUAA.RejectRefreshToken(true)
+			_, err := authTokenRefresher.RefreshAuthToken()
+			Expect(err).To(Equal(ErrRefreshTokenExpired))
+			Expect(authTokenRefresher.RefreshToken()).To(Equal("refresh-1"))
+		})
 	})
 })
@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ProxyFunc picks the proxy of a request, nil meaning a direct connection,
+// as http.Transport and websocket.Dialer expect.
+type ProxyFunc func(*http.Request) (*url.URL, error)
+
+// NewProxyFunc returns the proxy function of the outbound connections, each
+// empty setting falling back to its standard environment variable:
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, or their lowercase versions. Like
+// http.ProxyFromEnvironment, https and wss requests only go through the
+// https proxy, and requests to localhost and loopback addresses are direct.
+func NewProxyFunc(httpProxy string, httpsProxy string, noProxy string) (ProxyFunc, error) {
+	httpURL, err := parseProxy(getenv(httpProxy, "HTTP_PROXY", "http_proxy"))
+	if err != nil {
+		return nil, err
+	}
+	httpsURL, err := parseProxy(getenv(httpsProxy, "HTTPS_PROXY", "https_proxy"))
+	if err != nil {
+		return nil, err
+	}
+	bypass := parseNoProxy(getenv(noProxy, "NO_PROXY", "no_proxy"))
+
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL := httpURL
+		if req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+			proxyURL = httpsURL
+		}
+		if proxyURL == nil || bypass.matches(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+func getenv(value string, names ...string) string {
+	for _, name := range names {
+		if value != "" {
+			return value
+		}
+		value = os.Getenv(name)
+	}
+	return value
+}
+
+// parseProxy parses a proxy URL, the scheme defaulting to http.
+func parseProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy address %s", proxy)
+	}
+	return proxyURL, nil
+}
+
+// noProxy lists the hosts reached directly: domains, matching their
+// subdomains too, IP addresses and CIDR ranges, or any host with "*".
+type noProxy struct {
+	all      bool
+	domains  []string
+	networks []*net.IPNet
+}
+
+func parseNoProxy(list string) noProxy {
+	var bypass noProxy
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if host, _, err := net.SplitHostPort(entry); err == nil {
+			entry = host
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			bypass.all = true
+		case strings.Contains(entry, "/"):
+			if _, network, err := net.ParseCIDR(entry); err == nil {
+				bypass.networks = append(bypass.networks, network)
+			}
+		default:
+			bypass.domains = append(bypass.domains, strings.TrimPrefix(entry, "."))
+		}
+	}
+	return bypass
+}
+
+func (bypass noProxy) matches(host string) bool {
+	host = strings.ToLower(host)
+	if bypass.all || host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		for _, network := range bypass.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	for _, domain := range bypass.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
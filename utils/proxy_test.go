@@ -0,0 +1,70 @@
+package utils_test
+
+import (
+	"net/http"
+	"os"
+
+	. "github.com/cloudfoundry-community/firehose-to-syslog/utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Proxy", func() {
+	proxyOf := func(proxy ProxyFunc, target string) string {
+		req, err := http.NewRequest("GET", target, nil)
+		Expect(err).ToNot(HaveOccurred())
+		proxyURL, err := proxy(req)
+		Expect(err).ToNot(HaveOccurred())
+		if proxyURL == nil {
+			return ""
+		}
+		return proxyURL.String()
+	}
+
+	It("should pick the proxy of the scheme", func() {
+		proxy, err := NewProxyFunc("http://proxy:3128", "proxy-tls:3129", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyOf(proxy, "http://api.example.com/v2/info")).To(Equal("http://proxy:3128"))
+		Expect(proxyOf(proxy, "https://uaa.example.com/oauth/token")).To(Equal("http://proxy-tls:3129"))
+		Expect(proxyOf(proxy, "wss://doppler.example.com:443/firehose/nozzle")).To(Equal("http://proxy-tls:3129"))
+	})
+
+	It("should not use the http proxy for https", func() {
+		proxy, err := NewProxyFunc("http://proxy:3128", "", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyOf(proxy, "https://api.example.com")).To(BeEmpty())
+	})
+
+	It("should reach the no proxy hosts directly", func() {
+		proxy, err := NewProxyFunc("http://proxy:3128", "", ".internal, example.com:443, 10.0.0.0/8")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyOf(proxy, "http://api.internal")).To(BeEmpty())
+		Expect(proxyOf(proxy, "http://example.com")).To(BeEmpty())
+		Expect(proxyOf(proxy, "http://api.example.com")).To(BeEmpty())
+		Expect(proxyOf(proxy, "http://10.1.2.3:8080")).To(BeEmpty())
+		Expect(proxyOf(proxy, "http://localhost:8080")).To(BeEmpty())
+		Expect(proxyOf(proxy, "http://127.0.0.1:8080")).To(BeEmpty())
+		Expect(proxyOf(proxy, "http://notexample.com")).To(Equal("http://proxy:3128"))
+		Expect(proxyOf(proxy, "http://192.168.1.1")).To(Equal("http://proxy:3128"))
+	})
+
+	It("should fall back to the environment variables", func() {
+		defer os.Unsetenv("https_proxy")
+		defer os.Unsetenv("NO_PROXY")
+		os.Setenv("https_proxy", "http://env-proxy:3128")
+		os.Setenv("NO_PROXY", "*")
+
+		proxy, err := NewProxyFunc("", "", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyOf(proxy, "https://api.example.com")).To(BeEmpty())
+
+		proxy, err = NewProxyFunc("", "", "direct.example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyOf(proxy, "https://api.example.com")).To(Equal("http://env-proxy:3128"))
+	})
+
+	It("should reject invalid proxy addresses", func() {
+		_, err := NewProxyFunc("http://", "", "")
+		Expect(err).To(MatchError(ContainSubstring("Invalid proxy address")))
+	})
+})
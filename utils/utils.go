@@ -2,11 +2,17 @@ package utils
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/cloudfoundry/sonde-go/events"
+	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+var whitespaceRun = regexp.MustCompile(`\s+`)
+
 func FormatUUID(uuid *events.UUID) string {
 	if uuid == nil {
 		return ""
@@ -17,6 +23,18 @@ func FormatUUID(uuid *events.UUID) string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", uuidBytes[0:4], uuidBytes[4:6], uuidBytes[6:8], uuidBytes[8:10], uuidBytes[10:])
 }
 
+// ParseUUID is the reverse of FormatUUID, returning nil for strings that
+// aren't UUIDs.
+func ParseUUID(s string) *events.UUID {
+	uuidBytes, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(uuidBytes) != 16 {
+		return nil
+	}
+	low := binary.LittleEndian.Uint64(uuidBytes[:8])
+	high := binary.LittleEndian.Uint64(uuidBytes[8:])
+	return &events.UUID{Low: &low, High: &high}
+}
+
 func ConcatFormat(stringList []string) string {
 	r := strings.NewReplacer(".", "_")
 	for i, s := range stringList {
@@ -25,3 +43,25 @@ func ConcatFormat(stringList []string) string {
 
 	return strings.Join(stringList, ".")
 }
+
+// CollapseWhitespace compresses every run of whitespace to a single space.
+// Trailing whitespace is dropped, but a trailing newline is preserved.
+func CollapseWhitespace(s string) string {
+	collapsed := whitespaceRun.ReplaceAllString(strings.TrimRightFunc(s, unicode.IsSpace), " ")
+	if strings.HasSuffix(s, "\n") {
+		return collapsed + "\n"
+	}
+	return collapsed
+}
+
+// TruncateUTF8 cuts s to at most max bytes without splitting a multi-byte
+// character.
+func TruncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
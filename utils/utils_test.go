@@ -17,6 +17,15 @@ var _ = Describe("Testing Utils packages", func() {
 			})
 
 		})
+		Context("Parsed back", func() {
+			It("Should return the same UUID", func() {
+				Expect(FormatUUID(ParseUUID("6b2b8a4e-2d1c-4e5f-9a0b-1c2d3e4f5a6b"))).To(Equal("6b2b8a4e-2d1c-4e5f-9a0b-1c2d3e4f5a6b"))
+			})
+			It("Should return nil for other strings", func() {
+				Expect(ParseUUID("not-a-uuid")).To(BeNil())
+				Expect(ParseUUID("6b2b8a4e")).To(BeNil())
+			})
+		})
 	})
 	Describe("Concat String ", func() {
 		Context("Called with String Map", func() {
@@ -29,5 +38,30 @@ var _ = Describe("Testing Utils packages", func() {
 
 		})
 	})
+	Describe("Collapse Whitespace", func() {
+		Context("Called with runs of spaces and tabs", func() {
+			It("Should return single spaces", func() {
+				Expect(CollapseWhitespace("foo    bar\t\t baz")).To(Equal("foo bar baz"))
+			})
+			It("Should preserve a trailing newline", func() {
+				Expect(CollapseWhitespace("foo  bar   \n")).To(Equal("foo bar\n"))
+			})
+			It("Should leave a clean string untouched", func() {
+				Expect(CollapseWhitespace("foo bar")).To(Equal("foo bar"))
+			})
+		})
+	})
+
+	Describe("Truncate UTF-8", func() {
+		It("Should leave short strings untouched", func() {
+			Expect(TruncateUTF8("foo", 3)).To(Equal("foo"))
+		})
+		It("Should cut to the byte limit", func() {
+			Expect(TruncateUTF8("foobar", 3)).To(Equal("foo"))
+		})
+		It("Should not split a multi-byte character", func() {
+			Expect(TruncateUTF8("fooé", 4)).To(Equal("foo"))
+		})
+	})
 
 })